@@ -1,41 +1,95 @@
 package client
 
 import (
-	"bytes"
 	"cmstop-fserver/server"
+	"cmstop-fserver/util"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"gopkg.in/fatih/pool.v2"
+	"io"
 	"net"
+	"time"
 )
 
 type FSClient struct {
 	addr   *net.TCPAddr
-	p      pool.Pool
+	p      *connPool
 	passwd string
+	token  string // 租约令牌，随每个请求发送
+	opts   Options
 }
 
-var poolNum int
+// 服务端返回的错误
+type ServerError struct {
+	Code    int    // 响应状态码，server.CODE_*
+	Message string // 错误信息
+}
+
+func (e *ServerError) Error() string {
+	return "Error: " + e.Message
+}
+
+// 判断错误是否是写入的前提条件不满足
+func IsPreconditionFailed(err error) bool {
+	e, ok := err.(*ServerError)
+	return ok && e.Code == server.CODE_PRECONDITION_FAILED
+}
+
+// 判断错误是否是路径被其他客户端的租约锁定
+func IsLocked(err error) bool {
+	e, ok := err.(*ServerError)
+	return ok && e.Code == server.CODE_LOCKED
+}
 
+// 判断错误是否是服务端校验请求内容失败，请求没有被执行，可以重试
+func IsChecksumMismatch(err error) bool {
+	e, ok := err.(*ServerError)
+	return ok && e.Code == server.CODE_CHECKSUM_MISMATCH
+}
+
+// 判断错误是否是写入内容没有通过服务端的内容检查
+func IsContentRejected(err error) bool {
+	e, ok := err.(*ServerError)
+	return ok && e.Code == server.CODE_CONTENT_REJECTED
+}
+
+// 网络读写错误，保留原始错误用于判断连接是否失效
+type netError struct {
+	msg string
+	err error
+}
+
+func (e *netError) Error() string {
+	return e.msg + e.err.Error()
+}
+
+// 使用默认连接池配置创建客户端
 func NewClient(host, port, passwd string) (*FSClient, error) {
+	return NewClientWithOptions(host, port, passwd, DefaultOptions)
+}
+
+// 使用指定的连接池配置创建客户端
+func NewClientWithOptions(host, port, passwd string, opts Options) (*FSClient, error) {
 	addr, err := net.ResolveTCPAddr("tcp4", host+":"+port)
 	if err != nil {
 		return nil, err
 	}
 	client := new(FSClient)
 	client.addr = addr
-	p, err := pool.NewChannelPool(2, 100, func() (net.Conn, error) {
-		poolNum = poolNum + 1
-		fmt.Println("pool++ =", poolNum)
-		return net.DialTCP("tcp4", nil, addr)
+	p, err := newConnPool(opts, func() (net.Conn, error) {
+		d := net.Dialer{Timeout: opts.DialTimeout}
+		if opts.TLS != nil {
+			return tls.DialWithDialer(&d, "tcp4", addr.String(), opts.TLS)
+		}
+		return d.Dial("tcp4", addr.String())
 	})
 	if err != nil {
 		return nil, err
 	}
 	client.p = p
 	client.passwd = passwd
+	client.opts = opts
 
 	return client, nil
 }
@@ -45,8 +99,34 @@ func (t *FSClient) Close() {
 	t.p.Close()
 }
 
-// 向服务器写入数据
-func sendData(conn net.Conn, method uint32, passwd string, path string, body []byte) error {
+// 连接池统计信息
+func (t *FSClient) Stats() PoolStats {
+	return t.p.Stats()
+}
+
+// 返回一个共享连接池的客户端，它的每个请求都携带租约令牌，
+// 可以操作被该租约锁定的路径
+func (t *FSClient) Locked(token string) *FSClient {
+	c := *t
+	c.token = token
+	return &c
+}
+
+// 在请求附加信息中加入租约令牌，meta中已有令牌时不覆盖
+func (t *FSClient) meta(meta *server.RequestMeta) *server.RequestMeta {
+	if t.token == "" || (meta != nil && meta.LockToken != "") {
+		return meta
+	}
+	m := new(server.RequestMeta)
+	if meta != nil {
+		*m = *meta
+	}
+	m.LockToken = t.token
+	return m
+}
+
+// 生成一个请求
+func newMessage(method uint32, passwd string, path string, body []byte) *server.FileData {
 	msg := new(server.FileData)
 	msg.Method = method
 	msg.Password = passwd
@@ -55,73 +135,548 @@ func sendData(conn net.Conn, method uint32, passwd string, path string, body []b
 	msg.PassLength = uint32(len(msg.Password))
 	msg.PathLength = uint32(len(msg.Path))
 	msg.BodySize = uint32(len(msg.Body))
+	return msg
+}
+
+// 生成实际发送的请求，有内容的请求附带内容的sha256，服务端校验后才执行
+// 内容超过压缩阈值并且可以压缩时压缩发送，校验值是压缩前的内容的
+// 配置了签名时最后签名，签名覆盖内容的sha256
+func (t *FSClient) prepare(msg *server.FileData) *server.FileData {
+	sign := t.opts.Sign && t.passwd != ""
+	if msg.Body == nil && !sign {
+		return msg
+	}
+	m := *msg
+	if m.Body == nil {
+		server.SignRequest(t.passwd, &m)
+		return &m
+	}
+	if m.Meta == nil || (m.Meta.Sha256 == "" && (sign || m.Meta.Crc32c == "")) {
+		meta := new(server.RequestMeta)
+		if msg.Meta != nil {
+			*meta = *msg.Meta
+		}
+		meta.Sha256 = util.Hash(msg.Body)
+		m.Meta = meta
+	}
+	if t.opts.Compression != 0 && t.opts.CompressMin > 0 && len(m.Body) >= t.opts.CompressMin && compressible(m.Method, m.Path) {
+		body, err := compress(t.opts.Compression, m.Body)
+		if err == nil && len(body) < len(m.Body) {
+			m.Body = body
+			m.BodySize = uint32(len(body))
+			m.Flags |= t.opts.Compression
+		}
+	}
+	if sign {
+		server.SignRequest(t.passwd, &m)
+	}
+	return &m
+}
 
+// 按协议写入一个请求，msg的长度字段需要提前设置
+func writeRequest(conn net.Conn, msg *server.FileData) error {
 	var err error
 	var n int
-	err = binary.Write(conn, binary.LittleEndian, msg.Method)
+	var meta []byte
+	if msg.Meta != nil {
+		meta, err = json.Marshal(msg.Meta)
+		if err != nil {
+			return err
+		}
+		msg.Flags |= server.FLAG_META
+	}
+	err = binary.Write(conn, binary.LittleEndian, msg.Method|msg.Flags)
 	if err != nil {
-		return errors.New("Send Data Method Error: " + err.Error())
+		return &netError{"Send Data Method Error: ", err}
 	}
 	err = binary.Write(conn, binary.LittleEndian, msg.PassLength)
 	if err != nil {
-		return errors.New("Send Data PassLength Error: " + err.Error())
+		return &netError{"Send Data PassLength Error: ", err}
 	}
 	err = binary.Write(conn, binary.LittleEndian, msg.PathLength)
 	if err != nil {
-		return errors.New("Send Data PathLength Error: " + err.Error())
+		return &netError{"Send Data PathLength Error: ", err}
 	}
 	err = binary.Write(conn, binary.LittleEndian, msg.BodySize)
 	if err != nil {
-		return errors.New("Send Data BodySize Error: " + err.Error())
+		return &netError{"Send Data BodySize Error: ", err}
+	}
+	if msg.Flags&server.FLAG_REQUEST_ID != 0 {
+		err = binary.Write(conn, binary.LittleEndian, msg.RequestId)
+		if err != nil {
+			return &netError{"Send Data RequestId Error: ", err}
+		}
+	}
+	if meta != nil {
+		err = binary.Write(conn, binary.LittleEndian, uint32(len(meta)))
+		if err == nil {
+			_, err = conn.Write(meta)
+		}
+		if err != nil {
+			return &netError{"Send Data Meta Error: ", err}
+		}
+	}
+	_, err = conn.Write([]byte(msg.Password))
+	if err != nil {
+		return &netError{"Send Data Password Error: ", err}
+	}
+	_, err = conn.Write([]byte(msg.Path))
+	if err != nil {
+		return &netError{"Send Data Path Error: ", err}
 	}
-	n, err = conn.Write([]byte(msg.Password))
-	n, err = conn.Write([]byte(msg.Path))
 	n, err = conn.Write(msg.Body)
-	if err != nil || n == 0 {
-		return errors.New("Send Data Error: " + err.Error())
+	if err != nil {
+		return &netError{"Send Data Error: ", err}
+	}
+	if n != len(msg.Body) {
+		return errors.New("Send Data Error: short write")
 	}
 	return nil
 }
 
-// 从服务器端收字符串
-func readData(conn net.Conn) error {
-	buf := make([]byte, 4)
-	num, err := conn.Read(buf[0:])
-	result := bytes.NewBuffer(nil)
-	result.Write(buf[0:num])
+// 从服务器端读取响应
+func readData(conn net.Conn) (*server.ResponseData, error) {
 	var length uint32
-	err = binary.Read(result, binary.LittleEndian, &length)
+	err := binary.Read(conn, binary.LittleEndian, &length)
 	if err != nil {
-		return errors.New("Read Length Error: " + err.Error())
+		return nil, &netError{"Read Length Error: ", err}
 	}
 	data := make([]byte, length)
-	num, err = conn.Read(data)
-	if err != nil || num != int(length) {
-		return errors.New("Read Data Error: " + err.Error())
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return nil, &netError{"Read Data Error: ", err}
 	}
 	msg := new(server.ResponseData)
 	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
 	if msg.Code > 0 {
-		return errors.New("Error: " + msg.Message)
+		return msg, &ServerError{msg.Code, msg.Message}
 	}
-	return nil
+	return msg, nil
+}
+
+// 发送一次请求并读取响应
+func (t *FSClient) request(method uint32, path string, body []byte) (*server.ResponseData, error) {
+	msg := newMessage(method, t.passwd, path, body)
+	msg.Meta = t.meta(nil)
+	return t.send(msg)
 }
 
-// 写入文件
+// 发送一个请求并读取响应
+// 复用的空闲连接如果已被服务端关闭，请求没有写出或是只读请求时重新建立连接后重试
+func (t *FSClient) send(msg *server.FileData) (*server.ResponseData, error) {
+	msg = t.prepare(msg)
+	for {
+		conn, err := t.p.get()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := roundTrip(conn, msg)
+		if err == nil {
+			t.p.put(conn, false)
+			return resp, nil
+		}
+		// 服务端返回错误后会关闭连接，不能放回连接池
+		t.p.put(conn, true)
+		if resp == nil && retryable(conn, err, msg.Method) {
+			continue
+		}
+		return resp, err
+	}
+}
+
+func roundTrip(conn net.Conn, msg *server.FileData) (*server.ResponseData, error) {
+	err := writeRequest(conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	return readData(conn)
+}
+
+// 只关心成功与否的请求
+func (t *FSClient) do(method uint32, path string, body []byte) error {
+	_, err := t.request(method, path, body)
+	return err
+}
+
+// 按前提条件写入文件，method为METHOD_CREATE_FILE、METHOD_MODIFY_FILE或METHOD_APPEND_FILE
+// cond为nil时不检查，条件不满足时返回的错误可以用IsPreconditionFailed判断
+// 内容在传输中损坏时服务端不写入，返回的错误可以用IsChecksumMismatch判断
+// 成功时返回写入后文件内容的sha256和大小，覆盖写入时校验服务端保存的内容，服务端改写内容时不校验
+func (t *FSClient) WriteFileIf(method uint32, path string, body []byte, cond *server.Precondition) (*server.WriteResult, error) {
+	if body == nil {
+		body = []byte{}
+	}
+	msg := newMessage(method, t.passwd, path, body)
+	hash := util.Hash(body)
+	msg.Meta = t.meta(&server.RequestMeta{Precondition: cond, Sha256: hash})
+	resp, err := t.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	res := new(server.WriteResult)
+	err = json.Unmarshal(resp.Data, res)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	if method != server.METHOD_APPEND_FILE && !res.Rewritten && res.Hash != hash {
+		return res, errors.New("stored hash mismatch: " + res.Hash)
+	}
+	return res, nil
+}
+
+// 写入文件，文件存在时覆盖
 func (t *FSClient) WriteFile(path string, body []byte) error {
-	conn, err := t.p.Get()
-	//conn, err := net.DialTCP("tcp4", nil, t.addr)
+	_, err := t.WriteFileIf(server.METHOD_CREATE_FILE, path, body, nil)
+	return err
+}
+
+// 修改文件，从头部开始写入
+func (t *FSClient) ModifyFile(path string, body []byte) error {
+	_, err := t.WriteFileIf(server.METHOD_MODIFY_FILE, path, body, nil)
+	return err
+}
+
+// 追加写入文件
+func (t *FSClient) AppendFile(path string, body []byte) error {
+	_, err := t.WriteFileIf(server.METHOD_APPEND_FILE, path, body, nil)
+	return err
+}
+
+// 删除文件
+func (t *FSClient) RemoveFile(path string) error {
+	return t.do(server.METHOD_REMOVE_FILE, path, nil)
+}
+
+// 创建目录
+func (t *FSClient) CreateDir(path string) error {
+	return t.do(server.METHOD_CREATE_DIR, path, nil)
+}
+
+// 删除目录，含子目录中的内容和目录本身
+func (t *FSClient) RemoveDir(path string) error {
+	return t.do(server.METHOD_REMOVE_DIR, path, nil)
+}
+
+// 清空目录，目录本身不删除
+func (t *FSClient) ClearDir(path string) error {
+	return t.do(server.METHOD_CLEAR_DIR, path, nil)
+}
+
+// 复制一个文件或文件夹
+func (t *FSClient) Copy(path, newPath string) error {
+	body, err := json.Marshal(map[string]string{"newpath": newPath})
+	if err != nil {
+		return err
+	}
+	return t.do(server.METHOD_COPY, path, body)
+}
+
+// 重命名一个文件或文件夹
+func (t *FSClient) Rename(path, newPath string) error {
+	body, err := json.Marshal(map[string]string{"newpath": newPath})
+	if err != nil {
+		return err
+	}
+	return t.do(server.METHOD_RENAME, path, body)
+}
+
+// 获取远程路径信息，路径不存在时Exist为false
+func (t *FSClient) Stat(path string) (*server.FileInfo, error) {
+	resp, err := t.request(server.METHOD_STAT, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	info := new(server.FileInfo)
+	err = json.Unmarshal(resp.Data, info)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return info, nil
+}
+
+// 列出远程目录内容，返回的路径相对于dir
+func (t *FSClient) List(dir string, recursive, hash bool) ([]*server.FileInfo, error) {
+	body, err := json.Marshal(map[string]bool{"recursive": recursive, "hash": hash})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.request(server.METHOD_LIST, dir, body)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*server.FileInfo, 0)
+	err = json.Unmarshal(resp.Data, &list)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return list, nil
+}
+
+// 批量执行多个操作，全部成功或全部回滚，返回每个操作的执行结果
+// 失败时同时返回执行结果和错误，每个操作的内容不超过服务端的maxSize，编码后的参数不超过server.BATCH_MAX_SIZE
+func (t *FSClient) Batch(ops []*server.BatchOp) ([]*server.BatchResult, error) {
+	body, err := json.Marshal(&server.BatchParams{Ops: ops})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.request(server.METHOD_BATCH, "", body)
+	if resp == nil || len(resp.Data) == 0 {
+		return nil, err
+	}
+	results := make([]*server.BatchResult, 0, len(ops))
+	if jerr := json.Unmarshal(resp.Data, &results); jerr != nil && err == nil {
+		err = errors.New("Read Data Error: " + jerr.Error())
+	}
+	return results, err
+}
+
+// 锁定路径及其子目录，lease为租约时长，0 使用服务端默认值
+// 其他客户端操作被锁定的路径时返回的错误可以用IsLocked判断
+func (t *FSClient) Lock(path string, lease time.Duration, shared bool) (*server.Lease, error) {
+	body, err := json.Marshal(map[string]interface{}{"lease": int(lease / time.Second), "shared": shared})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.request(server.METHOD_LOCK, path, body)
+	if err != nil {
+		return nil, err
+	}
+	l := new(server.Lease)
+	err = json.Unmarshal(resp.Data, l)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return l, nil
+}
+
+// 续期租约
+func (t *FSClient) RenewLock(path, token string, lease time.Duration) (*server.Lease, error) {
+	return t.Locked(token).Lock(path, lease, false)
+}
+
+// 释放租约锁
+func (t *FSClient) Unlock(path, token string) error {
+	return t.Locked(token).do(server.METHOD_UNLOCK, path, nil)
+}
+
+// 列出文件的历史版本，按时间倒序
+func (t *FSClient) Versions(path string) ([]*server.StoreEntry, error) {
+	return t.storeEntries(server.METHOD_VERSIONS, path)
+}
+
+// 列出路径及其子目录在回收站中的条目，按时间倒序
+func (t *FSClient) Trash(path string) ([]*server.StoreEntry, error) {
+	return t.storeEntries(server.METHOD_TRASH, path)
+}
+
+func (t *FSClient) storeEntries(method uint32, path string) ([]*server.StoreEntry, error) {
+	resp, err := t.request(method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*server.StoreEntry, 0)
+	err = json.Unmarshal(resp.Data, &list)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return list, nil
+}
+
+// 恢复文件的一个历史版本，当前内容保存为新的历史版本
+func (t *FSClient) RestoreVersion(path, id string) error {
+	body, err := json.Marshal(map[string]string{"version": id})
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	err = sendData(conn, server.METHOD_CREATE_FILE, t.passwd, path, body)
+	return t.do(server.METHOD_RESTORE, path, body)
+}
+
+// 将回收站条目恢复到原路径，原路径已存在时返回错误
+func (t *FSClient) RestoreTrash(path, id string) error {
+	body, err := json.Marshal(map[string]string{"trash": id})
 	if err != nil {
 		return err
 	}
-	err = readData(conn)
+	return t.do(server.METHOD_RESTORE, path, body)
+}
+
+// 清空路径及其子目录在回收站中的条目，返回删除的条目数
+func (t *FSClient) EmptyTrash(path string) (int, error) {
+	resp, err := t.request(server.METHOD_EMPTY_TRASH, path, nil)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = json.Unmarshal(resp.Data, &n)
+	if err != nil {
+		return 0, errors.New("Read Data Error: " + err.Error())
+	}
+	return n, nil
+}
+
+// 创建目录的快照，name为快照说明，可以为空
+func (t *FSClient) CreateSnapshot(path, name string) (*server.Snapshot, error) {
+	body, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.request(server.METHOD_SNAPSHOT_CREATE, path, body)
+	if err != nil {
+		return nil, err
+	}
+	snap := new(server.Snapshot)
+	err = json.Unmarshal(resp.Data, snap)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return snap, nil
+}
+
+// 列出目录及其子目录的快照，按时间倒序
+func (t *FSClient) Snapshots(path string) ([]*server.Snapshot, error) {
+	resp, err := t.request(server.METHOD_SNAPSHOT_LIST, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*server.Snapshot, 0)
+	err = json.Unmarshal(resp.Data, &list)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return list, nil
+}
+
+// 将目录恢复到快照时的状态，path必须是创建快照时的目录
+func (t *FSClient) RestoreSnapshot(path, id string) error {
+	body, err := json.Marshal(map[string]string{"id": id})
 	if err != nil {
 		return err
 	}
-	return nil
+	return t.do(server.METHOD_SNAPSHOT_RESTORE, path, body)
+}
+
+// 删除快照
+func (t *FSClient) DeleteSnapshot(path, id string) error {
+	body, err := json.Marshal(map[string]string{"id": id})
+	if err != nil {
+		return err
+	}
+	return t.do(server.METHOD_SNAPSHOT_DELETE, path, body)
+}
+
+// 读取远程文件内容
+func (t *FSClient) ReadFile(path string) ([]byte, error) {
+	resp, err := t.request(server.METHOD_READ_FILE, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	err = json.Unmarshal(resp.Data, &body)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return body, nil
+}
+
+// 获取服务端的复制状态
+func (t *FSClient) ReplicaStatus() (*server.ReplicationStatus, error) {
+	resp, err := t.request(server.METHOD_REPLICA_STATUS, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	st := new(server.ReplicationStatus)
+	err = json.Unmarshal(resp.Data, st)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return st, nil
+}
+
+// 开始、停止扫描或获取扫描状态，开始扫描时dir为扫描的目录，报告保存在服务器的scanDir中
+func (t *FSClient) Scan(dir string, params *server.ScanParams) (*server.ScanStatus, error) {
+	body, _ := json.Marshal(params)
+	resp, err := t.request(server.METHOD_SCAN, dir, body)
+	if err != nil {
+		return nil, err
+	}
+	st := new(server.ScanStatus)
+	err = json.Unmarshal(resp.Data, st)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return st, nil
+}
+
+// 将tar、tar.gz或zip压缩包解压到远程目录，swap为true时解压完成后整体替换目录
+// 压缩包中的每个文件和单个写入的检查相同，任何一个不合法都不写入
+func (t *FSClient) Extract(dir string, archive []byte, swap bool) (*server.ExtractResult, error) {
+	msg := newMessage(server.METHOD_EXTRACT, t.passwd, dir, archive)
+	msg.Meta = t.meta(&server.RequestMeta{Extract: &server.ExtractParams{Swap: swap}})
+	resp, err := t.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	res := new(server.ExtractResult)
+	err = json.Unmarshal(resp.Data, res)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return res, nil
+}
+
+// 将目录打包为tar或tar.gz写入w，params为nil时打包全部文件为tar
+// 打包中出错时w中已写入的内容不完整
+func (t *FSClient) Archive(dir string, w io.Writer, params *server.ArchiveParams) (*server.ArchiveResult, error) {
+	msg := newMessage(server.METHOD_ARCHIVE, t.passwd, dir, nil)
+	msg.Meta = t.meta(&server.RequestMeta{Archive: params})
+	msg = t.prepare(msg)
+	for {
+		conn, err := t.p.get()
+		if err != nil {
+			return nil, err
+		}
+		_, err = roundTrip(conn, msg)
+		if err != nil {
+			t.p.put(conn, true)
+			if retryable(conn, err, msg.Method) {
+				continue
+			}
+			return nil, err
+		}
+		// 打包出错时服务端会关闭连接，w写入失败时打包流没有读完，都不能放回连接池
+		res, err := readArchive(conn, w)
+		t.p.put(conn, err != nil)
+		return res, err
+	}
+}
+
+// 读取打包流写入w，然后读取打包结果
+func readArchive(conn net.Conn, w io.Writer) (*server.ArchiveResult, error) {
+	for {
+		var length uint32
+		err := binary.Read(conn, binary.LittleEndian, &length)
+		if err != nil {
+			return nil, &netError{"Read Length Error: ", err}
+		}
+		if length == 0 {
+			break
+		}
+		_, err = io.CopyN(w, conn, int64(length))
+		if err != nil {
+			return nil, errors.New("Read Archive Error: " + err.Error())
+		}
+	}
+	resp, err := readData(conn)
+	if err != nil {
+		return nil, err
+	}
+	res := new(server.ArchiveResult)
+	err = json.Unmarshal(resp.Data, res)
+	if err != nil {
+		return nil, errors.New("Read Data Error: " + err.Error())
+	}
+	return res, nil
 }
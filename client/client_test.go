@@ -1,9 +1,14 @@
 package client
 
 import (
+	"cmstop-fserver/server"
 	"cmstop-fserver/util"
 	"fmt"
+	"github.com/9466/goconfig"
 	"io/ioutil"
+	"log"
+	"net"
+	"os"
 	"strconv"
 	"testing"
 	//"time"
@@ -13,6 +18,96 @@ var host = "127.0.0.1"
 var port = "9468"
 var password = "1234567890"
 
+// 启动进程内的服务端，返回地址和允许操作的目录
+func startTestServer(t *testing.T) (string, string, string) {
+	root, err := ioutil.TempDir("", "fserver-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := root + ".conf"
+	ioutil.WriteFile(conf, []byte("[common]\nrootDir="+root+"\nallowExt=html,txt,css\npassword=pw\n"), 0600)
+	defer os.Remove(conf)
+	c, err := goconfig.ReadConfigFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err = s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Stop()
+		os.RemoveAll(root)
+	})
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return host, port, root
+}
+
+func TestClientFileOps(t *testing.T) {
+	host, port, root := startTestServer(t)
+	c, err := NewClient(host, port, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	check := func(op string, err error) {
+		if err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+	}
+	check("mkdir", c.CreateDir(root+"/a"))
+	check("write", c.WriteFile(root+"/a/x.html", []byte("<p>1</p>")))
+	check("append", c.AppendFile(root+"/a/x.html", []byte("<p>2</p>")))
+	check("copy", c.Copy(root+"/a", root+"/b"))
+	check("rename", c.Rename(root+"/b/x.html", root+"/b/y.html"))
+	check("modify", c.ModifyFile(root+"/b/y.html", []byte("y")))
+	body, err := c.ReadFile(root + "/a/x.html")
+	if err != nil || string(body) != "<p>1</p><p>2</p>" {
+		t.Errorf("read: %q %v", body, err)
+	}
+	info, err := c.Stat(root + "/b/y.html")
+	if err != nil || !info.Exist || info.IsDir || info.Size != 1 {
+		t.Errorf("stat: %+v %v", info, err)
+	}
+	if info, err = c.Stat(root + "/b/x.html"); err != nil || info.Exist {
+		t.Errorf("stat renamed: %+v %v", info, err)
+	}
+	list, err := c.List(root, true, true)
+	if err != nil || len(list) != 4 {
+		t.Fatalf("list: %d %v", len(list), err)
+	}
+	for _, info := range list {
+		if !info.IsDir && info.Hash == "" {
+			t.Errorf("list without hash: %+v", info)
+		}
+	}
+	check("rm", c.RemoveFile(root+"/b/y.html"))
+	check("clear", c.ClearDir(root+"/a"))
+	if list, err = c.List(root+"/a", false, false); err != nil || len(list) != 0 {
+		t.Errorf("clear: %d %v", len(list), err)
+	}
+	check("rmdir", c.RemoveDir(root+"/a"))
+
+	// 服务端的错误
+	if err = c.WriteFile(root+"/x.php", []byte("x")); err == nil {
+		t.Error("write php")
+	}
+	if _, err = c.ReadFile(root + "/missing.html"); err == nil {
+		t.Error("read missing file")
+	}
+	bad, _ := NewClient(host, port, "bad")
+	defer bad.Close()
+	if err = bad.CreateDir(root + "/c"); err == nil {
+		t.Error("wrong password")
+	}
+}
+
 func TestClientWriteFile1(t *testing.T) {
 	client, err := NewClient(host, port, password)
 	if err != nil {
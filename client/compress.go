@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"cmstop-fserver/server"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"path"
+	"strings"
+)
+
+// 压缩效果好的文件扩展名，其他文件（如图片）已经压缩过，不再压缩
+var COMPRESS_EXT = []string{"html", "htm", "shtml", "css", "js", "json", "xml", "txt", "svg", "csv"}
+
+// 判断请求内容是否值得压缩，批量操作的内容是json
+func compressible(method uint32, p string) bool {
+	switch method {
+	case server.METHOD_BATCH:
+		return true
+	case server.METHOD_CREATE_FILE, server.METHOD_MODIFY_FILE, server.METHOD_APPEND_FILE:
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+		for _, e := range COMPRESS_EXT {
+			if ext == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 按压缩方式压缩内容
+func compress(flag uint32, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch flag {
+	case server.FLAG_GZIP:
+		w = gzip.NewWriter(&buf)
+	case server.FLAG_ZSTD:
+		w, err = zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("compression not supported")
+	}
+	_, err = w.Write(body)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bytes"
+	"cmstop-fserver/server"
+	"cmstop-fserver/util"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPrepareCompress(t *testing.T) {
+	c := &FSClient{opts: DefaultOptions}
+	page := []byte(strings.Repeat("<p>news</p>\n", 1000))
+
+	msg := c.prepare(newMessage(server.METHOD_CREATE_FILE, "pw", "/data/index.html", page))
+	if msg.Flags&server.FLAG_GZIP == 0 || int(msg.BodySize) != len(msg.Body) || len(msg.Body) >= len(page) {
+		t.Fatalf("html not compressed: flags %x, %d bytes", msg.Flags, len(msg.Body))
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(b, page) {
+		t.Fatal("decompressed body mismatch")
+	}
+	// 校验值是压缩前的内容的
+	if msg.Meta == nil || msg.Meta.Sha256 != util.Hash(page) {
+		t.Fatal("checksum not of original body")
+	}
+
+	for _, p := range []string{"/data/a.jpg", "/data/small.html"} {
+		body := page
+		if strings.HasPrefix(p, "/data/small") {
+			body = page[:100]
+		}
+		msg = c.prepare(newMessage(server.METHOD_CREATE_FILE, "pw", p, body))
+		if msg.Flags&server.FLAG_COMPRESS != 0 {
+			t.Errorf("%s compressed", p)
+		}
+	}
+}
+
+func TestPrepareSign(t *testing.T) {
+	opts := DefaultOptions
+	opts.Sign = true
+	c := &FSClient{opts: opts, passwd: "pw"}
+	page := []byte(strings.Repeat("<p>news</p>\n", 1000))
+	for _, msg := range []*server.FileData{
+		newMessage(server.METHOD_CREATE_FILE, "pw", "/data/index.html", page),
+		newMessage(server.METHOD_READ_FILE, "pw", "/data/index.html", nil),
+	} {
+		m := c.prepare(msg)
+		if m.Password != "" || m.PassLength != 0 {
+			t.Errorf("%x: password sent", m.Method)
+		}
+		if m.Meta == nil || m.Meta.Signature != server.Sign("pw", m.Method, m.Path, m.Meta) {
+			t.Errorf("%x: bad signature", m.Method)
+		}
+		if m.Body != nil && m.Meta.Sha256 != util.Hash(page) {
+			t.Errorf("%x: signature without body sha256", m.Method)
+		}
+	}
+}
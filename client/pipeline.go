@@ -0,0 +1,100 @@
+package client
+
+import (
+	"cmstop-fserver/server"
+	"errors"
+	"strconv"
+)
+
+// 流水线请求
+type Request struct {
+	Method uint32              // 操作类型，server.METHOD_*
+	Path   string              // 操作路径
+	Body   []byte              // 内容，复制和重命名为json编码的参数
+	Meta   *server.RequestMeta // 请求附加信息，可以为nil
+}
+
+// 流水线请求的结果
+type Result struct {
+	Response *server.ResponseData // 服务端响应，连接出错时为nil
+	Err      error                // 请求失败的原因
+}
+
+// 在一个连接上连续发送多个请求，不等待响应，服务端并发处理
+// 返回和reqs顺序对应的结果，请求之间没有顺序保证，有依赖的操作需要分批发送
+// 连接出错时尚未收到响应的请求都返回该错误
+// 打包下载(METHOD_ARCHIVE)的响应后有打包流，不能在流水线中发送，使用Archive
+func (t *FSClient) Pipeline(reqs []*Request) []*Result {
+	results := make([]*Result, len(reqs))
+	if len(reqs) == 0 {
+		return results
+	}
+	methods := make([]uint32, len(reqs))
+	for i, r := range reqs {
+		methods[i] = r.Method
+	}
+	var err error
+	for {
+		var conn *poolConn
+		conn, err = t.p.get()
+		if err != nil {
+			break
+		}
+		var n int
+		n, err = t.pipeline(conn, reqs, results)
+		t.p.put(conn, err != nil)
+		// 复用的空闲连接已失效，没有收到任何响应，请求没有写出或都是只读请求时重新建立连接后重试
+		if err != nil && n == 0 && retryable(conn, err, methods...) {
+			continue
+		}
+		break
+	}
+	for i := range results {
+		if results[i] == nil {
+			results[i] = &Result{Err: err}
+		}
+	}
+	return results
+}
+
+// 在连接上发送全部请求并读取响应，返回收到的响应数和连接错误
+func (t *FSClient) pipeline(conn *poolConn, reqs []*Request, results []*Result) (int, error) {
+	// 写入和读取同时进行，避免双方缓冲区写满后互相等待
+	werr := make(chan error, 1)
+	go func() {
+		for i, r := range reqs {
+			msg := newMessage(r.Method, t.passwd, r.Path, r.Body)
+			msg.Flags = server.FLAG_REQUEST_ID
+			msg.RequestId = uint32(i + 1)
+			msg.Meta = t.meta(r.Meta)
+			if err := writeRequest(conn, t.prepare(msg)); err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- nil
+	}()
+
+	var rerr error
+	n := 0
+	for ; n < len(reqs); n++ {
+		resp, err := readData(conn)
+		if resp == nil {
+			rerr = err
+			break
+		}
+		// 没有请求ID的响应是服务端的协议错误，之后连接会被关闭
+		if resp.Id == 0 || int(resp.Id) > len(reqs) || results[resp.Id-1] != nil {
+			rerr = errors.New("Error: unexpected response id " + strconv.Itoa(int(resp.Id)) + ": " + resp.Message)
+			break
+		}
+		results[resp.Id-1] = &Result{Response: resp, Err: err}
+	}
+	if rerr != nil {
+		conn.Close() // 中断写入
+	}
+	if err := <-werr; err != nil && rerr == nil {
+		rerr = err
+	}
+	return n, rerr
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"cmstop-fserver/server"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 客户端配置，连接池和内容压缩
+type Options struct {
+	MinConns    int           // 创建时预先建立的空闲连接数
+	MaxConns    int           // 最大连接数，含使用中的连接，0 表示不限制
+	IdleTimeout time.Duration // 空闲连接超时，超过后关闭，0 表示不限制
+	MaxLifetime time.Duration // 连接最长存活时间，超过后关闭，0 表示不限制
+	DialTimeout time.Duration // 建立连接超时，0 表示不限制
+	CompressMin int           // 内容达到此大小并且可以压缩时压缩发送，0 表示不压缩
+	Compression uint32        // 压缩方式，server.FLAG_GZIP或server.FLAG_ZSTD
+	TLS         *tls.Config   // 不为nil时使用TLS连接，见server.ClientTLSConfig
+	Sign        bool          // 以密钥签名请求，不发送密钥本身
+}
+
+// 默认配置，空闲超时小于服务端的10秒空闲超时
+var DefaultOptions = Options{
+	MinConns:    2,
+	MaxConns:    100,
+	IdleTimeout: 9 * time.Second,
+	MaxLifetime: 0,
+	DialTimeout: 5 * time.Second,
+	CompressMin: 4096,
+	Compression: server.FLAG_GZIP,
+}
+
+// 连接池统计信息
+type PoolStats struct {
+	Open         int           // 当前打开的连接数，含使用中和空闲
+	Idle         int           // 空闲连接数
+	InUse        int           // 使用中的连接数
+	Dials        int64         // 累计建立的连接数
+	Stale        int64         // 累计因超时或失效关闭的空闲连接数
+	WaitCount    int64         // 累计等待空闲名额的次数
+	WaitDuration time.Duration // 累计等待时间
+}
+
+var errPoolClosed = errors.New("connection pool is closed")
+
+// 池中的连接
+type poolConn struct {
+	net.Conn
+	created  time.Time // 建立时间
+	lastUsed time.Time // 最后放回池中的时间
+	reused   bool      // 是否是从空闲列表中取出的连接
+	written  int64     // 取出后写入的字节数
+}
+
+func (c *poolConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// 连接池
+type connPool struct {
+	mu     sync.Mutex
+	opts   Options
+	dial   func() (net.Conn, error)
+	idle   []*poolConn   // 空闲连接，后进先出
+	slots  chan struct{} // 连接名额，MaxConns为0时为nil
+	open   int
+	closed bool
+	stats  PoolStats
+}
+
+func newConnPool(opts Options, dial func() (net.Conn, error)) (*connPool, error) {
+	p := new(connPool)
+	p.opts = opts
+	p.dial = dial
+	p.idle = make([]*poolConn, 0, opts.MinConns)
+	if opts.MaxConns > 0 {
+		p.slots = make(chan struct{}, opts.MaxConns)
+	}
+	for i := 0; i < opts.MinConns; i++ {
+		c, err := p.newConn()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle = append(p.idle, c)
+	}
+	return p, nil
+}
+
+// 取得一个连接，优先使用空闲连接，空闲连接在使用前检测是否存活
+func (p *connPool) get() (*poolConn, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			start := time.Now()
+			p.slots <- struct{}{}
+			p.mu.Lock()
+			p.stats.WaitCount++
+			p.stats.WaitDuration += time.Since(start)
+			p.mu.Unlock()
+		}
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.release()
+			return nil, errPoolClosed
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if p.expired(c) || !alive(c) {
+			c.Conn.Close()
+			p.mu.Lock()
+			p.open--
+			p.stats.Stale++
+			p.mu.Unlock()
+			continue
+		}
+		c.reused = true
+		c.written = 0
+		return c, nil
+	}
+
+	c, err := p.newConn()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	c.written = 0
+	return c, nil
+}
+
+// 放回一个连接，broken为true时直接关闭
+func (p *connPool) put(c *poolConn, broken bool) {
+	p.mu.Lock()
+	if broken || p.closed || p.expired(c) {
+		p.open--
+		p.mu.Unlock()
+		c.Conn.Close()
+	} else {
+		c.lastUsed = time.Now()
+		c.reused = false
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+	}
+	p.release()
+}
+
+// 关闭连接池和全部空闲连接，使用中的连接在放回时关闭
+func (p *connPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.open -= len(idle)
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Conn.Close()
+	}
+}
+
+func (p *connPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.InUse = p.open - s.Idle
+	return s
+}
+
+func (p *connPool) newConn() (*poolConn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	p.open++
+	p.stats.Dials++
+	p.mu.Unlock()
+	return &poolConn{Conn: conn, created: now, lastUsed: now}, nil
+}
+
+// 释放一个连接名额
+func (p *connPool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// 判断连接是否超过空闲时间或存活时间
+func (p *connPool) expired(c *poolConn) bool {
+	now := time.Now()
+	if p.opts.IdleTimeout > 0 && now.Sub(c.lastUsed) > p.opts.IdleTimeout {
+		return true
+	}
+	if p.opts.MaxLifetime > 0 && now.Sub(c.created) > p.opts.MaxLifetime {
+		return true
+	}
+	return false
+}
+
+// 检测空闲连接是否存活，空闲连接上不应有可读数据，
+// 无数据可读说明连接正常，读到EOF或数据说明连接已被关闭或状态异常
+func alive(c *poolConn) bool {
+	conn := c.Conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var rerr error
+	var b [1]byte
+	err = rc.Read(func(fd uintptr) bool {
+		_, _, rerr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true
+	})
+	if err != nil {
+		return false
+	}
+	return rerr == syscall.EAGAIN || rerr == syscall.EWOULDBLOCK
+}
+
+// 复用的连接失效时是否可以重新建立连接后重试
+// 请求还没有写出，或者都是只读请求时，重试不会重复执行修改
+func retryable(c *poolConn, err error, methods ...uint32) bool {
+	if !c.reused || !isStale(err) {
+		return false
+	}
+	if c.written == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if !idempotent(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// 只读的请求，重复执行没有副作用
+func idempotent(method uint32) bool {
+	switch int(method) {
+	case server.METHOD_STAT, server.METHOD_LIST, server.METHOD_READ_FILE, server.METHOD_VERSIONS,
+		server.METHOD_TRASH, server.METHOD_SNAPSHOT_LIST, server.METHOD_REPLICA_STATUS, server.METHOD_ARCHIVE:
+		return true
+	}
+	return false
+}
+
+// 判断错误是否是复用了已失效连接造成的，这种错误可以重新建立连接后重试
+func isStale(err error) bool {
+	if e, ok := err.(*netError); ok {
+		err = e.err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		return !oe.Timeout()
+	}
+	return false
+}
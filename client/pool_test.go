@@ -0,0 +1,157 @@
+package client
+
+import (
+	"cmstop-fserver/server"
+	"cmstop-fserver/util"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动一个简单的服务端，每个连接只处理n个请求后关闭，n为0时不限制
+func startFakeServer(t *testing.T, n int) (string, string) {
+	host, port, _ := startDropServer(t, n, false)
+	return host, port
+}
+
+// 启动一个简单的服务端，每个连接处理n个请求后，drop为true时再读取一个请求不响应，然后关闭
+// 返回读取的请求数
+func startDropServer(t *testing.T, n int, drop bool) (string, string, *int32) {
+	var count int32
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for i := 0; n == 0 || i < n || drop && i == n; i++ {
+					var h [4]uint32
+					if err := binary.Read(conn, binary.LittleEndian, &h); err != nil {
+						return
+					}
+					var metaLength uint32
+					if h[0]&server.FLAG_META != 0 {
+						if err := binary.Read(conn, binary.LittleEndian, &metaLength); err != nil {
+							return
+						}
+					}
+					rest := make([]byte, metaLength+h[1]+h[2]+h[3])
+					if _, err := io.ReadFull(conn, rest); err != nil {
+						return
+					}
+					atomic.AddInt32(&count, 1)
+					if drop && i == n {
+						return
+					}
+					// 写入请求返回内容的哈希
+					data, _ := json.Marshal(&server.WriteResult{Hash: util.Hash(rest[len(rest)-int(h[3]):])})
+					b, _ := json.Marshal(&server.ResponseData{Message: "success", Data: data})
+					binary.Write(conn, binary.LittleEndian, uint32(len(b)))
+					conn.Write(b)
+				}
+			}(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return host, port, &count
+}
+
+func TestPoolRedialStaleConn(t *testing.T) {
+	host, port := startFakeServer(t, 1)
+	opts := DefaultOptions
+	opts.MinConns = 1
+	client, err := NewClientWithOptions(host, port, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if err := client.WriteFile("/tmp/x", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		// 等待服务端关闭连接
+		time.Sleep(20 * time.Millisecond)
+	}
+	s := client.Stats()
+	if s.Stale == 0 {
+		t.Errorf("expected stale connections to be detected, stats %+v", s)
+	}
+	if s.InUse != 0 {
+		t.Errorf("expected no connection in use, stats %+v", s)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	host, port := startFakeServer(t, 0)
+	opts := Options{MinConns: 0, MaxConns: 1, IdleTimeout: 10 * time.Millisecond}
+	client, err := NewClientWithOptions(host, port, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.CreateDir("/tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateDir("/tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	if s := client.Stats(); s.Dials != 1 || s.Idle != 1 {
+		t.Errorf("expected connection reuse, stats %+v", s)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := client.CreateDir("/tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	if s := client.Stats(); s.Dials != 2 || s.Stale != 1 || s.Open != 1 {
+		t.Errorf("expected idle connection to be replaced, stats %+v", s)
+	}
+}
+
+func TestPoolRetryIdempotent(t *testing.T) {
+	host, port, count := startDropServer(t, 1, true)
+	opts := DefaultOptions
+	opts.MinConns = 0
+	opts.MaxConns = 1
+	client, err := NewClientWithOptions(host, port, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 请求已经写出后连接失效，追加不重试，避免重复追加
+	if err = client.AppendFile("/tmp/x", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.AppendFile("/tmp/x", []byte("x")); err == nil {
+		t.Error("append retried on stale connection")
+	}
+	if n := atomic.LoadInt32(count); n != 2 {
+		t.Errorf("append requests received %d, want 2", n)
+	}
+
+	// 只读请求重新建立连接后重试
+	if _, err = client.Stat("/tmp/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Stat("/tmp/x"); err != nil {
+		t.Errorf("stat not retried: %v", err)
+	}
+	if n := atomic.LoadInt32(count); n != 5 {
+		t.Errorf("requests received %d, want 5", n)
+	}
+	rs := client.Pipeline([]*Request{{Method: server.METHOD_APPEND_FILE, Path: "/tmp/x", Body: []byte("x")}})
+	if rs[0].Err == nil {
+		t.Error("pipelined append retried on stale connection")
+	}
+}
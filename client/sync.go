@@ -0,0 +1,206 @@
+package client
+
+import (
+	"cmstop-fserver/util"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// 同步操作类型
+const (
+	SYNC_PUT   = "put"   // 上传新增或变化的文件
+	SYNC_RM    = "rm"    // 删除远程多余的文件
+	SYNC_RMDIR = "rmdir" // 删除远程多余的目录
+)
+
+const (
+	SYNC_CHUNK_SIZE = 4 << 20    // 上传时每次写入的大小
+	SYNC_TMP_PREFIX = ".fssync-" // 分块上传的临时文件前缀，和目标文件在同一目录
+)
+
+// 上传时每次写入的大小，测试时修改
+var syncChunkSize = SYNC_CHUNK_SIZE
+
+// 同步选项
+type SyncOptions struct {
+	Delete bool // 是否删除本地不存在的远程文件
+	DryRun bool // 只列出需要执行的操作，不实际执行
+}
+
+// 一个同步操作
+type SyncAction struct {
+	Op     string // 操作类型
+	Local  string // 本地路径，删除操作为空
+	Remote string // 远程路径
+	Size   int64  // 上传的文件大小
+	Err    error  // 执行结果，DryRun时为空
+}
+
+// 将本地目录同步到远程目录，只上传大小或内容哈希不同的文件
+// 变化的文件整个上传，不做按块比对的增量传输(rsync的滚动校验)，较大的文件分块上传，见put
+// 每个操作执行后调用fn（可以为nil），返回全部操作和比对阶段的错误
+// 单个操作失败不会中断同步，失败信息记录在SyncAction.Err中
+func (t *FSClient) Sync(local, remote string, opts *SyncOptions, fn func(*SyncAction)) ([]*SyncAction, error) {
+	if opts == nil {
+		opts = new(SyncOptions)
+	}
+	local = strings.TrimRight(local, "/")
+	remote = strings.TrimRight(remote, "/")
+
+	plan, err := t.syncPlan(local, remote, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range plan {
+		if !opts.DryRun {
+			switch a.Op {
+			case SYNC_PUT:
+				a.Err = t.put(a.Local, a.Remote)
+			case SYNC_RM:
+				a.Err = t.RemoveFile(a.Remote)
+			case SYNC_RMDIR:
+				a.Err = t.RemoveDir(a.Remote)
+			}
+		}
+		if fn != nil {
+			fn(a)
+		}
+	}
+	return plan, nil
+}
+
+// 上传一个文件，不超过syncChunkSize时一次写入
+// 较大的文件按块读取，第一块写入同目录的临时文件，之后的块追加写入，完成后更名为目标文件
+// 不把整个文件读入内存，中途失败时删除临时文件，目标文件保持不变
+// 内容检查对每一块分别进行，开启图片检查时图片不能追加写入，较大的图片会上传失败
+func (t *FSClient) put(local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, syncChunkSize)
+	n, err := io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return t.WriteFile(remote, buf[:n])
+	}
+	if err != nil {
+		return err
+	}
+	tmp := path.Dir(remote) + "/" + SYNC_TMP_PREFIX + path.Base(remote)
+	err = t.WriteFile(tmp, buf)
+	for err == nil {
+		var rerr error
+		n, rerr = io.ReadFull(f, buf)
+		if n > 0 {
+			err = t.AppendFile(tmp, buf[:n])
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if err == nil {
+			err = rerr
+		}
+	}
+	if err == nil {
+		err = t.Rename(tmp, remote)
+	}
+	if err != nil {
+		t.RemoveFile(tmp)
+	}
+	return err
+}
+
+// 比对本地和远程目录，生成同步操作列表
+func (t *FSClient) syncPlan(local, remote string, opts *SyncOptions) ([]*SyncAction, error) {
+	var files []string
+	err := util.ReadDirRecursiveFiles(local, &files)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	// 远程目录不存在时全部上传
+	remoteFiles := make(map[string]*remoteEntry)
+	info, err := t.Stat(remote)
+	if err != nil {
+		return nil, err
+	}
+	if info.Exist {
+		list, err := t.List(remote, true, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range list {
+			remoteFiles[f.Path] = &remoteEntry{isDir: f.IsDir, size: f.Size, hash: f.Hash}
+		}
+	}
+
+	puts := make([]*SyncAction, 0)
+	for _, f := range files {
+		rel := f[len(local)+1:]
+		s, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := remoteFiles[rel]; ok && !r.isDir && r.size == s.Size() {
+			h, err := util.FileHash(f)
+			if err != nil {
+				return nil, err
+			}
+			if h == r.hash {
+				continue
+			}
+		}
+		puts = append(puts, &SyncAction{Op: SYNC_PUT, Local: f, Remote: remote + "/" + rel, Size: s.Size()})
+	}
+
+	// 先删除再上传，远程文件和本地目录同名时才能上传成功
+	plan := make([]*SyncAction, 0)
+	if opts.Delete {
+		rels := make([]string, 0, len(remoteFiles))
+		for rel := range remoteFiles {
+			rels = append(rels, rel)
+		}
+		sort.Strings(rels)
+		removed := make(map[string]bool)
+		for _, rel := range rels {
+			// 父目录已经删除，跳过
+			if parentIn(rel, removed) {
+				continue
+			}
+			r := remoteFiles[rel]
+			s, err := os.Stat(local + "/" + rel)
+			if err == nil && s.IsDir() == r.isDir {
+				continue
+			}
+			if r.isDir {
+				plan = append(plan, &SyncAction{Op: SYNC_RMDIR, Remote: remote + "/" + rel})
+				removed[rel] = true
+			} else {
+				plan = append(plan, &SyncAction{Op: SYNC_RM, Remote: remote + "/" + rel})
+			}
+		}
+	}
+	return append(plan, puts...), nil
+}
+
+// 判断路径的某个上级目录是否在集合中
+func parentIn(rel string, dirs map[string]bool) bool {
+	for i := strings.LastIndex(rel, "/"); i > 0; i = strings.LastIndex(rel, "/") {
+		rel = rel[:i]
+		if dirs[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+type remoteEntry struct {
+	isDir bool
+	size  int64
+	hash  string
+}
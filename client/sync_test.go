@@ -0,0 +1,152 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	host, port, root := startTestServer(t)
+	c, err := NewClient(host, port, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	local, err := ioutil.TempDir("", "fsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	write := func(p, body string) {
+		os.MkdirAll(p[:strings.LastIndex(p, "/")], 0755)
+		ioutil.WriteFile(p, []byte(body), 0644)
+	}
+	write(local+"/index.html", "<p>index</p>")
+	write(local+"/css/a.css", "body{}")
+	write(local+"/d/e.txt", "e")
+	remote := root + "/www"
+	write(remote+"/index.html", "<p>index</p>")
+	write(remote+"/css/a.css", "p  {}")
+	write(remote+"/old.html", "old")
+	write(remote+"/gone/x.txt", "x")
+	write(remote+"/d", "file in place of dir")
+
+	ops := func(actions []*SyncAction) string {
+		var s []string
+		for _, a := range actions {
+			s = append(s, a.Op+" "+a.Remote[len(remote)+1:])
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+
+	// 只上传内容变化的文件，dry-run不修改远程文件
+	var called int
+	plan, err := c.Sync(local, remote, &SyncOptions{Delete: true, DryRun: true}, func(*SyncAction) { called++ })
+	want := "put css/a.css,put d/e.txt,rm d,rm old.html,rmdir gone"
+	if err != nil || ops(plan) != want || called != len(plan) {
+		t.Fatalf("dry-run: %s %v", ops(plan), err)
+	}
+	if _, err = os.Stat(remote + "/old.html"); err != nil {
+		t.Error("dry-run removed file")
+	}
+
+	// 不删除时保留远程多余的文件
+	plan, err = c.Sync(local+"/css/", remote+"/css", nil, nil)
+	if err != nil || ops(plan) != "put css/a.css" || plan[0].Err != nil {
+		t.Errorf("sync css: %s %v", ops(plan), err)
+	}
+	plan, err = c.Sync(local, remote, &SyncOptions{Delete: true}, nil)
+	if err != nil || ops(plan) != "put d/e.txt,rm d,rm old.html,rmdir gone" {
+		t.Fatalf("sync: %s %v", ops(plan), err)
+	}
+	for _, a := range plan {
+		if a.Err != nil {
+			t.Errorf("%s %s: %v", a.Op, a.Remote, a.Err)
+		}
+	}
+	for _, f := range []string{"index.html", "css/a.css", "d/e.txt"} {
+		l, _ := ioutil.ReadFile(local + "/" + f)
+		r, _ := ioutil.ReadFile(remote + "/" + f)
+		if string(l) != string(r) {
+			t.Errorf("%s: %q, want %q", f, r, l)
+		}
+	}
+	if _, err = os.Stat(remote + "/gone"); !os.IsNotExist(err) {
+		t.Errorf("gone not removed: %v", err)
+	}
+	if plan, err = c.Sync(local, remote, &SyncOptions{Delete: true}, nil); err != nil || len(plan) != 0 {
+		t.Errorf("second sync: %s %v", ops(plan), err)
+	}
+
+	// 远程目录不存在时全部上传，失败的文件记录错误
+	write(local+"/x.php", "<?php")
+	plan, err = c.Sync(local, root+"/new", nil, nil)
+	if err != nil || len(plan) != 4 {
+		t.Fatalf("sync new: %d %v", len(plan), err)
+	}
+	for _, a := range plan {
+		if (a.Err != nil) != strings.HasSuffix(a.Remote, ".php") {
+			t.Errorf("%s: %v", a.Remote, a.Err)
+		}
+	}
+	if _, err = c.Sync(local+"/none", remote, nil, nil); err == nil {
+		t.Error("missing local dir")
+	}
+}
+
+// 较大的文件分块上传到临时文件，完成后更名
+func TestSyncChunked(t *testing.T) {
+	host, port, root := startTestServer(t)
+	c, err := NewClient(host, port, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer func(n int) { syncChunkSize = n }(syncChunkSize)
+	syncChunkSize = 8
+	local := t.TempDir()
+	remote := root + "/www"
+	os.MkdirAll(remote, 0755)
+	ioutil.WriteFile(remote+"/big.txt", []byte("old"), 0644)
+	for name, body := range map[string]string{
+		"big.txt":   strings.Repeat("0123456789", 5),
+		"exact.txt": "01234567",
+		"two.txt":   "0123456789abcdef",
+		"small.txt": "small",
+	} {
+		ioutil.WriteFile(local+"/"+name, []byte(body), 0644)
+	}
+	plan, err := c.Sync(local, remote, nil, nil)
+	if err != nil || len(plan) != 4 {
+		t.Fatalf("sync: %d %v", len(plan), err)
+	}
+	for _, a := range plan {
+		if a.Err != nil {
+			t.Errorf("%s: %v", a.Remote, a.Err)
+		}
+		l, _ := ioutil.ReadFile(a.Local)
+		r, _ := ioutil.ReadFile(a.Remote)
+		if string(l) != string(r) {
+			t.Errorf("%s: %q, want %q", a.Remote, r, l)
+		}
+	}
+	fl, _ := ioutil.ReadDir(remote)
+	for _, f := range fl {
+		if strings.HasPrefix(f.Name(), SYNC_TMP_PREFIX) {
+			t.Errorf("temp file left: %s", f.Name())
+		}
+	}
+}
+
+func TestParentIn(t *testing.T) {
+	dirs := map[string]bool{"a": true, "b/c": true}
+	for rel, want := range map[string]bool{"a/x": true, "a/b/x": true, "b/c/d": true, "b/x": false, "a": false, "ab/x": false} {
+		if parentIn(rel, dirs) != want {
+			t.Errorf("%s: %v", rel, !want)
+		}
+	}
+}
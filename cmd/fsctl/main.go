@@ -0,0 +1,469 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+Command fsctl is a command-line tool for cmstop-fserver.
+it's use client package talk to the file server, provider
+put, append, rm, mkdir, rmdir, clear, cp, mv, stat, ls,
+sync, lock, unlock, versions, trash, restore, snapshot, extract,
+archive and scan operations.
+*/
+package main
+
+import (
+	"bufio"
+	"cmstop-fserver/client"
+	"cmstop-fserver/server"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NAME    = "CmsTop File Server Control"
+	VERSION = "1.0 beta"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// 执行命令，返回退出码，0 成功，1 操作失败，2 参数错误
+func run(argv []string, stdout, stderr io.Writer) (code int) {
+	out := newOutput(false, stdout, stderr)
+	defer func() {
+		if r := recover(); r != nil {
+			c, ok := r.(exitCode)
+			if !ok {
+				panic(r)
+			}
+			code = int(c)
+		}
+	}()
+
+	// 命令行全局参数
+	flags := flag.NewFlagSet("fsctl", flag.ContinueOnError)
+	confFile := flags.String("c", "", "profile config file, default ~/"+DEF_CONF_FILE)
+	profile := flags.String("p", DEF_PROFILE, "server profile name")
+	host := flags.String("H", "", "server host, override profile")
+	port := flags.String("P", "", "server port, override profile")
+	password := flags.String("k", "", "server password, override profile")
+	jsonOut := flags.Bool("json", false, "output json instead of text")
+	lockToken := flags.String("t", "", "lease token, operate on paths locked by it")
+	flags.Usage = func() { help(stdout) }
+	args := out.parse(flags, argv)
+	out.json = *jsonOut
+	if len(args) == 0 {
+		help(stdout)
+		return 2
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "help":
+		help(stdout)
+		return 0
+	case "version":
+		fmt.Fprintln(stdout, NAME, VERSION)
+		return 0
+	}
+
+	conf, err := loadProfile(*confFile, *profile)
+	if err != nil {
+		out.fatal(err)
+	}
+	if *host != "" {
+		conf.Host = *host
+	}
+	if *port != "" {
+		conf.Port = *port
+	}
+	if *password != "" {
+		conf.Password = *password
+	}
+
+	opts, err := conf.options()
+	if err != nil {
+		out.fatal(err)
+	}
+	c, err := client.NewClientWithOptions(conf.Host, conf.Port, conf.Password, opts)
+	if err != nil {
+		out.fatal(err)
+	}
+	defer c.Close()
+	if *lockToken != "" {
+		c = c.Locked(*lockToken)
+	}
+
+	var recursive bool // put -r, ls -r
+	switch cmd {
+	case "put":
+		fs := flag.NewFlagSet("put", flag.ContinueOnError)
+		fs.BoolVar(&recursive, "r", false, "upload local directory recursively")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 2)
+		if recursive {
+			putDir(c, out, args[0], args[1])
+		} else {
+			putFile(c, out, args[0], args[1])
+		}
+	case "append":
+		out.needArgs(cmd, args, 2)
+		body, err := readLocal(args[0])
+		if err == nil {
+			err = c.AppendFile(args[1], body)
+		}
+		out.result(cmd, args[1], "", err)
+	case "rm":
+		out.needArgs(cmd, args, 1)
+		out.result(cmd, args[0], "", c.RemoveFile(args[0]))
+	case "mkdir":
+		out.needArgs(cmd, args, 1)
+		out.result(cmd, args[0], "", c.CreateDir(args[0]))
+	case "rmdir":
+		out.needArgs(cmd, args, 1)
+		out.result(cmd, args[0], "", c.RemoveDir(args[0]))
+	case "clear":
+		out.needArgs(cmd, args, 1)
+		out.result(cmd, args[0], "", c.ClearDir(args[0]))
+	case "cp":
+		out.needArgs(cmd, args, 2)
+		out.result(cmd, args[0], args[1], c.Copy(args[0], args[1]))
+	case "mv":
+		out.needArgs(cmd, args, 2)
+		out.result(cmd, args[0], args[1], c.Rename(args[0], args[1]))
+	case "stat":
+		out.needArgs(cmd, args, 1)
+		info, err := c.Stat(args[0])
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		} else {
+			out.info(info)
+		}
+	case "ls":
+		fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+		fs.BoolVar(&recursive, "r", false, "list sub directories recursively")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 1)
+		list, err := c.List(args[0], recursive, false)
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		}
+		for _, info := range list {
+			out.info(info)
+		}
+	case "sync":
+		opts := new(client.SyncOptions)
+		fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+		fs.BoolVar(&opts.Delete, "delete", false, "delete remote files not exist in local")
+		fs.BoolVar(&opts.DryRun, "n", false, "dry run, only print actions")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 2)
+		_, err := c.Sync(args[0], args[1], opts, func(a *client.SyncAction) {
+			out.sync(a, opts.DryRun)
+		})
+		if err != nil {
+			out.result(cmd, args[1], "", err)
+		}
+	case "lock":
+		var lease int
+		var shared bool
+		fs := flag.NewFlagSet("lock", flag.ContinueOnError)
+		fs.IntVar(&lease, "lease", 0, "lease seconds, 0 use server default")
+		fs.BoolVar(&shared, "shared", false, "shared lock, allow reads and other shared locks")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 1)
+		// 带-t时续期该租约
+		l, err := c.Lock(args[0], time.Duration(lease)*time.Second, shared)
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		} else {
+			out.lease(l)
+		}
+	case "unlock":
+		out.needArgs(cmd, args, 2)
+		out.result(cmd, args[0], "", c.Unlock(args[0], args[1]))
+	case "versions", "trash":
+		out.needArgs(cmd, args, 1)
+		var list []*server.StoreEntry
+		if cmd == "versions" {
+			list, err = c.Versions(args[0])
+		} else {
+			list, err = c.Trash(args[0])
+		}
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		}
+		for _, e := range list {
+			out.entry(e)
+		}
+	case "restore":
+		var trash bool
+		fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+		fs.BoolVar(&trash, "trash", false, "restore trash entry instead of version")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 2)
+		if trash {
+			out.result(cmd, args[0], "", c.RestoreTrash(args[0], args[1]))
+		} else {
+			out.result(cmd, args[0], "", c.RestoreVersion(args[0], args[1]))
+		}
+	case "empty-trash":
+		out.needArgs(cmd, args, 1)
+		n, err := c.EmptyTrash(args[0])
+		if err == nil && !out.json {
+			fmt.Fprintln(stdout, strconv.Itoa(n)+" entries removed")
+		}
+		out.result(cmd, args[0], "", err)
+	case "snapshot":
+		snapshot(c, out, args)
+	case "extract":
+		var swap bool
+		fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+		fs.BoolVar(&swap, "swap", false, "replace directory instead of merging")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 2)
+		body, err := readLocal(args[0])
+		if err == nil {
+			var res *server.ExtractResult
+			res, err = c.Extract(args[1], body, swap)
+			if err == nil && !out.json {
+				fmt.Fprintf(stdout, "%d files, %d dirs, %d bytes\n", res.Files, res.Dirs, res.Size)
+			}
+		}
+		out.result(cmd, args[1], "", err)
+	case "archive":
+		params := new(server.ArchiveParams)
+		var gz bool
+		var include, exclude, since string
+		fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+		fs.BoolVar(&gz, "z", false, "gzip compressed, tar.gz")
+		fs.StringVar(&include, "include", "", "only archive files match patterns, comma separated")
+		fs.StringVar(&exclude, "exclude", "", "skip files match patterns, comma separated")
+		fs.StringVar(&since, "since", "", "only archive files modified since, 2006-01-02 or RFC3339")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 2)
+		if gz {
+			params.Format = server.EXTRACT_TGZ
+		}
+		params.Include = splitList(include)
+		params.Exclude = splitList(exclude)
+		if since != "" {
+			t, err := parseTime(since)
+			if err != nil {
+				out.fatal(err)
+			}
+			params.Since = t.Unix()
+		}
+		res, err := archive(c, args[0], args[1], params, stdout)
+		if err == nil && !out.json && args[1] != "-" {
+			fmt.Fprintf(stdout, "%d files, %d bytes\n", res.Files, res.Size)
+		}
+		if err != nil || args[1] != "-" {
+			out.result(cmd, args[0], args[1], err)
+		}
+	case "cat":
+		out.needArgs(cmd, args, 1)
+		body, err := c.ReadFile(args[0])
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		} else {
+			stdout.Write(body)
+		}
+	case "scan":
+		scan(c, out, args)
+	case "status":
+		out.needArgs(cmd, args, 0)
+		st, err := c.ReplicaStatus()
+		if err != nil {
+			out.result(cmd, "", "", err)
+		} else {
+			out.replication(st)
+		}
+	default:
+		out.usage("unknown command: " + cmd)
+	}
+
+	if out.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 下载目录的打包到本地文件，local为-时写入标准输出，失败时删除不完整的文件
+func archive(c *client.FSClient, remote, local string, params *server.ArchiveParams, stdout io.Writer) (*server.ArchiveResult, error) {
+	if local == "-" {
+		return c.Archive(remote, stdout, params)
+	}
+	f, err := os.Create(local)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	res, err := c.Archive(remote, w, params)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(local)
+		return nil, err
+	}
+	return res, nil
+}
+
+// 逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// 解析日期或RFC3339时间，日期使用本地时区
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, errors.New("time format error: " + s)
+	}
+	return t, nil
+}
+
+// 扫描子命令，start开始扫描远程目录，stop停止，status获取状态
+func scan(c *client.FSClient, out *output, args []string) {
+	if len(args) == 0 {
+		out.needArgs("scan", args, 1)
+	}
+	params := &server.ScanParams{Action: args[0]}
+	cmd, args := "scan "+args[0], args[1:]
+	dir := ""
+	switch cmd {
+	case "scan start":
+		var csv bool
+		fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+		fs.BoolVar(&csv, "csv", false, "csv report instead of json")
+		fs.BoolVar(&params.Quarantine, "quarantine", false, "move files with findings to quarantineDir")
+		fs.BoolVar(&params.Resume, "resume", false, "resume the last scan from checkpoint")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 1)
+		if csv {
+			params.Format = server.SCAN_CSV
+		}
+		dir = args[0]
+	case "scan stop", "scan status":
+		out.needArgs(cmd, args, 0)
+	default:
+		out.usage("unknown command: " + cmd)
+	}
+	st, err := c.Scan(dir, params)
+	if err != nil {
+		out.result(cmd, dir, "", err)
+	} else {
+		out.scan(st)
+	}
+}
+
+// 快照子命令
+func snapshot(c *client.FSClient, out *output, args []string) {
+	if len(args) == 0 {
+		out.needArgs("snapshot", args, 1)
+	}
+	cmd, args := "snapshot "+args[0], args[1:]
+	switch cmd {
+	case "snapshot create":
+		var name string
+		fs := flag.NewFlagSet("snapshot create", flag.ContinueOnError)
+		fs.StringVar(&name, "m", "", "snapshot description")
+		args = out.parse(fs, args)
+		out.needArgs(cmd, args, 1)
+		snap, err := c.CreateSnapshot(args[0], name)
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		} else {
+			out.snapshot(snap)
+		}
+	case "snapshot ls":
+		out.needArgs(cmd, args, 1)
+		list, err := c.Snapshots(args[0])
+		if err != nil {
+			out.result(cmd, args[0], "", err)
+		}
+		for _, snap := range list {
+			out.snapshot(snap)
+		}
+	case "snapshot restore":
+		out.needArgs(cmd, args, 2)
+		out.result(cmd, args[0], "", c.RestoreSnapshot(args[0], args[1]))
+	case "snapshot rm":
+		out.needArgs(cmd, args, 2)
+		out.result(cmd, args[0], "", c.DeleteSnapshot(args[0], args[1]))
+	default:
+		out.usage("unknown command: " + cmd)
+	}
+}
+
+func help(w io.Writer) {
+	prog := path.Base(os.Args[0])
+	fmt.Fprintln(w, NAME, VERSION)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Usage: "+prog+" [OPTIONS] <command> [ARGS]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Options:")
+	fmt.Fprintln(w, "  -c <file> \t\t profile config file, default ~/"+DEF_CONF_FILE)
+	fmt.Fprintln(w, "  -p <name> \t\t server profile, default "+DEF_PROFILE)
+	fmt.Fprintln(w, "  -H <host> \t\t server host, override profile")
+	fmt.Fprintln(w, "  -P <port> \t\t server port, override profile")
+	fmt.Fprintln(w, "  -k <password> \t server password, override profile")
+	fmt.Fprintln(w, "  -json \t\t output json lines")
+	fmt.Fprintln(w, "  -t <token> \t\t lease token, operate on paths locked by it")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  put [-r] <local> <remote> \t upload file, or directory with -r, local - read stdin")
+	fmt.Fprintln(w, "  append <local> <remote> \t append local file to remote file")
+	fmt.Fprintln(w, "  rm <remote> \t\t\t remove file")
+	fmt.Fprintln(w, "  mkdir <remote> \t\t create directory")
+	fmt.Fprintln(w, "  rmdir <remote> \t\t remove directory and it's content")
+	fmt.Fprintln(w, "  clear <remote> \t\t clear directory content")
+	fmt.Fprintln(w, "  cp <remote> <newpath> \t copy file or directory")
+	fmt.Fprintln(w, "  mv <remote> <newpath> \t rename file or directory")
+	fmt.Fprintln(w, "  stat <remote> \t\t show file or directory info")
+	fmt.Fprintln(w, "  ls [-r] <remote> \t\t list directory")
+	fmt.Fprintln(w, "  sync [-delete] [-n] <local> <remote> \t upload changed files, -n dry run")
+	fmt.Fprintln(w, "  lock [-lease N] [-shared] <remote> \t lock path and print lease token, renew with -t")
+	fmt.Fprintln(w, "  unlock <remote> <token> \t release lease")
+	fmt.Fprintln(w, "  versions <remote> \t\t list file versions")
+	fmt.Fprintln(w, "  trash <remote> \t\t list deleted entries under path")
+	fmt.Fprintln(w, "  restore [-trash] <remote> <id> \t restore version, or trash entry with -trash")
+	fmt.Fprintln(w, "  empty-trash <remote> \t\t remove trash entries under path")
+	fmt.Fprintln(w, "  snapshot create [-m name] <remote> \t snapshot directory")
+	fmt.Fprintln(w, "  snapshot ls <remote> \t\t list snapshots of directory and sub directories")
+	fmt.Fprintln(w, "  snapshot restore <remote> <id> \t roll back directory to snapshot")
+	fmt.Fprintln(w, "  snapshot rm <remote> <id> \t delete snapshot")
+	fmt.Fprintln(w, "  extract [-swap] <archive> <remote> \t extract tar, tar.gz or zip into directory")
+	fmt.Fprintln(w, "  archive [-z] [-include p] [-exclude p] [-since t] <remote> <local> \t download directory as tar or tar.gz, local - for stdout")
+	fmt.Fprintln(w, "  cat <remote> \t\t\t print file content")
+	fmt.Fprintln(w, "  scan start [-csv] [-quarantine] [-resume] <remote> \t scan existing files with the content filter")
+	fmt.Fprintln(w, "  scan stop|status \t\t stop the scan or show it's progress")
+	fmt.Fprintln(w, "  status \t\t\t show replication status")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Examples:")
+	fmt.Fprintln(w, "  "+prog+" -p test put -r ./theme /data/www/theme")
+	fmt.Fprintln(w, "  "+prog+" -p test sync -delete -n ./theme /data/www/theme")
+	fmt.Fprintln(w, "  "+prog+" -p test -t <token> sync ./theme /data/www/theme")
+	fmt.Fprintln(w, "  "+prog+" -p test snapshot create -m \"before redesign\" /data/www")
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"cmstop-fserver/server"
+	"encoding/json"
+	"errors"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 启动进程内的服务端，返回地址和允许操作的目录
+func startTestServer(t *testing.T) (string, string, string) {
+	root, err := ioutil.TempDir("", "fserver-fsctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := root + ".conf"
+	ioutil.WriteFile(conf, []byte("[common]\nrootDir="+root+"\nallowExt=html,txt\npassword=pw\nhmac=true\n"), 0600)
+	defer os.Remove(conf)
+	c, err := goconfig.ReadConfigFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err = s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Stop()
+		os.RemoveAll(root)
+	})
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return host, port, root
+}
+
+// 执行命令，返回退出码、标准输出和错误输出
+func runTest(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/fsctl.conf"
+	ioutil.WriteFile(file, []byte("[default]\npassword=a\n[test]\nhost=10.0.0.1\nport=9000\npassword=b\n"), 0600)
+
+	p, err := loadProfile(file, "default")
+	if err != nil || p.Host != DEF_HOST || p.Port != DEF_PORT || p.Password != "a" {
+		t.Errorf("default: %+v %v", p, err)
+	}
+	p, err = loadProfile(file, "test")
+	if err != nil || p.Host != "10.0.0.1" || p.Port != "9000" || p.Password != "b" {
+		t.Errorf("test: %+v %v", p, err)
+	}
+	if _, err = loadProfile(file, "missing"); err == nil {
+		t.Error("missing profile")
+	}
+	if _, err = loadProfile(dir+"/missing.conf", "default"); err == nil {
+		t.Error("missing config file")
+	}
+
+	// 没有指定配置文件时读取主目录中的默认文件，不存在时使用默认值
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", dir)
+	if p, err = loadProfile("", "default"); err != nil || p.Host != DEF_HOST || p.Password != "" {
+		t.Errorf("without config: %+v %v", p, err)
+	}
+	os.Rename(file, dir+"/"+DEF_CONF_FILE)
+	if p, err = loadProfile("", "test"); err != nil || p.Password != "b" {
+		t.Errorf("home config: %+v %v", p, err)
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	host, port, _ := startTestServer(t)
+	if code, _, _ := runTest(); code != 2 {
+		t.Errorf("no command: exit %d", code)
+	}
+	if code, _, _ := runTest("-x"); code != 2 {
+		t.Errorf("bad option: exit %d", code)
+	}
+	for _, args := range [][]string{
+		{"nope"},
+		{"put", "a"},
+		{"ls", "-x", "/a"},
+		{"snapshot", "nope", "/a"},
+		{"scan", "start"},
+	} {
+		if code, _, _ := runTest(append([]string{"-H", host, "-P", port}, args...)...); code != 2 {
+			t.Errorf("%v: exit %d", args, code)
+		}
+	}
+	if code, out, _ := runTest("version"); code != 0 || !strings.Contains(out, VERSION) {
+		t.Errorf("version: %d %q", code, out)
+	}
+	if code, out, _ := runTest("help"); code != 0 || !strings.Contains(out, "Commands:") {
+		t.Errorf("help: %d", code)
+	}
+	if code, _, errOut := runTest("-c", "/nonexistent/fsctl.conf", "stat", "/a"); code != 1 || !strings.HasPrefix(errOut, "fsctl: ") {
+		t.Errorf("bad profile: %d %q", code, errOut)
+	}
+	if got := splitList(" a, ,b,"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("splitList: %q", got)
+	}
+	if _, err := parseTime("2015-01-02"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseTime("yesterday"); err == nil {
+		t.Error("bad time parsed")
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	host, port, root := startTestServer(t)
+	dir, err := ioutil.TempDir("", "fsctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/theme/css", 0755)
+	ioutil.WriteFile(dir+"/theme/index.html", []byte("<p>index</p>"), 0644)
+	ioutil.WriteFile(dir+"/theme/css/a.txt", []byte("a"), 0644)
+	profile := dir + "/fsctl.conf"
+	ioutil.WriteFile(profile, []byte("[test]\nhost="+host+"\nport="+port+"\npassword=pw\nhmac=true\n"), 0600)
+	fsctl := func(args ...string) (int, string, string) {
+		return runTest(append([]string{"-c", profile, "-p", "test"}, args...)...)
+	}
+
+	code, out, _ := fsctl("put", "-r", dir+"/theme", root+"/www")
+	if code != 0 || strings.Count(out, ": success\n") != 2 {
+		t.Fatalf("put -r: %d %q", code, out)
+	}
+	if code, out, _ = fsctl("cat", root+"/www/index.html"); code != 0 || out != "<p>index</p>" {
+		t.Errorf("cat: %d %q", code, out)
+	}
+	if code, out, _ = fsctl("mv", root+"/www/css/a.txt", root+"/www/b.txt"); code != 0 ||
+		out != "mv "+root+"/www/css/a.txt -> "+root+"/www/b.txt: success\n" {
+		t.Errorf("mv: %d %q", code, out)
+	}
+	if code, out, _ = fsctl("stat", root+"/www/b.txt"); code != 0 || !strings.HasPrefix(out, "-rw-r--r--") ||
+		!strings.Contains(out, " "+root+"/www/b.txt ") {
+		t.Errorf("stat: %d %q", code, out)
+	}
+	if code, out, _ = fsctl("stat", root+"/www/none.txt"); code != 0 || out != root+"/www/none.txt: not exist\n" {
+		t.Errorf("stat missing: %d %q", code, out)
+	}
+
+	// json每行一个对象
+	code, out, _ = fsctl("-json", "ls", "-r", root+"/www")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if code != 0 || len(lines) != 3 {
+		t.Fatalf("ls: %d %q", code, out)
+	}
+	for _, l := range lines {
+		info := new(server.FileInfo)
+		if err = json.Unmarshal([]byte(l), info); err != nil || !info.Exist {
+			t.Errorf("ls line %q: %v", l, err)
+		}
+	}
+
+	// 操作失败时退出码为1，错误输出到标准错误
+	code, out, errOut := fsctl("cat", root+"/www/none.txt")
+	if code != 1 || out != "" || !strings.HasPrefix(errOut, "cat "+root+"/www/none.txt: ") {
+		t.Errorf("cat missing: %d %q %q", code, out, errOut)
+	}
+	code, out, _ = fsctl("-json", "put", dir+"/theme/index.html", root+"/x.php")
+	r := new(opResult)
+	if json.Unmarshal([]byte(out), r); code != 1 || r.Code != 1 || r.Op != "put" || r.Path != root+"/x.php" {
+		t.Errorf("put php: %d %q", code, out)
+	}
+	if code, _, _ = runTest("-H", host, "-P", port, "-k", "bad", "mkdir", root+"/c"); code != 1 {
+		t.Errorf("wrong password: %d", code)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	o := newOutput(false, &stdout, &stderr)
+	o.result("cp", "/a", "/b", nil)
+	o.result("rm", "/c", "", errors.New("not exist"))
+	if stdout.String() != "cp /a -> /b: success\n" || stderr.String() != "rm /c: not exist\n" || o.failed != 1 {
+		t.Errorf("text: %q %q %d", stdout.String(), stderr.String(), o.failed)
+	}
+	stdout.Reset()
+	o.json = true
+	o.result("rm", "/c", "", errors.New("not exist"))
+	o.info(&server.FileInfo{Path: "/a", Exist: true, Size: 3})
+	if stdout.String() != `{"op":"rm","path":"/c","code":1,"message":"not exist"}`+"\n"+
+		`{"path":"/a","exist":true,"dir":false,"size":3,"mode":0,"mtime":0}`+"\n" {
+		t.Errorf("json: %s", stdout.String())
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"cmstop-fserver/client"
+	"cmstop-fserver/server"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// 单个操作的输出结果
+type opResult struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	NewPath string `json:"newpath,omitempty"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// 输出操作结果，文本或JSON（每行一个对象）
+type output struct {
+	json   bool
+	failed int       // 失败的操作数
+	w      io.Writer // 结果
+	ew     io.Writer // 错误
+}
+
+// 结束命令的退出码，由run恢复
+type exitCode int
+
+func newOutput(isJson bool, w, ew io.Writer) *output {
+	o := new(output)
+	o.json = isJson
+	o.w = w
+	o.ew = ew
+	return o
+}
+
+// 解析参数，出错时退出码为2
+func (o *output) parse(fs *flag.FlagSet, args []string) []string {
+	fs.SetOutput(o.ew)
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		panic(exitCode(0))
+	}
+	if err != nil {
+		panic(exitCode(2))
+	}
+	return fs.Args()
+}
+
+// 检查子命令参数数量
+func (o *output) needArgs(cmd string, args []string, n int) {
+	if len(args) != n {
+		o.usage(cmd + ": wrong number of arguments")
+	}
+}
+
+// 参数错误，输出帮助后退出
+func (o *output) usage(msg string) {
+	fmt.Fprintln(o.ew, msg)
+	help(o.w)
+	panic(exitCode(2))
+}
+
+func (o *output) fatal(err error) {
+	fmt.Fprintln(o.ew, "fsctl: "+err.Error())
+	panic(exitCode(1))
+}
+
+func (o *output) result(op, path, newPath string, err error) {
+	r := opResult{Op: op, Path: path, NewPath: newPath, Message: "success"}
+	if err != nil {
+		r.Code = 1
+		r.Message = err.Error()
+		o.failed++
+	}
+	if o.json {
+		b, _ := json.Marshal(r)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	target := path
+	if newPath != "" {
+		target += " -> " + newPath
+	}
+	if err != nil {
+		fmt.Fprintln(o.ew, op+" "+target+": "+r.Message)
+	} else {
+		fmt.Fprintln(o.w, op+" "+target+": "+r.Message)
+	}
+}
+
+// 输出路径信息
+func (o *output) info(info *server.FileInfo) {
+	if o.json {
+		b, _ := json.Marshal(info)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	if !info.Exist {
+		fmt.Fprintln(o.w, info.Path+": not exist")
+		return
+	}
+	mode := os.FileMode(info.Mode)
+	if info.IsDir {
+		mode |= os.ModeDir
+	}
+	mtime := time.Unix(info.Mtime, 0).Format("2006-01-02 15:04:05")
+	line := fmt.Sprintf("%s %12d %s %s", mode, info.Size, mtime, info.Path)
+	if info.Hash != "" {
+		line += " " + info.Hash
+	}
+	fmt.Fprintln(o.w, line)
+}
+
+// 输出同步操作
+func (o *output) sync(a *client.SyncAction, dryRun bool) {
+	if !dryRun {
+		o.result(a.Op, a.Remote, "", a.Err)
+		return
+	}
+	if o.json {
+		b, _ := json.Marshal(opResult{Op: a.Op, Path: a.Remote, Message: "dry-run"})
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	fmt.Fprintln(o.w, a.Op+" "+a.Remote+": dry-run")
+}
+
+// 输出租约
+func (o *output) lease(l *server.Lease) {
+	if o.json {
+		b, _ := json.Marshal(l)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	mode := "exclusive"
+	if l.Shared {
+		mode = "shared"
+	}
+	expire := time.Unix(l.Expire, 0).Format("2006-01-02 15:04:05")
+	fmt.Fprintln(o.w, l.Token+" "+mode+" "+expire+" "+l.Path)
+}
+
+// 输出历史版本或回收站条目
+func (o *output) entry(e *server.StoreEntry) {
+	if o.json {
+		b, _ := json.Marshal(e)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	kind := "file"
+	if e.IsDir {
+		kind = "dir "
+	}
+	t := time.Unix(e.Time, 0).Format("2006-01-02 15:04:05")
+	fmt.Fprintf(o.w, "%s %s %s %12d %s\n", e.Id, t, kind, e.Size, e.Path)
+}
+
+// 输出快照
+func (o *output) snapshot(snap *server.Snapshot) {
+	if o.json {
+		b, _ := json.Marshal(snap)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	t := time.Unix(snap.Time, 0).Format("2006-01-02 15:04:05")
+	fmt.Fprintf(o.w, "%s %s %6d files %12d %s %s\n", snap.Id, t, snap.Files, snap.Size, snap.Path, snap.Name)
+}
+
+// 输出复制状态
+func (o *output) replication(st *server.ReplicationStatus) {
+	if o.json {
+		b, _ := json.Marshal(st)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	if st.Role == "primary" {
+		fmt.Fprintf(o.w, "primary seq %d\n", st.Seq)
+		return
+	}
+	state := "disconnected"
+	if st.Connected {
+		state = "connected"
+	}
+	fmt.Fprintf(o.w, "replica of %s %s, seq %d, primary seq %d, lag %d, resyncs %d\n",
+		st.Primary, state, st.Seq, st.PrimarySeq, st.Lag, st.Resyncs)
+	if st.LastContact > 0 {
+		fmt.Fprintln(o.w, "last contact "+time.Unix(st.LastContact, 0).Format("2006-01-02 15:04:05"))
+	}
+	if st.LastError != "" {
+		fmt.Fprintln(o.w, "last error "+st.LastError)
+	}
+}
+
+// 扫描状态
+func (o *output) scan(st *server.ScanStatus) {
+	if o.json {
+		b, _ := json.Marshal(st)
+		fmt.Fprintln(o.w, string(b))
+		return
+	}
+	if st.Dir == "" {
+		fmt.Fprintln(o.w, "no scan")
+		return
+	}
+	state := "finished"
+	if st.Running {
+		state = "running"
+	}
+	fmt.Fprintf(o.w, "scan of %s %s, files %d, hits %d, quarantined %d, skipped %d, errors %d\n",
+		st.Dir, state, st.Files, st.Hits, st.Quarantined, st.Skipped, st.Errors)
+	fmt.Fprintln(o.w, "report "+st.Report)
+	if st.Error != "" {
+		fmt.Fprintln(o.w, "error "+st.Error)
+	}
+}
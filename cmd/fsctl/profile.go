@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cmstop-fserver/client"
+	"cmstop-fserver/server"
+	"errors"
+	"github.com/9466/goconfig"
+	"os"
+)
+
+const (
+	DEF_CONF_FILE = ".fsctl.conf" // 默认配置文件，位于用户主目录
+	DEF_PROFILE   = "default"     // 默认使用的配置段
+	DEF_HOST      = "127.0.0.1"   // 默认服务器地址
+	DEF_PORT      = "9468"        // 默认服务器端口
+)
+
+// 服务器配置，对应配置文件中的一个段
+// hmac为true时以密钥签名请求，不发送密钥，tls为true时以TLS连接，
+// tlsCA为校验服务端证书的CA文件，为空时使用系统的根证书
+//
+// [default]
+// host = 127.0.0.1
+// port = 9468
+// password = "1234567890"
+// hmac = true
+// tls = true
+// tlsCA = /etc/fserver/ca.pem
+// tlsServerName = files.example.com
+type serverProfile struct {
+	Host          string
+	Port          string
+	Password      string
+	HMAC          bool
+	TLS           bool
+	TLSCA         string
+	TLSServerName string
+}
+
+// 按配置生成客户端选项
+func (p *serverProfile) options() (client.Options, error) {
+	opts := client.DefaultOptions
+	opts.Sign = p.HMAC
+	if p.TLS {
+		c, err := server.ClientTLSConfig(p.TLSCA, p.TLSServerName)
+		if err != nil {
+			return opts, err
+		}
+		opts.TLS = c
+	}
+	return opts, nil
+}
+
+// 读取指定的服务器配置，未指定配置文件且默认文件不存在时使用默认值
+func loadProfile(file, name string) (*serverProfile, error) {
+	p := &serverProfile{Host: DEF_HOST, Port: DEF_PORT}
+	if file == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return p, nil
+		}
+		file = home + "/" + DEF_CONF_FILE
+		if _, err := os.Stat(file); err != nil {
+			return p, nil
+		}
+	}
+	conf, err := goconfig.ReadConfigFile(file)
+	if err != nil {
+		return nil, errors.New("read profile config " + file + ": " + err.Error())
+	}
+	if !conf.HasSection(name) {
+		return nil, errors.New("profile not found: " + name)
+	}
+	if v, _ := conf.GetString(name, "host"); v != "" {
+		p.Host = v
+	}
+	if v, _ := conf.GetString(name, "port"); v != "" {
+		p.Port = v
+	}
+	p.Password, _ = conf.GetString(name, "password")
+	p.HMAC, _ = conf.GetBool(name, "hmac")
+	p.TLS, _ = conf.GetBool(name, "tls")
+	p.TLSCA, _ = conf.GetString(name, "tlsCA")
+	p.TLSServerName, _ = conf.GetString(name, "tlsServerName")
+	return p, nil
+}
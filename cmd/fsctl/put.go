@@ -0,0 +1,63 @@
+package main
+
+import (
+	"cmstop-fserver/client"
+	"cmstop-fserver/server"
+	"cmstop-fserver/util"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const PUT_BATCH = 64 // 递归上传时每批流水线发送的文件数
+
+// 读取本地文件，- 表示标准输入
+func readLocal(file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// 上传单个文件
+func putFile(c *client.FSClient, out *output, local, remote string) {
+	body, err := readLocal(local)
+	if err == nil {
+		err = c.WriteFile(remote, body)
+	}
+	out.result("put", remote, "", err)
+}
+
+// 递归上传本地目录，remote为对应的远程目录
+// 文件按批次流水线发送，减少等待响应的时间
+func putDir(c *client.FSClient, out *output, local, remote string) {
+	local = strings.TrimRight(local, "/")
+	remote = strings.TrimRight(remote, "/")
+	var list []string
+	err := util.ReadDirRecursiveFiles(local, &list)
+	if err != nil {
+		out.result("put", remote, "", err)
+		return
+	}
+	for len(list) > 0 {
+		n := len(list)
+		if n > PUT_BATCH {
+			n = PUT_BATCH
+		}
+		reqs := make([]*client.Request, 0, n)
+		paths := make([]string, 0, n)
+		for _, f := range list[:n] {
+			body, err := readLocal(f)
+			if err != nil {
+				out.result("put", remote+f[len(local):], "", err)
+				continue
+			}
+			reqs = append(reqs, &client.Request{Method: server.METHOD_CREATE_FILE, Path: remote + f[len(local):], Body: body})
+			paths = append(paths, remote+f[len(local):])
+		}
+		for i, r := range c.Pipeline(reqs) {
+			out.result("put", paths[i], "", r.Err)
+		}
+		list = list[n:]
+	}
+}
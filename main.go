@@ -32,14 +32,14 @@ const (
 	CONFIG_DIR     = "conf/"          // 配置文件目录，因为有多个配置文件，所以指定目录，不指定文件
 	CONFIG_FILE    = "cmstop.conf"    // 主配置文件
 	INJECTION_FILE = "injection.conf" // 木马检测配置文件
-	PROCESS_NUM    = 3                // 进程数量，1 文件写入，2 文件读取， 3，文件监测
 )
 
 func main() {
 	// parse args
 
 	var err error
-	var confdir, pidfile string
+	var confdir, pidfile, replay, scan, report string
+	var quarantine bool
 	argc := len(os.Args)
 	for key, val := range os.Args {
 		switch val {
@@ -59,6 +59,20 @@ func main() {
 			if argc > key+1 {
 				pidfile = os.Args[key+1]
 			}
+		case "--replay":
+			if argc > key+1 {
+				replay = os.Args[key+1]
+			}
+		case "--scan":
+			if argc > key+1 {
+				scan = os.Args[key+1]
+			}
+		case "--report":
+			if argc > key+1 {
+				report = os.Args[key+1]
+			}
+		case "--quarantine":
+			quarantine = true
 		case "-V":
 			version()
 			os.Exit(0)
@@ -90,7 +104,33 @@ func main() {
 		log.Fatalln("ReadConfigFile Err: ", err.Error(), "\nConfigFile:", configFile)
 	}
 
+	// 重放操作日志到空目录后退出
+	if replay != "" {
+		journalDir, _ := config.GetString("journal", "journalDir")
+		if journalDir == "" {
+			log.Fatalln("replay error: journalDir not configured")
+		}
+		res, err := server.Replay(journalDir, fixPath(replay), func(msg string) { log.Println(msg) })
+		if res != nil {
+			fmt.Printf("replay applied %d records, skipped %d, last seq %d\n", res.Applied, res.Skipped, res.Last)
+		}
+		if err != nil {
+			log.Fatalln("replay error: " + err.Error())
+		}
+		os.Exit(0)
+	}
+
+	// 升级启动时继承原进程的监听
+	listener, oldPid, err := server.InheritedListener()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
 	isDaemon, err := config.GetBool("log", "daemon")
+	// 扫描在前台执行
+	if scan != "" {
+		isDaemon = false
+	}
 	logfile, err := config.GetString("log", "logFile")
 
 	// pidfile
@@ -109,8 +149,8 @@ func main() {
 		}
 	}
 
-	// Daemon
-	if isDaemon {
+	// Daemon，升级启动的进程已经在后台，仍然写入日志文件
+	if isDaemon && listener == nil {
 		_, err := daemon.Daemon(1, 0)
 		if err != nil {
 			fmt.Println(err)
@@ -146,52 +186,165 @@ func main() {
 	s := server.NewServer()
 	s.Logger = log.New(logFileHandle, "", log.Ldate|log.Ltime)
 	// init之前必须先设置logger
-	err = s.Init(config)
+	// 扫描和运行中的服务同时执行，不能打开服务的操作日志
+	// 升级启动时原进程还在服务，检查配置失败时原进程继续服务
+	if scan != "" {
+		if journalDir, _ := config.GetString("journal", "journalDir"); quarantine && journalDir != "" {
+			fmt.Println("scan error: --quarantine cannot be used with journalDir, the removals must be journaled by the running server, use fsctl scan start -quarantine instead")
+			os.Exit(2)
+		}
+		err = s.InitOffline(config)
+	} else if oldPid > 0 {
+		err = s.InitUpgrade(config)
+	} else {
+		err = s.Init(config)
+	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	err = s.LoadInjection(confdir + INJECTION_FILE)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// 扫描目录中已有的文件后退出
+	if scan != "" {
+		os.Exit(scanFiles(s, scan, report, quarantine))
+	}
 
 	// 开始服务
 	s.Logger.Println("CmsTop File Server starting...")
-	go s.Start()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Start(listener)
+	}()
+	if oldPid > 0 {
+		// 有操作日志时等待原进程关闭后打开，打开失败时停止
+		s.Logger.Println("CmsTop File Server upgrade, stopping the old process " + strconv.Itoa(oldPid))
+		err = s.Takeover(oldPid)
+		if err != nil {
+			s.Logger.Println("CmsTop File Server upgrade failed: " + err.Error())
+			if err := s.Stop(); err != nil {
+				s.Logger.Println(err.Error())
+			}
+			os.Exit(1)
+		}
+	}
 
-	// 监听系统信号，重启或停止服务
+	// 监听系统信号，SIGHUP重新加载配置，SIGUSR2升级，其他信号停止服务
 	// trap signal
 	sch := make(chan os.Signal, 10)
 	signal.Notify(sch, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGINT,
-		syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT)
-	go func(ch <-chan os.Signal) {
-		sig := <-ch
-		s.Logger.Println("signal recieved " + sig.String() + ", at: " + time.Now().String())
-		s.Shutdown = true
-		s.Stop()
-		if sig == syscall.SIGHUP {
-			s.Logger.Println("CmsTop File Server restart now...")
-			procAttr := new(os.ProcAttr)
-			procAttr.Files = []*os.File{nil, os.Stdout, os.Stderr}
-			procAttr.Dir = os.Getenv("PWD")
-			procAttr.Env = os.Environ()
-			process, err := os.StartProcess(os.Args[0], os.Args, procAttr)
-			if err != nil {
-				s.Logger.Println("CmsTop File Server restart process failed:" + err.Error())
-				return
+		syscall.SIGHUP, syscall.SIGSTOP, syscall.SIGQUIT, syscall.SIGUSR2)
+	for {
+		select {
+		case err = <-serveErr:
+			// 监听出错，停止服务后退出
+			s.Logger.Println("CmsTop File Server serve error: " + err.Error())
+			if err := s.Stop(); err != nil {
+				s.Logger.Println(err.Error())
 			}
-			waitMsg, err := process.Wait()
-			if err != nil {
-				s.Logger.Println("CmsTop File Server restart wait error:" + err.Error())
+			os.Exit(1)
+		case sig := <-sch:
+			s.Logger.Println("signal recieved " + sig.String() + ", at: " + time.Now().String())
+			if sig == syscall.SIGHUP {
+				reload(s, configFile, confdir+INJECTION_FILE)
+				continue
 			}
-			s.Logger.Println(waitMsg)
-		} else {
+			if sig == syscall.SIGUSR2 {
+				// 新进程开始服务后发送SIGTERM，本进程再停止
+				p, err := s.Upgrade()
+				if err != nil {
+					s.Logger.Println("CmsTop File Server upgrade failed: " + err.Error())
+				} else {
+					s.Logger.Println("CmsTop File Server upgrade, new process " + strconv.Itoa(p.Pid))
+				}
+				continue
+			}
+			// 停止接受连接，等待处理中的请求完成，超时后强制关闭
 			s.Logger.Println("CmsTop File Server shutdown now...")
+			err = s.Stop()
+			if e := <-serveErr; e != nil && err == nil {
+				err = e
+			}
+			if err != nil {
+				s.Logger.Println("CmsTop File Server stopped with error: " + err.Error())
+				os.Exit(1)
+			}
+			s.Logger.Println("CmsTop File Server stopped.")
+			return
 		}
-	}(sch)
+	}
+}
 
-	// 启动chs监听，等待所有Process都运行结束
-	for i := 0; i < PROCESS_NUM; i++ {
-		<-s.Chs
+// 扫描目录，报告的扩展名为.csv时使用csv格式，报告的检查点存在时继续上次的扫描
+// 返回退出码，发现问题时为1，扫描失败时为2
+func scanFiles(s *server.Server, dir, report string, quarantine bool) int {
+	if report == "" {
+		fmt.Println("scan error: --report not specified")
+		return 2
+	}
+	report = fixPath(report)
+	format := server.SCAN_JSON
+	if strings.HasSuffix(strings.ToLower(report), ".csv") {
+		format = server.SCAN_CSV
+	}
+	job, err := s.NewScanJob(dir, server.ScanOptions{Report: report, Format: format, Checkpoint: report + ".checkpoint",
+		Resume: true, Quarantine: quarantine})
+	if err != nil {
+		fmt.Println("scan error: " + err.Error())
+		return 2
+	}
+
+	// 中断时停止扫描，保存检查点
+	sch := make(chan os.Signal, 1)
+	signal.Notify(sch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sch
+		job.Stop()
+	}()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				st := job.Status()
+				s.Logger.Printf("scan progress: files %d, hits %d, last %s\n", st.Files, st.Hits, st.Last)
+			}
+		}
+	}()
+	err = job.Run()
+	close(done)
+	st := job.Status()
+	fmt.Printf("scan %s: files %d, hits %d, quarantined %d, skipped %d, errors %d, report %s\n",
+		dir, st.Files, st.Hits, st.Quarantined, st.Skipped, st.Errors, st.Report)
+	if err != nil {
+		fmt.Println("scan error: " + err.Error() + ", run again to resume")
+		return 2
+	}
+	if st.Hits > 0 {
+		return 1
+	}
+	return 0
+}
+
+// 重新读取配置文件和木马检测配置，有错误时保留原配置
+func reload(s *server.Server, configFile, injectionFile string) {
+	config, err := goconfig.ReadConfigFile(configFile)
+	if err == nil {
+		err = s.Reload(config, injectionFile)
+	}
+	if err != nil {
+		s.Logger.Println("CmsTop File Server reload failed, keep the old config: " + err.Error())
+		return
 	}
-	s.Logger.Println("CmsTop File Server stopped.")
+	s.Logger.Println("CmsTop File Server config reloaded")
 }
 
 func fixPath(path string) string {
@@ -224,6 +377,10 @@ func help() {
 	fmt.Println("Usage: " + prog + " [OPTIONS]")
 	fmt.Println("  -C|--confdir <dir> \t config dir, default " + CONFIG_DIR)
 	fmt.Println("  -P|--pid <file> \t pid file, default none.")
+	fmt.Println("  --replay <dir> \t apply the journal to an empty directory and exit.")
+	fmt.Println("  --scan <dir> \t\t scan existing files with the content filter and exit.")
+	fmt.Println("  --report <file> \t scan report, .csv for csv, json lines otherwise, resumed when it's checkpoint exists.")
+	fmt.Println("  --quarantine \t\t move scanned files with findings to quarantineDir.")
 	fmt.Println("  -h|--help \t\t Output this help and exit. ")
 	fmt.Println("  -V|--version \t\t Output version and and exit. ")
 	fmt.Println("")
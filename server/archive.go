@@ -0,0 +1,252 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+archive download.
+
+METHOD_ARCHIVE streams a directory as tar or tar.gz, the archive is never
+built in memory. the response is:
+
+	response (json, data is ArchiveHeader)
+	chunk length (4 bytes) + chunk ... repeated
+	0 (4 bytes, end of stream)
+	response (json, data is ArchiveResult, or the error)
+
+when the first response is an error there is no stream.
+only regular files are archived, links are skipped, files which can not
+pass CheckPath are skipped. the directory is locked shared while
+streaming, writes to it wait while the client keeps reading. every write to
+the connection has a deadline of ARCHIVE_TIMEOUT, a client which stops
+reading is disconnected and the lock is released.
+*/
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"cmstop-fserver/util"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ARCHIVE_CHUNK   = 64 * 1024        // 流式响应每块的大小
+	ARCHIVE_TIMEOUT = 30 * time.Second // 每次写入连接的超时，超时后断开连接并释放目录锁
+)
+
+// 打包参数，在RequestMeta中发送
+type ArchiveParams struct {
+	Format  string   `json:"format,omitempty"`  // tar或tar.gz，默认tar
+	Include []string `json:"include,omitempty"` // 只打包匹配的文件，为空时全部打包
+	Exclude []string `json:"exclude,omitempty"` // 不打包匹配的文件
+	Since   int64    `json:"since,omitempty"`   // 只打包此时间(unix时间戳)及之后修改的文件
+}
+
+// 打包开始的响应数据
+type ArchiveHeader struct {
+	Format string `json:"format"` // 打包格式
+	Files  int    `json:"files"`  // 将要打包的文件数
+}
+
+// 打包完成的响应数据
+type ArchiveResult struct {
+	Files int   `json:"files"` // 文件数
+	Size  int64 `json:"size"`  // 文件总大小，不含tar头和压缩
+}
+
+// 等待写入连接的打包流，持有目录的共享锁
+type archiveStream struct {
+	dir     string
+	format  string
+	files   []string
+	unlock  func()
+	timeout time.Duration // 每次写入连接的超时
+}
+
+// 检查参数，锁定目录并列出需要打包的文件，内容在写入响应时读取
+func (t *CTFile) Archive(rec *FileData) (*archiveStream, error) {
+	token := ""
+	params := new(ArchiveParams)
+	if rec.Meta != nil {
+		token = rec.Meta.LockToken
+		if rec.Meta.Archive != nil {
+			params = rec.Meta.Archive
+		}
+	}
+	if params.Format == "" {
+		params.Format = EXTRACT_TAR
+	}
+	if params.Format != EXTRACT_TAR && params.Format != EXTRACT_TGZ {
+		return nil, errors.New("archive format not supported: " + params.Format)
+	}
+	for _, p := range append(params.Include, params.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.New("archive pattern error: " + p)
+		}
+	}
+	dir := path.Clean(rec.Path)
+	if !isDir(dir) {
+		return nil, errors.New("path is not a directory: " + dir)
+	}
+
+	unlock, err := t.locks.Lock(token, lockPath{dir, true})
+	if err != nil {
+		return nil, err
+	}
+	all := make([]string, 0)
+	err = util.ReadDirRecursiveFiles(dir, &all)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	st := &archiveStream{dir: dir, format: params.Format, files: make([]string, 0, len(all)), unlock: unlock, timeout: t.archiveTimeout}
+	for _, p := range all {
+		if t.Server.CheckPath(p) != nil {
+			continue
+		}
+		f, err := os.Lstat(p)
+		if err != nil || !f.Mode().IsRegular() {
+			continue
+		}
+		if params.Since > 0 && f.ModTime().Unix() < params.Since {
+			continue
+		}
+		rel := strings.TrimPrefix(p, dir+"/")
+		if len(params.Include) > 0 && !matchAny(params.Include, rel) {
+			continue
+		}
+		if matchAny(params.Exclude, rel) {
+			continue
+		}
+		st.files = append(st.files, p)
+	}
+	return st, nil
+}
+
+// 匹配相对路径，不含/的模式同时匹配文件名
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if !strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, path.Base(rel)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 写入响应和打包流，完成后释放目录锁
+// 返回打包中的错误，写入连接失败或超时时返回写入错误，连接不能继续使用
+func (st *archiveStream) stream(conn net.Conn, id uint32) error {
+	defer st.unlock()
+	defer conn.SetWriteDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Now().Add(st.timeout))
+	writeResponse(conn, newResponse(id, &ArchiveHeader{Format: st.format, Files: len(st.files)}, nil))
+	cw := &chunkWriter{w: conn, conn: conn, timeout: st.timeout}
+	bw := bufio.NewWriterSize(cw, ARCHIVE_CHUNK)
+	res, err := st.write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	// 打包出错时也结束流，在最后的响应中返回错误
+	conn.SetWriteDeadline(time.Now().Add(st.timeout))
+	err2 := binary.Write(conn, binary.LittleEndian, uint32(0))
+	if err2 != nil {
+		return err2
+	}
+	if err != nil {
+		res = nil
+	}
+	writeResponse(conn, newResponse(id, res, err))
+	return err
+}
+
+// 将文件依次写入tar
+func (st *archiveStream) write(w io.Writer) (*ArchiveResult, error) {
+	var gw *gzip.Writer
+	if st.format == EXTRACT_TGZ {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	res := new(ArchiveResult)
+	for _, p := range st.files {
+		n, err := archiveFile(tw, p, strings.TrimPrefix(p, st.dir+"/"))
+		if err != nil {
+			return nil, errors.New("archive " + p + " error: " + err.Error())
+		}
+		res.Files++
+		res.Size += n
+	}
+	err := tw.Close()
+	if err == nil && gw != nil {
+		err = gw.Close()
+	}
+	return res, err
+}
+
+func archiveFile(tw *tar.Writer, p, name string) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	h := &tar.Header{
+		Name:     name,
+		Mode:     int64(fi.Mode().Perm()),
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime().Truncate(time.Second),
+		Typeflag: tar.TypeReg,
+	}
+	err = tw.WriteHeader(h)
+	if err != nil {
+		return 0, err
+	}
+	return io.CopyN(tw, f, h.Size)
+}
+
+// 每次写入作为一块，前面加4字节长度
+// 记录写入连接的错误，和打包中的错误区分
+// conn不为nil时每块写入前设置写超时
+type chunkWriter struct {
+	w       io.Writer
+	conn    net.Conn
+	timeout time.Duration
+	err     error
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.conn != nil {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	c.err = binary.Write(c.w, binary.LittleEndian, uint32(len(p)))
+	if c.err == nil {
+		_, c.err = c.w.Write(p)
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(p), nil
+}
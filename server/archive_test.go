@@ -0,0 +1,184 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 通过连接发送打包请求，读取响应和打包流
+func archiveTestRequest(t *testing.T, conn net.Conn, id uint32, dir string, params *ArchiveParams) (*ResponseData, []byte, *ResponseData) {
+	err := sendTestRequest(conn, &FileData{Method: METHOD_ARCHIVE, Flags: FLAG_REQUEST_ID, RequestId: id,
+		Password: "pw", Path: dir, Meta: &RequestMeta{Archive: params}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := readTestResponse(t, conn)
+	if head.Code != CODE_SUCCESS {
+		return head, nil, nil
+	}
+	var buf bytes.Buffer
+	for {
+		var length uint32
+		if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+		if length == 0 {
+			break
+		}
+		if length > ARCHIVE_CHUNK {
+			t.Fatalf("chunk size %d", length)
+		}
+		if _, err := io.CopyN(&buf, conn, int64(length)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return head, buf.Bytes(), readTestResponse(t, conn)
+}
+
+func tarTestNames(t *testing.T, body []byte, gz bool) map[string]string {
+	var r io.Reader = bytes.NewReader(body)
+	if gz {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	files := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[h.Name] = string(b)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	dir := root + "/www"
+	os.MkdirAll(dir+"/css", 0755)
+	os.MkdirAll(dir+"/img", 0755)
+	ioutil.WriteFile(dir+"/index.html", []byte("index"), 0644)
+	ioutil.WriteFile(dir+"/css/a.css", []byte("a{}"), 0644)
+	ioutil.WriteFile(dir+"/img/logo.png", bytes.Repeat([]byte{1}, 3*ARCHIVE_CHUNK), 0644)
+	ioutil.WriteFile(dir+"/shell.php", []byte("x"), 0644)
+	os.Symlink("/etc/passwd", dir+"/passwd.html")
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(dir+"/css/a.css", old, old)
+
+	conn := dialTestServer(t, addr)
+
+	head, body, res := archiveTestRequest(t, conn, 1, dir, nil)
+	var h ArchiveHeader
+	json.Unmarshal(head.Data, &h)
+	if h.Format != EXTRACT_TAR || h.Files != 3 {
+		t.Errorf("header %+v", h)
+	}
+	if res.Code != CODE_SUCCESS || res.Id != 1 {
+		t.Fatalf("result %+v", res)
+	}
+	files := tarTestNames(t, body, false)
+	names := make([]string, 0)
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "css/a.css,img/logo.png,index.html" {
+		t.Errorf("archived %v", names)
+	}
+	if files["index.html"] != "index" || len(files["img/logo.png"]) != 3*ARCHIVE_CHUNK {
+		t.Errorf("archived content error")
+	}
+
+	cases := []struct {
+		params *ArchiveParams
+		want   string
+	}{
+		{&ArchiveParams{Format: EXTRACT_TGZ, Include: []string{"*.html", "css/*"}}, "css/a.css,index.html"},
+		{&ArchiveParams{Exclude: []string{"img"}}, "css/a.css,img/logo.png,index.html"},
+		{&ArchiveParams{Exclude: []string{"*.png"}}, "css/a.css,index.html"},
+		{&ArchiveParams{Since: time.Now().Add(-time.Hour).Unix()}, "img/logo.png,index.html"},
+	}
+	for i, c := range cases {
+		_, body, res = archiveTestRequest(t, conn, uint32(i+2), dir, c.params)
+		if res.Code != CODE_SUCCESS {
+			t.Fatalf("%d: %s", i, res.Message)
+		}
+		names = names[:0]
+		for n := range tarTestNames(t, body, c.params.Format == EXTRACT_TGZ) {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != c.want {
+			t.Errorf("%d: archived %s, want %s", i, got, c.want)
+		}
+	}
+
+	// 参数错误时没有打包流
+	for i, p := range []*ArchiveParams{{Format: EXTRACT_ZIP}, {Include: []string{"["}}} {
+		head, _, _ = archiveTestRequest(t, conn, 10, dir, p)
+		if head.Code == CODE_SUCCESS {
+			t.Errorf("%d: invalid params accepted", i)
+		}
+	}
+	head, _, _ = archiveTestRequest(t, conn, 11, dir+"/index.html", nil)
+	if head.Code == CODE_SUCCESS {
+		t.Errorf("archived a file")
+	}
+
+	// 打包完成后释放目录锁
+	_, err := s.ctFile.Handle(&FileData{Method: METHOD_CREATE_FILE, Path: dir + "/new.html", Body: []byte("new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveStalledClient(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	s.ctFile.archiveTimeout = 200 * time.Millisecond
+	dir := root + "/www"
+	os.MkdirAll(dir, 0755)
+	// 大于连接的发送和接收缓冲，客户端不读取时写入会阻塞
+	ioutil.WriteFile(dir+"/big.png", bytes.Repeat([]byte{1}, 64<<20), 0644)
+
+	conn := dialTestServer(t, addr)
+	err := sendTestRequest(conn, &FileData{Method: METHOD_ARCHIVE, Password: "pw", Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head := readTestResponse(t, conn); head.Code != CODE_SUCCESS {
+		t.Fatal(head.Message)
+	}
+
+	// 客户端不再读取，写入超时后释放目录锁
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ctFile.Handle(&FileData{Method: METHOD_CREATE_FILE, Path: dir + "/new.html", Body: []byte("new")})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by a stalled archive download")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+transport security.
+
+with certFile and keyFile in the [tls] section every connection is TLS,
+clients verify the server certificate against their caFile (or the system
+roots). the TLS settings need a restart.
+
+a request may be signed instead of carrying the password: RequestMeta has
+the unix time and Signature, the hex HMAC-SHA256 keyed with the password of
+
+	<method code>\n<path>\n<json of RequestMeta without Signature>
+
+a body must come with it's sha256 in RequestMeta, so the signature covers
+it. requests more than SIGN_WINDOW away from the server's clock are
+rejected, a captured request can be replayed within the window, use TLS
+against that. with hmac = true in [common] unsigned requests are rejected,
+otherwise the plain password is accepted too.
+*/
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+const SIGN_WINDOW = 5 * time.Minute // 签名请求的时间和服务端时间的最大差距
+
+// 请求签名，以密钥计算操作代码、路径和附加信息的HMAC-SHA256
+// meta中的Signature不参与计算
+func Sign(password string, method uint32, path string, meta *RequestMeta) string {
+	m := RequestMeta{}
+	if meta != nil {
+		m = *meta
+	}
+	m.Signature = ""
+	data, _ := json.Marshal(&m)
+	h := hmac.New(sha256.New, []byte(password))
+	h.Write([]byte(strconv.FormatUint(uint64(method&METHOD_MASK), 10) + "\n" + path + "\n"))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 为请求签名，不再发送密钥
+func SignRequest(password string, rec *FileData) {
+	m := new(RequestMeta)
+	if rec.Meta != nil {
+		*m = *rec.Meta
+	}
+	m.Time = time.Now().Unix()
+	m.Signature = Sign(password, rec.Method, rec.Path, m)
+	rec.Meta = m
+	rec.Password = ""
+	rec.PassLength = 0
+}
+
+// 检查请求的密钥或签名，签名通过后按密钥记录请求凭证
+func (c *settings) checkAuth(rec *FileData) error {
+	if len(c.password) == 0 {
+		return nil
+	}
+	if rec.Meta == nil || rec.Meta.Signature == "" {
+		if c.hmac {
+			return errors.New("Signature required")
+		}
+		if c.password != rec.Password {
+			return errors.New("Password check failed")
+		}
+		return nil
+	}
+	d := time.Since(time.Unix(rec.Meta.Time, 0))
+	if d > SIGN_WINDOW || d < -SIGN_WINDOW {
+		return errors.New("Signature expired, check the clock")
+	}
+	if rec.BodySize > 0 && rec.Meta.Sha256 == "" {
+		return errors.New("Signature check failed: body sha256 required")
+	}
+	sign := Sign(c.password, rec.Method, rec.Path, rec.Meta)
+	if !hmac.Equal([]byte(sign), []byte(rec.Meta.Signature)) {
+		return errors.New("Signature check failed")
+	}
+	rec.Password = c.password
+	return nil
+}
+
+// 按[tls]配置服务端的TLS，没有配置证书时返回nil
+func loadServerTLS(conf *goconfig.ConfigFile) (*tls.Config, error) {
+	certFile, _ := conf.GetString("tls", "certFile")
+	keyFile, _ := conf.GetString("tls", "keyFile")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("tls certificate error: " + err.Error())
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// 客户端的TLS配置，caFile为空时使用系统的根证书，serverName为空时使用连接的主机名
+func ClientTLSConfig(caFile, serverName string) (*tls.Config, error) {
+	c := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return c, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.New("tls ca error: " + err.Error())
+	}
+	c.RootCAs = x509.NewCertPool()
+	if !c.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("tls ca error: no certificate in " + caFile)
+	}
+	return c, nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"cmstop-fserver/util"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSignedRequest(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	write := func(rec *FileData) *ResponseData {
+		conn := dialTestServer(t, addr)
+		if err := sendTestRequest(conn, rec); err != nil {
+			t.Fatal(err)
+		}
+		return readTestResponse(t, conn)
+	}
+	body := []byte("signed")
+	signed := func(password string) *FileData {
+		rec := &FileData{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: body, Meta: &RequestMeta{Sha256: util.Hash(body)}}
+		SignRequest(password, rec)
+		return rec
+	}
+
+	if resp := write(signed("pw")); resp.Code != CODE_SUCCESS {
+		t.Fatalf("signed request: %d %s", resp.Code, resp.Message)
+	}
+	if resp := write(signed("other")); resp.Code == CODE_SUCCESS {
+		t.Error("wrong key accepted")
+	}
+	// 签名覆盖路径和附加信息
+	rec := signed("pw")
+	rec.Path = root + "/b.html"
+	if resp := write(rec); resp.Code == CODE_SUCCESS {
+		t.Error("changed path accepted")
+	}
+	rec = signed("pw")
+	rec.Meta.Precondition = &Precondition{IfExist: true}
+	if resp := write(rec); resp.Code == CODE_SUCCESS {
+		t.Error("changed meta accepted")
+	}
+	// 过期的签名
+	rec = &FileData{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: body, Meta: &RequestMeta{Sha256: util.Hash(body)}}
+	rec.Meta.Time = time.Now().Add(-2 * SIGN_WINDOW).Unix()
+	rec.Meta.Signature = Sign("pw", rec.Method, rec.Path, rec.Meta)
+	if resp := write(rec); resp.Code == CODE_SUCCESS {
+		t.Error("expired signature accepted")
+	}
+	// 有内容时必须有sha256
+	rec = &FileData{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: body}
+	SignRequest("pw", rec)
+	if resp := write(rec); resp.Code == CODE_SUCCESS {
+		t.Error("body without sha256 accepted")
+	}
+
+	// hmac开启后不接受密钥，重新加载替换整个配置
+	c := *s.settings()
+	c.hmac = true
+	s.conf.Store(&c)
+	plain := &FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/a.html", Body: body}
+	if resp := write(plain); resp.Code == CODE_SUCCESS {
+		t.Error("password accepted with hmac")
+	}
+	if resp := write(signed("pw")); resp.Code != CODE_SUCCESS {
+		t.Fatalf("signed request with hmac: %d %s", resp.Code, resp.Message)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir)
+	f := dir + "/tls.conf"
+	ioutil.WriteFile(f, []byte("[tls]\ncertFile="+dir+"/cert.pem\nkeyFile="+dir+"/key.pem\n"), 0600)
+	conf, err := goconfig.ReadConfigFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	s := NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	c := s.settings()
+	c.rootDir = []string{root}
+	c.maxSize = MAX_BODY_SIZE
+	s.pipeline = 4
+	c.password = "pw"
+	s.ctFile = NewCtFile(s)
+	if s.tls, err = loadServerTLS(conf); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.Serve(l.(*net.TCPListener))
+
+	// 不信任的证书
+	if conn, err := tls.Dial("tcp4", l.Addr().String(), &tls.Config{}); err == nil {
+		conn.Close()
+		t.Error("untrusted certificate accepted")
+	}
+	cc, err := ClientTLSConfig(dir+"/cert.pem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp4", l.Addr().String(), cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	body := []byte("tls")
+	rec := &FileData{Method: METHOD_CREATE_FILE, Flags: FLAG_REQUEST_ID, RequestId: 1, Password: "pw", Path: root + "/a.html", Body: body}
+	if err = sendTestRequest(conn, rec); err != nil {
+		t.Fatal(err)
+	}
+	if resp := readTestResponse(t, conn); resp.Code != CODE_SUCCESS {
+		t.Fatalf("tls write: %d %s", resp.Code, resp.Message)
+	}
+	if b, _ := ioutil.ReadFile(root + "/a.html"); string(b) != "tls" {
+		t.Errorf("written %q", b)
+	}
+
+	if _, err = ClientTLSConfig(dir+"/tls.conf", ""); err == nil {
+		t.Error("ca file without certificate accepted")
+	}
+	os.Remove(dir + "/key.pem")
+	if _, err = loadServerTLS(conf); err == nil {
+		t.Error("missing key accepted")
+	}
+}
+
+// 生成127.0.0.1的自签名证书
+func writeTestCert(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fserver test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(dir+"/cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(dir+"/key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+}
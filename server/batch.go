@@ -0,0 +1,597 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+batch operation, apply many operations all-or-nothing.
+*/
+package server
+
+import (
+	"bytes"
+	"cmstop-fserver/util"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 批量操作结果的状态
+const (
+	BATCH_SUCCESS    = "success"      // 执行成功
+	BATCH_ROLLBACK   = "rolled back"  // 执行成功，因其他操作失败已回滚
+	BATCH_NOT_RUN    = "not executed" // 因其他操作失败未执行
+	BATCH_MAX_OPS    = 1000           // 单次批量操作的最大数量
+	BATCH_MAX_SIZE   = 64 << 20       // 批量操作的参数解压后的最大大小
+	BATCH_TMP_PREFIX = ".fsbatch-"    // 暂存文件和备份文件的前缀
+)
+
+// 批量操作中的一个子操作
+type BatchOp struct {
+	Method  uint32 `json:"method"`            // 操作类型，支持文件写入、删除文件、创建目录、复制、重命名
+	Path    string `json:"path"`              // 操作路径
+	NewPath string `json:"newpath,omitempty"` // 复制和重命名的目标路径
+	Body    []byte `json:"body,omitempty"`    // 文件内容
+
+	rewritten bool   // 内容被内容检查改写
+	checked   bool   // 内容在加入批量操作前已经检查(解压)，锁定后只检查路径
+	file      string // 内容暂存的文件，不为空时没有Body，暂存时移动到目标目录
+}
+
+// 批量操作的参数，METHOD_BATCH的body是它的json编码
+type BatchParams struct {
+	Ops []*BatchOp `json:"ops"`
+}
+
+// 子操作的执行结果
+type BatchResult struct {
+	Method  uint32 `json:"method"`
+	Path    string `json:"path"`
+	Code    int    `json:"code"`           // 0 表示成功，非0表示失败
+	Message string `json:"message"`        // 状态说明
+	Hash    string `json:"hash,omitempty"` // 写入操作成功后文件内容的sha256
+	// 内容被服务端改写，如图片重新编码
+	Rewritten bool `json:"rewritten,omitempty"`
+}
+
+// 回滚动作，按执行的逆序调用
+type undoFunc func() error
+
+// 被覆盖或删除内容的备份，提交后保存到历史版本或回收站
+type batchBackup struct {
+	tmp     string // 备份文件
+	path    string // 原路径
+	deleted bool   // 是否是删除操作
+}
+
+// 一次批量操作的执行状态
+type batch struct {
+	file    *CTFile
+	ops     []*BatchOp
+	results []*BatchResult
+	staged  []string   // 每个写入操作暂存内容的临时文件
+	undo    []undoFunc // 已执行操作的回滚动作
+	backups []string   // 提交成功后需要删除的备份和暂存文件
+	kept    []*batchBackup
+}
+
+// 批量执行多个操作，要么全部成功，要么全部回滚
+// rec.Body是BatchParams的json编码后的数据，成功后每个子操作分别记录操作日志
+// 返回每个子操作的执行结果
+func (t *CTFile) Batch(rec *FileData) ([]*BatchResult, error) {
+	token := ""
+	if rec.Meta != nil {
+		token = rec.Meta.LockToken
+	}
+	params, err := decodeBatch(rec, t.Server.settings().maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Ops) == 0 {
+		return nil, errors.New("batch is empty")
+	}
+	// 清理并锁定全部操作涉及的路径
+	paths := make([]lockPath, 0, len(params.Ops))
+	for _, op := range params.Ops {
+		op.Path = cleanPath(op.Path)
+		op.NewPath = cleanPath(op.NewPath)
+		paths = append(paths, lockPath{op.Path, int(op.Method) == METHOD_COPY})
+		if op.NewPath != "" {
+			paths = append(paths, lockPath{op.NewPath, false})
+		}
+	}
+	return t.runBatch(rec, token, paths, params.Ops)
+}
+
+// 解码批量操作的参数，压缩的内容边解压边解码，内容超过BATCH_MAX_SIZE时返回错误
+// 每个子操作解码后检查内容大小，超过maxSize或操作数超过BATCH_MAX_OPS时不再读取
+func decodeBatch(rec *FileData, maxSize uint32) (*BatchParams, error) {
+	if rec.BodySize > BATCH_MAX_SIZE {
+		return nil, errors.New("batch too large! body should less than " + strconv.Itoa(BATCH_MAX_SIZE))
+	}
+	r, err := decompressReader(rec.Flags, rec.Body, BATCH_MAX_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var sum *checksumReader
+	if rec.Flags&FLAG_COMPRESS != 0 {
+		sum = newChecksumReader(r, rec.Meta)
+	}
+	dec := json.NewDecoder(r)
+	if sum != nil {
+		dec = json.NewDecoder(sum)
+	}
+	fail := func(err error) (*BatchParams, error) {
+		return nil, errors.New("batch params decode error: " + err.Error())
+	}
+	params := new(BatchParams)
+	// {"ops":[{...},...]}，其他字段忽略
+	if err = expectDelim(dec, '{'); err != nil {
+		return fail(err)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fail(err)
+		}
+		if key, _ := tok.(string); !strings.EqualFold(key, "ops") {
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		if err = expectDelim(dec, '['); err != nil {
+			return fail(err)
+		}
+		for dec.More() {
+			if len(params.Ops) >= BATCH_MAX_OPS {
+				return nil, errors.New("batch too large! operations should less than " + strconv.Itoa(BATCH_MAX_OPS))
+			}
+			op := new(BatchOp)
+			if err = dec.Decode(op); err != nil {
+				return fail(err)
+			}
+			if uint32(len(op.Body)) > maxSize {
+				return nil, errors.New("batch operation " + strconv.Itoa(len(params.Ops)) +
+					": body too large! body should less than " + strconv.FormatInt(int64(maxSize), 10))
+			}
+			params.Ops = append(params.Ops, op)
+		}
+		if err = expectDelim(dec, ']'); err != nil {
+			return fail(err)
+		}
+	}
+	if err = expectDelim(dec, '}'); err != nil {
+		return fail(err)
+	}
+	if sum != nil {
+		if err = sum.check(); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// 读取一个json分隔符，不是d时返回错误
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return errors.New("expected " + d.String())
+	}
+	return nil
+}
+
+// 锁定paths后执行一组操作，rec是原始请求，用于记录操作日志
+func (t *CTFile) runBatch(rec *FileData, token string, paths []lockPath, ops []*BatchOp) ([]*BatchResult, error) {
+	var err error
+	b := &batch{file: t, ops: ops}
+	b.results = make([]*BatchResult, len(b.ops))
+	b.staged = make([]string, len(b.ops))
+	for i, op := range b.ops {
+		b.results[i] = &BatchResult{Method: op.Method, Path: op.Path, Message: BATCH_NOT_RUN}
+	}
+
+	unlock, err := t.locks.Lock(token, paths...)
+	if err != nil {
+		return b.results, err
+	}
+	defer unlock()
+	// 锁定后检查全部操作，任何一个不合法都不执行
+	if err = b.validate(); err != nil {
+		return b.results, err
+	}
+
+	// 暂存写入内容，磁盘错误在修改任何文件之前发现
+	// 先删除暂存文件，回滚时新建的目录为空才能删除
+	if err = b.stage(); err != nil {
+		b.cleanup(b.staged)
+		b.rollback(0)
+		return b.results, err
+	}
+	for i, op := range b.ops {
+		err = b.apply(i, op)
+		if err != nil {
+			b.results[i].Code = 1
+			b.results[i].Message = err.Error()
+			b.cleanup(b.staged)
+			b.rollback(i)
+			return b.results, errors.New("batch operation " + strconv.Itoa(i) + " failed, rolled back: " + err.Error())
+		}
+		b.results[i].Message = BATCH_SUCCESS
+		b.results[i].Rewritten = op.rewritten
+		switch int(op.Method) {
+		case METHOD_CREATE_FILE, METHOD_MODIFY_FILE:
+			if op.file != "" {
+				b.results[i].Hash, _ = util.FileHash(op.Path)
+			} else {
+				b.results[i].Hash = util.Hash(op.Body)
+			}
+		case METHOD_APPEND_FILE:
+			b.results[i].Hash, _ = util.FileHash(op.Path)
+		}
+	}
+	b.cleanup(b.backups)
+	b.keep()
+	for _, op := range b.ops {
+		sub := &FileData{Method: op.Method, Path: op.Path, Body: op.Body, Password: rec.Password, Client: rec.Client}
+		if op.NewPath != "" {
+			sub.Body, _ = json.Marshal(&renameParams{op.NewPath})
+		}
+		if op.file != "" {
+			sub.BodyFile = op.Path
+		}
+		if err = t.journalOp(sub); err != nil {
+			return b.results, err
+		}
+	}
+	return b.results, nil
+}
+
+func (b *batch) validate() error {
+	var failed error
+	// 批量操作中写入的文件内容和创建的目录，之后的复制和重命名按它们检查
+	written := make(map[string][]byte)
+	dirs := make(map[string]bool)
+	for i, op := range b.ops {
+		err := b.check(op, written, dirs)
+		if err != nil {
+			b.results[i].Code = 1
+			b.results[i].Message = err.Error()
+			if failed == nil {
+				failed = errors.New("batch operation " + strconv.Itoa(i) + " invalid: " + err.Error())
+			}
+		}
+	}
+	return failed
+}
+
+func (b *batch) check(op *BatchOp, written map[string][]byte, dirs map[string]bool) error {
+	c := b.file.Server.settings()
+	switch int(op.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE:
+	case METHOD_REMOVE_FILE:
+		delete(written, op.Path)
+	case METHOD_CREATE_DIR:
+		dirs[op.Path] = true
+	case METHOD_COPY, METHOD_RENAME:
+		if op.NewPath == "" {
+			return errors.New("destination path error: cannot empty")
+		}
+		err := c.checkPath(op.NewPath)
+		body, ok := written[op.Path]
+		switch {
+		case err != nil:
+		case dirs[op.Path]:
+			dirs[op.NewPath] = true
+		case ok:
+			// 源文件在批量操作中写入，按写入的内容检查
+			if fileExt(op.Path) != fileExt(op.NewPath) {
+				err = c.checkDestContent(op.NewPath, body)
+			}
+			written[op.NewPath] = body
+		default:
+			err = c.checkDest(op.Path, op.NewPath)
+		}
+		if err != nil {
+			return errors.New("destination path error: " + err.Error())
+		}
+		if int(op.Method) == METHOD_RENAME {
+			delete(written, op.Path)
+			delete(dirs, op.Path)
+		}
+	default:
+		return errors.New("method not allowed in batch")
+	}
+	switch int(op.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE:
+		if op.checked {
+			err := c.checkPath(op.Path)
+			if err == nil {
+				err = c.policy.CheckWrite(op.Path)
+			}
+			return err
+		}
+		body, err := c.checkWrite(op.Method, op.Path, op.Body)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(body, op.Body) {
+			op.Body = body
+			op.rewritten = true
+		}
+		if int(op.Method) == METHOD_APPEND_FILE {
+			// 追加后的完整内容，之后改名时按它检查
+			prev, ok := written[op.Path]
+			if !ok {
+				if f, err := os.Lstat(op.Path); err == nil && f.Size() <= int64(c.maxSize) {
+					prev, _ = ioutil.ReadFile(op.Path)
+				}
+			}
+			body = append(append([]byte{}, prev...), op.Body...)
+		}
+		written[op.Path] = body
+		return nil
+	}
+	return c.checkPath(op.Path)
+}
+
+// 将写入操作的内容写入目标目录中的临时文件，提交时重命名到目标路径
+func (b *batch) stage() error {
+	for i, op := range b.ops {
+		m := int(op.Method)
+		if m != METHOD_CREATE_FILE && m != METHOD_MODIFY_FILE {
+			continue
+		}
+		err := b.mkdirAll(path.Dir(op.Path))
+		if err != nil {
+			b.results[i].Code = 1
+			b.results[i].Message = err.Error()
+			return err
+		}
+		tmp := tmpName(op.Path)
+		if op.file != "" {
+			err = moveAll(op.file, tmp)
+		} else {
+			err = b.file.writeNew(tmp, op.Body)
+		}
+		if err != nil {
+			b.results[i].Code = 1
+			b.results[i].Message = err.Error()
+			return err
+		}
+		b.staged[i] = tmp
+	}
+	return nil
+}
+
+// 执行一个操作，执行前备份会被覆盖或删除的内容，并记录回滚动作
+func (b *batch) apply(i int, op *BatchOp) error {
+	switch int(op.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE:
+		if isDir(op.Path) {
+			return errors.New("path is a directory: " + op.Path)
+		}
+		if int(op.Method) == METHOD_MODIFY_FILE {
+			if ok, _ := util.IsExist(op.Path); !ok {
+				return errors.New("file not exists: " + op.Path)
+			}
+		}
+		err := b.backup(op.Path, true, false)
+		if err != nil {
+			return err
+		}
+		err = b.file.rename(b.staged[i], op.Path)
+		if err != nil {
+			return err
+		}
+		b.staged[i] = ""
+		return nil
+	case METHOD_APPEND_FILE:
+		err := b.mkdirAll(path.Dir(op.Path))
+		if err != nil {
+			return err
+		}
+		if ok, _ := util.IsExist(op.Path); ok {
+			// 追加写入先复制一份作为备份
+			bak := tmpName(op.Path)
+			err = util.CopyFile(op.Path, bak)
+			if err != nil {
+				return err
+			}
+			b.backups = append(b.backups, bak)
+			p := op.Path
+			b.undo = append(b.undo, func() error { return os.Rename(bak, p) })
+		} else {
+			p := op.Path
+			b.undo = append(b.undo, func() error { return os.Remove(p) })
+		}
+		return b.file.WriteFile(op.Path, op.Body, true)
+	case METHOD_REMOVE_FILE:
+		if isDir(op.Path) {
+			return errors.New("path is a directory: " + op.Path)
+		}
+		return b.backup(op.Path, false, true)
+	case METHOD_CREATE_DIR:
+		return b.mkdirAll(op.Path)
+	case METHOD_COPY:
+		err := b.mkdirAll(path.Dir(op.NewPath))
+		if err != nil {
+			return err
+		}
+		err = b.backup(op.NewPath, true, false)
+		if err != nil {
+			return err
+		}
+		f, err := os.Stat(op.Path)
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return util.CopyDir(op.Path, op.NewPath)
+		}
+		return util.CopyFile(op.Path, op.NewPath)
+	case METHOD_RENAME:
+		err := b.mkdirAll(path.Dir(op.NewPath))
+		if err != nil {
+			return err
+		}
+		err = b.backup(op.NewPath, false, false)
+		if err != nil {
+			return err
+		}
+		err = b.file.rename(op.Path, op.NewPath)
+		if err != nil {
+			return err
+		}
+		src, dest := op.Path, op.NewPath
+		b.undo = append(b.undo, func() error { return b.file.rename(dest, src) })
+		return nil
+	}
+	return errors.New("method not allowed in batch")
+}
+
+// 将已存在的路径移到同目录下的备份文件，回滚时移回
+// 路径不存在且removeNew为true时，回滚时删除操作新建的内容
+// deleted表示是删除操作，提交后备份保存到回收站，否则保存为历史版本
+func (b *batch) backup(p string, removeNew, deleted bool) error {
+	if ok, _ := util.IsExist(p); !ok {
+		if removeNew {
+			b.undo = append(b.undo, func() error { return os.RemoveAll(p) })
+		}
+		return nil
+	}
+	bak := tmpName(p)
+	err := os.Rename(p, bak)
+	if err != nil {
+		return err
+	}
+	b.kept = append(b.kept, &batchBackup{bak, p, deleted})
+	b.undo = append(b.undo, func() error {
+		os.RemoveAll(p)
+		return os.Rename(bak, p)
+	})
+	return nil
+}
+
+// 创建目录，记录新建的目录用于回滚，created从最深的目录开始
+func (b *batch) mkdirAll(dir string) error {
+	created := make([]string, 0)
+	for d := dir; d != "/" && d != "."; d = path.Dir(d) {
+		if ok, _ := util.IsExist(d); ok {
+			break
+		}
+		created = append(created, d)
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.New("permission deny, cannot mkdir: " + dir)
+	}
+	// 回滚时从最深的目录开始，只删除空目录，期间其他请求在其中写入的内容不受影响
+	b.undo = append(b.undo, func() error {
+		for _, d := range created {
+			os.Remove(d)
+		}
+		return nil
+	})
+	return nil
+}
+
+// 逆序回滚已执行的操作，failed为失败的操作序号
+// 回滚出错时停止，保留剩余的备份文件用于人工恢复，避免继续回滚删除数据
+func (b *batch) rollback(failed int) {
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		err := b.undo[i]()
+		if err != nil && !os.IsNotExist(err) {
+			b.file.Logger.Println("batch rollback stopped, backups " + BATCH_TMP_PREFIX + "* kept: " + err.Error())
+			return
+		}
+	}
+	for i := 0; i < failed; i++ {
+		b.results[i].Message = BATCH_ROLLBACK
+	}
+}
+
+// 提交后保存被覆盖和删除的内容，没有开启保留时删除
+// 保存失败时保留备份文件用于人工恢复
+func (b *batch) keep() {
+	for _, k := range b.kept {
+		if b.file.store == nil {
+			os.RemoveAll(k.tmp)
+			continue
+		}
+		err := b.file.store.Keep(k.path, k.tmp, k.deleted)
+		if err != nil {
+			b.file.Logger.Println("batch backup " + k.tmp + " kept: " + err.Error())
+		}
+	}
+}
+
+// 删除暂存和备份文件
+func (b *batch) cleanup(files []string) {
+	for _, f := range files {
+		if f != "" {
+			os.RemoveAll(f)
+		}
+	}
+}
+
+// 临时文件序号，保证同一进程中的临时文件名不重复
+var tmpSeq uint64
+
+// 同目录下的临时文件名，保证重命名是原子操作
+func tmpName(p string) string {
+	seq := atomic.AddUint64(&tmpSeq, 1)
+	return path.Dir(p) + "/" + BATCH_TMP_PREFIX + strconv.Itoa(os.Getpid()) + "-" +
+		strconv.FormatUint(seq, 10) + "-" + path.Base(p)
+}
+
+func isDir(p string) bool {
+	f, err := os.Stat(p)
+	return err == nil && f.IsDir()
+}
+
+// 在rootDir中创建并写入一个新文件，从rootDir开始逐级打开
+func (t *CTFile) writeNew(name string, body []byte) error {
+	root, err := t.rootOf(name)
+	if err != nil {
+		return err
+	}
+	f, err := openInRoot(root, name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		removeInRoot(root, name)
+	}
+	return err
+}
+
+// 创建并写入一个新文件
+func writeNewFile(name string, body []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func batchRequest(t *testing.T, ops ...*BatchOp) *FileData {
+	body, err := json.Marshal(&BatchParams{Ops: ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FileData{Method: METHOD_BATCH, Body: body}
+}
+
+func readTestFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(b)
+}
+
+// 批量操作目录中不应残留暂存和备份文件
+func checkNoBatchFiles(t *testing.T, root string) {
+	filepath.Walk(root, func(p string, f os.FileInfo, err error) error {
+		if err == nil && len(f.Name()) > len(BATCH_TMP_PREFIX) && f.Name()[:len(BATCH_TMP_PREFIX)] == BATCH_TMP_PREFIX {
+			t.Errorf("batch temp file left: %s", p)
+		}
+		return nil
+	})
+}
+
+func TestBatchCommit(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	ioutil.WriteFile(root+"/index.html", []byte("old"), 0664)
+	ioutil.WriteFile(root+"/gone.html", []byte("gone"), 0664)
+
+	results, err := s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_CREATE_DIR, Path: root + "/news/2015"},
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/news/2015/a.html", Body: []byte("article")},
+		&BatchOp{Method: METHOD_MODIFY_FILE, Path: root + "/index.html", Body: []byte("new")},
+		&BatchOp{Method: METHOD_APPEND_FILE, Path: root + "/index.html", Body: []byte("+")},
+		&BatchOp{Method: METHOD_REMOVE_FILE, Path: root + "/gone.html"},
+		&BatchOp{Method: METHOD_COPY, Path: root + "/news/2015/a.html", NewPath: root + "/news/latest.html"},
+		&BatchOp{Method: METHOD_RENAME, Path: root + "/news/2015/a.html", NewPath: root + "/news/2015/b.html"},
+	))
+	if err != nil {
+		t.Fatal(err, results)
+	}
+	for i, r := range results {
+		if r.Code != 0 || r.Message != BATCH_SUCCESS {
+			t.Errorf("op %d: %+v", i, r)
+		}
+	}
+	if got := readTestFile(root + "/index.html"); got != "new+" {
+		t.Errorf("index.html = %q", got)
+	}
+	if got := readTestFile(root + "/news/2015/b.html"); got != "article" {
+		t.Errorf("b.html = %q", got)
+	}
+	if got := readTestFile(root + "/news/latest.html"); got != "article" {
+		t.Errorf("latest.html = %q", got)
+	}
+	if _, err := os.Stat(root + "/gone.html"); !os.IsNotExist(err) {
+		t.Errorf("gone.html not removed: %v", err)
+	}
+	checkNoBatchFiles(t, root)
+}
+
+func TestBatchRollback(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	ioutil.WriteFile(root+"/index.html", []byte("old"), 0664)
+	ioutil.WriteFile(root+"/list.html", []byte("list"), 0664)
+
+	results, err := s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/new/a.html", Body: []byte("a")},
+		&BatchOp{Method: METHOD_MODIFY_FILE, Path: root + "/index.html", Body: []byte("new")},
+		&BatchOp{Method: METHOD_APPEND_FILE, Path: root + "/list.html", Body: []byte("+")},
+		&BatchOp{Method: METHOD_REMOVE_FILE, Path: root + "/list.html"},
+		&BatchOp{Method: METHOD_RENAME, Path: root + "/missing.html", NewPath: root + "/x.html"},
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/never.html"},
+	))
+	if err == nil {
+		t.Fatal("expected batch to fail")
+	}
+	want := []string{BATCH_ROLLBACK, BATCH_ROLLBACK, BATCH_ROLLBACK, BATCH_ROLLBACK, "", BATCH_NOT_RUN}
+	for i, r := range results {
+		if i == 4 {
+			if r.Code == 0 {
+				t.Errorf("op %d should fail: %+v", i, r)
+			}
+			continue
+		}
+		if r.Message != want[i] {
+			t.Errorf("op %d: %+v", i, r)
+		}
+	}
+	if got := readTestFile(root + "/index.html"); got != "old" {
+		t.Errorf("index.html = %q", got)
+	}
+	if got := readTestFile(root + "/list.html"); got != "list" {
+		t.Errorf("list.html = %q", got)
+	}
+	for _, p := range []string{"/new", "/never.html"} {
+		if _, err := os.Stat(root + p); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist: %v", p, err)
+		}
+	}
+	checkNoBatchFiles(t, root)
+}
+
+func TestBatchValidate(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	results, err := s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: []byte("a")},
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: "/etc/passwd", Body: []byte("x")},
+	))
+	if err == nil || results[1].Code == 0 || results[0].Message != BATCH_NOT_RUN {
+		t.Fatalf("expected validation failure, got %v %+v", err, results)
+	}
+	if _, err := os.Stat(root + "/a.html"); !os.IsNotExist(err) {
+		t.Errorf("a.html should not be written")
+	}
+}
+
+func TestBatchRollbackDirs(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	b := &batch{file: s.ctFile}
+	if err := b.mkdirAll(root + "/n/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	// 其他请求在新建的目录中写入的文件，回滚时保留
+	ioutil.WriteFile(root+"/n/other.html", []byte("other"), 0664)
+	b.rollback(0)
+	if _, err := os.Stat(root + "/n/a"); !os.IsNotExist(err) {
+		t.Errorf("n/a should be removed: %v", err)
+	}
+	if got := readTestFile(root + "/n/other.html"); got != "other" {
+		t.Errorf("other.html = %q", got)
+	}
+}
+
+func TestBatchValidateLocked(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	outside, err := ioutil.TempDir("", "fserver-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	os.Mkdir(root+"/d", 0755)
+	unlock, err := s.ctFile.locks.Lock("", lockPath{root + "/d", false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.ctFile.Batch(batchRequest(t,
+			&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/d/x.html", Body: []byte("x")}))
+		done <- err
+	}()
+	// 等待批量操作时目录被替换为指向外部的符号链接，锁定后的检查发现
+	time.Sleep(50 * time.Millisecond)
+	os.Remove(root + "/d")
+	os.Symlink(outside, root+"/d")
+	unlock()
+	if err = <-done; err == nil {
+		t.Error("batch wrote through symlink replaced before lock")
+	}
+	if _, err = os.Stat(outside + "/x.html"); !os.IsNotExist(err) {
+		t.Errorf("file written outside rootDir: %v", err)
+	}
+}
+
+// 子操作的内容和批量操作的参数在解码时检查大小
+func TestBatchLimits(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().maxSize = 1 << 10
+	big := make([]byte, 2<<10)
+	_, err := s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: []byte("a")},
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/b.html", Body: big},
+	))
+	if err == nil || !strings.Contains(err.Error(), "batch operation 1") {
+		t.Errorf("operation over maxSize: %v", err)
+	}
+
+	// 压缩的参数解压后超过BATCH_MAX_SIZE
+	body := []byte(`{"ops":[{"method":1,"path":"` + root + `/a.html","body":"` + strings.Repeat("A", BATCH_MAX_SIZE) + `"}]}`)
+	rec := &FileData{Method: METHOD_BATCH, Flags: FLAG_GZIP, Body: compressTestBody(t, FLAG_GZIP, body)}
+	if _, err = s.ctFile.Batch(rec); err == nil {
+		t.Error("batch over BATCH_MAX_SIZE accepted")
+	}
+	rec = &FileData{Method: METHOD_BATCH, Body: body, BodySize: uint32(len(body))}
+	if _, err = s.ctFile.Batch(rec); err == nil || !strings.Contains(err.Error(), "batch too large") {
+		t.Errorf("uncompressed batch over BATCH_MAX_SIZE: %v", err)
+	}
+	if _, err = os.Stat(root + "/a.html"); !os.IsNotExist(err) {
+		t.Error("rejected batch applied")
+	}
+
+	// 压缩的参数边解压边解码
+	body, _ = json.Marshal(&BatchParams{Ops: []*BatchOp{{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: []byte("a")}}})
+	rec = &FileData{Method: METHOD_BATCH, Flags: FLAG_ZSTD, Body: compressTestBody(t, FLAG_ZSTD, body)}
+	if _, err = s.ctFile.Batch(rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(root + "/a.html"); got != "a" {
+		t.Errorf("a.html = %q", got)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 解压请求内容，解压后超过limit时返回错误，不会读取超过limit的内容
+func decompress(flags uint32, body []byte, limit uint32) ([]byte, error) {
+	r, err := decompressReader(flags, body, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 将压缩的写入内容边解压边写入系统临时目录中的暂存文件，不在内存中解压，写入后校验
+// 成功后rec.BodyFile是暂存文件，由调用者删除
+func stageBody(rec *FileData, limit uint32) error {
+	dr, err := decompressReader(rec.Flags, rec.Body, limit)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	f, err := ioutil.TempFile("", BATCH_TMP_PREFIX)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	sum := newChecksumReader(dr, rec.Meta)
+	n, err := io.Copy(f, sum)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = sum.check()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	rec.BodyFile = tmp
+	rec.Body = nil
+	rec.BodySize = uint32(n)
+	rec.Flags &^= FLAG_COMPRESS
+	return nil
+}
+
+// 边读取边解压请求内容，读取的内容超过limit时返回错误
+func decompressReader(flags uint32, body []byte, limit uint32) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	switch flags & FLAG_COMPRESS {
+	case 0:
+		r = ioutil.NopCloser(bytes.NewReader(body))
+	case FLAG_GZIP:
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.New("gzip body error: " + err.Error())
+		}
+		r = gr
+	case FLAG_ZSTD:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.New("zstd body error: " + err.Error())
+		}
+		r = zr.IOReadCloser()
+	default:
+		return nil, errors.New("only one compression flag allowed")
+	}
+	return &limitReader{r: r, n: int64(limit), limit: limit}, nil
+}
+
+// 限制读取大小的解压内容
+type limitReader struct {
+	r     io.ReadCloser
+	n     int64 // 剩余可以读取的大小
+	limit uint32
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	// 多读取一个字节，判断内容是否超过限制
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		return int(l.n), errors.New("body too large! decompressed body should less than " + strconv.FormatInt(int64(l.limit), 10))
+	}
+	l.n -= int64(n)
+	if err != nil && err != io.EOF {
+		err = errors.New("decompress body error: " + err.Error())
+	}
+	return n, err
+}
+
+func (l *limitReader) Close() error {
+	return l.r.Close()
+}
+
+// 读取时计算内容的校验值，流式处理的内容读取完成后校验
+type checksumReader struct {
+	r    io.Reader
+	meta *RequestMeta
+	sha  hash.Hash
+	crc  hash.Hash32
+}
+
+func newChecksumReader(r io.Reader, meta *RequestMeta) *checksumReader {
+	return &checksumReader{r: r, meta: meta, sha: sha256.New(), crc: crc32.New(crcTable)}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.sha.Write(p[:n])
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+// 读取剩余的内容后校验
+func (c *checksumReader) check() error {
+	_, err := io.Copy(ioutil.Discard, c)
+	if err != nil {
+		return err
+	}
+	if c.meta == nil {
+		return nil
+	}
+	if c.meta.Sha256 != "" {
+		if h := hex.EncodeToString(c.sha.Sum(nil)); !strings.EqualFold(h, c.meta.Sha256) {
+			return &CodeError{CODE_CHECKSUM_MISMATCH, "checksum mismatch: body sha256 " + h}
+		}
+	}
+	if c.meta.Crc32c != "" {
+		if s := fmt.Sprintf("%08x", c.crc.Sum32()); !strings.EqualFold(s, c.meta.Crc32c) {
+			return &CodeError{CODE_CHECKSUM_MISMATCH, "checksum mismatch: body crc32c " + s}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"cmstop-fserver/util"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func compressTestBody(t *testing.T, flag uint32, body []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser = gzip.NewWriter(&buf)
+	if flag == FLAG_ZSTD {
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	}
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCompressedWrite(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	s.settings().maxSize = 64 << 10
+	page := []byte(strings.Repeat("<p>news</p>\n", 1000))
+	bomb := make([]byte, 1<<20)
+
+	tests := []struct {
+		flags uint32
+		body  []byte
+		code  int
+	}{
+		{FLAG_GZIP, page, CODE_SUCCESS},
+		{FLAG_ZSTD, page, CODE_SUCCESS},
+		{FLAG_GZIP, bomb, CODE_ERROR}, // 解压后超过maxSize
+		{FLAG_GZIP | FLAG_ZSTD, page, CODE_ERROR},
+	}
+	// 流水线请求失败时不关闭连接
+	conn := dialTestServer(t, addr)
+	for i, tt := range tests {
+		p := root + "/page.html"
+		os.Remove(p)
+		flag := tt.flags
+		if flag == FLAG_GZIP|FLAG_ZSTD {
+			flag = FLAG_GZIP
+		}
+		rec := &FileData{Method: METHOD_CREATE_FILE, Flags: tt.flags | FLAG_REQUEST_ID, RequestId: uint32(i + 1), Password: "pw", Path: p,
+			Body: compressTestBody(t, flag, tt.body), Meta: &RequestMeta{Sha256: util.Hash(tt.body)}}
+		if err := sendTestRequest(conn, rec); err != nil {
+			t.Fatal(err)
+		}
+		resp := readTestResponse(t, conn)
+		if resp.Code != tt.code {
+			t.Errorf("%d: code %d, want %d: %s", i, resp.Code, tt.code, resp.Message)
+			continue
+		}
+		b, err := ioutil.ReadFile(p)
+		if tt.code == CODE_SUCCESS && !bytes.Equal(b, tt.body) {
+			t.Errorf("%d: content not decompressed, %d bytes", i, len(b))
+		}
+		if tt.code != CODE_SUCCESS && err == nil {
+			t.Errorf("%d: rejected body written", i)
+		}
+	}
+}
+
+// 压缩的写入解压到暂存文件，写入和记录日志后删除
+func TestCompressedStaged(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.journal = j
+	s.settings().maxSize = 64 << 10
+	write := func(method uint32, p string, body []byte) error {
+		_, err := s.handleRequest(&FileData{Method: method, Flags: FLAG_ZSTD, Password: "pw", Path: p,
+			Body: compressTestBody(t, FLAG_ZSTD, body), Meta: &RequestMeta{Sha256: util.Hash(body)}})
+		return err
+	}
+	page := []byte(strings.Repeat("<p>news</p>\n", 1000))
+	if err = write(METHOD_CREATE_FILE, root+"/a.html", page); err != nil {
+		t.Fatal(err)
+	}
+	if err = write(METHOD_APPEND_FILE, root+"/a.html", []byte("end")); err != nil {
+		t.Fatal(err)
+	}
+	if err = write(METHOD_CREATE_FILE, root+"/b.html", make([]byte, 1<<20)); err == nil {
+		t.Error("body over maxSize accepted")
+	}
+	if err = write(METHOD_CREATE_FILE, root+"/c.php", page); err == nil {
+		t.Error("disallowed extension accepted")
+	}
+	if fl, _ := ioutil.ReadDir(tmp); len(fl) != 0 {
+		t.Errorf("staged files left: %d", len(fl))
+	}
+	if _, err = os.Stat(root + "/b.html"); !os.IsNotExist(err) {
+		t.Error("rejected body written")
+	}
+	j.Close()
+
+	target := t.TempDir()
+	if _, err = Replay(dir, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := string(page) + "end"
+	if got := readTestFile(root + "/a.html"); got != want {
+		t.Errorf("written %d bytes, want %d", len(got), len(want))
+	}
+	if got := readTestFile(target + root + "/a.html"); got != want {
+		t.Errorf("replayed %d bytes, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+archive extraction.
+
+METHOD_EXTRACT extracts a tar, tar.gz or zip body into the request path.
+every entry is checked like a single write (CheckWrite), links, devices,
+absolute names and names with .. are rejected, nothing is written when any
+entry is invalid. a compressed body is decompressed while the entries are
+read, a zip is spooled to a temporary file. entries are checked one at a time
+and spooled to temporary files, the content filter runs once per entry, after
+locking only the paths are checked again.
+by default the entries are merged into the directory as one batch, existing
+files are overwritten (and kept as versions), a failure rolls back all.
+with swap the archive is extracted into a staging directory which replaces
+the directory with two renames, the old directory is moved to the trash.
+the staging directory is created next to the directory, so a rootDir itself
+cannot be swapped.
+*/
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmstop-fserver/util"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	EXTRACT_TAR         = "tar"    // tar格式
+	EXTRACT_TGZ         = "tar.gz" // gzip压缩的tar格式
+	EXTRACT_ZIP         = "zip"    // zip格式
+	EXTRACT_MAX_ENTRIES = 100000   // 压缩包中的最大条目数
+)
+
+// 解压参数，在RequestMeta中发送
+type ExtractParams struct {
+	Format string `json:"format,omitempty"` // tar、tar.gz或zip，为空时按内容判断
+	Swap   bool   `json:"swap,omitempty"`   // 解压到临时目录后整体替换目标目录
+}
+
+// 解压结果
+type ExtractResult struct {
+	Files int   `json:"files"` // 文件数
+	Dirs  int   `json:"dirs"`  // 目录数
+	Size  int64 `json:"size"`  // 文件总大小
+}
+
+// 将压缩包解压到目录，全部条目检查通过后才写入
+func (t *CTFile) Extract(rec *FileData) (*ExtractResult, error) {
+	token := ""
+	params := new(ExtractParams)
+	if rec.Meta != nil {
+		token = rec.Meta.LockToken
+		if rec.Meta.Extract != nil {
+			params = rec.Meta.Extract
+		}
+	}
+	dir := path.Clean(rec.Path)
+	if ok, _ := util.IsExist(dir); ok && !isDir(dir) {
+		return nil, errors.New("path is not a directory: " + dir)
+	}
+	if params.Swap && t.Server.settings().isRootDir(dir) {
+		return nil, errors.New("rootDir cannot be swapped, extract without swap")
+	}
+	// 压缩的内容边读取边解压，不在内存中保留整个解压后的压缩包，读取完成后校验
+	var r io.Reader = bytes.NewReader(rec.Body)
+	var sum *checksumReader
+	if rec.Flags&FLAG_COMPRESS != 0 {
+		dr, err := decompressReader(rec.Flags, rec.Body, MAX_BODY_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		defer dr.Close()
+		sum = newChecksumReader(dr, rec.Meta)
+		r = sum
+	}
+	spool, err := ioutil.TempDir("", "fserver-extract")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(spool)
+	ops, res, err := t.readArchive(dir, r, params.Format, spool)
+	if err == nil && sum != nil {
+		err = sum.check()
+	}
+	if err != nil {
+		return nil, err
+	}
+	paths := []lockPath{{dir, false}}
+	if !params.Swap {
+		if len(ops) > 0 {
+			_, err = t.runBatch(rec, token, paths, ops)
+		}
+		return res, err
+	}
+
+	unlock, err := t.locks.Lock(token, paths...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	existed := isDir(dir)
+	err = t.extractSwap(dir, ops)
+	if err != nil {
+		return nil, err
+	}
+	// 替换记录为删除原目录后重新创建
+	records := make([]*BatchOp, 0, len(ops)+2)
+	if existed {
+		records = append(records, &BatchOp{Method: METHOD_REMOVE_DIR, Path: dir})
+	}
+	records = append(records, &BatchOp{Method: METHOD_CREATE_DIR, Path: dir})
+	for _, op := range append(records, ops...) {
+		sub := &FileData{Method: op.Method, Path: op.Path, Password: rec.Password, Client: rec.Client}
+		if op.file != "" {
+			sub.BodyFile = op.Path
+		}
+		err = t.journalOp(sub)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// 在同一目录中构建新的目录树后替换原目录，原目录开启保留时移到回收站
+func (t *CTFile) extractSwap(dir string, ops []*BatchOp) error {
+	err := checkPath(dir)
+	if err != nil {
+		return err
+	}
+	tmp := tmpName(dir)
+	err = os.Mkdir(tmp, 0755)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		p := tmp + strings.TrimPrefix(op.Path, dir)
+		if int(op.Method) == METHOD_CREATE_DIR {
+			err = os.MkdirAll(p, 0755)
+		} else {
+			err = os.MkdirAll(path.Dir(p), 0755)
+			if err == nil {
+				err = moveAll(op.file, p)
+			}
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	var keep func(p, old string) error
+	if t.store != nil {
+		keep = func(p, old string) error { return t.store.Keep(p, old, true) }
+	}
+	swapped, err := swapDir(dir, tmp, keep)
+	if err != nil {
+		if !swapped {
+			os.RemoveAll(tmp)
+			return err
+		}
+		return errors.New("archive extracted, but " + err.Error())
+	}
+	return nil
+}
+
+// 读取并检查压缩包中的全部条目，返回创建目录和文件的操作
+// 文件的内容检查后写入spool目录中的临时文件，不在内存中保留
+func (t *CTFile) readArchive(dir string, r io.Reader, format, spool string) ([]*BatchOp, *ExtractResult, error) {
+	br := bufio.NewReader(r)
+	if format == "" {
+		head, _ := br.Peek(4)
+		format = archiveFormat(head)
+	}
+	ops := make([]*BatchOp, 0)
+	res := new(ExtractResult)
+	c := t.Server.settings()
+	maxSize := int64(c.maxSize)
+	add := func(name string, isDir bool, r io.Reader) error {
+		if len(ops) >= EXTRACT_MAX_ENTRIES {
+			return errors.New("archive too large! entries should less than " + strconv.Itoa(EXTRACT_MAX_ENTRIES))
+		}
+		p, err := entryPath(dir, name)
+		if err != nil || p == dir {
+			return err
+		}
+		if isDir {
+			err = c.checkPath(p)
+			if err != nil {
+				return errors.New("archive entry " + name + ": " + err.Error())
+			}
+			ops = append(ops, &BatchOp{Method: METHOD_CREATE_DIR, Path: p})
+			res.Dirs++
+			return nil
+		}
+		// 超过maxSize的内容不再读取，CheckWrite返回错误
+		data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+		if err != nil {
+			return errors.New("archive entry " + name + ": " + err.Error())
+		}
+		data, err = c.checkWrite(METHOD_CREATE_FILE, p, data)
+		if err != nil {
+			return errors.New("archive entry " + name + ": " + err.Error())
+		}
+		res.Files++
+		res.Size += int64(len(data))
+		if res.Size > int64(MAX_BODY_SIZE) {
+			return errors.New("archive too large! extracted size should less than " + strconv.FormatInt(int64(MAX_BODY_SIZE), 10))
+		}
+		tmp := spool + "/" + strconv.Itoa(len(ops))
+		err = writeNewFile(tmp, data)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &BatchOp{Method: METHOD_CREATE_FILE, Path: p, checked: true, file: tmp})
+		return nil
+	}
+
+	var err error
+	switch format {
+	case EXTRACT_ZIP:
+		// zip需要随机读取，解压的内容先写入临时文件
+		if b, ok := r.(*bytes.Reader); ok {
+			err = readZip(b, b.Size(), add)
+		} else {
+			err = spoolZip(br, add)
+		}
+	case EXTRACT_TGZ:
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(br)
+		if err == nil {
+			err = readTar(gr, add)
+			gr.Close()
+		}
+	case EXTRACT_TAR:
+		err = readTar(br, add)
+	default:
+		err = errors.New("archive format not supported: " + format)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return ops, res, nil
+}
+
+// 按内容判断压缩包格式
+func archiveFormat(body []byte) string {
+	switch {
+	case bytes.HasPrefix(body, []byte("PK\x03\x04")), bytes.HasPrefix(body, []byte("PK\x05\x06")):
+		return EXTRACT_ZIP
+	case bytes.HasPrefix(body, []byte{0x1f, 0x8b}):
+		return EXTRACT_TGZ
+	}
+	return EXTRACT_TAR
+}
+
+// 条目在目录中的路径，拒绝绝对路径和含有..的路径
+func entryPath(dir, name string) (string, error) {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, "\\") {
+		return "", errors.New("archive entry name not allowed: " + name)
+	}
+	for _, e := range strings.Split(name, "/") {
+		if e == ".." {
+			return "", errors.New("archive entry name not allowed: " + name)
+		}
+	}
+	p := path.Clean(name)
+	if p == "." {
+		return dir, nil
+	}
+	return dir + "/" + p, nil
+}
+
+func readTar(r io.Reader, add func(name string, isDir bool, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("tar read error: " + err.Error())
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = add(h.Name, true, nil)
+		case tar.TypeReg:
+			err = add(h.Name, false, tr)
+		case tar.TypeXGlobalHeader:
+		case tar.TypeSymlink, tar.TypeLink:
+			err = errors.New("archive entry " + h.Name + ": link not allowed")
+		default:
+			err = errors.New("archive entry " + h.Name + ": type not allowed")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readZip(r io.ReaderAt, size int64, add func(name string, isDir bool, r io.Reader) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errors.New("zip read error: " + err.Error())
+	}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = add(f.Name, true, nil)
+		case mode&os.ModeSymlink != 0:
+			err = errors.New("archive entry " + f.Name + ": link not allowed")
+		case !mode.IsRegular():
+			err = errors.New("archive entry " + f.Name + ": type not allowed")
+		default:
+			var rc io.ReadCloser
+			rc, err = f.Open()
+			if err == nil {
+				err = add(f.Name, false, rc)
+				rc.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将zip写入临时文件后读取
+func spoolZip(r io.Reader, add func(name string, isDir bool, r io.Reader) error) error {
+	f, err := ioutil.TempFile("", "fserver-zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return readZip(f, size, add)
+}
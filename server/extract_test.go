@@ -0,0 +1,208 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"cmstop-fserver/util"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testEntry struct {
+	name string
+	body string
+	flag byte // tar条目类型，0 为普通文件
+}
+
+func tarTestArchive(entries []testEntry) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		switch e.flag {
+		case tar.TypeDir:
+			h.Typeflag, h.Mode, h.Size = tar.TypeDir, 0755, 0
+		case tar.TypeSymlink:
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, e.body, 0
+		}
+		tw.WriteHeader(h)
+		if h.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	dir := root + "/www"
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(dir+"/index.html", []byte("old"), 0644)
+	ioutil.WriteFile(dir+"/keep.html", []byte("keep"), 0644)
+
+	body := tarTestArchive([]testEntry{
+		{"./", "", tar.TypeDir},
+		{"css/", "", tar.TypeDir},
+		{"css/a.css", "a{}", 0},
+		{"index.html", "new", 0},
+	})
+	v, err := s.ctFile.Handle(&FileData{Method: METHOD_EXTRACT, Path: dir, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := v.(*ExtractResult); res.Files != 2 || res.Dirs != 1 {
+		t.Errorf("result %+v", res)
+	}
+	for p, want := range map[string]string{"/index.html": "new", "/css/a.css": "a{}", "/keep.html": "keep"} {
+		if got := readTestFile(dir + p); got != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+
+	// 任何一个条目不合法都不写入
+	s.settings().maxSize = 8
+	bad := [][]testEntry{
+		{{"b.html", "b", 0}, {"../escape.html", "x", 0}},
+		{{"b.html", "b", 0}, {"/tmp/abs.html", "x", 0}},
+		{{"b.html", "b", 0}, {"link.html", "/etc/passwd", tar.TypeSymlink}},
+		{{"b.html", "b", 0}, {"shell.php", "x", 0}},
+		{{"b.html", "b", 0}, {"big.html", "0123456789", 0}},
+	}
+	for i, entries := range bad {
+		_, err = s.ctFile.Handle(&FileData{Method: METHOD_EXTRACT, Path: dir, Body: tarTestArchive(entries)})
+		if err == nil {
+			t.Errorf("%d: invalid archive extracted", i)
+		}
+		if _, err = os.Stat(dir + "/b.html"); !os.IsNotExist(err) {
+			t.Fatalf("%d: entry written before invalid entry rejected", i)
+		}
+	}
+	if _, err = os.Stat(root + "/escape.html"); !os.IsNotExist(err) {
+		t.Fatal("entry escaped target directory")
+	}
+}
+
+func TestExtractSwap(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	dir := root + "/www"
+	os.MkdirAll(dir, 0755)
+	ioutil.WriteFile(dir+"/old.html", []byte("old"), 0644)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("news/a.html")
+	w.Write([]byte("a"))
+	zw.Close()
+	meta := &RequestMeta{Extract: &ExtractParams{Swap: true}}
+	_, err := s.ctFile.Handle(&FileData{Method: METHOD_EXTRACT, Path: dir, Body: buf.Bytes(), Meta: meta})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(dir + "/news/a.html"); got != "a" {
+		t.Errorf("a.html = %q", got)
+	}
+	if _, err = os.Stat(dir + "/old.html"); !os.IsNotExist(err) {
+		t.Error("old content still in swapped directory")
+	}
+
+	// rootDir不能被替换，临时目录会在rootDir之外
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_EXTRACT, Path: root, Body: buf.Bytes(), Meta: meta})
+	if err == nil || !strings.Contains(err.Error(), "rootDir") {
+		t.Errorf("rootDir swapped: %v", err)
+	}
+}
+
+func TestExtractCompressed(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	dir := root + "/www"
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("a.html")
+	w.Write([]byte("a"))
+	zw.Close()
+	tgz := tarTestArchive([]testEntry{{"b.html", "b", 0}})
+
+	// 压缩的zip写入临时文件后解压，校验解压后的内容
+	tests := []struct {
+		flags uint32
+		body  []byte
+		hash  string
+		file  string
+		code  int
+	}{
+		{FLAG_GZIP, buf.Bytes(), util.Hash(buf.Bytes()), "/a.html", CODE_SUCCESS},
+		{FLAG_ZSTD, tgz, util.Hash(tgz), "/b.html", CODE_SUCCESS},
+		{FLAG_GZIP, tgz, util.Hash([]byte("x")), "/b.html", CODE_CHECKSUM_MISMATCH},
+	}
+	for i, tt := range tests {
+		os.RemoveAll(dir)
+		rec := &FileData{Method: METHOD_EXTRACT, Flags: tt.flags, Password: "pw", Path: dir,
+			Body: compressTestBody(t, tt.flags, tt.body), Meta: &RequestMeta{Sha256: tt.hash}}
+		_, err := s.handleRequest(rec)
+		code := CODE_SUCCESS
+		if e, ok := err.(*CodeError); ok {
+			code = e.Code
+		} else if err != nil {
+			code = CODE_ERROR
+		}
+		if code != tt.code {
+			t.Errorf("%d: code %d, want %d: %v", i, code, tt.code, err)
+		}
+		if _, err = os.Stat(dir + tt.file); (err == nil) != (tt.code == CODE_SUCCESS) {
+			t.Errorf("%d: %s written %v", i, tt.file, err == nil)
+		}
+	}
+
+	// 超过限制时停止解压
+	r, err := decompressReader(FLAG_GZIP, compressTestBody(t, FLAG_GZIP, make([]byte, 1<<20)), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if err == nil || n != 1000 || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("read %d: %v", n, err)
+	}
+}
+
+// 条目内容只检查一次，重新编码的图片不会再次编码
+func TestExtractCheckedOnce(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().filter.image.open = true
+	s.settings().filter.image.reencode = true
+	dir := root + "/www"
+	img := testImage("jpeg", 64, 64)
+	once, f := s.settings().filter.image.check("jpg", img, true)
+	if f != nil {
+		t.Fatal(f)
+	}
+	twice, _ := s.settings().filter.image.check("jpg", once, true)
+	if bytes.Equal(once, twice) {
+		t.Skip("re-encoding is stable, cannot tell how often it ran")
+	}
+	jdir := t.TempDir()
+	s.ctFile.journal, _ = OpenJournal(jdir, 0, 0, false)
+	_, err := s.ctFile.Handle(&FileData{Method: METHOD_EXTRACT, Path: dir, Body: tarTestArchive([]testEntry{{"a.jpg", string(img), 0}})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(dir + "/a.jpg"); got != string(once) {
+		t.Errorf("image re-encoded %d times", map[bool]int{true: 2, false: 0}[got == string(twice)])
+	}
+	// 暂存文件中的内容记录到操作日志
+	s.ctFile.journal.Close()
+	target := t.TempDir()
+	if _, err = Replay(jdir, target, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(target + dir + "/a.jpg"); got != string(once) {
+		t.Errorf("journaled content differs, %d bytes", len(got))
+	}
+}
@@ -1,88 +1,485 @@
 package server
 
 import (
+	"bytes"
 	"cmstop-fserver/util"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type copyParams struct {
-	NewPath string `json:newpath`
+	NewPath string `json:"newpath"`
 }
 
 type renameParams struct {
-	NewPath string `json:newpath`
+	NewPath string `json:"newpath"`
 }
 
+type listParams struct {
+	Recursive bool   `json:"recursive"`       // 是否递归列出子目录
+	Hash      bool   `json:"hash"`            // 是否计算文件内容哈希
+	After     string `json:"after,omitempty"` // 分页，只列出在这个相对路径之后的内容
+	Limit     int    `json:"limit,omitempty"` // 分页，最多列出的数量，0 不限制
+}
+
+// 分页列出时已经达到数量
+var errListFull = errors.New("list full")
+
 type CTFile struct {
-	Server *Server     // server实例指针
-	Logger *log.Logger // 日志实例指针
+	Server  *Server        // server实例指针
+	Logger  *log.Logger    // 日志实例指针
+	locks   *LockManager   // 路径锁
+	store   *Store         // 历史版本和回收站，为nil时不保留
+	snaps   *SnapshotStore // 快照存储，为nil时不支持快照
+	journal *Journal       // 操作日志，为nil时不记录
+	replica *Replica       // 复制，为nil时不是副本
+
+	archiveTimeout time.Duration // 打包下载每次写入连接的超时
 }
 
 func NewCtFile(server *Server) *CTFile {
 	f := new(CTFile)
 	f.Server = server
 	f.Logger = server.Logger
+	f.locks = NewLockManager()
+	f.archiveTimeout = ARCHIVE_TIMEOUT
 	return f
 }
 
-// 处理请求
-func (t *CTFile) Handle(rec *FileData) error {
+// 前提条件不满足的错误
+func preconditionFailed(msg string) error {
+	return &CodeError{CODE_PRECONDITION_FAILED, "precondition failed: " + msg}
+}
+
+// 校验请求内容，请求附加信息中没有校验值时不校验
+func checkChecksum(rec *FileData) error {
+	if rec.Meta == nil {
+		return nil
+	}
+	if rec.Meta.Sha256 != "" {
+		if h := util.Hash(rec.Body); !strings.EqualFold(h, rec.Meta.Sha256) {
+			return &CodeError{CODE_CHECKSUM_MISMATCH, "checksum mismatch: body sha256 " + h}
+		}
+	}
+	if rec.Meta.Crc32c != "" {
+		if c := fmt.Sprintf("%08x", crc32.Checksum(rec.Body, crcTable)); !strings.EqualFold(c, rec.Meta.Crc32c) {
+			return &CodeError{CODE_CHECKSUM_MISMATCH, "checksum mismatch: body crc32c " + c}
+		}
+	}
+	return nil
+}
+
+// 处理请求，返回需要响应给客户端的数据
+// 执行前校验请求内容并锁定操作涉及的路径，成功后在锁内记录操作日志
+func (t *CTFile) Handle(rec *FileData) (interface{}, error) {
+	// 压缩的内容在解压时校验，暂存的内容已经校验过
+	var err error
+	if rec.Flags&FLAG_COMPRESS == 0 && rec.BodyFile == "" {
+		err = checkChecksum(rec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token := ""
+	if rec.Meta != nil {
+		token = rec.Meta.LockToken
+	}
 	switch int(rec.Method) {
-	case METHOD_CREATE_FILE:
-		return t.WriteFile(rec.Path, rec.Body, false)
-	case METHOD_MODIFY_FILE:
-		return t.WriteFile(rec.Path, rec.Body, false)
-	case METHOD_APPEND_FILE:
-		return t.WriteFile(rec.Path, rec.Body, true)
+	case METHOD_LOCK:
+		return t.Lock(rec.Path, rec.Body, token)
+	case METHOD_UNLOCK:
+		return nil, t.locks.Release(token, rec.Path)
+	case METHOD_BATCH:
+		return t.Batch(rec)
+	case METHOD_JOURNAL_READ:
+		return t.JournalRead(rec.Body)
+	case METHOD_REPLICA_STATUS:
+		return t.ReplicaStatus()
+	case METHOD_EXTRACT:
+		return t.Extract(rec)
+	case METHOD_ARCHIVE:
+		return t.Archive(rec)
+	case METHOD_SCAN:
+		return t.Server.Scan(rec.Path, rec.Body)
+	}
+
+	unlock, err := t.locks.Lock(token, t.lockPaths(rec)...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	data, err := t.handle(rec)
+	if err == nil {
+		err = t.journalOp(rec)
+	}
+	return data, err
+}
+
+func (t *CTFile) handle(rec *FileData) (interface{}, error) {
+	switch int(rec.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE:
+		return t.ConditionalWrite(rec)
 	case METHOD_REMOVE_FILE:
-		return t.RemoveFile(rec.Path)
+		return nil, t.RemoveFile(rec.Path)
 	case METHOD_CREATE_DIR:
-		return t.CreateDir(rec.Path)
+		return nil, t.CreateDir(rec.Path)
 	case METHOD_REMOVE_DIR:
-		return t.RemoveDir(rec.Path)
+		return nil, t.RemoveDir(rec.Path)
 	case METHOD_CLEAR_DIR:
-		return t.ClearDir(rec.Path)
+		return nil, t.ClearDir(rec.Path)
 	case METHOD_COPY:
-		return t.Copy(rec.Path, rec.Body)
+		return nil, t.Copy(rec.Path, rec.Body)
 	case METHOD_RENAME:
-		return t.Rename(rec.Path, rec.Body)
+		return nil, t.Rename(rec.Path, rec.Body)
+	case METHOD_STAT:
+		return t.Stat(rec.Path)
+	case METHOD_LIST:
+		return t.List(rec.Path, rec.Body)
+	case METHOD_READ_FILE:
+		return t.ReadFile(rec.Path)
+	case METHOD_VERSIONS, METHOD_TRASH, METHOD_RESTORE, METHOD_EMPTY_TRASH:
+		return t.handleStore(rec)
+	case METHOD_SNAPSHOT_CREATE, METHOD_SNAPSHOT_LIST, METHOD_SNAPSHOT_RESTORE, METHOD_SNAPSHOT_DELETE:
+		return t.handleSnapshot(rec)
+	}
+	return nil, errors.New("Method not defined")
+}
+
+// 记录一个已经成功执行的操作，只记录修改文件的操作
+func (t *CTFile) journalOp(rec *FileData) error {
+	// 读取的请求在升级启动时不等待操作日志打开
+	if readOnlyMethod(rec.Method) || t.journal == nil {
+		return nil
+	}
+	r := &JournalRecord{Method: rec.Method, Path: rec.Path, Cred: t.journal.credential(rec.Password), Client: rec.Client}
+	var body []byte
+	switch int(rec.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE:
+		if rec.BodyFile != "" {
+			return t.journalFile(r, rec.BodyFile)
+		}
+		body = rec.Body
+		if body == nil {
+			body = []byte{}
+		}
+	case METHOD_COPY, METHOD_RENAME:
+		params := new(renameParams)
+		json.Unmarshal(rec.Body, params)
+		r.NewPath = params.NewPath
+	case METHOD_RESTORE:
+		// 恢复记录为写入恢复后的内容，重放和复制时不需要历史版本和回收站
+		return t.journalTree(r, rec.Path, false)
+	case METHOD_SNAPSHOT_RESTORE:
+		// 快照只在本节点上，记录为删除原目录后重新创建
+		return t.journalTree(r, rec.Path, true)
+	case METHOD_REMOVE_FILE, METHOD_CREATE_DIR, METHOD_REMOVE_DIR, METHOD_CLEAR_DIR:
+	default:
+		return nil
+	}
+	err := t.journal.Write(r, body)
+	if err != nil {
+		t.Logger.Println(err)
+		return errors.New("operation applied, but " + err.Error())
+	}
+	return nil
+}
+
+// 记录写入的操作，内容从文件name读取
+func (t *CTFile) journalFile(r *JournalRecord, name string) error {
+	err := t.journal.WriteFile(r, name)
+	if err != nil {
+		t.Logger.Println(err)
+		return errors.New("operation applied, but " + err.Error())
+	}
+	return nil
+}
+
+// 记录恢复后的路径，文件记录为写入恢复后的内容，目录记录为创建其中的每个目录和文件
+// replace为true时先记录删除原目录
+func (t *CTFile) journalTree(base *JournalRecord, p string, replace bool) error {
+	write := func(method uint32, fp string, body []byte) error {
+		r := *base
+		r.Method, r.Path = method, fp
+		err := t.journal.Write(&r, body)
+		if err != nil {
+			t.Logger.Println(err)
+			return errors.New("operation applied, but " + err.Error())
+		}
+		return nil
+	}
+	if replace {
+		err := write(METHOD_REMOVE_DIR, p, nil)
+		if err != nil {
+			return err
+		}
 	}
-	return errors.New("Method not defined")
+	return filepath.Walk(p, func(fp string, f os.FileInfo, err error) error {
+		if err != nil {
+			return errors.New("operation applied, but journal read restored path error: " + err.Error())
+		}
+		if f.IsDir() {
+			return write(METHOD_CREATE_DIR, fp, nil)
+		}
+		if !f.Mode().IsRegular() {
+			return nil
+		}
+		r := *base
+		r.Method, r.Path = METHOD_CREATE_FILE, fp
+		return t.journalFile(&r, fp)
+	})
+}
+
+// 处理历史版本和回收站的请求
+func (t *CTFile) handleStore(rec *FileData) (interface{}, error) {
+	if t.store == nil {
+		return nil, errors.New("retention store is not enabled")
+	}
+	switch int(rec.Method) {
+	case METHOD_VERSIONS:
+		return t.store.Versions(rec.Path)
+	case METHOD_TRASH:
+		return t.store.TrashList(rec.Path)
+	case METHOD_EMPTY_TRASH:
+		return t.store.EmptyTrash(rec.Path)
+	}
+	params := new(restoreParams)
+	err := json.Unmarshal(rec.Body, params)
+	if err != nil {
+		return nil, errors.New("params decode error: " + err.Error())
+	}
+	if params.Version != "" {
+		return t.store.RestoreVersion(rec.Path, params.Version)
+	}
+	if params.Trash != "" {
+		return t.store.RestoreTrash(rec.Path, params.Trash)
+	}
+	return nil, errors.New("params error: version or trash required")
+}
+
+// 处理快照请求
+func (t *CTFile) handleSnapshot(rec *FileData) (interface{}, error) {
+	if t.snaps == nil {
+		return nil, errors.New("snapshot is not enabled")
+	}
+	if int(rec.Method) == METHOD_SNAPSHOT_LIST {
+		return t.snaps.List(rec.Path)
+	}
+	params := new(snapshotParams)
+	if len(rec.Body) > 0 {
+		err := json.Unmarshal(rec.Body, params)
+		if err != nil {
+			return nil, errors.New("params decode error: " + err.Error())
+		}
+	}
+	switch int(rec.Method) {
+	case METHOD_SNAPSHOT_CREATE:
+		return t.snaps.Create(rec.Path, params.Name)
+	case METHOD_SNAPSHOT_DELETE:
+		return t.snaps.Delete(rec.Path, params.Id)
+	}
+	if t.Server.settings().isRootDir(path.Clean(rec.Path)) {
+		return nil, errors.New("snapshot of a rootDir cannot be restored, restore it's subdirectories")
+	}
+	// 开启保留时被替换的目录移到回收站
+	var keep func(p, old string) error
+	if t.store != nil {
+		keep = func(p, old string) error { return t.store.Keep(p, old, true) }
+	}
+	return t.snaps.Restore(rec.Path, params.Id, keep)
+}
+
+// 请求需要锁定的路径，目录操作锁定整个子目录
+func (t *CTFile) lockPaths(rec *FileData) []lockPath {
+	switch int(rec.Method) {
+	case METHOD_STAT, METHOD_LIST, METHOD_READ_FILE, METHOD_VERSIONS, METHOD_TRASH,
+		METHOD_SNAPSHOT_CREATE, METHOD_SNAPSHOT_LIST, METHOD_SNAPSHOT_DELETE:
+		return []lockPath{{rec.Path, true}}
+	case METHOD_COPY, METHOD_RENAME:
+		params := new(renameParams)
+		json.Unmarshal(rec.Body, params)
+		return []lockPath{{rec.Path, int(rec.Method) == METHOD_COPY}, {params.NewPath, false}}
+	}
+	return []lockPath{{rec.Path, false}}
+}
+
+// 锁定路径，body是lockParams的json编码后的数据，允许为空
+// token不为空时为续期
+func (t *CTFile) Lock(path string, body []byte, token string) (*Lease, error) {
+	params := new(lockParams)
+	if len(body) > 0 {
+		err := json.Unmarshal(body, params)
+		if err != nil {
+			return nil, errors.New("params decode error: " + err.Error())
+		}
+	}
+	return t.locks.Acquire(token, path, params.Shared, time.Duration(params.Lease)*time.Second)
+}
+
+// 检查前提条件后写入文件，返回写入后的内容哈希，调用前需要锁定路径
+// 修改文件时文件必须存在
+func (t *CTFile) ConditionalWrite(rec *FileData) (*WriteResult, error) {
+	var cond *Precondition
+	if rec.Meta != nil {
+		cond = rec.Meta.Precondition
+	}
+	if int(rec.Method) == METHOD_MODIFY_FILE {
+		if cond == nil {
+			cond = new(Precondition)
+		} else {
+			c := *cond
+			cond = &c
+		}
+		cond.IfExist = true
+	}
+	if cond != nil {
+		err := checkPrecondition(rec.Path, cond)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	isAppend := int(rec.Method) == METHOD_APPEND_FILE
+	// 覆盖写入前保留当前内容，追加写入不会丢失内容
+	if !isAppend && t.store != nil {
+		err := t.store.KeepVersion(rec.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if rec.BodyFile != "" {
+		err = t.writeBodyFile(rec.Path, rec.BodyFile, isAppend)
+	} else {
+		err = t.WriteFile(rec.Path, rec.Body, isAppend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := new(WriteResult)
+	res.Rewritten = rec.Rewritten
+	if isAppend || rec.BodyFile != "" {
+		f, err := os.Stat(rec.Path)
+		if err != nil {
+			return nil, err
+		}
+		res.Size = f.Size()
+		res.Hash, err = util.FileHash(rec.Path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		res.Size = int64(len(rec.Body))
+		res.Hash = util.Hash(rec.Body)
+	}
+	return res, nil
+}
+
+// 检查写入的前提条件
+func checkPrecondition(p string, cond *Precondition) error {
+	f, err := os.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exist := err == nil
+	if cond.IfNotExist && exist {
+		return preconditionFailed("file exists")
+	}
+	if !exist {
+		if cond.IfExist || cond.IfMatch != "" || cond.IfMtime != 0 || cond.IfSize != nil {
+			return preconditionFailed("file not exists")
+		}
+		return nil
+	}
+	if f.IsDir() {
+		return errors.New("path is a directory: " + p)
+	}
+	if cond.IfSize != nil && f.Size() != *cond.IfSize {
+		return preconditionFailed("size mismatch, current " + strconv.FormatInt(f.Size(), 10))
+	}
+	if cond.IfMtime != 0 && f.ModTime().Unix() != cond.IfMtime {
+		return preconditionFailed("mtime mismatch, current " + strconv.FormatInt(f.ModTime().Unix(), 10))
+	}
+	if cond.IfMatch != "" {
+		h, err := util.FileHash(p)
+		if err != nil {
+			return err
+		}
+		if h != cond.IfMatch {
+			return preconditionFailed("hash mismatch, current " + h)
+		}
+	}
+	return nil
 }
 
 // 创建文件，修改文件，追加写入
 func (t *CTFile) WriteFile(path string, body []byte, isAppend bool) error {
-	err := checkPath(path)
+	return t.writeFrom(path, bytes.NewReader(body), isAppend)
+}
+
+// 将文件name的内容写入path，用于暂存的内容
+func (t *CTFile) writeBodyFile(path, name string, isAppend bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.writeFrom(path, f, isAppend)
+}
+
+// 将r中的内容写入文件，从rootDir开始逐级打开，不存在的上级目录在打开时创建
+func (t *CTFile) writeFrom(path string, r io.Reader, isAppend bool) error {
+	root, err := t.rootOf(path)
+	if err != nil {
+		return err
+	}
+	// 以前的版本中快照恢复的文件和快照中的对象是硬链接
+	err = breakLink(path)
 	if err != nil {
 		return err
 	}
 	var f *os.File
 	if isAppend { // 追加模式
-		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0664)
+		f, err = openInRoot(root, path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0664)
 	} else { // 覆写模式
-		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
+		f, err = openInRoot(root, path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
 	}
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = f.Write(body)
+	_, err = io.Copy(f, r)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// 删除文件
+// 删除文件，开启保留时移到回收站
 func (t *CTFile) RemoveFile(path string) error {
 	if ok, _ := util.IsExist(path); !ok {
 		return nil // 文件不存在，直接返回
 	}
-	return os.Remove(path)
+	if t.store != nil && !isDir(path) {
+		return t.store.Trash(path)
+	}
+	root, err := t.rootOf(path)
+	if err != nil {
+		return err
+	}
+	return removeInRoot(root, path)
 }
 
 // 创建目录
@@ -90,11 +487,14 @@ func (t *CTFile) CreateDir(path string) error {
 	return os.MkdirAll(path, 0755)
 }
 
-// 删除目录，含子目录中的内容和目录本身
+// 删除目录，含子目录中的内容和目录本身，开启保留时移到回收站
 func (t *CTFile) RemoveDir(path string) error {
 	if ok, _ := util.IsExist(path); !ok {
 		return nil // 文件不存在，直接返回
 	}
+	if t.store != nil {
+		return t.store.Trash(path)
+	}
 	return os.RemoveAll(path)
 }
 
@@ -103,7 +503,13 @@ func (t *CTFile) ClearDir(path string) error {
 	if ok, _ := util.IsExist(path); !ok {
 		return nil // 文件不存在，直接返回
 	}
-	err := os.RemoveAll(path)
+	var err error
+	if t.store != nil {
+		// 整个目录移到回收站后重建，恢复时替换这个空目录
+		err = t.store.Trash(path)
+	} else {
+		err = os.RemoveAll(path)
+	}
 	if err != nil {
 		return err
 	}
@@ -118,7 +524,8 @@ func (t *CTFile) Copy(path string, body []byte) error {
 	if params.NewPath == "" {
 		return errors.New("destination path error: cannot empty")
 	}
-	err = t.Server.CheckPath(params.NewPath)
+	params.NewPath = cleanPath(params.NewPath)
+	err = t.Server.CheckDest(path, params.NewPath)
 	if err != nil {
 		return errors.New("destination path error: " + err.Error())
 	}
@@ -131,9 +538,23 @@ func (t *CTFile) Copy(path string, body []byte) error {
 	if err != nil {
 		return err
 	}
+	if t.store != nil {
+		err = t.store.KeepVersion(params.NewPath)
+		if err != nil {
+			return err
+		}
+	}
 	if f.IsDir() {
+		// 目录中有符号链接时复制失败，删除已复制的部分
 		err = util.CopyDir(path, params.NewPath)
+		if err != nil {
+			os.RemoveAll(params.NewPath)
+		}
 	} else {
+		err = breakLink(params.NewPath)
+		if err != nil {
+			return err
+		}
 		err = util.CopyFile(path, params.NewPath)
 	}
 	return err
@@ -147,7 +568,8 @@ func (t *CTFile) Rename(path string, body []byte) error {
 	if params.NewPath == "" {
 		return errors.New("destination path error: cannot empty")
 	}
-	err = t.Server.CheckPath(params.NewPath)
+	params.NewPath = cleanPath(params.NewPath)
+	err = t.Server.CheckDest(path, params.NewPath)
 	if err != nil {
 		return errors.New("destination path error: " + err.Error())
 	}
@@ -155,7 +577,159 @@ func (t *CTFile) Rename(path string, body []byte) error {
 	if err != nil {
 		return err
 	}
-	return os.Rename(path, params.NewPath)
+	if t.store != nil {
+		err = t.store.KeepVersion(params.NewPath)
+		if err != nil {
+			return err
+		}
+	}
+	return t.rename(path, params.NewPath)
+}
+
+// 获取一个路径的信息，路径不存在时返回Exist为false
+func (t *CTFile) Stat(path string) (*FileInfo, error) {
+	f, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &FileInfo{Path: path}, nil
+		}
+		return nil, err
+	}
+	return newFileInfo(path, path, f, true)
+}
+
+// 读取文件内容，从rootDir开始逐级打开
+func (t *CTFile) ReadFile(path string) ([]byte, error) {
+	root, err := t.rootOf(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openInRoot(root, path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("path is not a file: " + path)
+	}
+	return ioutil.ReadAll(f)
+}
+
+// 列出目录内容，body是params的json编码后的数据，允许为空
+// 返回的路径相对于请求的目录，同一目录中按名称排序，递归时子目录的内容紧跟在目录之后，
+// 分页时以上一页最后一个路径为after继续
+func (t *CTFile) List(dir string, body []byte) ([]*FileInfo, error) {
+	params := new(listParams)
+	if len(body) > 0 {
+		err := json.Unmarshal(body, &params)
+		if err != nil {
+			return nil, errors.New("params decode error: " + err.Error())
+		}
+	}
+	f, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !f.IsDir() {
+		return nil, errors.New("path is not a directory: " + dir)
+	}
+	list := make([]*FileInfo, 0)
+	err = listDir(dir, "", params, &list)
+	if err == errListFull {
+		err = nil
+	}
+	return list, err
+}
+
+// 按List的顺序列出目录内容，分页达到数量时返回errListFull
+func listDir(dir, rel string, params *listParams, list *[]*FileInfo) error {
+	fl, err := util.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(fl, func(i, j int) bool { return fl[i].Name() < fl[j].Name() })
+	for _, f := range fl {
+		p := dir + "/" + f.Name()
+		name := rel + f.Name()
+		if params.After != "" && comparePath(name, params.After) <= 0 {
+			// 已经列出，只进入after所在的目录
+			if !f.IsDir() || !params.Recursive || !inDir(params.After, name) {
+				continue
+			}
+		} else {
+			if params.Limit > 0 && len(*list) >= params.Limit {
+				return errListFull
+			}
+			info, err := newFileInfo(p, name, f, params.Hash)
+			if err != nil {
+				return err
+			}
+			*list = append(*list, info)
+		}
+		if f.IsDir() && params.Recursive {
+			err = listDir(p, name+"/", params, list)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 按List的顺序比较两个相对路径，上级目录在前，同一目录中按名称排序
+func comparePath(a, b string) int {
+	ea, eb := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ea) && i < len(eb); i++ {
+		if ea[i] != eb[i] {
+			return strings.Compare(ea[i], eb[i])
+		}
+	}
+	return len(ea) - len(eb)
+}
+
+func newFileInfo(p, name string, f os.FileInfo, hash bool) (*FileInfo, error) {
+	info := &FileInfo{
+		Path:  name,
+		Exist: true,
+		IsDir: f.IsDir(),
+		Size:  f.Size(),
+		Mode:  uint32(f.Mode().Perm()),
+		Mtime: f.ModTime().Unix(),
+	}
+	if hash && f.Mode().IsRegular() {
+		h, err := util.FileHash(p)
+		if err != nil {
+			return nil, err
+		}
+		info.Hash = h
+	}
+	return info, nil
+}
+
+// 路径所在的rootDir，用于从rootDir开始逐级打开路径
+func (t *CTFile) rootOf(p string) (string, error) {
+	root := t.Server.settings().rootOf(p)
+	if root == "" {
+		return "", errors.New("Path not in rootDir")
+	}
+	return root, nil
+}
+
+// 更名，源路径和目标路径分别从所在的rootDir开始逐级打开
+func (t *CTFile) rename(oldpath, newpath string) error {
+	oroot, err := t.rootOf(oldpath)
+	if err != nil {
+		return err
+	}
+	nroot, err := t.rootOf(newpath)
+	if err != nil {
+		return err
+	}
+	return renameInRoot(oroot, oldpath, nroot, newpath)
 }
 
 // 检测路径是否存在并可写
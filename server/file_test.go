@@ -0,0 +1,207 @@
+package server
+
+import (
+	"cmstop-fserver/util"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConditionalWrite(t *testing.T) {
+	_, root, addr := newTestServer(t)
+	p := root + "/page.html"
+	var size0 int64 = 0
+
+	tests := []struct {
+		method uint32
+		body   string
+		cond   *Precondition
+		code   int
+	}{
+		{METHOD_MODIFY_FILE, "x", nil, CODE_PRECONDITION_FAILED}, // 修改不存在的文件
+		{METHOD_CREATE_FILE, "v1", &Precondition{IfNotExist: true}, CODE_SUCCESS},
+		{METHOD_CREATE_FILE, "v1", &Precondition{IfNotExist: true}, CODE_PRECONDITION_FAILED},
+		{METHOD_MODIFY_FILE, "v2", &Precondition{IfMatch: util.Hash([]byte("v1"))}, CODE_SUCCESS},
+		{METHOD_MODIFY_FILE, "v3", &Precondition{IfMatch: util.Hash([]byte("v1"))}, CODE_PRECONDITION_FAILED},
+		{METHOD_APPEND_FILE, "+", &Precondition{IfSize: &size0}, CODE_PRECONDITION_FAILED},
+		{METHOD_APPEND_FILE, "+", &Precondition{IfExist: true}, CODE_SUCCESS},
+	}
+	for i, tt := range tests {
+		// 失败的普通请求会关闭连接，每次使用新连接
+		conn := dialTestServer(t, addr)
+		rec := &FileData{Method: tt.method, Password: "pw", Path: p, Body: []byte(tt.body)}
+		if tt.cond != nil {
+			rec.Meta = &RequestMeta{Precondition: tt.cond}
+		}
+		if err := sendTestRequest(conn, rec); err != nil {
+			t.Fatal(err)
+		}
+		resp := readTestResponse(t, conn)
+		if resp.Code != tt.code {
+			t.Errorf("%d: code %d, want %d: %s", i, resp.Code, tt.code, resp.Message)
+		}
+		if resp.Code == CODE_SUCCESS {
+			res := new(WriteResult)
+			json.Unmarshal(resp.Data, res)
+			h, _ := util.FileHash(p)
+			if res.Hash != h {
+				t.Errorf("%d: returned hash %s, file hash %s", i, res.Hash, h)
+			}
+		}
+	}
+	if b, _ := ioutil.ReadFile(p); string(b) != "v2+" {
+		t.Errorf("content = %q", b)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	p := root + "/page.html"
+	body := []byte("<html>")
+
+	tests := []struct {
+		meta *RequestMeta
+		code int
+	}{
+		{&RequestMeta{Sha256: util.Hash(body)}, CODE_SUCCESS},
+		{&RequestMeta{Sha256: util.Hash([]byte("<htm"))}, CODE_CHECKSUM_MISMATCH}, // 内容被截断
+		{&RequestMeta{Crc32c: "2d0c6803"}, CODE_SUCCESS},
+		{&RequestMeta{Crc32c: "00000000"}, CODE_CHECKSUM_MISMATCH},
+		{&RequestMeta{Sha256: util.Hash(body), Crc32c: "00000000"}, CODE_CHECKSUM_MISMATCH},
+	}
+	for i, tt := range tests {
+		os.Remove(p)
+		_, err := s.ctFile.Handle(&FileData{Method: METHOD_CREATE_FILE, Path: p, Body: body, Meta: tt.meta})
+		code := CODE_SUCCESS
+		if e, ok := err.(*CodeError); ok {
+			code = e.Code
+		} else if err != nil {
+			code = CODE_ERROR
+		}
+		if code != tt.code {
+			t.Errorf("%d: code %d, want %d: %v", i, code, tt.code, err)
+		}
+		if _, err = os.Stat(p); (err == nil) != (tt.code == CODE_SUCCESS) {
+			t.Errorf("%d: file written %v", i, err == nil)
+		}
+	}
+}
+
+// 并发的比较写入只有一个成功
+func TestConditionalWriteRace(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	p := root + "/page.html"
+	ioutil.WriteFile(p, []byte("v0"), 0664)
+	cond := &Precondition{IfMatch: util.Hash([]byte("v0"))}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	success := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := &FileData{Method: METHOD_MODIFY_FILE, Path: p, Body: []byte("editor" + strconv.Itoa(i)),
+				Meta: &RequestMeta{Precondition: cond}}
+			_, err := s.ctFile.Handle(rec)
+			if err == nil {
+				mu.Lock()
+				success++
+				mu.Unlock()
+			} else if ce, ok := err.(*CodeError); !ok || ce.Code != CODE_PRECONDITION_FAILED {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if success != 1 {
+		t.Errorf("%d writes succeeded, want 1", success)
+	}
+}
+
+func TestStatList(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	os.MkdirAll(root+"/a/b", 0755)
+	ioutil.WriteFile(root+"/a/x.html", []byte("x"), 0644)
+	ioutil.WriteFile(root+"/a/b/y.html", []byte("yy"), 0600)
+	call := func(method uint32, p string, body []byte) (interface{}, error) {
+		return s.handleRequest(&FileData{Method: method, Password: "pw", Path: p, Body: body})
+	}
+
+	data, err := call(METHOD_STAT, root+"/a/b/y.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := data.(*FileInfo)
+	if !info.Exist || info.IsDir || info.Size != 2 || info.Mode != 0600 || info.Path != root+"/a/b/y.html" ||
+		info.Hash != util.Hash([]byte("yy")) {
+		t.Errorf("stat file: %+v", info)
+	}
+	data, _ = call(METHOD_STAT, root+"/a/", nil)
+	if info = data.(*FileInfo); !info.Exist || !info.IsDir || info.Hash != "" || info.Path != root+"/a" {
+		t.Errorf("stat dir: %+v", info)
+	}
+	data, err = call(METHOD_STAT, root+"/none.html", nil)
+	if info = data.(*FileInfo); err != nil || info.Exist {
+		t.Errorf("stat missing: %+v %v", info, err)
+	}
+	if _, err = call(METHOD_STAT, "/etc/passwd", nil); err == nil {
+		t.Error("stat outside rootDir")
+	}
+
+	// 路径相对于请求的目录，顺序不固定，排序后比较
+	names := func(list []*FileInfo) string {
+		var s []string
+		for _, f := range list {
+			s = append(s, f.Path+":"+strconv.FormatBool(f.Hash != ""))
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	data, err = call(METHOD_LIST, root+"/a", nil)
+	if err != nil || names(data.([]*FileInfo)) != "b:false,x.html:false" {
+		t.Errorf("list: %v %v", data, err)
+	}
+	data, err = call(METHOD_LIST, root+"/a", []byte(`{"recursive":true,"hash":true}`))
+	if err != nil || names(data.([]*FileInfo)) != "b/y.html:true,b:false,x.html:true" {
+		t.Errorf("list recursive: %v %v", names(data.([]*FileInfo)), err)
+	}
+
+	// 分页按固定的顺序列出，以上一页最后一个路径继续
+	os.MkdirAll(root+"/a/b.d", 0755)
+	ioutil.WriteFile(root+"/a/b.d/z.html", []byte("z"), 0644)
+	var pages []string
+	for after := ""; ; {
+		body, _ := json.Marshal(&listParams{Recursive: true, After: after, Limit: 2})
+		data, err = call(METHOD_LIST, root+"/a", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := data.([]*FileInfo)
+		for _, f := range list {
+			pages = append(pages, f.Path)
+		}
+		if len(list) < 2 {
+			break
+		}
+		after = list[len(list)-1].Path
+	}
+	if got := strings.Join(pages, ","); got != "b,b/y.html,b.d,b.d/z.html,x.html" {
+		t.Errorf("list pages: %s", got)
+	}
+
+	if _, err = call(METHOD_LIST, root+"/a/x.html", nil); err == nil {
+		t.Error("list file")
+	}
+	if _, err = call(METHOD_LIST, root+"/none", nil); err == nil {
+		t.Error("list missing dir")
+	}
+	if _, err = call(METHOD_LIST, root+"/a", []byte("{")); err == nil {
+		t.Error("bad params")
+	}
+}
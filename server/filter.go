@@ -3,23 +3,158 @@
 /*
 Package server provider file server Daemon.
 this file provider injection filter and warning.
+
+every write passes the content filter before anything is written (CheckWrite),
+a copy or rename to another extension checks the source content for the
+destination extension (CheckDest). the body is sniffed (magic numbers of ELF, PE, Mach-O, shebang, php open tags
+and http.DetectContentType) and the detected type is checked against the
+types allowed for the extension in the [types] section. executable types are
+rejected for every extension which does not allow them explicitly.
+html and shtml documents are scanned for SSI exec and include directives,
+script and iframe sources outside the allowed domains and hidden links.
+text content is scored for injection: keywords from injection.conf and
+obfuscation metrics (entropy, long tokens, non-printable bytes, escape
+sequences) add to the score, the body is rejected when it reaches the limit.
+images (jpg, png, gif, webp) are decoded and checked against the size limits,
+and optionally re-encoded, the re-encoded body is written instead.
+a rejected body is optionally kept in quarantineDir, findings are logged and
+reported by mail. reports are queued to one reporter, which mails a digest at
+most once every REPORT_INTERVAL, reports are dropped when the queue is full.
 */
 package server
 
 import (
-	"log"
+	"cmstop-fserver/util"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/9466/goconfig"
+	"html"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FILTER_REJECT     = "reject"     // 拒绝写入
+	FILTER_QUARANTINE = "quarantine" // 拒绝写入，内容保存到隔离目录
+	REPORT_QUEUE      = 256          // 等待发送的报告数，队列满时丢弃新的报告
+	REPORT_INTERVAL   = time.Minute  // 报告邮件的最小间隔，期间的报告合并为一封邮件
+	REPORT_MAX_ITEMS  = 50           // 一封报告邮件中最多列出的报告数
 )
 
+// 内容检查发现的问题
+type Finding struct {
+	Rule     string `json:"rule"`               // 规则，如sniff
+	Message  string `json:"message"`            // 说明
+	Claimed  string `json:"claimed,omitempty"`  // 扩展名对应的类型
+	Detected string `json:"detected,omitempty"` // 检测到的类型
+	Line     int    `json:"line,omitempty"`     // 所在行号，从1开始，0 不确定
+}
+
+// 带行号的说明
+func (f *Finding) String() string {
+	if f.Line > 0 {
+		return "line " + strconv.Itoa(f.Line) + ": " + f.Message
+	}
+	return f.Message
+}
+
+// 隔离的内容说明，和内容保存在一起
+type quarantineInfo struct {
+	Path     string     `json:"path"`     // 写入的路径
+	Time     int64      `json:"time"`     // 隔离时间，unix时间戳
+	Findings []*Finding `json:"findings"` // 发现的问题
+}
+
 type CTFilter struct {
-	Logger *log.Logger // 日志操作句柄
+	Server     *Server
+	sniff      bool                // 是否检查写入内容的类型
+	types      map[string][]string // 每个扩展名允许的内容类型
+	action     string              // 发现问题时的处理，reject或quarantine
+	quarantine string              // 隔离目录
+	mail       bool                // 是否发送报告邮件
+	mailConf   *mailConf           // 报告邮件的配置，和所在的配置一起加载
+	image      imagePolicy         // 图片检查
+	html       htmlPolicy          // html检查
+	injection  injectionPolicy     // 木马检测
 }
 
-func NewCtFilter(logger *log.Logger) *CTFilter {
+func NewCtFilter(s *Server) *CTFilter {
 	f := new(CTFilter)
-	f.Logger = logger
+	f.Server = s
+	f.types = make(map[string][]string)
+	f.action = FILTER_REJECT
+	f.image.maxPixels = DEF_IMAGE_MAX_PIXELS
+	f.image.quality = DEF_JPEG_QUALITY
+	f.html.exts = lowerSet(HTML_EXT, "")
+	f.injection = newInjectionPolicy()
 	return f
 }
 
+// 读取[filter]和[types]配置，rootDir是同一次加载的允许操作的目录
+func (t *CTFilter) Init(conf *goconfig.ConfigFile, rootDir []string) error {
+	t.sniff, _ = conf.GetBool("filter", "sniffOpen")
+	t.mail, _ = conf.GetBool("filter", "reportMail")
+	err := t.image.init(conf)
+	if err != nil {
+		return err
+	}
+	err = t.html.init(conf)
+	if err != nil {
+		return err
+	}
+	err = t.injection.init(conf)
+	if err != nil {
+		return err
+	}
+	// 隔离目录，action为quarantine和扫描隔离文件时使用
+	t.quarantine, _ = conf.GetString("filter", "quarantineDir")
+	if t.quarantine != "" {
+		t.quarantine = path.Clean(t.quarantine)
+		for _, d := range rootDir {
+			if inDir(t.quarantine, d) || inDir(d, t.quarantine) {
+				return errors.New("quarantineDir cannot inside or contain rootDir: " + d)
+			}
+		}
+		err = os.MkdirAll(t.quarantine, 0700)
+		if err != nil {
+			return errors.New("quarantineDir cannot create: " + err.Error())
+		}
+	}
+	action, _ := conf.GetString("filter", "action")
+	switch action {
+	case "", FILTER_REJECT:
+	case FILTER_QUARANTINE:
+		t.action = action
+		if t.quarantine == "" {
+			return errors.New("quarantineDir cannot empty when action is quarantine")
+		}
+	default:
+		return errors.New("filter action not supported: " + action)
+	}
+	if conf.HasSection("types") {
+		exts, _ := conf.GetOptions("types")
+		for _, e := range exts {
+			v, _ := conf.GetString("types", e)
+			list := make([]string, 0)
+			for _, s := range strings.Split(v, ",") {
+				if s = mediaType(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			t.types[strings.ToLower(strings.TrimPrefix(e, "."))] = list
+		}
+	}
+	return nil
+}
+
 func (t *CTFilter) Frequency(path string) {
 
 }
@@ -27,3 +162,195 @@ func (t *CTFilter) Frequency(path string) {
 func (t *CTFilter) Injection(path string) {
 
 }
+
+// 写入前检查内容，method为写入方法，追加写入的内容不在文件开头
+// 返回需要写入的内容，图片重新编码时和body不同
+// 发现问题时拒绝写入，返回CODE_CONTENT_REJECTED错误
+func (t *CTFilter) Check(method uint32, p string, body []byte) ([]byte, error) {
+	out, findings := t.Inspect(method, p, body)
+	if len(findings) > 0 {
+		return nil, t.reject(p, body, findings)
+	}
+	return out, nil
+}
+
+// 写入p的内容是否需要检查，不需要时暂存的内容不读取到内存中
+func (t *CTFilter) inspects(p string) bool {
+	ext := fileExt(p)
+	_, image := IMAGE_EXT[ext]
+	return t.sniff || t.html.open && t.html.exts[ext] || t.injection.open && t.injection.exts[ext] || t.image.open && image
+}
+
+// 检查内容，返回需要写入的内容和发现的问题，不记录也不隔离，扫描已有文件时使用
+func (t *CTFilter) Inspect(method uint32, p string, body []byte) ([]byte, []*Finding) {
+	if len(body) == 0 {
+		return body, nil
+	}
+	start := method != METHOD_APPEND_FILE
+	ext := fileExt(p)
+	findings := make([]*Finding, 0)
+	if t.sniff {
+		if f := t.sniffCheck(ext, body, start); f != nil {
+			findings = append(findings, f)
+		}
+	}
+	findings = append(findings, t.html.check(ext, body)...)
+	findings = append(findings, t.injection.check(ext, body)...)
+	out, f := t.image.check(ext, body, start)
+	if f != nil {
+		findings = append(findings, f)
+	}
+	return out, findings
+}
+
+// 检查内容类型是否允许使用扩展名
+func (t *CTFilter) sniffCheck(ext string, body []byte, start bool) *Finding {
+	detected := sniffType(body, start)
+	if detected == "" {
+		return nil
+	}
+	allowed, ok := t.types[ext]
+	if ok && typeAllowed(allowed, detected) || !ok && !executableType(detected) {
+		return nil
+	}
+	claimed := claimedType(ext)
+	return &Finding{
+		Rule:     "sniff",
+		Message:  "content type not allowed: claimed " + claimed + ", detected " + detected,
+		Claimed:  claimed,
+		Detected: detected,
+	}
+}
+
+// 拒绝写入的报告
+type rejectReport struct {
+	mail     *mailConf  // 拒绝写入时的邮件配置
+	path     string     // 写入的路径
+	time     time.Time  // 拒绝的时间
+	findings []*Finding // 发现的问题
+}
+
+// 发送报告邮件，所有的报告由一个goroutine合并发送，重新加载配置后继续使用
+type reporter struct {
+	dropped  uint64 // 丢弃和没有列出的报告数，原子操作，放在开头保证对齐
+	server   *Server
+	queue    chan *rejectReport
+	once     sync.Once
+	interval time.Duration             // 邮件的最小间隔
+	send     func(m *util.MailT) error // 发送邮件，测试时替换
+}
+
+func newReporter(s *Server) *reporter {
+	return &reporter{server: s, queue: make(chan *rejectReport, REPORT_QUEUE), interval: REPORT_INTERVAL, send: util.SendMail}
+}
+
+// 加入报告，不阻塞，队列满时丢弃
+func (r *reporter) add(rep *rejectReport) {
+	r.once.Do(func() { go r.run() })
+	select {
+	case r.queue <- rep:
+	default:
+		atomic.AddUint64(&r.dropped, 1)
+	}
+}
+
+// 收到报告后等待interval，期间的报告合并发送，服务停止时退出
+func (r *reporter) run() {
+	for {
+		var list []*rejectReport
+		select {
+		case rep := <-r.queue:
+			list = append(list, rep)
+		case <-r.server.ctx.Done():
+			return
+		}
+		timer := time.NewTimer(r.interval)
+	collect:
+		for {
+			select {
+			case rep := <-r.queue:
+				if len(list) < REPORT_MAX_ITEMS {
+					list = append(list, rep)
+				} else {
+					atomic.AddUint64(&r.dropped, 1)
+				}
+			case <-timer.C:
+				break collect
+			case <-r.server.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		r.mail(list, atomic.SwapUint64(&r.dropped, 0))
+	}
+}
+
+// 发送一封报告邮件，使用最后一个报告的邮件配置，dropped是没有列出的报告数
+func (r *reporter) mail(list []*rejectReport, dropped uint64) {
+	m := list[len(list)-1].mail
+	if m == nil || m.to == "" {
+		return
+	}
+	body := "<p>异常信息：写入内容检查未通过，已拒绝写入" + strconv.Itoa(len(list)) + "次"
+	if dropped > 0 {
+		body += "，另有" + strconv.FormatUint(dropped, 10) + "次未列出"
+	}
+	body += "<br/>服务信息：" + m.serverInfo + "</p>"
+	for _, rep := range list {
+		body += "<p>发生时间：" + rep.time.Format("2006-01-02 15:04:05") + "<br/>" +
+			"文件路径：" + html.EscapeString(rep.path) + "</p><ul>"
+		for _, f := range rep.findings {
+			body += "<li>" + html.EscapeString(f.Rule+": "+f.String()) + "</li>"
+		}
+		body += "</ul>"
+	}
+	err := r.send(&util.MailT{Addr: m.host, User: m.user, Pass: m.pass, From: m.from, To: m.to, Title: m.title, Body: body, Type: "html"})
+	if err != nil {
+		r.server.Logger.Println("report mail error: " + err.Error())
+	}
+}
+
+// 记录并报告发现的问题，需要时隔离内容，返回拒绝写入的错误
+func (t *CTFilter) reject(p string, body []byte, findings []*Finding) error {
+	msgs := make([]string, 0, len(findings))
+	for _, f := range findings {
+		msgs = append(msgs, f.String())
+	}
+	msg := strings.Join(msgs, "; ")
+	t.Server.Logger.Println("content rejected: " + p + ": " + msg)
+	if t.action == FILTER_QUARANTINE {
+		saved, err := t.keep(p, body, findings)
+		if err != nil {
+			t.Server.Logger.Println("quarantine error: " + err.Error())
+		} else {
+			msg += " (quarantined " + path.Base(saved) + ")"
+		}
+	}
+	if t.mail {
+		t.Server.reporter.add(&rejectReport{mail: t.mailConf, path: p, time: time.Now(), findings: findings})
+	}
+	return &CodeError{CODE_CONTENT_REJECTED, "content rejected: " + msg}
+}
+
+// 保存被拒绝的内容和说明到隔离目录，返回保存的路径
+func (t *CTFilter) keep(p string, body []byte, findings []*Finding) (string, error) {
+	now := time.Now()
+	dir := t.quarantine + "/" + now.Format("20060102")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	name := dir + "/" + now.Format("150405") + "-" + hex.EncodeToString(sum[:4]) + "-" + path.Base(p)
+	err = ioutil.WriteFile(name, body, 0600)
+	if err != nil {
+		return "", err
+	}
+	info, _ := json.Marshal(&quarantineInfo{Path: p, Time: now.Unix(), Findings: findings})
+	err = ioutil.WriteFile(name+".json", info, 0600)
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"cmstop-fserver/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContentFilter(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	q, err := ioutil.TempDir("", "fserver-quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(q)
+	s.settings().filter.sniff = true
+	s.settings().filter.action = FILTER_QUARANTINE
+	s.settings().filter.quarantine = q
+	s.settings().filter.types = map[string][]string{"html": {"text/html", "text/plain"}, "jpg": {"image/jpeg"}, "sh": {TYPE_SHELL}}
+
+	write := func(method uint32, p, body string) error {
+		_, err := s.handleRequest(&FileData{Method: method, Password: "pw", Path: root + "/" + p, Body: []byte(body)})
+		return err
+	}
+	for p, body := range map[string]string{
+		"index.html": "<html><body>hello</body></html>",
+		"a.jpg":      "\xff\xd8\xff\xe0\x00\x10JFIF\x00",
+		"run.sh":     "#!/bin/sh\necho ok",
+		"notes.txt":  "plain text",
+	} {
+		if err := write(METHOD_CREATE_FILE, p, body); err != nil {
+			t.Errorf("%s rejected: %v", p, err)
+		}
+	}
+
+	rejected := map[string]string{
+		"shell.html": "<?php system($_GET['c']);",
+		"logo.jpg":   "<html>not an image</html>",
+		"bin.txt":    "\x7fELF\x02\x01\x01\x00",
+		"x.css":      "#!/usr/bin/perl\n",
+	}
+	for p, body := range rejected {
+		err := write(METHOD_CREATE_FILE, p, body)
+		if ce, ok := err.(*CodeError); !ok || ce.Code != CODE_CONTENT_REJECTED {
+			t.Errorf("%s: %v", p, err)
+			continue
+		}
+		if _, err := os.Stat(root + "/" + p); err == nil {
+			t.Errorf("%s written", p)
+		}
+	}
+	err = write(METHOD_CREATE_FILE, "logo.jpg", "<html></html>")
+	if err == nil || !strings.Contains(err.Error(), "claimed image/jpeg, detected text/html") {
+		t.Errorf("message: %v", err)
+	}
+
+	// 追加的内容只检查php标签
+	if err = write(METHOD_APPEND_FILE, "a.jpg", "\x00\x01binary"); err != nil {
+		t.Error(err)
+	}
+	if err = write(METHOD_APPEND_FILE, "a.jpg", "<?php eval($_POST[x]);"); err == nil {
+		t.Errorf("php appended")
+	}
+
+	// 被拒绝的内容和说明保存在隔离目录
+	saved, _ := filepath.Glob(q + "/*/*-shell.html")
+	if len(saved) != 1 || readTestFile(saved[0]) != rejected["shell.html"] {
+		t.Fatalf("quarantined %v", saved)
+	}
+	if info := readTestFile(saved[0] + ".json"); !strings.Contains(info, TYPE_PHP) {
+		t.Errorf("quarantine info %s", info)
+	}
+}
+
+// 大量拒绝的写入合并为少量邮件，队列满时丢弃，不为每次拒绝启动goroutine
+func TestRejectReport(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	defer s.cancel()
+	c := s.settings()
+	c.filter.sniff = true
+	c.filter.mail = true
+	c.filter.mailConf = &mailConf{to: "ops@example.com"}
+	var mu sync.Mutex
+	var mails []string
+	s.reporter.interval = 100 * time.Millisecond
+	s.reporter.send = func(m *util.MailT) error {
+		mu.Lock()
+		mails = append(mails, m.Body)
+		mu.Unlock()
+		return nil
+	}
+
+	for i := 0; i < 2*REPORT_QUEUE; i++ {
+		_, err := s.handleRequest(&FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/shell.html", Body: []byte("<?php eval($_POST[1]);")})
+		if err == nil {
+			t.Fatal("php accepted")
+		}
+	}
+	time.Sleep(3 * s.reporter.interval)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(mails) != 1 {
+		t.Fatalf("%d mails, want 1", len(mails))
+	}
+	if n := strings.Count(mails[0], "shell.html"); n != REPORT_MAX_ITEMS {
+		t.Errorf("%d reports listed, want %d", n, REPORT_MAX_ITEMS)
+	}
+	if !strings.Contains(mails[0], "另有") {
+		t.Error("dropped reports not counted")
+	}
+}
@@ -1,33 +1,136 @@
 package server
 
+import (
+	"encoding/json"
+)
+
 // 定义文件操作代码
 const (
-	METHOD_MIN         = iota // 标识，用来判断method的范围
-	METHOD_CREATE_FILE = iota // 创建文件，当文件不存在时，尝试创建
-	METHOD_MODIFY_FILE        // 修改文件，当文件不存在时，返回错误，当文件存在时从头部开始写入
-	METHOD_APPEND_FILE        // 增量写入文件，当文件不存在时，尝试创建，当文件存在时从尾部追加写入
-	METHOD_REMOVE_FILE        // 删除文件，当文件不存在时，返回错误
-	METHOD_CREATE_DIR         // 创建目录
-	METHOD_REMOVE_DIR         // 删除目录，含子目录中的内容和目录本身
-	METHOD_CLEAR_DIR          // 清空目录，只清空目录中的内容含子目录，但目录本身不删除
-	METHOD_COPY               // 复制一个路径，文件或文件夹，如果是文件夹递归复制所有子目录中的内容
-	METHOD_RENAME             // 更名，重命名一个路径，文件或文件夹，如果不存在返回错误
-	METHOD_MAX                // 标识，用来判断method的范围
+	METHOD_MIN              = iota // 标识，用来判断method的范围
+	METHOD_CREATE_FILE      = iota // 创建文件，当文件不存在时，尝试创建
+	METHOD_MODIFY_FILE             // 修改文件，当文件不存在时，返回错误，当文件存在时从头部开始写入
+	METHOD_APPEND_FILE             // 增量写入文件，当文件不存在时，尝试创建，当文件存在时从尾部追加写入
+	METHOD_REMOVE_FILE             // 删除文件，当文件不存在时，返回错误
+	METHOD_CREATE_DIR              // 创建目录
+	METHOD_REMOVE_DIR              // 删除目录，含子目录中的内容和目录本身
+	METHOD_CLEAR_DIR               // 清空目录，只清空目录中的内容含子目录，但目录本身不删除
+	METHOD_COPY                    // 复制一个路径，文件或文件夹，如果是文件夹递归复制所有子目录中的内容
+	METHOD_RENAME                  // 更名，重命名一个路径，文件或文件夹，如果不存在返回错误
+	METHOD_STAT                    // 获取一个路径的信息，文件含内容哈希
+	METHOD_LIST                    // 列出目录内容，body可选json参数，支持递归和内容哈希
+	METHOD_BATCH                   // 批量操作，body是json编码的操作列表，全部成功或全部回滚
+	METHOD_LOCK                    // 锁定路径及其子目录，返回租约令牌，带令牌时续期
+	METHOD_UNLOCK                  // 释放租约锁，令牌在RequestMeta中
+	METHOD_VERSIONS                // 列出文件的历史版本
+	METHOD_TRASH                   // 列出路径及其子目录在回收站中的条目
+	METHOD_RESTORE                 // 恢复历史版本或回收站条目，body是json编码的参数
+	METHOD_EMPTY_TRASH             // 清空路径及其子目录在回收站中的条目
+	METHOD_SNAPSHOT_CREATE         // 创建目录的快照，body可选json参数，含快照说明
+	METHOD_SNAPSHOT_LIST           // 列出目录及其子目录的快照
+	METHOD_SNAPSHOT_RESTORE        // 将目录恢复到快照时的状态，body是json编码的参数，含快照ID
+	METHOD_SNAPSHOT_DELETE         // 删除快照，body是json编码的参数，含快照ID
+	METHOD_READ_FILE               // 读取文件内容
+	METHOD_JOURNAL_READ            // 读取操作日志，副本复制使用，body是json编码的参数
+	METHOD_REPLICA_STATUS          // 获取复制状态
+	METHOD_EXTRACT                 // 将body中的tar、tar.gz或zip解压到目录，参数在RequestMeta中
+	METHOD_ARCHIVE                 // 将目录打包为tar或tar.gz流式返回，参数在RequestMeta中
+	METHOD_SCAN                    // 扫描目录中已有的文件，body是json编码的参数，开始、停止扫描或获取状态
+	METHOD_MAX                     // 标识，用来判断method的范围
+)
+
+// 请求标志，占用操作类型的高16位
+const (
+	METHOD_MASK     uint32 = 0xFFFF  // 操作类型中操作代码的部分
+	FLAG_REQUEST_ID uint32 = 1 << 16 // 请求头后附加4字节请求ID，服务端并发处理，响应带回请求ID
+	FLAG_META       uint32 = 1 << 17 // 请求头后附加4字节长度和json编码的RequestMeta
+	FLAG_GZIP       uint32 = 1 << 18 // 内容使用gzip压缩，内容长度为压缩后的长度
+	FLAG_ZSTD       uint32 = 1 << 19 // 内容使用zstd压缩，内容长度为压缩后的长度
+	FLAG_COMPRESS          = FLAG_GZIP | FLAG_ZSTD
+	FLAG_ALL               = FLAG_REQUEST_ID | FLAG_META | FLAG_COMPRESS
+)
+
+// 响应状态码
+const (
+	CODE_SUCCESS             = 0 // 成功
+	CODE_ERROR               = 1 // 失败
+	CODE_PRECONDITION_FAILED = 2 // 写入的前提条件不满足，文件没有被修改
+	CODE_LOCKED              = 3 // 路径被其他客户端的租约锁定
+	CODE_JOURNAL_COMPACTED   = 4 // 请求的日志记录已被清理，副本需要全量同步
+	CODE_CHECKSUM_MISMATCH   = 5 // 请求内容和校验值不一致，内容在传输中损坏或不完整，没有执行
+	CODE_CONTENT_REJECTED    = 6 // 写入内容没有通过内容检查，如类型和扩展名不符，没有写入
 )
 
 // 交互数据结构
 type FileData struct {
-	Method     uint32 // 操作方法，是一组定义的枚举常量
-	PassLength uint32 // 密钥长度
-	PathLength uint32 // 路径长度
-	BodySize   uint32 // 内容长度
-	Password   string // 密钥
-	Path       string // 操作路径
-	Body       []byte // 文件内容，允许为空
+	Method     uint32       // 操作方法，是一组定义的枚举常量
+	Flags      uint32       // 请求标志
+	RequestId  uint32       // 请求ID，流水线模式使用
+	PassLength uint32       // 密钥长度
+	PathLength uint32       // 路径长度
+	BodySize   uint32       // 内容长度
+	Password   string       // 密钥
+	Path       string       // 操作路径
+	Body       []byte       // 文件内容，允许为空
+	Meta       *RequestMeta // 请求附加信息，没有时为nil
+	Client     string       // 客户端地址，不在协议中传输
+	Rewritten  bool         // 内容被内容检查改写，不在协议中传输
+	BodyFile   string       // 内容所在的文件，不为空时不使用Body，压缩的写入解压到暂存文件，不在协议中传输
+}
+
+// 请求附加信息，使用FLAG_META发送
+type RequestMeta struct {
+	Precondition *Precondition  `json:"precondition,omitempty"` // 写入的前提条件
+	LockToken    string         `json:"lock_token,omitempty"`   // 持有的租约令牌，可以操作被该租约锁定的路径
+	Sha256       string         `json:"sha256,omitempty"`       // 请求内容的sha256，服务端校验后才执行
+	Crc32c       string         `json:"crc32c,omitempty"`       // 请求内容的crc32c，8位十六进制，服务端校验后才执行
+	Extract      *ExtractParams `json:"extract,omitempty"`      // 解压参数
+	Archive      *ArchiveParams `json:"archive,omitempty"`      // 打包参数
+	Time         int64          `json:"time,omitempty"`         // 签名时间，unix时间戳
+	Signature    string         `json:"signature,omitempty"`    // 请求签名，有签名时不发送密钥，见auth.go
+}
+
+// 写入的前提条件，在路径锁内检查，全部满足才写入
+type Precondition struct {
+	IfMatch    string `json:"if_match,omitempty"`     // 文件内容的sha256必须与此相同
+	IfMtime    int64  `json:"if_mtime,omitempty"`     // 文件修改时间(unix时间戳)必须与此相同
+	IfSize     *int64 `json:"if_size,omitempty"`      // 文件大小必须与此相同
+	IfExist    bool   `json:"if_exist,omitempty"`     // 文件必须存在
+	IfNotExist bool   `json:"if_not_exist,omitempty"` // 文件必须不存在
+}
+
+// 文件写入的返回数据
+type WriteResult struct {
+	Hash string `json:"hash"` // 写入后文件内容的sha256
+	Size int64  `json:"size"` // 写入后文件大小
+	// 内容被服务端改写，如图片重新编码，Hash是改写后内容的sha256
+	Rewritten bool `json:"rewritten,omitempty"`
+}
+
+// 带有响应状态码的错误
+type CodeError struct {
+	Code    int
+	Message string
+}
+
+func (e *CodeError) Error() string {
+	return e.Message
 }
 
 // 响应数据结构
 type ResponseData struct {
-	Code    int    `json:"code"`    // 状态码，0 表示成功，非0表示失败
-	Message string `json:"message"` // 消息字符串
+	Code    int             `json:"code"`           // 状态码，0 表示成功，非0表示失败
+	Message string          `json:"message"`        // 消息字符串
+	Id      uint32          `json:"id,omitempty"`   // 流水线请求的请求ID，请求ID应从1开始
+	Data    json.RawMessage `json:"data,omitempty"` // 附加数据，如stat和list的结果
+}
+
+// 路径信息，stat和list的返回数据
+type FileInfo struct {
+	Path  string `json:"path"`           // 路径，stat时为请求路径，list时为相对路径
+	Exist bool   `json:"exist"`          // 是否存在，只有stat会返回不存在的路径
+	IsDir bool   `json:"dir"`            // 是否是目录
+	Size  int64  `json:"size"`           // 文件大小
+	Mode  uint32 `json:"mode"`           // 权限
+	Mtime int64  `json:"mtime"`          // 修改时间，unix时间戳
+	Hash  string `json:"hash,omitempty"` // 文件内容的sha256，目录为空
 }
@@ -0,0 +1,411 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"bytes"
+	"github.com/9466/goconfig"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const HTML_MAX_FINDINGS = 20 // 一个文件最多记录的问题数
+
+var (
+	HTML_EXT = []string{"html", "htm", "shtml", "shtm"} // 默认检查的扩展名
+	// 不解析内容的元素，内容中的<不是标签
+	htmlRawText = map[string]bool{"script": true, "style": true, "textarea": true, "title": true, "xmp": true}
+	// 没有结束标签的元素
+	htmlVoid = map[string]bool{"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+		"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true}
+	// 隐藏元素的样式，去掉空白后匹配
+	hiddenStyle = regexp.MustCompile(`(?:^|;)(?:display:none|visibility:hidden|font-size:0(?:px|pt|em)?(?:;|!|$)|(?:left|top|text-indent):-\d{3,})`)
+)
+
+// html和shtml内容检查，解析标签和注释，发现以下问题时拒绝写入：
+// SSI exec指令，include到不允许的路径，script、iframe引用允许的域名以外的地址，
+// 隐藏元素中指向其他域名的链接（SEO垃圾链接）
+type htmlPolicy struct {
+	open    bool            // 是否检查
+	exts    map[string]bool // 检查的扩展名
+	domains []string        // 允许引用的域名，含子域名，*为不限制
+	virtual []string        // SSI include virtual允许的目录，为空时只禁止..
+}
+
+// 读取[filter]中的html配置
+func (p *htmlPolicy) init(conf *goconfig.ConfigFile) error {
+	p.open, _ = conf.GetBool("filter", "htmlOpen")
+	exts, _ := conf.GetString("filter", "htmlExt")
+	if exts != "" {
+		p.exts = lowerSet(strings.Split(exts, ","), ".")
+	}
+	domains, _ := conf.GetString("filter", "htmlDomains")
+	p.domains = make([]string, 0)
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), "."); d != "" {
+			p.domains = append(p.domains, d)
+		}
+	}
+	dirs, _ := conf.GetString("filter", "ssiVirtualDir")
+	p.virtual = make([]string, 0)
+	for _, d := range strings.Split(dirs, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			p.virtual = append(p.virtual, path.Clean("/"+d))
+		}
+	}
+	return nil
+}
+
+// 检查html内容，返回发现的问题，每个问题带有行号
+// 追加写入时检查写入的一段，行号从这一段开始计算
+func (p *htmlPolicy) check(ext string, body []byte) []*Finding {
+	if !p.open || !p.exts[ext] {
+		return nil
+	}
+	sc := &htmlScanner{policy: p, body: body, line: 1}
+	sc.scan()
+	return sc.findings
+}
+
+// 允许引用的域名
+func (p *htmlPolicy) allowHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range p.domains {
+		if d == "*" || host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查引用的地址，允许时返回空，相对地址允许，javascript:、data:等地址不允许
+func (p *htmlPolicy) checkURL(src string) string {
+	// 浏览器会忽略地址中的换行和制表符，并把\当作/
+	src = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(src))
+	src = strings.Replace(src, "\\", "/", -1)
+	u, err := url.Parse(src)
+	if err != nil {
+		return "invalid url " + strconv.Quote(src)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https":
+	default:
+		return "scheme " + u.Scheme + ":"
+	}
+	if u.Host == "" || p.allowHost(u.Hostname()) {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// 检查SSI include的路径，允许时返回true
+func (p *htmlPolicy) allowInclude(attrs map[string]string) bool {
+	if f, ok := attrs["file"]; ok {
+		// file是相对当前文件的路径
+		if path.IsAbs(f) || hasDotDot(f) {
+			return false
+		}
+	}
+	if v, ok := attrs["virtual"]; ok {
+		if hasDotDot(v) {
+			return false
+		}
+		if len(p.virtual) == 0 {
+			return true
+		}
+		if !path.IsAbs(v) {
+			return false
+		}
+		v = path.Clean(v)
+		for _, d := range p.virtual {
+			if inDir(v, d) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// 路径中是否有..
+func hasDotDot(p string) bool {
+	for _, s := range strings.Split(strings.Replace(p, "\\", "/", -1), "/") {
+		if s == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// 打开的元素，用于判断是否在隐藏元素中
+type htmlElem struct {
+	name   string
+	hidden bool
+}
+
+// 简单的html扫描，只识别标签、属性和注释，不构建文档树
+type htmlScanner struct {
+	policy   *htmlPolicy
+	body     []byte
+	line     int // lpos处的行号
+	lpos     int
+	stack    []htmlElem
+	findings []*Finding
+}
+
+// pos处的行号，pos递增时只计算新增的部分
+func (sc *htmlScanner) lineAt(pos int) int {
+	if pos < sc.lpos {
+		sc.line, sc.lpos = 1, 0
+	}
+	sc.line += bytes.Count(sc.body[sc.lpos:pos], []byte("\n"))
+	sc.lpos = pos
+	return sc.line
+}
+
+func (sc *htmlScanner) add(pos int, msg string) {
+	if len(sc.findings) >= HTML_MAX_FINDINGS {
+		return
+	}
+	line := sc.lineAt(pos)
+	sc.findings = append(sc.findings, &Finding{Rule: "html", Message: msg, Line: line})
+}
+
+func (sc *htmlScanner) scan() {
+	b := sc.body
+	i := 0
+	for i < len(b) && len(sc.findings) < HTML_MAX_FINDINGS {
+		k := bytes.IndexByte(b[i:], '<')
+		if k < 0 {
+			break
+		}
+		i += k
+		rest := b[i:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			c := rest[4:]
+			next := len(b)
+			if e := bytes.Index(c, []byte("-->")); e >= 0 {
+				c = c[:e]
+				next = i + 4 + e + 3
+			}
+			if len(c) > 0 && c[0] == '#' {
+				sc.ssi(i, c[1:])
+			}
+			i = next
+			continue
+		case len(rest) > 1 && (rest[1] == '!' || rest[1] == '?'):
+			// doctype、cdata和处理指令
+			e := bytes.IndexByte(rest, '>')
+			if e < 0 {
+				return
+			}
+			i += e + 1
+			continue
+		}
+		name, attrs, end, next := parseTag(b, i)
+		if name == "" {
+			i++
+			continue
+		}
+		if end {
+			sc.pop(name)
+		} else {
+			sc.tag(i, name, attrs, bytes.HasSuffix(bytes.TrimRight(b[i:next-1], " \t\r\n"), []byte("/")))
+		}
+		i = next
+		if !end && htmlRawText[name] {
+			e := indexFold(b[i:], "</"+name)
+			if e < 0 {
+				return
+			}
+			i += e
+		}
+	}
+}
+
+// 检查开始标签
+func (sc *htmlScanner) tag(pos int, name string, attrs map[string]string, selfClose bool) {
+	hidden := isHidden(attrs)
+	switch name {
+	case "script", "iframe", "frame":
+		if src, ok := attrs["src"]; ok {
+			if r := sc.policy.checkURL(src); r != "" {
+				sc.add(pos, name+" source not allowed: "+r)
+			}
+		}
+	case "a":
+		if href, ok := attrs["href"]; ok && (hidden || sc.inHidden()) {
+			if r := sc.policy.checkURL(href); r != "" {
+				sc.add(pos, "hidden link to "+r)
+			}
+		}
+	}
+	if !htmlVoid[name] && !selfClose {
+		sc.stack = append(sc.stack, htmlElem{name, hidden})
+	}
+}
+
+// 结束标签，关闭到最近的同名元素
+func (sc *htmlScanner) pop(name string) {
+	for i := len(sc.stack) - 1; i >= 0; i-- {
+		if sc.stack[i].name == name {
+			sc.stack = sc.stack[:i]
+			return
+		}
+	}
+}
+
+func (sc *htmlScanner) inHidden() bool {
+	for _, e := range sc.stack {
+		if e.hidden {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查SSI指令，c为<!--#之后的内容，指令前可以有空白，如nginx的<!--# include -->
+func (sc *htmlScanner) ssi(pos int, c []byte) {
+	i := 0
+	for i < len(c) && isSpace(c[i]) {
+		i++
+	}
+	j := i
+	for j < len(c) && !isSpace(c[j]) {
+		j++
+	}
+	directive := strings.ToLower(string(c[i:j]))
+	attrs, _ := parseAttrs(c, j)
+	switch directive {
+	case "exec":
+		sc.add(pos, "ssi exec directive")
+	case "include":
+		if !sc.policy.allowInclude(attrs) {
+			sc.add(pos, "ssi include path not allowed: "+attrs["file"]+attrs["virtual"])
+		}
+	}
+}
+
+// 元素是否隐藏
+func isHidden(attrs map[string]string) bool {
+	if _, ok := attrs["hidden"]; ok {
+		return true
+	}
+	style := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(attrs["style"]))
+	return style != "" && hiddenStyle.MatchString(style)
+}
+
+// 解析i处的标签，返回小写的标签名、属性、是否是结束标签和标签之后的位置
+// 不是标签时标签名为空
+func parseTag(b []byte, i int) (name string, attrs map[string]string, end bool, next int) {
+	j := i + 1
+	if j < len(b) && b[j] == '/' {
+		end = true
+		j++
+	}
+	s := j
+	if j >= len(b) || !isLetter(b[j]) {
+		return "", nil, false, i + 1
+	}
+	for j < len(b) && !isSpace(b[j]) && b[j] != '/' && b[j] != '>' {
+		j++
+	}
+	name = strings.ToLower(string(b[s:j]))
+	attrs, next = parseAttrs(b, j)
+	return name, attrs, end, next
+}
+
+// 从j开始解析属性到>，属性名小写，属性值解码实体，同名属性使用第一个
+func parseAttrs(b []byte, j int) (map[string]string, int) {
+	attrs := make(map[string]string)
+	for j < len(b) {
+		for j < len(b) && (isSpace(b[j]) || b[j] == '/') {
+			j++
+		}
+		if j >= len(b) {
+			break
+		}
+		if b[j] == '>' {
+			return attrs, j + 1
+		}
+		s := j
+		for j < len(b) && !isSpace(b[j]) && b[j] != '=' && b[j] != '>' && b[j] != '/' {
+			j++
+		}
+		if j == s {
+			// 属性名以=开头
+			j++
+			continue
+		}
+		key := strings.ToLower(string(b[s:j]))
+		val := ""
+		k := j
+		for k < len(b) && isSpace(b[k]) {
+			k++
+		}
+		if k < len(b) && b[k] == '=' {
+			k++
+			for k < len(b) && isSpace(b[k]) {
+				k++
+			}
+			if k < len(b) && (b[k] == '"' || b[k] == '\'') {
+				q := b[k]
+				e := bytes.IndexByte(b[k+1:], q)
+				if e < 0 {
+					val, k = string(b[k+1:]), len(b)
+				} else {
+					val, k = string(b[k+1:k+1+e]), k+e+2
+				}
+			} else {
+				s := k
+				for k < len(b) && !isSpace(b[k]) && b[k] != '>' {
+					k++
+				}
+				val = string(b[s:k])
+			}
+			j = k
+		}
+		if _, ok := attrs[key]; !ok {
+			attrs[key] = html.UnescapeString(val)
+		}
+	}
+	return attrs, len(b)
+}
+
+// 不区分大小写查找ASCII字符串
+func indexFold(b []byte, sub string) int {
+	for i := 0; i+len(sub) <= len(b); i++ {
+		k := bytes.IndexByte(b[i:], sub[0])
+		if k < 0 || i+k+len(sub) > len(b) {
+			return -1
+		}
+		i += k
+		if bytes.EqualFold(b[i:i+len(sub)], []byte(sub)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
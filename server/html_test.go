@@ -0,0 +1,119 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTMLPolicy(t *testing.T) {
+	p := &htmlPolicy{open: true, exts: lowerSet(HTML_EXT, ""), domains: []string{"cmstop.com"}, virtual: []string{"/include"}}
+	allowed := []string{
+		`<html><head><script src="/js/app.js"></script><script src="https://static.cmstop.com/a.js"></script></head>
+<body><!--#include virtual="/include/header.html" --><!--#include file="footer.html" --><!--#echo var="DATE_LOCAL" -->
+<iframe src="//www.cmstop.com/player"></iframe><a href="http://example.com/">visible</a>
+<div style="display:none"><a href="/about">menu</a></div><p>1 < 2</p></body></html>`,
+		`<script>document.write('<iframe src="http://evil.com/"></iframe>')</script><style>a{}</style>`,
+	}
+	for _, body := range allowed {
+		if f := p.check("html", []byte(body)); len(f) > 0 {
+			t.Errorf("%s: %s", body, f[0])
+		}
+	}
+	if f := p.check("txt", []byte(`<!--#exec cmd="id" -->`)); len(f) > 0 {
+		t.Errorf("txt checked: %s", f[0])
+	}
+
+	rejected := map[string]string{
+		`<!--#exec cmd="cat /etc/passwd" -->`:                                                               "line 1: ssi exec directive",
+		"<p>\n<!--#include virtual=\"/etc/passwd\" -->":                                                     "line 2: ssi include path not allowed: /etc/passwd",
+		`<!--#include file="../../conf/cmstop.conf" -->`:                                                    "ssi include path not allowed",
+		"\n\n<IFRAME width=0 SRC=http://evil.com/x></IFRAME>":                                               "line 3: iframe source not allowed: evil.com",
+		`<script src="https://cmstop.com.evil.com/a.js"></script>`:                                          "script source not allowed: cmstop.com.evil.com",
+		`<script src="&#x2f;&#x2f;evil.com/a.js"></script>`:                                                 "script source not allowed: evil.com",
+		`<script src="/\evil.com/a.js"></script>`:                                                           "script source not allowed: evil.com",
+		`<iframe src="javascript:alert(1)"></iframe>`:                                                       "scheme javascript:",
+		"<div style=\"position: absolute; left: -9999px\">\n<a href=\"http://casino.example/\">x</a></div>": "line 2: hidden link to casino.example",
+		`<span hidden><b><a href="https://pills.example/">x</a></b></span>`:                                 "hidden link to pills.example",
+		`<a style="DISPLAY: NONE" href="http://spam.example/">x</a>`:                                        "hidden link to spam.example",
+		`<!--# exec cmd="id" -->`:                                                                           "ssi exec directive",
+		"<!--#\n\tEXEC cgi=\"/cgi-bin/x\" -->":                                                              "ssi exec directive",
+		`<!--# include virtual="/../x" -->`:                                                                 "ssi include path not allowed: /../x",
+	}
+	for body, msg := range rejected {
+		f := p.check("shtml", []byte(body))
+		if len(f) != 1 || !strings.Contains(f[0].String(), msg) {
+			t.Errorf("%s: %v", body, f)
+		}
+	}
+
+	// 隐藏元素结束后的链接不是隐藏链接
+	if f := p.check("html", []byte(`<div style="display:none"><p>x</div><a href="http://example.com/">x</a>`)); len(f) > 0 {
+		t.Errorf("closed hidden: %s", f[0])
+	}
+	// 没有配置允许的目录时只禁止..
+	p.virtual = nil
+	if !p.allowInclude(map[string]string{"virtual": "/ssi/a.html"}) || p.allowInclude(map[string]string{"virtual": "/a/../../b"}) {
+		t.Error("virtual without dirs")
+	}
+	p.domains = []string{"*"}
+	if f := p.check("html", []byte(`<script src="http://any.example/a.js"></script>`)); len(f) > 0 {
+		t.Errorf("any domain: %s", f[0])
+	}
+
+	s, root, _ := newTestServer(t)
+	s.settings().filter.html = *p
+	_, err := s.handleRequest(&FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/a.shtml", Body: []byte("ok\n<!--#exec cgi=\"/cgi-bin/x\"-->")})
+	if ce, ok := err.(*CodeError); !ok || ce.Code != CODE_CONTENT_REJECTED || !strings.Contains(err.Error(), "line 2: ssi exec") {
+		t.Errorf("handle: %v", err)
+	}
+}
+
+// 改名或复制为html不能绕过内容检查
+func TestHTMLPolicyDest(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().filter.html = htmlPolicy{open: true, exts: lowerSet(HTML_EXT, "")}
+	body := []byte(`<!--#exec cmd="id" -->`)
+	ioutil.WriteFile(root+"/a.txt", body, 0644)
+	for _, m := range []uint32{METHOD_RENAME, METHOD_COPY} {
+		_, err := s.handleRequest(&FileData{Method: m, Password: "pw", Path: root + "/a.txt", Body: []byte(`{"newpath":"` + root + `/a.shtml"}`)})
+		if err == nil || !strings.Contains(err.Error(), "ssi exec") {
+			t.Errorf("method %d: %v", m, err)
+		}
+	}
+	if _, err := os.Stat(root + "/a.shtml"); !os.IsNotExist(err) {
+		t.Error("rejected destination written")
+	}
+	// 扩展名相同时不检查内容
+	_, err := s.handleRequest(&FileData{Method: METHOD_RENAME, Password: "pw", Path: root + "/a.txt", Body: []byte(`{"newpath":"` + root + `/b.txt"}`)})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 批量操作中写入后改名
+	_, err = s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/c.txt", Body: []byte(`<script src="//evil.com/x.js"></script>`)},
+		&BatchOp{Method: METHOD_RENAME, Path: root + "/c.txt", NewPath: root + "/c.html"},
+	))
+	if err == nil || !strings.Contains(err.Error(), "script source not allowed") {
+		t.Errorf("batch: %v", err)
+	}
+	_, err = s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/d.txt", Body: []byte("ok")},
+		&BatchOp{Method: METHOD_APPEND_FILE, Path: root + "/d.txt", Body: []byte(`<!--# exec cmd="id" -->`)},
+		&BatchOp{Method: METHOD_COPY, Path: root + "/d.txt", NewPath: root + "/d.shtml"},
+	))
+	if err == nil || !strings.Contains(err.Error(), "ssi exec") {
+		t.Errorf("batch append: %v", err)
+	}
+	// 源路径还不存在时也检查目标的扩展名
+	s.settings().policy, _ = NewPathPolicy([]string{"txt"}, nil, nil, nil)
+	_, err = s.ctFile.Batch(batchRequest(t,
+		&BatchOp{Method: METHOD_RENAME, Path: root + "/e.txt", NewPath: root + "/e.html"},
+		&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/e.txt", Body: []byte("ok")},
+	))
+	if err == nil || !strings.Contains(err.Error(), "allowExt") {
+		t.Errorf("batch missing source: %v", err)
+	}
+}
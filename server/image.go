@@ -0,0 +1,184 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/9466/goconfig"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+)
+
+const (
+	DEF_IMAGE_MAX_PIXELS = 50000000 // 默认图片最大像素数
+	DEF_JPEG_QUALITY     = 90       // 默认重新编码jpeg的质量
+)
+
+// 检查的图片扩展名和对应的格式
+var IMAGE_EXT = map[string]string{"jpg": "jpeg", "jpeg": "jpeg", "png": "png", "gif": "gif", "webp": "webp"}
+
+// 图片检查，解码失败、格式和扩展名不符、尺寸超过限制时拒绝写入
+// 重新编码可以去掉图片数据之后附加的内容和EXIF等元数据，webp没有编码器，只去掉附加的内容
+type imagePolicy struct {
+	open      bool // 是否检查图片
+	maxWidth  int  // 最大宽度，0 不限制
+	maxHeight int  // 最大高度，0 不限制
+	maxPixels int  // 最大像素数，解码前检查，避免解压炸弹
+	reencode  bool // 是否重新编码
+	quality   int  // 重新编码jpeg的质量
+}
+
+// 读取[filter]中的图片配置
+func (p *imagePolicy) init(conf *goconfig.ConfigFile) error {
+	p.open, _ = conf.GetBool("filter", "imageOpen")
+	p.reencode, _ = conf.GetBool("filter", "imageReencode")
+	p.maxWidth, _ = conf.GetInt("filter", "imageMaxWidth")
+	p.maxHeight, _ = conf.GetInt("filter", "imageMaxHeight")
+	p.maxPixels, _ = conf.GetInt("filter", "imageMaxPixels")
+	if p.maxPixels <= 0 {
+		p.maxPixels = DEF_IMAGE_MAX_PIXELS
+	}
+	p.quality, _ = conf.GetInt("filter", "jpegQuality")
+	if p.quality == 0 {
+		p.quality = DEF_JPEG_QUALITY
+	}
+	if p.quality < 1 || p.quality > 100 {
+		return errors.New("jpegQuality should between 1 and 100")
+	}
+	return nil
+}
+
+// 检查图片，返回需要写入的内容，重新编码时是编码后的内容
+// start为false时是追加写入，图片不允许追加
+func (p *imagePolicy) check(ext string, body []byte, start bool) ([]byte, *Finding) {
+	format, ok := IMAGE_EXT[ext]
+	if !p.open || !ok {
+		return body, nil
+	}
+	fail := func(msg string) ([]byte, *Finding) {
+		return nil, &Finding{Rule: "image", Message: msg, Claimed: claimedType(ext)}
+	}
+	if !start {
+		return fail("image cannot be appended")
+	}
+	cfg, got, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return fail("image decode error: " + err.Error())
+	}
+	if got != format {
+		return fail("image format " + got + " does not match extension " + ext)
+	}
+	size := strconv.Itoa(cfg.Width) + "x" + strconv.Itoa(cfg.Height)
+	if p.maxWidth > 0 && cfg.Width > p.maxWidth || p.maxHeight > 0 && cfg.Height > p.maxHeight ||
+		int64(cfg.Width)*int64(cfg.Height) > int64(p.maxPixels) {
+		return fail("image too large: " + size)
+	}
+
+	// gif的每一帧解码后都保留在内存中，解码前检查全部帧的像素数之和
+	if format == "gif" {
+		frames, pixels := gifFrames(body)
+		if pixels > int64(p.maxPixels) {
+			return fail("image too large: " + strconv.Itoa(frames) + " frames of " + strconv.FormatInt(pixels, 10) + " pixels")
+		}
+	}
+
+	// 完整解码，gif检查全部帧
+	var img image.Image
+	var anim *gif.GIF
+	if format == "gif" {
+		anim, err = gif.DecodeAll(bytes.NewReader(body))
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(body))
+	}
+	if err != nil {
+		return fail("image decode error: " + err.Error())
+	}
+	if !p.reencode {
+		return body, nil
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: p.quality})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.EncodeAll(&buf, anim)
+	case "webp":
+		return trimRIFF(body), nil
+	}
+	if err != nil {
+		return fail("image encode error: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// 不解压图像数据，读取gif的块结构，返回帧数和全部帧的像素数之和
+// 格式错误时返回已读取的部分，错误由解码返回
+func gifFrames(body []byte) (frames int, pixels int64) {
+	if len(body) < 13 {
+		return 0, 0
+	}
+	i := 13
+	if body[10]&0x80 != 0 {
+		i += 3 << (uint(body[10]&7) + 1)
+	}
+	// 跳过数据子块，以长度0结束
+	skip := func() bool {
+		for i < len(body) {
+			n := int(body[i])
+			i += n + 1
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for i < len(body) {
+		switch body[i] {
+		case 0x21: // 扩展
+			i += 2
+			if !skip() {
+				return
+			}
+		case 0x2c: // 图像
+			if i+10 > len(body) {
+				return
+			}
+			w := int64(binary.LittleEndian.Uint16(body[i+5:]))
+			h := int64(binary.LittleEndian.Uint16(body[i+7:]))
+			frames++
+			pixels += w * h
+			flags := body[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (uint(flags&7) + 1)
+			}
+			i++ // LZW最小编码长度
+			if !skip() {
+				return
+			}
+		default: // 0x3b结束
+			return
+		}
+	}
+	return
+}
+
+// 去掉RIFF块之后附加的内容
+func trimRIFF(body []byte) []byte {
+	if len(body) < 8 {
+		return body
+	}
+	n := int64(binary.LittleEndian.Uint32(body[4:8])) + 8
+	if n < int64(len(body)) {
+		return body[:n]
+	}
+	return body
+}
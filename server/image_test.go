@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"cmstop-fserver/util"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func testImage(format string, w, h int) []byte {
+	img := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White})
+	img.Set(1, 1, color.White)
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		png.Encode(&buf, img)
+	case "jpeg":
+		jpeg.Encode(&buf, img, nil)
+	case "gif":
+		gif.Encode(&buf, img, nil)
+	}
+	return buf.Bytes()
+}
+
+func TestImagePolicy(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().filter.image.open = true
+	s.settings().filter.image.maxWidth = 100
+	write := func(method uint32, p string, body []byte) (interface{}, error) {
+		return s.handleRequest(&FileData{Method: method, Password: "pw", Path: root + "/" + p, Body: body,
+			Meta: &RequestMeta{Sha256: util.Hash(body)}})
+	}
+
+	for p, body := range map[string][]byte{"a.png": testImage("png", 10, 10), "a.JPG": testImage("jpeg", 10, 10), "a.gif": testImage("gif", 10, 10)} {
+		if _, err := write(METHOD_CREATE_FILE, p, body); err != nil {
+			t.Errorf("%s rejected: %v", p, err)
+		}
+	}
+	polyglot := append(testImage("png", 10, 10), "<?php system($_GET['c']); ?>"...)
+	if _, err := write(METHOD_CREATE_FILE, "poly.png", polyglot); err != nil {
+		t.Errorf("polyglot without reencode: %v", err)
+	}
+
+	rejected := map[string][]byte{
+		"png.jpg":   testImage("png", 10, 10),
+		"junk.png":  []byte("not an image at all"),
+		"cut.png":   testImage("png", 10, 10)[:40],
+		"wide.gif":  testImage("gif", 101, 10),
+		"empty.gif": []byte("GIF89a"),
+	}
+	for p, body := range rejected {
+		_, err := write(METHOD_CREATE_FILE, p, body)
+		if ce, ok := err.(*CodeError); !ok || ce.Code != CODE_CONTENT_REJECTED {
+			t.Errorf("%s: %v", p, err)
+		}
+	}
+	s.settings().filter.image.maxPixels = 50
+	if _, err := write(METHOD_CREATE_FILE, "pixels.png", testImage("png", 10, 10)); err == nil {
+		t.Errorf("image over maxPixels written")
+	}
+	// gif全部帧的像素数之和不超过maxPixels
+	anim := &gif.GIF{}
+	for i := 0; i < 5; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+		img.Set(i%4, 1, color.White)
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, anim)
+	if frames, pixels := gifFrames(buf.Bytes()); frames != 5 || pixels != 80 {
+		t.Errorf("gif frames %d, pixels %d", frames, pixels)
+	}
+	if _, err := write(METHOD_CREATE_FILE, "anim.gif", buf.Bytes()); err == nil || !strings.Contains(err.Error(), "5 frames") {
+		t.Errorf("gif over maxPixels: %v", err)
+	}
+	s.settings().filter.image.maxPixels = DEF_IMAGE_MAX_PIXELS
+	if _, err := write(METHOD_CREATE_FILE, "anim.gif", buf.Bytes()); err != nil {
+		t.Errorf("animated gif rejected: %v", err)
+	}
+	if _, err := write(METHOD_APPEND_FILE, "a.png", []byte("<?php")); err == nil {
+		t.Errorf("image appended")
+	}
+
+	// 重新编码去掉附加的内容，返回改写后内容的哈希
+	s.settings().filter.image.reencode = true
+	v, err := write(METHOD_CREATE_FILE, "poly.png", polyglot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := readTestFile(root + "/poly.png")
+	if res := v.(*WriteResult); !res.Rewritten || res.Hash != util.Hash([]byte(stored)) {
+		t.Errorf("result %+v", res)
+	}
+	if strings.Contains(stored, "<?php") {
+		t.Errorf("payload kept after reencode")
+	}
+	if _, _, err := image.Decode(strings.NewReader(stored)); err != nil {
+		t.Errorf("reencoded image: %v", err)
+	}
+
+	// 批量写入同样改写
+	body, _ := json.Marshal(&BatchParams{Ops: []*BatchOp{{Method: METHOD_CREATE_FILE, Path: root + "/b.png", Body: polyglot}}})
+	v, err = s.handleRequest(&FileData{Method: METHOD_BATCH, Password: "pw", Path: root, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := v.([]*BatchResult)[0]; !res.Rewritten || strings.Contains(readTestFile(root+"/b.png"), "<?php") {
+		t.Errorf("batch result %+v", res)
+	}
+
+	if got := trimRIFF([]byte("RIFF\x04\x00\x00\x00WEBPextra")); string(got) != "RIFF\x04\x00\x00\x00WEBP" {
+		t.Errorf("trimRIFF %q", got)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/9466/goconfig"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	INJECTION_MIN_LINE  = 64 // 计算熵和转义密度的最短行，太短的行没有意义
+	DEF_INJECTION_SCORE = 10 // 默认拒绝写入的分数
+	DEF_SIGNAL_SCORE    = 5  // 默认每项检查的分数
+)
+
+var (
+	INJECTION_EXT = []string{"html", "htm", "shtml", "shtm", "js", "css", "xml", "svg", "txt", "json"} // 默认检查的扩展名
+	// 转义序列，\x41、\101、A、%41、&#65;、chr(65)
+	escapeSeq = regexp.MustCompile(`(?i)\\x[0-9a-f]{2}|\\[0-7]{3}|\\u[0-9a-f]{4}|%[0-9a-f]{2}|&#x?[0-9a-f]+;|chr\s*\(\s*\d+\s*\)`)
+)
+
+// 一项检查的阈值和分数，超过阈值时加分
+type injectionSignal struct {
+	limit float64
+	score int
+}
+
+// 混淆特征，按整个文件和每一行计算
+const (
+	SIGNAL_ENTROPY   = iota // 信息熵，比特/字节
+	SIGNAL_TOKEN            // 最长的连续字符数
+	SIGNAL_NON_PRINT        // 不可打印字符比例
+	SIGNAL_ESCAPE           // 转义序列占的比例
+	SIGNAL_NUM
+)
+
+// 混淆特征在配置中的名称，配置项为名称加Limit和Score
+var SIGNAL_NAMES = [SIGNAL_NUM]string{"entropy", "token", "nonPrint", "escape"}
+
+// 木马检测，关键词和混淆特征分别计分，总分达到score时拒绝写入
+type injectionPolicy struct {
+	open     bool                        // 是否检测
+	exts     map[string]bool             // 检查的扩展名
+	score    int                         // 拒绝写入的分数
+	keywords []string                    // 关键词，不区分大小写，来自injection.conf
+	keyword  int                         // 每个关键词的分数
+	signals  [SIGNAL_NUM]injectionSignal // 混淆特征的阈值和分数
+}
+
+func newInjectionPolicy() injectionPolicy {
+	return injectionPolicy{
+		exts:    lowerSet(INJECTION_EXT, ""),
+		score:   DEF_INJECTION_SCORE,
+		keyword: DEF_SIGNAL_SCORE,
+		signals: [SIGNAL_NUM]injectionSignal{{5.8, DEF_SIGNAL_SCORE}, {200, DEF_SIGNAL_SCORE}, {0.1, DEF_SIGNAL_SCORE}, {0.3, DEF_SIGNAL_SCORE}},
+	}
+}
+
+// 读取[filter]中的木马检测配置，没有配置的使用默认值
+func (p *injectionPolicy) init(conf *goconfig.ConfigFile) error {
+	p.open, _ = conf.GetBool("filter", "injectionOpen")
+	if exts, _ := conf.GetString("filter", "injectionExt"); exts != "" {
+		p.exts = lowerSet(strings.Split(exts, ","), ".")
+	}
+	getInt := func(key string, v *int) {
+		if n, err := conf.GetInt("filter", key); err == nil && n > 0 {
+			*v = n
+		}
+	}
+	getInt("injectionScore", &p.score)
+	getInt("keywordScore", &p.keyword)
+	for i, name := range SIGNAL_NAMES {
+		if v, _ := conf.GetString("filter", name+"Limit"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				return errors.New(name + "Limit should be a positive number: " + v)
+			}
+			p.signals[i].limit = f
+		}
+		getInt(name+"Score", &p.signals[i].score)
+	}
+	return nil
+}
+
+// 读取关键词文件，每行一个，#开头的是注释
+func (p *injectionPolicy) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.New("injection file cannot open: " + err.Error())
+	}
+	defer f.Close()
+	keywords := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k := strings.TrimSpace(sc.Text())
+		if k != "" && k[0] != '#' {
+			keywords = append(keywords, k)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return errors.New("injection file read error: " + err.Error())
+	}
+	p.keywords = keywords
+	return nil
+}
+
+// 计算混淆特征，short为true时内容太短，不计算熵和转义密度
+func measure(b []byte, short bool) (m [SIGNAL_NUM]float64) {
+	if len(b) == 0 {
+		return
+	}
+	var count [256]int
+	nonPrint, run := 0, 0
+	for _, c := range b {
+		count[c]++
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' || c == 0x7f {
+			nonPrint++
+		}
+		if tokenByte(c) {
+			run++
+			if float64(run) > m[SIGNAL_TOKEN] {
+				m[SIGNAL_TOKEN] = float64(run)
+			}
+		} else {
+			run = 0
+		}
+	}
+	n := float64(len(b))
+	m[SIGNAL_NON_PRINT] = float64(nonPrint) / n
+	if short {
+		return
+	}
+	for _, c := range count {
+		if c > 0 {
+			q := float64(c) / n
+			m[SIGNAL_ENTROPY] -= q * math.Log2(q)
+		}
+	}
+	esc := 0
+	for _, loc := range escapeSeq.FindAllIndex(b, -1) {
+		esc += loc[1] - loc[0]
+	}
+	m[SIGNAL_ESCAPE] = float64(esc) / n
+	return
+}
+
+// 组成连续字符的字节，空白、引号和分隔符以外的字符
+func tokenByte(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\f', '"', '\'', '`', ';', ',', '(', ')', '{', '}', '[', ']', '<', '>':
+		return false
+	}
+	return true
+}
+
+// 检测内容，总分达到阈值时返回每一项加分的说明和总分
+func (p *injectionPolicy) check(ext string, body []byte) []*Finding {
+	if !p.open || !p.exts[ext] {
+		return nil
+	}
+	findings := make([]*Finding, 0)
+	total := 0
+
+	// 关键词，记录第一次出现的行
+	for _, k := range p.keywords {
+		if i := indexFold(body, k); i >= 0 {
+			total += p.keyword
+			findings = append(findings, &Finding{Rule: "injection", Line: bytes.Count(body[:i], []byte("\n")) + 1,
+				Message: "keyword " + strconv.Quote(k) + " (+" + strconv.Itoa(p.keyword) + ")"})
+		}
+	}
+
+	// 每一行和整个文件的特征，每一项取最大值和所在的行，行号为0时是整个文件
+	var top [SIGNAL_NUM]float64
+	var lines [SIGNAL_NUM]int
+	line := 0
+	for rest := body; len(rest) > 0; {
+		line++
+		b := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			b, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		for i, v := range measure(b, len(b) < INJECTION_MIN_LINE) {
+			if v > top[i] {
+				top[i], lines[i] = v, line
+			}
+		}
+	}
+	for i, v := range measure(body, len(body) < INJECTION_MIN_LINE) {
+		if v > top[i] {
+			top[i], lines[i] = v, 0
+		}
+	}
+	for i, sig := range p.signals {
+		if top[i] <= sig.limit {
+			continue
+		}
+		total += sig.score
+		findings = append(findings, &Finding{Rule: "injection", Line: lines[i],
+			Message: SIGNAL_NAMES[i] + " " + strconv.FormatFloat(top[i], 'f', 2, 64) + " > " +
+				strconv.FormatFloat(sig.limit, 'f', 2, 64) + " (+" + strconv.Itoa(sig.score) + ")"})
+	}
+	if total < p.score {
+		return nil
+	}
+	return append(findings, &Finding{Rule: "injection", Message: "injection score " + strconv.Itoa(total) + " reached " + strconv.Itoa(p.score)})
+}
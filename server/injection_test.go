@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMeasure(t *testing.T) {
+	m := measure([]byte(strings.Repeat("a", 100)), false)
+	if m[SIGNAL_ENTROPY] != 0 || m[SIGNAL_TOKEN] != 100 || m[SIGNAL_NON_PRINT] != 0 {
+		t.Errorf("repeat: %v", m)
+	}
+	m = measure([]byte("ab\x00\x01"), true)
+	if m[SIGNAL_NON_PRINT] != 0.5 || m[SIGNAL_ENTROPY] != 0 {
+		t.Errorf("short: %v", m)
+	}
+	all := make([]byte, 256*4)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if m = measure(all, false); m[SIGNAL_ENTROPY] != 8 {
+		t.Errorf("entropy: %v", m)
+	}
+	m = measure([]byte(strings.Repeat(`\x41`, 20)+strings.Repeat(" ", 20)), false)
+	if m[SIGNAL_ESCAPE] != 0.8 {
+		t.Errorf("escape: %v", m)
+	}
+}
+
+func TestInjectionPolicy(t *testing.T) {
+	p := newInjectionPolicy()
+	p.open = true
+	f, err := ioutil.TempFile("", "injection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\n\neval\nbase64_decode\n")
+	f.Close()
+	if err = p.load(f.Name()); err != nil || len(p.keywords) != 2 {
+		t.Fatalf("load: %v %v", p.keywords, err)
+	}
+
+	blob := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(blob)
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog, again and again.\n", 50)
+	allowed := map[string]string{
+		"plain":   text,
+		"keyword": "<script>\nvar x = eval('1+1');\n</script>\n" + text,
+	}
+	for name, body := range allowed {
+		if f := p.check("html", []byte(body)); len(f) > 0 {
+			t.Errorf("%s: %v", name, f)
+		}
+	}
+
+	rejected := map[string][]string{
+		"base64":  {"line 52: keyword \"eval\"", "line 52: entropy", "line 52: token", "injection score 20 reached 10"},
+		"chr":     {"line 51: escape", "line 52: keyword \"eval\""},
+		"hex":     {"escape", "token"},
+		"control": {"nonPrint", "keyword \"base64_decode\""},
+	}
+	bodies := map[string]string{
+		"base64":  text + "\n<?=eval(base64_decode('" + encoded + "'));",
+		"chr":     text + "$f=" + strings.Repeat("chr(101).", 100) + "chr(108);\neval($f);",
+		"hex":     strings.Repeat(`\x65\x76\x61\x6c`, 80),
+		"control": "base64_decode " + strings.Repeat("\x01\x02 ok", 40),
+	}
+	for name, want := range rejected {
+		f := p.check("js", []byte(bodies[name]))
+		msgs := make([]string, 0)
+		for _, x := range f {
+			msgs = append(msgs, x.String())
+		}
+		all := strings.Join(msgs, "; ")
+		for _, w := range want {
+			if !strings.Contains(all, w) {
+				t.Errorf("%s: %q not in %q", name, w, all)
+			}
+		}
+	}
+	if f := p.check("png", []byte(bodies["base64"])); len(f) > 0 {
+		t.Errorf("png checked: %v", f)
+	}
+	p.score = 100
+	if f := p.check("js", []byte(bodies["base64"])); len(f) > 0 {
+		t.Errorf("below score: %v", f)
+	}
+}
@@ -0,0 +1,746 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+append-only operation journal.
+
+every successful operation which changes files is appended to the journal
+in the order it was applied. the journal is a list of segment files
+<journalDir>/<first seq>.journal, a segment is rotated when it reaches
+maxSize, segments older than maxAge are dropped by Compact, and the oldest
+segments are dropped while the segments and their bodies take more than
+totalSize. the current segment is never dropped.
+
+record format:
+|-----------|-----------|-----------------------------|
+| 4b(uint)  | 4b(uint)  | N                           |
+|-----------|-----------|-----------------------------|
+| 记录长度  | crc32c    | 记录内容(JSON JournalRecord) |
+|-----------|-----------|-----------------------------|
+LittleEndian, crc32c (Castagnoli) of the json.
+written bodies are stored once by sha256 in <journalDir>/bodies/.
+the journal is flocked (<journalDir>/LOCK) while it is open, a second
+process cannot open it until the first one closes it or exits.
+*/
+package server
+
+import (
+	"bufio"
+	"cmstop-fserver/util"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/9466/goconfig"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	JOURNAL_EXT        = ".journal" // 日志分段文件扩展名
+	JOURNAL_BODIES_DIR = "bodies"   // 写入内容目录
+	JOURNAL_LOCK       = "LOCK"     // 打开期间加锁的文件，同时只有一个进程写入
+	DEF_JOURNAL_SIZE   = 64 << 20   // 默认分段大小64M
+	DEF_JOURNAL_TOTAL  = 16 << 30   // 默认分段和写入内容的总大小上限16G
+	MAX_JOURNAL_RECORD = 1 << 20    // 单条记录最大长度
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errJournalLocked = errors.New("journal is locked by another process")
+
+// 日志记录
+type JournalRecord struct {
+	Seq     uint64 `json:"seq"`               // 序号，从1开始连续递增
+	Time    int64  `json:"time"`              // 执行时间，unix纳秒
+	Cred    string `json:"cred,omitempty"`    // 请求凭证，以credKey计算的密钥HMAC-SHA256的前16位
+	Client  string `json:"client,omitempty"`  // 客户端地址
+	Method  uint32 `json:"method"`            // 操作类型
+	Path    string `json:"path"`              // 操作路径
+	NewPath string `json:"newpath,omitempty"` // 复制和重命名的目标路径
+	Hash    string `json:"hash,omitempty"`    // 写入内容的sha256，写入操作才有
+	Size    int64  `json:"size,omitempty"`    // 写入内容的大小
+}
+
+// 操作日志
+type Journal struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64         // 分段大小
+	maxAge  time.Duration // 分段保留时间，0 表示不限制
+	total   int64         // 分段和写入内容的总大小上限，0 表示不限制
+	credKey []byte        // 计算请求凭证的密钥，为空时不记录请求凭证
+	fsync   bool          // 每条记录写入后是否同步到磁盘
+	seq     uint64        // 最后一条记录的序号
+	f       *os.File      // 当前分段
+	lock    *os.File      // 加锁的JOURNAL_LOCK，关闭时释放
+	size    int64         // 当前分段大小
+	notify  chan struct{} // 写入新记录时关闭并替换，用于等待新记录
+}
+
+func OpenJournal(dir string, maxSize int64, maxAge time.Duration, fsync bool) (*Journal, error) {
+	j := new(Journal)
+	j.dir = path.Clean(dir)
+	j.maxSize = maxSize
+	if j.maxSize <= 0 {
+		j.maxSize = DEF_JOURNAL_SIZE
+	}
+	j.maxAge = maxAge
+	j.fsync = fsync
+	j.notify = make(chan struct{})
+	err := os.MkdirAll(j.dir+"/"+JOURNAL_BODIES_DIR, 0755)
+	if err != nil {
+		return nil, errors.New("cannot create journal dir: " + err.Error())
+	}
+	j.lock, err = lockJournal(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	err = j.open()
+	if err != nil {
+		j.lock.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// 加锁操作日志目录，已经被其他进程打开时返回errJournalLocked
+func lockJournal(dir string) (*os.File, error) {
+	f, err := os.OpenFile(dir+"/"+JOURNAL_LOCK, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errJournalLocked
+		}
+		return nil, errors.New("journal lock error: " + err.Error())
+	}
+	return f, nil
+}
+
+// 打开最后一个分段继续写入，没有分段时新建
+func (j *Journal) open() error {
+	segs, err := journalSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return j.rotate()
+	}
+
+	// 最后一个分段末尾可能是写入一半的记录，截断到最后一条完整的记录
+	last := segs[len(segs)-1]
+	j.seq = last.first - 1
+	var good int64
+	err = readSegment(last.name, func(r *JournalRecord, end int64) error {
+		j.seq = r.Seq
+		good = end
+		return nil
+	})
+	if err != nil && err != errTornRecord {
+		return err
+	}
+	j.f, err = os.OpenFile(last.name, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = j.f.Truncate(good)
+	if err == nil {
+		_, err = j.f.Seek(good, io.SeekStart)
+	}
+	if err != nil {
+		j.f.Close()
+		j.f = nil
+		return err
+	}
+	j.size = good
+	return nil
+}
+
+// 按配置打开操作日志，没有配置journalDir时返回nil
+func OpenJournalConf(conf *goconfig.ConfigFile) (*Journal, error) {
+	dir, _ := conf.GetString("journal", "journalDir")
+	if dir == "" {
+		return nil, nil
+	}
+	maxSize, _ := conf.GetString("journal", "maxSize")
+	maxAge, _ := conf.GetInt("journal", "maxAge")
+	fsync, _ := conf.GetBool("journal", "fsync")
+	j, err := OpenJournal(dir, util.ReverseFormatSize(maxSize), time.Duration(maxAge)*24*time.Hour, fsync)
+	if err != nil {
+		return nil, err
+	}
+	j.total = DEF_JOURNAL_TOTAL
+	if total, _ := conf.GetString("journal", "totalSize"); total != "" {
+		j.total = util.ReverseFormatSize(total)
+	}
+	credKey, _ := conf.GetString("journal", "credKey")
+	j.credKey = []byte(credKey)
+	return j, nil
+}
+
+// 写入一条记录，body不为nil时保存写入内容，设置记录的序号和时间
+func (j *Journal) Write(r *JournalRecord, body []byte) error {
+	if body != nil {
+		r.Hash = util.Hash(body)
+		r.Size = int64(len(body))
+		err := j.saveBody(r.Hash, func(tmp string) error { return writeNewFile(tmp, body) })
+		if err != nil {
+			return err
+		}
+	}
+	return j.append(r)
+}
+
+// 写入一条记录，写入内容从文件name复制，不读取到内存中
+func (j *Journal) WriteFile(r *JournalRecord, name string) error {
+	f, err := os.Stat(name)
+	if err != nil {
+		return errors.New("journal read body error: " + err.Error())
+	}
+	r.Hash, err = util.FileHash(name)
+	if err != nil {
+		return errors.New("journal read body error: " + err.Error())
+	}
+	r.Size = f.Size()
+	err = j.saveBody(r.Hash, func(tmp string) error { return util.CopyFile(name, tmp) })
+	if err != nil {
+		return err
+	}
+	return j.append(r)
+}
+
+// 追加一条记录，设置记录的序号和时间
+func (j *Journal) append(r *JournalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return errors.New("journal is closed")
+	}
+	if j.size >= j.maxSize {
+		err := j.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	r.Seq = j.seq + 1
+	r.Time = time.Now().UnixNano()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(data, crcTable))
+	buf = append(buf, data...)
+	n, err := j.f.Write(buf)
+	if err != nil {
+		// 截断写入一半的记录
+		j.f.Truncate(j.size)
+		j.f.Seek(j.size, io.SeekStart)
+		return errors.New("journal write error: " + err.Error())
+	}
+	if j.fsync {
+		err = j.f.Sync()
+		if err != nil {
+			return errors.New("journal sync error: " + err.Error())
+		}
+	}
+	j.seq = r.Seq
+	j.size += int64(n)
+	close(j.notify)
+	j.notify = make(chan struct{})
+	return nil
+}
+
+// 等待序号大于after的记录写入，超时返回，返回最后一条记录的序号
+func (j *Journal) Wait(after uint64, timeout time.Duration) uint64 {
+	j.mu.Lock()
+	seq, ch := j.seq, j.notify
+	j.mu.Unlock()
+	if seq > after {
+		return seq
+	}
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+	}
+	return j.Seq()
+}
+
+var errJournalCompacted = &CodeError{CODE_JOURNAL_COMPACTED, "journal compacted past requested sequence"}
+
+// 读取序号大于after的记录和写入内容，最多limit条，写入内容总大小超过maxBody时提前返回
+// maxBody小于0时不读取写入内容
+// 需要的记录已被清理时返回CODE_JOURNAL_COMPACTED错误
+func (j *Journal) Records(after uint64, limit int, maxBody int64) ([]*ReplicaRecord, error) {
+	seq := j.Seq()
+	if after > seq {
+		// 日志比请求的位置旧，可能被重建过
+		return nil, errJournalCompacted
+	}
+	list := make([]*ReplicaRecord, 0)
+	if after == seq || limit <= 0 {
+		return list, nil
+	}
+	segs, err := journalSegments(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 || segs[0].first > after+1 {
+		return nil, errJournalCompacted
+	}
+	var size int64
+	err = ReadJournal(j.dir, after, func(r *JournalRecord) error {
+		rr := &ReplicaRecord{JournalRecord: r}
+		if r.Hash != "" && maxBody >= 0 {
+			body, err := ioutil.ReadFile(j.Body(r.Hash))
+			if err != nil {
+				return errJournalCompacted
+			}
+			rr.Body = body
+			size += int64(len(body))
+		}
+		list = append(list, rr)
+		if len(list) >= limit || (maxBody >= 0 && size >= maxBody) {
+			return errReadDone
+		}
+		return nil
+	})
+	if err != nil && err != errReadDone {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 最后一条记录的序号
+func (j *Journal) Seq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq
+}
+
+// 删除超过保留时间的分段和超过总大小时最早的分段，当前分段不删除
+// 同时删除不再被引用的写入内容
+func (j *Journal) Compact() error {
+	if j.maxAge <= 0 && j.total <= 0 {
+		return nil
+	}
+	j.mu.Lock()
+	current := j.f.Name()
+	j.mu.Unlock()
+	segs, err := journalSegments(j.dir)
+	if err != nil {
+		return err
+	}
+	// 当前分段之前的分段可以删除
+	n := 0
+	for n < len(segs) && segs[n].name != current {
+		n++
+	}
+	drop := 0
+	if j.maxAge > 0 {
+		deadline := time.Now().Add(-j.maxAge)
+		for drop < n {
+			f, err := os.Stat(segs[drop].name)
+			if err != nil || f.ModTime().After(deadline) {
+				// 分段按顺序写入，后面的分段更新
+				break
+			}
+			drop++
+		}
+	}
+	if j.total > 0 && drop < n {
+		over, err := j.overTotal(segs, n)
+		if err != nil {
+			return err
+		}
+		if over > drop {
+			drop = over
+		}
+	}
+	if drop == 0 {
+		return nil
+	}
+	for _, s := range segs[:drop] {
+		err = os.Remove(s.name)
+		if err != nil {
+			return err
+		}
+	}
+	return j.compactBodies()
+}
+
+// 总大小不超过上限需要删除的最早分段数，最多删除前n个分段
+// 写入内容在最后引用它的分段删除后才释放
+func (j *Journal) overTotal(segs []*journalSegment, n int) (int, error) {
+	var total int64
+	sizes := make([]int64, len(segs))
+	last := make(map[string]int)
+	for i, s := range segs {
+		f, err := os.Stat(s.name)
+		if err != nil {
+			return 0, err
+		}
+		sizes[i] = f.Size()
+		err = readSegment(s.name, func(r *JournalRecord, end int64) error {
+			if r.Hash != "" {
+				last[r.Hash] = i
+			}
+			return nil
+		})
+		if err != nil && err != errTornRecord {
+			return 0, err
+		}
+	}
+	for hash, i := range last {
+		if f, err := os.Stat(j.Body(hash)); err == nil {
+			sizes[i] += f.Size()
+		}
+	}
+	for _, size := range sizes {
+		total += size
+	}
+	drop := 0
+	for drop < n && total > j.total {
+		total -= sizes[drop]
+		drop++
+	}
+	return drop, nil
+}
+
+// 删除没有被任何记录引用的写入内容
+func (j *Journal) compactBodies() error {
+	used := make(map[string]bool)
+	// 写入内容先于记录保存，最近保存或引用的内容可能还没有记录
+	start := time.Now().Add(-time.Minute)
+	err := ReadJournal(j.dir, 0, func(r *JournalRecord) error {
+		if r.Hash != "" {
+			used[r.Hash] = true
+		}
+		return nil
+	})
+	if err != nil && err != errTornRecord {
+		return err
+	}
+	bdir := j.dir + "/" + JOURNAL_BODIES_DIR
+	buckets, err := util.ReadDir(bdir)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		fl, err := util.ReadDir(bdir + "/" + b.Name())
+		if err != nil {
+			return err
+		}
+		for _, f := range fl {
+			if !used[f.Name()] && f.ModTime().Before(start) {
+				os.Remove(bdir + "/" + b.Name() + "/" + f.Name())
+			}
+		}
+	}
+	return nil
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	j.lock.Close()
+	return err
+}
+
+// 写入内容的保存路径
+func (j *Journal) Body(hash string) string {
+	return journalBody(j.dir, hash)
+}
+
+func journalBody(dir, hash string) string {
+	return dir + "/" + JOURNAL_BODIES_DIR + "/" + hash[:2] + "/" + path.Base(hash)
+}
+
+// 按内容哈希保存写入内容，已存在时更新修改时间，避免被清理
+// write将内容写入临时文件，之后重命名为内容的保存路径
+func (j *Journal) saveBody(hash string, write func(tmp string) error) error {
+	p := j.Body(hash)
+	if ok, _ := util.IsExist(p); ok {
+		now := time.Now()
+		return os.Chtimes(p, now, now)
+	}
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := tmpName(p)
+	err = write(tmp)
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.New("journal save body error: " + err.Error())
+	}
+	return nil
+}
+
+// 开始一个新的分段，需要持有mu
+func (j *Journal) rotate() error {
+	name := fmt.Sprintf("%s/%020d%s", j.dir, j.seq+1, JOURNAL_EXT)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("journal rotate error: " + err.Error())
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f = f
+	j.size = 0
+	return nil
+}
+
+// 日志分段
+type journalSegment struct {
+	name  string
+	first uint64 // 第一条记录的序号
+}
+
+// 按序号排列的全部分段
+func journalSegments(dir string) ([]*journalSegment, error) {
+	fl, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segs := make([]*journalSegment, 0)
+	for _, f := range fl {
+		if !strings.HasSuffix(f.Name(), JOURNAL_EXT) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), JOURNAL_EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, &journalSegment{dir + "/" + f.Name(), first})
+	}
+	sort.Slice(segs, func(i, k int) bool { return segs[i].first < segs[k].first })
+	return segs, nil
+}
+
+var (
+	errTornRecord = errors.New("journal record incomplete")
+	errReadDone   = errors.New("journal read done")
+)
+
+// 读取一个分段中的全部记录，fn的end为记录结束的位置
+// 末尾不完整的记录返回errTornRecord，校验失败返回错误
+func readSegment(name string, fn func(r *JournalRecord, end int64) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	var off int64
+	head := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(rd, head)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return errTornRecord
+		}
+		if err != nil {
+			return err
+		}
+		length := binary.LittleEndian.Uint32(head[0:4])
+		if length > MAX_JOURNAL_RECORD {
+			return errors.New("journal " + name + " corrupt at offset " + strconv.FormatInt(off, 10) + ": record too large")
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(rd, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errTornRecord
+		}
+		if err != nil {
+			return err
+		}
+		if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(head[4:8]) {
+			return errors.New("journal " + name + " checksum mismatch at offset " + strconv.FormatInt(off, 10))
+		}
+		r := new(JournalRecord)
+		err = json.Unmarshal(data, r)
+		if err != nil {
+			return errors.New("journal " + name + " corrupt at offset " + strconv.FormatInt(off, 10) + ": " + err.Error())
+		}
+		off += 8 + int64(length)
+		err = fn(r, off)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 按顺序读取日志中序号大于after的记录，记录序号不连续时返回错误
+// 最后一个分段末尾不完整的记录被忽略
+func ReadJournal(dir string, after uint64, fn func(r *JournalRecord) error) error {
+	segs, err := journalSegments(path.Clean(dir))
+	if err != nil {
+		return err
+	}
+	var last uint64
+	for i, s := range segs {
+		// 下一个分段的第一条记录不大于after时跳过这个分段
+		if i+1 < len(segs) && segs[i+1].first <= after+1 {
+			continue
+		}
+		err = readSegment(s.name, func(r *JournalRecord, end int64) error {
+			if last != 0 && r.Seq != last+1 {
+				return errors.New("journal sequence gap after " + strconv.FormatUint(last, 10))
+			}
+			last = r.Seq
+			if r.Seq <= after {
+				return nil
+			}
+			return fn(r)
+		})
+		if err == errTornRecord && i == len(segs)-1 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 重放结果
+type ReplayResult struct {
+	Applied uint64 // 执行的记录数
+	Skipped uint64 // 无法重放的记录数，如回收站和快照恢复
+	Last    uint64 // 最后一条记录的序号
+}
+
+// 将日志重放到一个空目录中，记录中的路径都放在target下
+func Replay(dir, target string, logger func(string)) (*ReplayResult, error) {
+	target = path.Clean(target)
+	fl, err := util.ReadDir(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(fl) > 0 {
+		return nil, errors.New("replay target is not empty: " + target)
+	}
+	res := new(ReplayResult)
+	err = ReadJournal(dir, 0, func(r *JournalRecord) error {
+		res.Last = r.Seq
+		ok, err := applyRecord(dir, target, r)
+		if err != nil {
+			return errors.New("replay record " + strconv.FormatUint(r.Seq, 10) + " error: " + err.Error())
+		}
+		if ok {
+			res.Applied++
+		} else {
+			res.Skipped++
+			if logger != nil {
+				logger("replay record " + strconv.FormatUint(r.Seq, 10) + " skipped, method " +
+					strconv.FormatUint(uint64(r.Method), 10) + " cannot replay: " + r.Path)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// 在target下执行一条记录，不支持的操作返回false
+func applyRecord(dir, target string, r *JournalRecord) (bool, error) {
+	p := target + r.Path
+	np := target + r.NewPath
+	switch int(r.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE:
+		body, err := ioutil.ReadFile(journalBody(dir, r.Hash))
+		if err != nil {
+			return false, err
+		}
+		if util.Hash(body) != r.Hash {
+			return false, errors.New("body checksum mismatch: " + r.Hash)
+		}
+		err = checkPath(p)
+		if err != nil {
+			return false, err
+		}
+		flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if int(r.Method) == METHOD_APPEND_FILE {
+			flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(p, flag, 0664)
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Write(body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return true, err
+	case METHOD_REMOVE_FILE:
+		err := os.Remove(p)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return true, err
+	case METHOD_CREATE_DIR:
+		return true, os.MkdirAll(p, 0755)
+	case METHOD_REMOVE_DIR:
+		return true, os.RemoveAll(p)
+	case METHOD_CLEAR_DIR:
+		err := os.RemoveAll(p)
+		if err == nil {
+			err = os.MkdirAll(p, 0755)
+		}
+		return true, err
+	case METHOD_COPY:
+		err := checkPath(np)
+		if err != nil {
+			return false, err
+		}
+		if isDir(p) {
+			return true, util.CopyDir(p, np)
+		}
+		return true, util.CopyFile(p, np)
+	case METHOD_RENAME:
+		err := checkPath(np)
+		if err != nil {
+			return false, err
+		}
+		return true, os.Rename(p, np)
+	}
+	return false, nil
+}
+
+// 请求凭证，不记录密钥本身，使用credKey计算HMAC，读取操作日志不能离线破解密钥
+// 没有配置credKey时不记录
+func (j *Journal) credential(password string) string {
+	if password == "" || len(j.credKey) == 0 {
+		return ""
+	}
+	m := hmac.New(sha256.New, j.credKey)
+	m.Write([]byte(password))
+	return hex.EncodeToString(m.Sum(nil))[:16]
+}
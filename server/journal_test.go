@@ -0,0 +1,221 @@
+package server
+
+import (
+	"cmstop-fserver/util"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 记录的操作重放到空目录后和原目录相同
+func TestJournalReplay(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, 256, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.journal = j
+
+	for _, rec := range []*FileData{
+		{Method: METHOD_CREATE_FILE, Path: root + "/a.html", Body: []byte("a")},
+		{Method: METHOD_APPEND_FILE, Path: root + "/a.html", Body: []byte("+")},
+		{Method: METHOD_CREATE_DIR, Path: root + "/news"},
+		{Method: METHOD_COPY, Path: root + "/a.html", Body: []byte(`{"newpath":"` + root + `/news/b.html"}`)},
+		{Method: METHOD_RENAME, Path: root + "/a.html", Body: []byte(`{"newpath":"` + root + `/c.html"}`)},
+		{Method: METHOD_STAT, Path: root + "/c.html"},
+		batchRequest(t,
+			&BatchOp{Method: METHOD_CREATE_FILE, Path: root + "/news/d.html", Body: []byte("d")},
+			&BatchOp{Method: METHOD_REMOVE_FILE, Path: root + "/c.html"},
+		),
+	} {
+		rec.Password = "pw"
+		if _, err = s.ctFile.Handle(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if j.Seq() != 7 {
+		t.Fatalf("journal seq %d, want 7", j.Seq())
+	}
+	if segs, _ := journalSegments(dir); len(segs) < 2 {
+		t.Fatalf("journal not rotated, %d segments", len(segs))
+	}
+	j.Close()
+
+	target := t.TempDir()
+	res, err := Replay(dir, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Applied != 7 || res.Last != 7 {
+		t.Fatalf("replay result %+v", res)
+	}
+	for _, p := range []string{"/news/b.html", "/news/d.html"} {
+		want := readTestFile(root + p)
+		if got := readTestFile(target + root + p); got != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+	if _, err = os.Stat(target + root + "/c.html"); !os.IsNotExist(err) {
+		t.Error("file removed in batch exists after replay")
+	}
+}
+
+// 从回收站和快照恢复记录为恢复后的内容，重放后和原目录相同
+func TestJournalRestore(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	st := newTestStore(t, s, 0, 0)
+	snaps, err := NewSnapshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.snaps = snaps
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.journal = j
+	handle := func(rec *FileData) interface{} {
+		res, err := s.ctFile.Handle(rec)
+		if err != nil {
+			t.Fatalf("method %d %s: %v", rec.Method, rec.Path, err)
+		}
+		return res
+	}
+	trash := func(p string) string {
+		list, _ := st.TrashList(p)
+		return `{"trash":"` + list[0].Id + `"}`
+	}
+
+	handle(&FileData{Method: METHOD_CREATE_FILE, Path: root + "/www/a.html", Body: []byte("a")})
+	handle(&FileData{Method: METHOD_CREATE_FILE, Path: root + "/www/css/b.html", Body: []byte("b")})
+	snap := handle(&FileData{Method: METHOD_SNAPSHOT_CREATE, Path: root + "/www"}).(*Snapshot)
+	handle(&FileData{Method: METHOD_REMOVE_FILE, Path: root + "/www/a.html"})
+	handle(&FileData{Method: METHOD_RESTORE, Path: root + "/www/a.html", Body: []byte(trash(root + "/www/a.html"))})
+	handle(&FileData{Method: METHOD_REMOVE_DIR, Path: root + "/www/css"})
+	handle(&FileData{Method: METHOD_RESTORE, Path: root + "/www/css", Body: []byte(trash(root + "/www/css"))})
+	handle(&FileData{Method: METHOD_MODIFY_FILE, Path: root + "/www/a.html", Body: []byte("changed")})
+	handle(&FileData{Method: METHOD_CREATE_FILE, Path: root + "/www/new.html", Body: []byte("new")})
+	handle(&FileData{Method: METHOD_SNAPSHOT_RESTORE, Path: root + "/www", Body: []byte(`{"id":"` + snap.Id + `"}`)})
+	j.Close()
+
+	target := t.TempDir()
+	res, err := Replay(dir, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Skipped != 0 {
+		t.Errorf("replay skipped %d records", res.Skipped)
+	}
+	for p, want := range map[string]string{"/www/a.html": "a", "/www/css/b.html": "b"} {
+		if got := readTestFile(target + root + p); got != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+	if _, err = os.Stat(target + root + "/www/new.html"); !os.IsNotExist(err) {
+		t.Error("file removed by snapshot restore exists after replay")
+	}
+}
+
+func TestJournalTornAndCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = j.Write(&JournalRecord{Method: METHOD_CREATE_DIR, Path: "/data/a"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := j.f.Name()
+	j.Close()
+
+	// 写入一半的记录在打开时被截断，序号继续
+	f, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{50, 0, 0, 0, 1, 2})
+	f.Close()
+	j, err = OpenJournal(dir, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Write(&JournalRecord{Method: METHOD_CREATE_DIR, Path: "/data/b"}, nil)
+	j.Close()
+	n := 0
+	err = ReadJournal(dir, 2, func(r *JournalRecord) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("read after seq 2: %d records, %v", n, err)
+	}
+
+	// 校验失败
+	b, _ := ioutil.ReadFile(name)
+	b[len(b)-3] ^= 0xff
+	ioutil.WriteFile(name, b, 0644)
+	err = ReadJournal(dir, 0, func(r *JournalRecord) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("corrupt record not detected: %v", err)
+	}
+}
+
+// 超过总大小时删除最早的分段和只被它们引用的写入内容
+func TestJournalCompactTotal(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(dir, 256, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	bodies := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		body := []byte(strings.Repeat(strconv.Itoa(i), 1024))
+		if err = j.Write(&JournalRecord{Method: METHOD_CREATE_FILE, Path: "/data/a.html"}, body); err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, j.Body(util.Hash(body)))
+	}
+	// 写入内容保存一分钟内不清理
+	old := time.Now().Add(-time.Hour)
+	for _, b := range bodies {
+		os.Chtimes(b, old, old)
+	}
+	segs, _ := journalSegments(dir)
+	j.total = 3 * 1024
+	if err = j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := journalSegments(dir)
+	if len(left) >= len(segs) || len(left) == 0 {
+		t.Fatalf("segments %d -> %d", len(segs), len(left))
+	}
+	if _, err = os.Stat(bodies[0]); !os.IsNotExist(err) {
+		t.Error("body of dropped segment kept")
+	}
+	if _, err = os.Stat(bodies[7]); err != nil {
+		t.Error("body of current segment removed")
+	}
+	// 当前分段超过上限时也不删除
+	j.total = 1
+	j.Compact()
+	if left, _ = journalSegments(dir); len(left) != 1 {
+		t.Errorf("%d segments left", len(left))
+	}
+}
+
+func TestJournalCredential(t *testing.T) {
+	j := &Journal{}
+	if c := j.credential("pw"); c != "" {
+		t.Errorf("credential without key: %s", c)
+	}
+	j.credKey = []byte("key")
+	c := j.credential("pw")
+	if len(c) != 16 || c == util.Hash([]byte("pw"))[:16] || c == j.credential("pw2") {
+		t.Errorf("credential %s", c)
+	}
+}
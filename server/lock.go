@@ -0,0 +1,227 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+hierarchical path lock manager.
+
+a lock on a path covers it's subtree, two locks conflict when one path
+is the other or an ancestor of it, and at least one of them is exclusive.
+every operation takes short-lived locks on the paths it touches and waits
+for conflicting operations. clients can hold leased locks across requests
+with METHOD_LOCK/METHOD_UNLOCK, other requests touching a leased subtree
+fail immediately with CODE_LOCKED unless they carry the lease token.
+*/
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEF_LEASE = 30 * time.Second  // 默认租约时长
+	MAX_LEASE = 600 * time.Second // 最长租约时长
+)
+
+// 加锁的路径
+type lockPath struct {
+	path   string
+	shared bool // 共享锁，读操作使用
+}
+
+// 租约锁，客户端通过METHOD_LOCK获得
+type Lease struct {
+	Token  string `json:"token"`  // 租约令牌，后续请求在RequestMeta中携带
+	Path   string `json:"path"`   // 锁定的路径，含子目录
+	Shared bool   `json:"shared"` // 是否是共享锁
+	Expire int64  `json:"expire"` // 过期时间，unix时间戳
+}
+
+// 加锁参数，METHOD_LOCK的body是它的json编码，允许为空
+type lockParams struct {
+	Lease  int  `json:"lease"`  // 租约时长，秒
+	Shared bool `json:"shared"` // 是否是共享锁
+}
+
+// 路径锁管理
+type LockManager struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	held   map[uint64][]lockPath // 操作持有的锁
+	leases map[string]*Lease     // 租约锁，key为令牌
+	seq    uint64
+}
+
+func NewLockManager() *LockManager {
+	m := new(LockManager)
+	m.cond = sync.NewCond(&m.mu)
+	m.held = make(map[uint64][]lockPath)
+	m.leases = make(map[string]*Lease)
+	return m
+}
+
+// 锁定操作涉及的路径，等待冲突的操作完成，返回解锁函数
+// 路径与其他令牌的租约冲突时立即返回CODE_LOCKED错误，token为请求携带的租约令牌
+func (m *LockManager) Lock(token string, paths ...lockPath) (func(), error) {
+	paths = cleanLockPaths(paths)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if err := m.checkLeases(token, paths); err != nil {
+			return nil, err
+		}
+		if !m.heldConflict(paths) {
+			break
+		}
+		m.cond.Wait()
+	}
+	m.seq++
+	id := m.seq
+	m.held[id] = paths
+	return func() {
+		m.mu.Lock()
+		delete(m.held, id)
+		m.mu.Unlock()
+		m.cond.Broadcast()
+	}, nil
+}
+
+// 获取或续期一个租约锁，token为空时新建租约，不为空时续期该租约
+func (m *LockManager) Acquire(token, p string, shared bool, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		ttl = DEF_LEASE
+	}
+	if ttl > MAX_LEASE {
+		ttl = MAX_LEASE
+	}
+	p = path.Clean(p)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLeases()
+
+	if token != "" {
+		l, ok := m.leases[token]
+		if !ok {
+			return nil, &CodeError{CODE_LOCKED, "lock token not found or expired"}
+		}
+		if l.Path != p {
+			return nil, errors.New("lock token belongs to another path: " + l.Path)
+		}
+		l.Expire = time.Now().Add(ttl).Unix()
+		c := *l
+		return &c, nil
+	}
+
+	paths := []lockPath{{p, shared}}
+	for {
+		if err := m.checkLeases("", paths); err != nil {
+			return nil, err
+		}
+		// 等待正在执行的冲突操作完成
+		if !m.heldConflict(paths) {
+			break
+		}
+		m.cond.Wait()
+	}
+	l := &Lease{Token: newToken(), Path: p, Shared: shared, Expire: time.Now().Add(ttl).Unix()}
+	m.leases[l.Token] = l
+	c := *l
+	return &c, nil
+}
+
+// 释放一个租约锁
+func (m *LockManager) Release(token, p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.leases[token]
+	if !ok {
+		return &CodeError{CODE_LOCKED, "lock token not found or expired"}
+	}
+	if l.Path != path.Clean(p) {
+		return errors.New("lock token belongs to another path: " + l.Path)
+	}
+	delete(m.leases, token)
+	return nil
+}
+
+// 当前有效的租约锁
+func (m *LockManager) Leases() []*Lease {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLeases()
+	list := make([]*Lease, 0, len(m.leases))
+	for _, l := range m.leases {
+		c := *l
+		list = append(list, &c)
+	}
+	return list
+}
+
+// 检查路径是否与其他令牌的租约冲突，需要持有mu
+func (m *LockManager) checkLeases(token string, paths []lockPath) error {
+	m.expireLeases()
+	for t, l := range m.leases {
+		if t == token {
+			continue
+		}
+		for _, p := range paths {
+			if (!p.shared || !l.Shared) && overlap(p.path, l.Path) {
+				return &CodeError{CODE_LOCKED, "path is locked: " + l.Path}
+			}
+		}
+	}
+	return nil
+}
+
+// 检查路径是否与正在执行的操作冲突，需要持有mu
+func (m *LockManager) heldConflict(paths []lockPath) bool {
+	for _, held := range m.held {
+		for _, h := range held {
+			for _, p := range paths {
+				if (!p.shared || !h.shared) && overlap(p.path, h.path) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// 删除过期的租约，需要持有mu
+func (m *LockManager) expireLeases() {
+	now := time.Now().Unix()
+	for t, l := range m.leases {
+		if l.Expire < now {
+			delete(m.leases, t)
+		}
+	}
+}
+
+// 判断两个路径是否有包含关系
+func overlap(a, b string) bool {
+	if a == b || a == "/" || b == "/" {
+		return true
+	}
+	return strings.HasPrefix(b, a+"/") || strings.HasPrefix(a, b+"/")
+}
+
+func cleanLockPaths(paths []lockPath) []lockPath {
+	list := make([]lockPath, 0, len(paths))
+	for _, p := range paths {
+		if p.path == "" {
+			continue
+		}
+		list = append(list, lockPath{path.Clean(p.path), p.shared})
+	}
+	return list
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"/data/news", "/data/news", true},
+		{"/data/news", "/data/news/a.html", true},
+		{"/data/news/2015", "/data/news", true},
+		{"/data/news", "/data/newsletter", false},
+		{"/data/a", "/data/b", false},
+		{"/", "/data", true},
+	}
+	for _, tt := range tests {
+		if got := overlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("overlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// 子目录上的操作等待父目录上的操作完成，共享锁之间不等待
+func TestLockWait(t *testing.T) {
+	m := NewLockManager()
+	unlock, err := m.Lock("", lockPath{"/data/news", false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, err := m.Lock("", lockPath{"/data/other", true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1()
+
+	done := make(chan struct{})
+	go func() {
+		u, _ := m.Lock("", lockPath{"/data/news/a.html", true})
+		u()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("lock on subtree did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock not granted after unlock")
+	}
+}
+
+func TestLease(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	dir := root + "/news"
+	resp, err := s.ctFile.Handle(&FileData{Method: METHOD_LOCK, Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := resp.(*Lease)
+
+	write := &FileData{Method: METHOD_CREATE_FILE, Path: dir + "/a.html", Body: []byte("a")}
+	_, err = s.ctFile.Handle(write)
+	if e, ok := err.(*CodeError); !ok || e.Code != CODE_LOCKED {
+		t.Fatalf("write without token: %v, want CODE_LOCKED", err)
+	}
+	write.Meta = &RequestMeta{LockToken: lease.Token}
+	if _, err = s.ctFile.Handle(write); err != nil {
+		t.Fatalf("write with token: %v", err)
+	}
+
+	// 共享租约不阻止读操作，阻止另一个排他租约
+	body, _ := json.Marshal(&lockParams{Shared: true})
+	if _, err = s.ctFile.Handle(&FileData{Method: METHOD_LOCK, Path: root, Body: body}); err == nil {
+		t.Fatal("shared lease on parent of exclusive lease granted")
+	}
+
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_UNLOCK, Path: dir, Meta: &RequestMeta{LockToken: lease.Token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write.Meta = nil
+	if _, err = s.ctFile.Handle(write); err != nil {
+		t.Fatalf("write after unlock: %v", err)
+	}
+}
+
+func TestLeaseExpire(t *testing.T) {
+	m := NewLockManager()
+	l, err := m.Acquire("", "/data", false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.leases[l.Token].Expire = time.Now().Add(-time.Second).Unix()
+	if _, err = m.Lock("", lockPath{"/data/a", false}); err != nil {
+		t.Fatalf("expired lease still blocks: %v", err)
+	}
+	if len(m.Leases()) != 0 {
+		t.Fatal("expired lease not removed")
+	}
+}
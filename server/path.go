@@ -0,0 +1,242 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	MAX_SYMLINKS = 40 // 解析路径时最多跟随的符号链接数，和内核相同
+)
+
+// 清理路径，去掉..、.和多余的/，空路径保持为空
+func cleanPath(p string) string {
+	if p == "" {
+		return p
+	}
+	return path.Clean(p)
+}
+
+// 判断路径p是否是目录d或在目录d中，按完整的路径分段比较，/tmp2不在/tmp中
+func inDir(p, d string) bool {
+	return p == d || d == "/" || strings.HasPrefix(p, d+"/")
+}
+
+// 从root开始逐级检查路径的每一段，不跟随离开root的符号链接
+// 符号链接按内容继续解析，指向root之外(绝对路径或..)时返回错误
+// 遇到不存在的一段时停止，之后的部分会在root中创建
+// p必须是root中已经清理过的路径
+// 这个检查在请求开始时拒绝离开rootDir的路径，和之后的操作之间不是原子的，
+// 文件的写入、读取、删除和更名使用openInRoot等从rootDir的文件描述符开始逐级打开，
+// 检查之后被替换为符号链接的目录不会被跟随到rootDir之外
+// 复制目录时不跟随目录中的符号链接(util.CopyDir)
+func resolveInRoot(root, p string) error {
+	rest := strings.Split(strings.TrimPrefix(p, root), "/")
+	cur := root
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if cur == root {
+				return errors.New("Path escapes rootDir")
+			}
+			cur = path.Dir(cur)
+			continue
+		}
+		next := path.Join(cur, name)
+		f, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if f.Mode()&os.ModeSymlink == 0 {
+			// 文件后面还有路径时，操作本身会失败
+			if !f.IsDir() {
+				return nil
+			}
+			cur = next
+			continue
+		}
+		links++
+		if links > MAX_SYMLINKS {
+			return errors.New("Path has too many symlinks")
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if path.IsAbs(target) {
+			target = path.Clean(target)
+			if !inDir(target, root) {
+				return errors.New("Path symlink leaves rootDir: " + next)
+			}
+			cur = root
+			target = strings.TrimPrefix(target, root)
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return nil
+}
+
+// 路径中打开的一级目录
+type rootEntry struct {
+	fd   int    // 目录的文件描述符
+	name string // 在上一级目录中的名称
+}
+
+// 从root的文件描述符开始逐级用openat(O_NOFOLLOW)打开p所在的目录，返回目录的文件描述符和最后一段名称
+// 符号链接通过/proc/self/fd从已打开的目录读取，按内容在root中继续解析，离开root时返回错误
+// 最后一段不跟随，调用者用O_NOFOLLOW或*at系统调用操作，之后被替换为符号链接时操作失败
+// mkdir为true时创建不存在的目录，返回的文件描述符由调用者关闭
+func walkInRoot(root, p string, mkdir bool) (int, string, error) {
+	if !inDir(p, root) {
+		return -1, "", errors.New("Path not in rootDir")
+	}
+	fd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, "", &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	stack := []rootEntry{{fd, ""}}
+	defer func() {
+		for _, e := range stack {
+			syscall.Close(e.fd)
+		}
+	}()
+	fail := func(op, name string, err error) (int, string, error) {
+		return -1, "", &os.PathError{Op: op, Path: p + " (" + name + ")", Err: err}
+	}
+	rest := strings.Split(strings.TrimPrefix(p, root), "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) == 1 {
+				return -1, "", errors.New("Path escapes rootDir")
+			}
+			syscall.Close(stack[len(stack)-1].fd)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		dir := stack[len(stack)-1].fd
+		target, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(dir) + "/" + name)
+		if err == nil {
+			links++
+			if links > MAX_SYMLINKS {
+				return -1, "", errors.New("Path has too many symlinks")
+			}
+			if path.IsAbs(target) {
+				target = path.Clean(target)
+				if !inDir(target, root) {
+					return -1, "", errors.New("Path symlink leaves rootDir: " + name)
+				}
+				for _, e := range stack[1:] {
+					syscall.Close(e.fd)
+				}
+				stack = stack[:1]
+				target = strings.TrimPrefix(target, root)
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+			continue
+		}
+		if last(rest) {
+			// 最后一段，返回所在目录的文件描述符，不再关闭
+			stack = stack[:len(stack)-1]
+			return dir, name, nil
+		}
+		fd, err := syscall.Openat(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err == syscall.ENOENT && mkdir {
+			err = syscall.Mkdirat(dir, name, 0755)
+			if err == nil || err == syscall.EEXIST {
+				fd, err = syscall.Openat(dir, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+			}
+		}
+		if err != nil {
+			return fail("openat", name, err)
+		}
+		stack = append(stack, rootEntry{fd, name})
+	}
+	// 路径以目录结束(符号链接指向..等)，返回上一级目录和目录的名称
+	if len(stack) == 1 {
+		return -1, "", errors.New("Path is rootDir")
+	}
+	e := stack[len(stack)-1]
+	syscall.Close(e.fd)
+	stack = stack[:len(stack)-1]
+	dir := stack[len(stack)-1].fd
+	stack = stack[:len(stack)-1]
+	return dir, e.name, nil
+}
+
+// 剩余的路径中是否只有空的段和.
+func last(rest []string) bool {
+	for _, name := range rest {
+		if name != "" && name != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// 在root中打开文件，路径中的每一段相对于上一级目录打开，不跟随符号链接离开root
+// flag含os.O_CREATE时创建不存在的上级目录
+func openInRoot(root, p string, flag int, perm os.FileMode) (*os.File, error) {
+	dir, name, err := walkInRoot(root, p, flag&os.O_CREATE != 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dir)
+	fd, err := syscall.Openat(dir, name, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+// 在root中删除文件，不跟随符号链接离开root，文件本身是符号链接时删除链接
+func removeInRoot(root, p string) error {
+	dir, name, err := walkInRoot(root, p, false)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dir)
+	err = syscall.Unlinkat(dir, name)
+	if err != nil {
+		return &os.PathError{Op: "unlink", Path: p, Err: err}
+	}
+	return nil
+}
+
+// 更名，源路径和目标路径分别相对于所在的oroot和nroot逐级打开，目标的上级目录不存在时创建
+func renameInRoot(oroot, oldpath, nroot, newpath string) error {
+	odir, oname, err := walkInRoot(oroot, oldpath, false)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(odir)
+	ndir, nname, err := walkInRoot(nroot, newpath, true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(ndir)
+	err = syscall.Renameat(odir, oname, ndir, nname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
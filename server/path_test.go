@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// 在rootDir中创建指向外部和内部的符号链接
+func newTestPathServer(t testing.TB) (*Server, string) {
+	root, err := ioutil.TempDir("", "fserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	// 临时目录本身可能在符号链接中
+	root, _ = filepath.EvalSymlinks(root)
+	os.MkdirAll(root+"/www/sub", 0755)
+	os.Symlink("/etc", root+"/www/etc")
+	os.Symlink("../..", root+"/www/up")
+	os.Symlink("../../..", root+"/www/sub/up3")
+	os.Symlink("sub", root+"/www/in")
+	os.Symlink(root+"/www/sub", root+"/www/abs")
+	os.Symlink("loop", root+"/www/loop")
+	os.Symlink("etc/passwd", root+"/www/passwd.html")
+	s := NewServer()
+	s.settings().rootDir = []string{root + "/www"}
+	return s, root
+}
+
+func TestCheckPath(t *testing.T) {
+	s, root := newTestPathServer(t)
+	www := root + "/www"
+	allow := []string{
+		www,
+		www + "/index.html",
+		www + "/new/dir/a.html",
+		www + "/in/a.html",
+		www + "/abs/a.html",
+		www + "/sub/a.html",
+	}
+	deny := []string{
+		"www/index.html",
+		www + "/../index.html",
+		www + "/sub/../../index.html",
+		www + "/./index.html",
+		www + "//index.html",
+		www + "/",
+		www + "2/index.html",
+		root,
+		www + "/etc/passwd",
+		www + "/etc",
+		www + "/passwd.html",
+		www + "/up/index.html",
+		www + "/sub/up3/index.html",
+		www + "/in/up3/index.html",
+		www + "/loop/a.html",
+		www + "/shell.php",
+		"/etc/passwd",
+	}
+	for _, p := range allow {
+		if err := s.CheckPath(p); err != nil {
+			t.Errorf("%s denied: %v", p, err)
+		}
+	}
+	for _, p := range deny {
+		if err := s.CheckPath(p); err == nil {
+			t.Errorf("%s allowed", p)
+		}
+	}
+
+	// 复制和重命名的目标路径同样检查
+	s.ctFile = NewCtFile(s)
+	ioutil.WriteFile(www+"/index.html", []byte("x"), 0644)
+	for _, np := range []string{www + "/up/x.html", www + "/etc/x.html", www + "2/x.html"} {
+		if err := s.ctFile.Rename(www+"/index.html", []byte(`{"newpath":"`+np+`"}`)); err == nil {
+			t.Errorf("renamed to %s", np)
+		}
+		if err := s.ctFile.Copy(www+"/index.html", []byte(`{"newpath":"`+np+`"}`)); err == nil {
+			t.Errorf("copied to %s", np)
+		}
+	}
+}
+
+// 通过检查的路径解析符号链接后必须仍在rootDir中
+func FuzzCheckPath(f *testing.F) {
+	for _, p := range []string{
+		"index.html", "../index.html", "sub/../../etc/passwd", "up/tmp", "in/up3/x",
+		"etc/passwd", "./a", "a//b", "abs/../../x", "..", "passwd.html", "loop/x",
+		"in/../in/a.html", "sub/up3", "%2e%2e/x", "a\x00b", "sub/\\..\\..\\x",
+	} {
+		f.Add(p)
+	}
+	s, root := newTestPathServer(f)
+	www := root + "/www"
+	f.Fuzz(func(t *testing.T, rel string) {
+		for _, p := range []string{www + "/" + rel, rel} {
+			if s.CheckPath(p) != nil {
+				continue
+			}
+			if !inDir(p, www) {
+				t.Fatalf("%q allowed outside rootDir", p)
+			}
+			if real := existingPrefix(p); !inDir(real, www) {
+				t.Fatalf("%q allowed, resolves to %q", p, real)
+			}
+		}
+	})
+}
+
+// 解析路径中已存在部分的符号链接
+func existingPrefix(p string) string {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(real, rest)
+		}
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			return ""
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = filepath.Dir(p)
+	}
+}
+
+// 检查之后目录被替换为指向外部的符号链接，写入、读取、删除和更名不跟随到rootDir之外
+func TestPathSwappedAfterCheck(t *testing.T) {
+	s, root := newTestPathServer(t)
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.ctFile = NewCtFile(s)
+	www := root + "/www"
+	outside := root + "/outside"
+	os.Mkdir(outside, 0755)
+	ioutil.WriteFile(outside+"/secret.html", []byte("secret"), 0644)
+	os.Mkdir(www+"/dir", 0755)
+	if err := s.CheckPath(www + "/dir/secret.html"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(www + "/dir")
+	os.Symlink(outside, www+"/dir")
+
+	if err := s.ctFile.WriteFile(www+"/dir/secret.html", []byte("x"), false); err == nil {
+		t.Error("written through swapped directory")
+	}
+	if b, err := s.ctFile.ReadFile(www + "/dir/secret.html"); err == nil {
+		t.Errorf("read through swapped directory: %q", b)
+	}
+	if err := s.ctFile.RemoveFile(www + "/dir/secret.html"); err == nil {
+		t.Error("removed through swapped directory")
+	}
+	ioutil.WriteFile(www+"/a.html", []byte("a"), 0644)
+	if err := s.ctFile.rename(www+"/a.html", www+"/dir/a.html"); err == nil {
+		t.Error("renamed through swapped directory")
+	}
+	if b, _ := ioutil.ReadFile(outside + "/secret.html"); string(b) != "secret" {
+		t.Errorf("outside file changed: %q", b)
+	}
+	if _, err := os.Stat(outside + "/a.html"); !os.IsNotExist(err) {
+		t.Error("file moved outside rootDir")
+	}
+
+	// rootDir中的符号链接和不存在的目录
+	if err := s.ctFile.WriteFile(www+"/in/a.html", []byte("in"), false); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(www + "/sub/a.html"); string(b) != "in" {
+		t.Errorf("sub/a.html = %q", b)
+	}
+	if err := s.ctFile.WriteFile(www+"/new/dir/a.html", []byte("new"), false); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.ctFile.ReadFile(www + "/abs/a.html"); string(b) != "in" {
+		t.Errorf("abs/a.html = %q %v", b, err)
+	}
+	// 文件本身是指向外部的符号链接
+	os.Symlink(outside+"/secret.html", www+"/link.html")
+	if err := s.ctFile.WriteFile(www+"/link.html", []byte("x"), false); err == nil {
+		t.Error("written through file symlink")
+	}
+}
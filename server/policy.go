@@ -0,0 +1,122 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var (
+	DENY_EXT  = []string{"php", "php3", "php4", "php5", "php7", "phtml", "phar", "cgi", "pl", "py", "asp", "aspx", "jsp"} // 禁止使用的扩展名
+	DENY_DIR  = []string{"/etc/", "/boot/"}                                                                               // 禁止写入的目录
+	DENY_NAME = []string{".htaccess", ".htpasswd", ".user.ini", "web.config"}                                             // 禁止使用的文件名，会改变web服务器的配置
+)
+
+// 路径策略，配置的列表和内置列表合并，扩展名和文件名不区分大小写
+type PathPolicy struct {
+	allowExt   map[string]bool // 允许写入的扩展名，为nil时不限制
+	allowNoExt bool            // 是否允许写入没有扩展名的文件，allowExt为nil时不限制
+	denyExt    map[string]bool // 禁止使用的扩展名
+	denyName   map[string]bool // 禁止使用的文件名
+	denyDir    []string        // 禁止写入的目录
+}
+
+// 创建路径策略，allowExt为空或含有*时不限制写入的扩展名
+func NewPathPolicy(allowExt, denyExt, denyDir, denyName []string) (*PathPolicy, error) {
+	p := new(PathPolicy)
+	p.denyExt = lowerSet(append(DENY_EXT, denyExt...), ".")
+	p.denyName = lowerSet(append(DENY_NAME, denyName...), "")
+	if len(allowExt) > 0 {
+		p.allowExt = lowerSet(allowExt, ".")
+		if p.allowExt["*"] {
+			p.allowExt = nil
+		}
+		for e := range p.allowExt {
+			if p.denyExt[e] {
+				return nil, errors.New("allowExt contains denied extension: " + e)
+			}
+		}
+	}
+	for _, d := range append(DENY_DIR, denyDir...) {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if !path.IsAbs(d) {
+			return nil, errors.New("denyDir must be absolute: " + d)
+		}
+		p.denyDir = append(p.denyDir, path.Clean(d))
+	}
+	return p, nil
+}
+
+// 转为小写的集合，去掉空白和前缀prefix，忽略空项
+func lowerSet(list []string, prefix string) map[string]bool {
+	set := make(map[string]bool)
+	for _, e := range list {
+		e = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(e)), prefix)
+		if e != "" {
+			set[e] = true
+		}
+	}
+	return set
+}
+
+// 检查禁止的目录、文件名和扩展名，文件名中的每一段扩展名都检查，x.php.html也被禁止
+func (p *PathPolicy) Check(filepath string) error {
+	for _, d := range p.denyDir {
+		if inDir(filepath, d) {
+			return errors.New("Path in DENY_DIR")
+		}
+	}
+	name := baseName(filepath)
+	if p.denyName[name] {
+		return errors.New("Name in DENY_NAME")
+	}
+	for _, e := range extensions(name) {
+		if p.denyExt[e] {
+			return errors.New("Extension in DENY_EXT")
+		}
+	}
+	return nil
+}
+
+// 检查写入文件的扩展名，没有扩展名的文件需要allowNoExt
+func (p *PathPolicy) CheckWrite(filepath string) error {
+	if p.allowExt == nil {
+		return nil
+	}
+	ext := fileExt(filepath)
+	if ext == "" {
+		if !p.allowNoExt {
+			return errors.New("File without extension not allowed")
+		}
+		return nil
+	}
+	if !p.allowExt[ext] {
+		return errors.New("Extension not in allowExt")
+	}
+	return nil
+}
+
+// 小写的文件名，去掉结尾的.和空格，部分系统和web服务器会忽略它们
+func baseName(filepath string) string {
+	return strings.TrimRight(strings.ToLower(path.Base(filepath)), ". ")
+}
+
+// 文件名中.之后的每一段，.htaccess为htaccess
+func extensions(name string) []string {
+	parts := strings.Split(name, ".")
+	return parts[1:]
+}
+
+// 小写的最后一段扩展名，不含.，没有时为空
+func fileExt(filepath string) string {
+	ext := extensions(baseName(filepath))
+	if len(ext) == 0 {
+		return ""
+	}
+	return ext[len(ext)-1]
+}
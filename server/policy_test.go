@@ -0,0 +1,80 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPathPolicy(t *testing.T) {
+	p, err := NewPathPolicy([]string{"html", ".CSS", " js"}, []string{"exe"}, []string{"/data/private/"}, []string{"Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := []string{
+		"/data/www/shell.php",
+		"/data/www/shell.PHP",
+		"/data/www/shell.Php5",
+		"/data/www/x.php.html",
+		"/data/www/x.phtml.",
+		"/data/www/x.php ",
+		"/data/www/.htaccess",
+		"/data/www/.HTACCESS",
+		"/data/www/.user.ini",
+		"/data/www/Web.Config",
+		"/data/www/makefile",
+		"/data/www/run.exe",
+		"/data/private",
+		"/data/private/a.html",
+		"/etc/passwd",
+	}
+	for _, f := range deny {
+		if p.Check(f) == nil {
+			t.Errorf("%s allowed", f)
+		}
+	}
+	allow := []string{"/data/www/index.html", "/data/privates/a.html", "/data/www/README", "/data/www/php/a.html", "/data/www/x.user"}
+	for _, f := range allow {
+		if err := p.Check(f); err != nil {
+			t.Errorf("%s denied: %v", f, err)
+		}
+	}
+
+	for f, ok := range map[string]bool{"/a/x.html": true, "/a/x.HTML": true, "/a/x.min.css": true, "/a/README": false, "/a/x.": false,
+		"/a/x.txt": false, "/a/x.html.txt": false, "/a/.profile": false} {
+		if err := p.CheckWrite(f); (err == nil) != ok {
+			t.Errorf("write %s: %v", f, err)
+		}
+	}
+	// 没有扩展名的文件需要明确允许
+	p.allowNoExt = true
+	if p.CheckWrite("/a/README") != nil || p.CheckWrite("/a/x.txt") == nil {
+		t.Errorf("allowNoExt")
+	}
+	if p, _ = NewPathPolicy([]string{"*"}, nil, nil, nil); p.CheckWrite("/a/x.txt") != nil {
+		t.Errorf("allowExt * should not limit")
+	}
+	if _, err = NewPathPolicy([]string{"html", "PHP"}, nil, nil, nil); err == nil {
+		t.Errorf("allowExt with denied extension accepted")
+	}
+}
+
+func TestPolicyWrite(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().policy, _ = NewPathPolicy([]string{"html"}, nil, nil, nil)
+	_, err := s.handleRequest(&FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/a.txt", Body: []byte("a")})
+	if err == nil {
+		t.Errorf("extension not in allowExt written")
+	}
+	ioutil.WriteFile(root+"/a.html", []byte("a"), 0644)
+	_, err = s.handleRequest(&FileData{Method: METHOD_RENAME, Password: "pw", Path: root + "/a.html", Body: []byte(`{"newpath":"` + root + `/a.txt"}`)})
+	if err == nil {
+		t.Errorf("renamed to extension not in allowExt")
+	}
+	// 目录不检查允许的扩展名
+	os.Mkdir(root+"/v1.2", 0755)
+	_, err = s.handleRequest(&FileData{Method: METHOD_RENAME, Password: "pw", Path: root + "/v1.2", Body: []byte(`{"newpath":"` + root + `/v1.3"}`)})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+configuration reload.
+
+on SIGHUP cmstop.conf and injection.conf are read again, the settings which
+can change at runtime (rootDir, maxSize, allowExt and the deny lists,
+password, hmac, mail and the content filter) are loaded into a new Server first,
+an invalid config is rejected and the old one stays active. the settings are
+an immutable struct swapped atomically, a request takes the current one when
+it starts, nothing waits for a reload and a reload waits for no request.
+checks made later in a request (each batch entry, the destination of a copy
+or rename) take the settings current at that moment.
+listen address, pipeline, tls, retention, snapshot, journal, replica and
+scan settings need a restart.
+*/
+package server
+
+import (
+	"errors"
+	"github.com/9466/goconfig"
+)
+
+// 重新加载配置，检查通过后整体替换，失败时保留原配置
+func (s *Server) Reload(conf *goconfig.ConfigFile, injectionFile string) error {
+	c, err := s.loadSettings(conf)
+	if err == nil {
+		err = c.loadInjection(injectionFile)
+	}
+	if err == nil {
+		err = s.checkRootDir(c.rootDir)
+	}
+	if err != nil {
+		return err
+	}
+	s.conf.Store(c)
+	return nil
+}
+
+// 当前允许操作的目录，请求处理以外使用
+func (s *Server) RootDir() []string {
+	return s.settings().rootDir
+}
+
+// 新的rootDir不能和历史版本、快照、扫描目录互相包含
+func (s *Server) checkRootDir(rootDir []string) error {
+	for _, d := range rootDir {
+		if s.ctFile != nil && s.ctFile.store != nil && s.ctFile.store.contains(d) {
+			return errors.New("storeDir cannot inside or contain rootDir: " + d)
+		}
+		if s.ctFile != nil && s.ctFile.snaps != nil && s.ctFile.snaps.contains(d) {
+			return errors.New("snapshotDir cannot inside or contain rootDir: " + d)
+		}
+		if s.scanner.dir != "" && (inDir(s.scanner.dir, d) || inDir(d, s.scanner.dir)) {
+			return errors.New("scanDir cannot inside or contain rootDir: " + d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	root2, err := ioutil.TempDir("", "fserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root2)
+	conf := func(body string) *goconfig.ConfigFile {
+		f := root2 + ".conf"
+		ioutil.WriteFile(f, []byte(body), 0600)
+		defer os.Remove(f)
+		c, err := goconfig.ReadConfigFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	write := func(password, p, body string) error {
+		_, err := s.handleRequest(&FileData{Method: METHOD_CREATE_FILE, Password: password, Path: p, Body: []byte(body)})
+		return err
+	}
+
+	// 重新加载时并发的请求使用原配置或新配置
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.handleRequest(&FileData{Method: METHOD_STAT, Password: "pw", Path: root})
+			}
+		}
+	}()
+	valid := "[common]\nrootDir=" + root + "," + root2 + "\nallowExt=html,txt\npassword=pw2\nmaxSize=1K\n" +
+		"[filter]\nsniffOpen=true\ninjectionOpen=true\n"
+	injection := root2 + ".injection"
+	ioutil.WriteFile(injection, []byte("eval\n"), 0600)
+	defer os.Remove(injection)
+	err = s.Reload(conf(valid), injection)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write("pw", root2+"/a.txt", "x"); err == nil || !strings.Contains(err.Error(), "Password") {
+		t.Errorf("old password: %v", err)
+	}
+	if err = write("pw2", root2+"/a.txt", "x"); err != nil {
+		t.Errorf("new rootDir: %v", err)
+	}
+	if err = write("pw2", root2+"/a.jpg", "x"); err == nil {
+		t.Error("allowExt not reloaded")
+	}
+	if err = write("pw2", root2+"/b.txt", strings.Repeat("x", 2048)); err == nil {
+		t.Error("maxSize not reloaded")
+	}
+	if err = write("pw2", root2+"/c.txt", "<?php"); err == nil {
+		t.Error("filter not reloaded")
+	}
+	if s.settings().filter.Server != s || len(s.settings().filter.injection.keywords) != 1 {
+		t.Errorf("filter: %v %v", s.settings().filter.Server == s, s.settings().filter.injection.keywords)
+	}
+
+	// 错误的配置不生效
+	for _, body := range []string{
+		"[common]\nallowExt=html\n",
+		"[common]\nrootDir=relative\nallowExt=html\n",
+		"[common]\nrootDir=" + root + "\nallowExt=html,php\n",
+		"[common]\nrootDir=" + root + "\nallowExt=html\n[filter]\naction=drop\n",
+		"[common]\nrootDir=" + root + "\nallowExt=html\n[filter]\ninjectionOpen=true\n",
+	} {
+		if err = s.Reload(conf(body), root2+"/missing.conf"); err == nil {
+			t.Errorf("invalid config reloaded: %q", body)
+		}
+	}
+	s.scanner.dir = root2 + "/reports"
+	if err = s.Reload(conf(valid), injection); err == nil || !strings.Contains(err.Error(), "scanDir") {
+		t.Errorf("scanDir in rootDir: %v", err)
+	}
+	if err = write("pw2", root2+"/d.txt", "x"); err != nil {
+		t.Errorf("old config after failed reload: %v", err)
+	}
+	if d := s.RootDir(); len(d) != 2 || d[1] != root2 {
+		t.Errorf("RootDir: %v", d)
+	}
+}
+
+// 副本执行记录时重新加载配置，使用go test -race检查
+func TestReloadReplicaApply(t *testing.T) {
+	root := t.TempDir()
+	s := NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	c := s.settings()
+	c.rootDir = []string{root}
+	c.maxSize = MAX_BODY_SIZE
+	s.ctFile = NewCtFile(s)
+	r, err := NewReplica(s.ctFile, "127.0.0.1:1", "pw", root+".state", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(root + ".state")
+	f := root + ".conf"
+	ioutil.WriteFile(f, []byte("[common]\nrootDir="+root+"\nallowExt=html,txt\n"), 0600)
+	defer os.Remove(f)
+	conf, err := goconfig.ReadConfigFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			s.Reload(conf, "")
+		}
+	}()
+	for i := 1; i <= 50; i++ {
+		err = r.apply(&JournalBatch{Records: []*ReplicaRecord{
+			{JournalRecord: &JournalRecord{Seq: uint64(2*i - 1), Method: METHOD_CREATE_FILE, Path: root + "/a.txt"}, Body: []byte("x")},
+			{JournalRecord: &JournalRecord{Seq: uint64(2 * i), Method: METHOD_RENAME, Path: root + "/a.txt", NewPath: root + "/b.html"}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+// 处理中的请求不阻塞重新加载和新的请求，处理中的请求按开始时的配置完成
+func TestReloadInFlight(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	f := root + ".conf"
+	ioutil.WriteFile(f, []byte("[common]\nrootDir="+root+"\nallowExt=txt\npassword=pw2\n"), 0600)
+	defer os.Remove(f)
+	conf, err := goconfig.ReadConfigFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, _ := s.ctFile.locks.Lock("", lockPath{root + "/a.html", false})
+	busy := dialTestServer(t, addr)
+	if err = sendTestRequest(busy, &FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/a.html", Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	waitActive(t, s, 1)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Reload(conf, "") }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reload waits for the request in progress")
+	}
+	conn := dialTestServer(t, addr)
+	if err = sendTestRequest(conn, &FileData{Method: METHOD_CREATE_FILE, Password: "pw2", Path: root + "/b.txt", Body: []byte("y")}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := readTestResponse(t, conn); resp.Code != 0 {
+		t.Errorf("request after reload: %s", resp.Message)
+	}
+
+	unlock()
+	if resp := readTestResponse(t, busy); resp.Code != 0 {
+		t.Errorf("in-flight request: %s", resp.Message)
+	}
+}
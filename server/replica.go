@@ -0,0 +1,689 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+primary/replica replication.
+
+the primary needs the journal. a replica connects to the primary and reads
+the journal after it's last applied sequence with METHOD_JOURNAL_READ, the
+primary waits for new records when the replica is up to date (long poll).
+records are applied through the replica's own CTFile, the applied sequence
+is saved to stateFile after every batch.
+
+when the records after the replica's position have been compacted, or a
+record cannot be applied, the replica does a full resync without blocking
+writes on the primary: it notes the primary's sequence, compares every
+rootDir with the primary page by page (METHOD_LIST with hash, after and
+limit), fetches changed files with METHOD_READ_FILE and removes files which
+do not exist on the primary. then it reads the records written meanwhile
+(without bodies) and syncs the paths they touched again, until a round
+passes without new records, the replica is then at the primary's sequence.
+after REPLICA_RESYNC rounds the resync fails and is retried later.
+
+with tls in the [replica] section the primary is dialed over TLS, with hmac
+the requests are signed instead of carrying the password (see auth.go).
+*/
+package server
+
+import (
+	"bytes"
+	"cmstop-fserver/util"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REPLICA_BATCH      = 100              // 每次读取的最大记录数
+	REPLICA_BATCH_SIZE = 16 << 20         // 每次读取的写入内容最大总大小
+	REPLICA_WAIT       = 5 * time.Second  // 主节点等待新记录的时间，小于连接空闲超时
+	REPLICA_MAX_WAIT   = 8 * time.Second  // 主节点等待新记录的最长时间
+	REPLICA_RETRY      = time.Second      // 断开后重连的初始间隔
+	REPLICA_MAX_RETRY  = 30 * time.Second // 断开后重连的最大间隔
+	REPLICA_RESYNC     = 10               // 全量同步后重新同步期间写入的路径的最大轮数
+	REPLICA_LIST_PAGE  = 1000             // 全量同步时每次列出的数量
+)
+
+// 复制的一条记录，含写入内容
+type ReplicaRecord struct {
+	*JournalRecord
+	Body []byte `json:"body,omitempty"`
+}
+
+// METHOD_JOURNAL_READ的返回数据
+type JournalBatch struct {
+	Seq     uint64           `json:"seq"` // 主节点最后一条记录的序号
+	Records []*ReplicaRecord `json:"records"`
+}
+
+// METHOD_JOURNAL_READ的参数
+type journalReadParams struct {
+	After  uint64 `json:"after"`            // 读取序号大于after的记录
+	Limit  int    `json:"limit"`            // 最大记录数，0 只返回主节点的序号
+	Wait   int    `json:"wait"`             // 没有新记录时等待的毫秒数
+	NoBody bool   `json:"nobody,omitempty"` // 不返回写入内容
+}
+
+// 复制状态
+type ReplicationStatus struct {
+	Role        string `json:"role"`                   // primary 或 replica
+	Primary     string `json:"primary,omitempty"`      // 主节点地址
+	Seq         uint64 `json:"seq"`                    // 已执行的最后一条记录的序号，主节点为日志序号
+	PrimarySeq  uint64 `json:"primary_seq,omitempty"`  // 主节点最后一条记录的序号
+	Lag         uint64 `json:"lag"`                    // 落后的记录数
+	Connected   bool   `json:"connected"`              // 是否连接到主节点
+	LastContact int64  `json:"last_contact,omitempty"` // 最后一次收到主节点响应的时间
+	LastError   string `json:"last_error,omitempty"`   // 最近一次错误
+	Resyncs     int    `json:"resyncs"`                // 全量同步次数
+}
+
+// 副本
+type Replica struct {
+	file      *CTFile
+	primary   string        // 主节点地址
+	password  string        // 主节点的密钥
+	sign      bool          // 是否签名请求，不发送密钥
+	tls       *tls.Config   // 不为nil时以TLS连接主节点
+	stateFile string        // 复制位置保存文件
+	prefix    string        // 主节点的路径在本地的前缀，同一台机器上运行副本时使用
+	wait      time.Duration // 主节点等待新记录的时间
+	page      int           // 全量同步时每次列出的数量
+	requestId uint32        // 最后一个请求的ID
+
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+func NewReplica(file *CTFile, primary, password, stateFile, prefix string) (*Replica, error) {
+	r := new(Replica)
+	r.file = file
+	r.primary = primary
+	r.password = password
+	r.stateFile = stateFile
+	r.prefix = strings.TrimRight(prefix, "/")
+	r.wait = REPLICA_WAIT
+	r.page = REPLICA_LIST_PAGE
+	r.status.Role = "replica"
+	r.status.Primary = primary
+	if stateFile == "" {
+		return nil, errors.New("replica stateFile cannot empty")
+	}
+	b, err := ioutil.ReadFile(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		r.status.Seq, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return nil, errors.New("replica stateFile error: " + err.Error())
+		}
+	}
+	return r, nil
+}
+
+// 复制状态
+func (r *Replica) Status() *ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.status
+	if s.PrimarySeq > s.Seq {
+		s.Lag = s.PrimarySeq - s.Seq
+	}
+	return &s
+}
+
+// 持续从主节点复制，断开后自动重连，stop返回true时退出
+func (r *Replica) Run(stop func() bool) {
+	retry := REPLICA_RETRY
+	for !stop() {
+		err := r.follow(stop)
+		r.mu.Lock()
+		r.status.Connected = false
+		if err != nil {
+			r.status.LastError = err.Error()
+		}
+		r.mu.Unlock()
+		if err == nil {
+			return
+		}
+		r.file.Logger.Println("replica error: " + err.Error())
+		// 等待期间也检查是否需要退出
+		for t := time.Duration(0); t < retry && !stop(); t += 100 * time.Millisecond {
+			time.Sleep(100 * time.Millisecond)
+		}
+		retry *= 2
+		if retry > REPLICA_MAX_RETRY {
+			retry = REPLICA_MAX_RETRY
+		}
+	}
+}
+
+// 连接主节点，读取并执行新的记录，直到出错或退出
+func (r *Replica) follow(stop func() bool) error {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if r.tls != nil {
+		conn, err = tls.DialWithDialer(&d, "tcp4", r.primary, r.tls)
+	} else {
+		conn, err = d.Dial("tcp4", r.primary)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.mu.Lock()
+	r.status.Connected = true
+	r.mu.Unlock()
+
+	for !stop() {
+		batch, err := r.read(conn, r.Status().Seq, REPLICA_BATCH)
+		if ce, ok := err.(*CodeError); ok && ce.Code == CODE_JOURNAL_COMPACTED {
+			r.file.Logger.Println("replica position compacted on primary, full resync")
+			err = r.resync(conn)
+		} else if err == nil {
+			err = r.apply(batch)
+			if ae, ok := err.(*applyError); ok {
+				r.file.Logger.Println("replica " + ae.Error() + ", full resync")
+				err = r.resync(conn)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取序号大于after的记录
+func (r *Replica) read(conn net.Conn, after uint64, limit int) (*JournalBatch, error) {
+	params := &journalReadParams{After: after, Limit: limit, Wait: int(r.wait / time.Millisecond)}
+	data, err := r.call(conn, METHOD_JOURNAL_READ, "", params)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(JournalBatch)
+	err = json.Unmarshal(data, batch)
+	if err != nil {
+		return nil, errors.New("journal batch decode error: " + err.Error())
+	}
+	r.mu.Lock()
+	r.status.PrimarySeq = batch.Seq
+	r.status.LastContact = time.Now().Unix()
+	r.mu.Unlock()
+	return batch, nil
+}
+
+// 执行失败的记录，需要全量同步
+type applyError struct {
+	seq uint64
+	err error
+}
+
+func (e *applyError) Error() string {
+	return "apply record " + strconv.FormatUint(e.seq, 10) + " error: " + e.err.Error()
+}
+
+// 通过本地CTFile执行记录，每批执行后保存位置
+func (r *Replica) apply(batch *JournalBatch) error {
+	if len(batch.Records) == 0 {
+		return nil
+	}
+	for _, rec := range batch.Records {
+		if int(rec.Method) == METHOD_SNAPSHOT_RESTORE {
+			// 之前的版本记录的快照恢复，快照只在主节点上，无法在副本执行
+			return &applyError{rec.Seq, errors.New("snapshot restore cannot apply on replica")}
+		}
+		if rec.Hash != "" && util.Hash(rec.Body) != rec.Hash {
+			return errors.New("record " + strconv.FormatUint(rec.Seq, 10) + " body checksum mismatch")
+		}
+		fd := &FileData{Method: rec.Method, Path: r.prefix + rec.Path, Body: rec.Body, Client: r.primary}
+		if rec.NewPath != "" {
+			fd.Body, _ = json.Marshal(&renameParams{r.prefix + rec.NewPath})
+		}
+		if fd.Body == nil && rec.Hash != "" {
+			fd.Body = []byte{}
+		}
+		err := r.handle(fd)
+		if err != nil {
+			return &applyError{rec.Seq, err}
+		}
+	}
+	return r.setSeq(batch.Records[len(batch.Records)-1].Seq)
+}
+
+// 通过本地CTFile执行一个操作
+func (r *Replica) handle(fd *FileData) error {
+	_, err := r.file.Handle(fd)
+	return err
+}
+
+// 保存复制位置
+func (r *Replica) setSeq(seq uint64) error {
+	tmp := r.stateFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0644)
+	if err == nil {
+		err = os.Rename(tmp, r.stateFile)
+	}
+	if err != nil {
+		return errors.New("replica save state error: " + err.Error())
+	}
+	r.mu.Lock()
+	r.status.Seq = seq
+	r.mu.Unlock()
+	return nil
+}
+
+// 全量同步，不阻止主节点上的写入
+// 从开始时主节点的序号起，重新同步期间写入的记录涉及的路径，直到一轮中没有新的记录
+func (r *Replica) resync(conn net.Conn) error {
+	r.mu.Lock()
+	r.status.Resyncs++
+	r.mu.Unlock()
+	before, err := r.read(conn, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, d := range r.file.Server.RootDir() {
+		err = r.syncDir(conn, d)
+		if err != nil {
+			return err
+		}
+	}
+	seq := before.Seq
+	for i := 0; i < REPLICA_RESYNC; i++ {
+		paths, last, err := r.touched(conn, seq)
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return r.setSeq(last)
+		}
+		for _, p := range paths {
+			err = r.syncPath(conn, p)
+			if err != nil {
+				return err
+			}
+		}
+		seq = last
+	}
+	return errors.New("primary changed in every resync round, resync later")
+}
+
+// 序号大于after的记录涉及的本地路径，返回读取到的最后一个序号
+func (r *Replica) touched(conn net.Conn, after uint64) ([]string, uint64, error) {
+	batch, err := r.read(conn, 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	paths := make([]string, 0)
+	seen := make(map[string]bool)
+	for end := batch.Seq; after < end; {
+		data, err := r.call(conn, METHOD_JOURNAL_READ, "", &journalReadParams{After: after, Limit: REPLICA_BATCH, NoBody: true})
+		if err != nil {
+			return nil, 0, err
+		}
+		batch = new(JournalBatch)
+		err = json.Unmarshal(data, batch)
+		if err != nil {
+			return nil, 0, errors.New("journal batch decode error: " + err.Error())
+		}
+		if len(batch.Records) == 0 {
+			break
+		}
+		for _, rec := range batch.Records {
+			for _, p := range []string{rec.Path, rec.NewPath} {
+				if p != "" && !seen[p] {
+					seen[p] = true
+					paths = append(paths, r.prefix+p)
+				}
+			}
+			after = rec.Seq
+		}
+	}
+	return paths, after, nil
+}
+
+// 重新同步一个路径，主节点上不存在时删除本地的路径
+func (r *Replica) syncPath(conn net.Conn, p string) error {
+	data, err := r.call(conn, METHOD_STAT, r.primaryPath(p), nil)
+	if err != nil {
+		return err
+	}
+	remote := new(FileInfo)
+	err = json.Unmarshal(data, remote)
+	if err != nil {
+		return errors.New("stat decode error: " + err.Error())
+	}
+	f, err := os.Lstat(p)
+	if err == nil && (!remote.Exist || f.IsDir() != remote.IsDir) {
+		err = r.remove(p, f.IsDir())
+		if err != nil {
+			return err
+		}
+		f = nil
+	}
+	switch {
+	case !remote.Exist:
+		return nil
+	case remote.IsDir:
+		if f == nil {
+			err = r.handle(&FileData{Method: METHOD_CREATE_DIR, Path: p, Client: r.primary})
+			if err != nil {
+				return err
+			}
+		}
+		return r.syncDir(conn, p)
+	}
+	if f != nil {
+		h, err := util.FileHash(p)
+		if err == nil && h == remote.Hash {
+			return nil
+		}
+	}
+	return r.fetch(conn, p)
+}
+
+// 同步一个目录，使本地内容和主节点相同
+// 本地和主节点的内容按List的顺序分页列出，逐项比较
+func (r *Replica) syncDir(conn net.Conn, dir string) error {
+	params := listParams{Recursive: true, Hash: true, Limit: r.page}
+	remote := &listPager{limit: r.page, next: func(after string) ([]*FileInfo, error) {
+		params.After = after
+		data, err := r.call(conn, METHOD_LIST, r.primaryPath(dir), &params)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]*FileInfo, 0)
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return nil, errors.New("list decode error: " + err.Error())
+		}
+		return list, nil
+	}}
+	local := &listPager{limit: r.page, next: func(after string) ([]*FileInfo, error) {
+		list := make([]*FileInfo, 0)
+		if !isDir(dir) {
+			return list, nil
+		}
+		lp := params
+		lp.After = after
+		err := listDir(dir, "", &lp, &list)
+		if err == errListFull {
+			err = nil
+		}
+		return list, err
+	}}
+
+	// 删除的目录中的内容已经不存在
+	removed := make(map[string]bool)
+	for {
+		lf, err := local.peek()
+		if err != nil {
+			return err
+		}
+		if lf != nil && parentIn(lf.Path, removed) {
+			local.pop()
+			continue
+		}
+		rf, err := remote.peek()
+		if err != nil {
+			return err
+		}
+		var c int
+		switch {
+		case lf == nil && rf == nil:
+			return nil
+		case lf == nil:
+			c = 1
+		case rf == nil:
+			c = -1
+		default:
+			c = comparePath(lf.Path, rf.Path)
+		}
+		if c < 0 || (c == 0 && lf.IsDir != rf.IsDir) {
+			// 主节点上没有或者类型不同
+			err = r.remove(dir+"/"+lf.Path, lf.IsDir)
+			if lf.IsDir {
+				removed[lf.Path] = true
+			}
+			local.pop()
+			if c == 0 {
+				c = 1
+			}
+		} else if c == 0 {
+			if !rf.IsDir && lf.Hash != rf.Hash {
+				err = r.fetch(conn, dir+"/"+rf.Path)
+			}
+			local.pop()
+			remote.pop()
+		}
+		if err == nil && c > 0 {
+			if rf.IsDir {
+				err = r.handle(&FileData{Method: METHOD_CREATE_DIR, Path: dir + "/" + rf.Path, Client: r.primary})
+			} else {
+				err = r.fetch(conn, dir+"/"+rf.Path)
+			}
+			remote.pop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 从主节点读取文件写入本地
+func (r *Replica) fetch(conn net.Conn, p string) error {
+	var body []byte
+	data, err := r.call(conn, METHOD_READ_FILE, r.primaryPath(p), nil)
+	if err == nil {
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	return r.handle(&FileData{Method: METHOD_CREATE_FILE, Path: p, Body: body, Client: r.primary})
+}
+
+// 删除本地的文件或目录
+func (r *Replica) remove(p string, dir bool) error {
+	method := METHOD_REMOVE_FILE
+	if dir {
+		method = METHOD_REMOVE_DIR
+	}
+	return r.handle(&FileData{Method: uint32(method), Path: p, Client: r.primary})
+}
+
+// 分页读取的列表，上一页最后一个路径作为下一页的after
+type listPager struct {
+	limit int
+	next  func(after string) ([]*FileInfo, error)
+	page  []*FileInfo
+	after string
+	done  bool
+}
+
+// 当前项，没有更多内容时返回nil
+func (l *listPager) peek() (*FileInfo, error) {
+	if len(l.page) == 0 && !l.done {
+		page, err := l.next(l.after)
+		if err != nil {
+			return nil, err
+		}
+		l.page = page
+		l.done = len(page) < l.limit
+		if len(page) > 0 {
+			l.after = page[len(page)-1].Path
+		}
+	}
+	if len(l.page) == 0 {
+		return nil, nil
+	}
+	return l.page[0], nil
+}
+
+func (l *listPager) pop() {
+	l.page = l.page[1:]
+}
+
+// 本地路径对应的主节点路径
+func (r *Replica) primaryPath(p string) string {
+	return strings.TrimPrefix(p, r.prefix)
+}
+
+// 判断路径的某个上级目录是否在集合中
+func parentIn(rel string, dirs map[string]bool) bool {
+	for i := strings.LastIndex(rel, "/"); i > 0; i = strings.LastIndex(rel, "/") {
+		rel = rel[:i]
+		if dirs[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replica) call(conn net.Conn, method uint32, p string, params interface{}) (json.RawMessage, error) {
+	return r.callMeta(conn, method, p, params, nil)
+}
+
+// 向主节点发送一个请求，返回响应数据，失败时返回的CodeError带有响应状态码
+// 请求带有请求ID，主节点返回错误时不会断开连接
+func (r *Replica) callMeta(conn net.Conn, method uint32, p string, params interface{}, meta *RequestMeta) (json.RawMessage, error) {
+	var body []byte
+	var err error
+	if params != nil {
+		body, err = json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	password := r.password
+	if r.sign && password != "" {
+		rec := &FileData{Method: method, Path: p, Meta: meta}
+		if len(body) > 0 {
+			rec.Meta = new(RequestMeta)
+			if meta != nil {
+				*rec.Meta = *meta
+			}
+			rec.Meta.Sha256 = util.Hash(body)
+		}
+		SignRequest(password, rec)
+		meta, password = rec.Meta, ""
+	}
+	var metaData []byte
+	if meta != nil {
+		metaData, err = json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		method |= FLAG_META
+	}
+	r.requestId++
+	buf := new(bytes.Buffer)
+	for _, v := range []uint32{method | FLAG_REQUEST_ID, uint32(len(password)), uint32(len(p)), uint32(len(body)), r.requestId} {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+	if meta != nil {
+		binary.Write(buf, binary.LittleEndian, uint32(len(metaData)))
+		buf.Write(metaData)
+	}
+	buf.WriteString(password)
+	buf.WriteString(p)
+	buf.Write(body)
+	conn.SetDeadline(time.Now().Add(r.wait + 30*time.Second))
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var length uint32
+	err = binary.Read(conn, binary.LittleEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(ResponseData)
+	err = json.Unmarshal(data, resp)
+	if err != nil {
+		return nil, errors.New("response decode error: " + err.Error())
+	}
+	if resp.Id != r.requestId {
+		return nil, errors.New("response id mismatch")
+	}
+	if resp.Code != CODE_SUCCESS {
+		return nil, &CodeError{resp.Code, "primary: " + resp.Message}
+	}
+	return resp.Data, nil
+}
+
+// 主节点读取操作日志，没有新记录时等待
+func (t *CTFile) JournalRead(body []byte) (*JournalBatch, error) {
+	if t.journal == nil {
+		return nil, errors.New("journal is not enabled")
+	}
+	params := new(journalReadParams)
+	if len(body) > 0 {
+		err := json.Unmarshal(body, params)
+		if err != nil {
+			return nil, errors.New("params decode error: " + err.Error())
+		}
+	}
+	if params.Limit > 0 {
+		wait := time.Duration(params.Wait) * time.Millisecond
+		if wait > REPLICA_MAX_WAIT {
+			wait = REPLICA_MAX_WAIT
+		}
+		t.journal.Wait(params.After, wait)
+	}
+	batch := new(JournalBatch)
+	batch.Seq = t.journal.Seq()
+	if params.Limit > REPLICA_BATCH*10 {
+		params.Limit = REPLICA_BATCH * 10
+	}
+	maxBody := int64(REPLICA_BATCH_SIZE)
+	if params.NoBody {
+		maxBody = -1
+	}
+	var err error
+	batch.Records, err = t.journal.Records(params.After, params.Limit, maxBody)
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// 复制状态，没有开启复制时返回主节点的日志序号
+func (t *CTFile) ReplicaStatus() (*ReplicationStatus, error) {
+	if t.replica != nil {
+		return t.replica.Status(), nil
+	}
+	if t.journal == nil {
+		return nil, errors.New("replication is not enabled")
+	}
+	return &ReplicationStatus{Role: "primary", Seq: t.journal.Seq(), Connected: true}, nil
+}
+
+// 不修改文件的请求，副本只接受这些请求
+func readOnlyMethod(method uint32) bool {
+	switch int(method) {
+	case METHOD_STAT, METHOD_LIST, METHOD_READ_FILE, METHOD_VERSIONS, METHOD_TRASH,
+		METHOD_SNAPSHOT_LIST, METHOD_LOCK, METHOD_UNLOCK, METHOD_JOURNAL_READ, METHOD_REPLICA_STATUS, METHOD_ARCHIVE:
+		return true
+	}
+	return false
+}
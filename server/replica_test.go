@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 开启操作日志的主节点
+func newTestPrimary(t *testing.T, maxSize int64) (*Server, string, string) {
+	s, root, addr := newTestServer(t)
+	dir, err := ioutil.TempDir("", "fjournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.journal, err = OpenJournal(dir, maxSize, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.ctFile.journal.Close()
+		os.RemoveAll(dir)
+	})
+	return s, root, addr
+}
+
+// 在同一台机器上运行的副本，主节点的路径在本地加上前缀prefix
+func newTestReplica(t *testing.T, addr, root, prefix string) (*Replica, func()) {
+	s := NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	s.settings().rootDir = []string{prefix + root}
+	s.ctFile = NewCtFile(s)
+	err := os.MkdirAll(prefix+root, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReplica(s.ctFile, addr, "pw", prefix+"/state", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.replica = r
+	r.wait = 200 * time.Millisecond
+	r.page = 3
+	var stop int32
+	done := make(chan struct{})
+	go func() {
+		r.Run(func() bool { return atomic.LoadInt32(&stop) == 1 })
+		close(done)
+	}()
+	return r, func() {
+		atomic.StoreInt32(&stop, 1)
+		<-done
+	}
+}
+
+func waitReplica(t *testing.T, r *Replica, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Status().Seq < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica seq %d, want %d: %s", r.Status().Seq, seq, r.Status().LastError)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func handleOps(t *testing.T, f *CTFile, ops ...*FileData) {
+	for _, op := range ops {
+		if _, err := f.Handle(op); err != nil {
+			t.Fatalf("method %d %s: %v", op.Method, op.Path, err)
+		}
+	}
+}
+
+func TestReplicaFollow(t *testing.T) {
+	s, root, addr := newTestPrimary(t, 0)
+	prefix, _ := ioutil.TempDir("", "freplica")
+	defer os.RemoveAll(prefix)
+
+	rename, _ := json.Marshal(&renameParams{root + "/news/b.html"})
+	handleOps(t, s.ctFile,
+		&FileData{Method: METHOD_CREATE_DIR, Path: root + "/news"},
+		&FileData{Method: METHOD_CREATE_FILE, Path: root + "/news/a.html", Body: []byte("a")},
+		&FileData{Method: METHOD_CREATE_FILE, Path: root + "/news/empty.html", Body: []byte{}},
+		&FileData{Method: METHOD_RENAME, Path: root + "/news/a.html", Body: rename},
+	)
+	r, stop := newTestReplica(t, addr, root, prefix)
+	waitReplica(t, r, s.ctFile.journal.Seq())
+	if got := readTestFile(prefix + root + "/news/b.html"); got != "a" {
+		t.Fatalf("replica b.html = %q", got)
+	}
+	if _, err := os.Stat(prefix + root + "/news/empty.html"); err != nil {
+		t.Fatal(err)
+	}
+	if st := r.Status(); st.Lag != 0 || !st.Connected {
+		t.Fatalf("status %+v", st)
+	}
+
+	// 新的写入通过长轮询到达副本
+	handleOps(t, s.ctFile, &FileData{Method: METHOD_APPEND_FILE, Path: root + "/news/b.html", Body: []byte("b")})
+	waitReplica(t, r, s.ctFile.journal.Seq())
+	if got := readTestFile(prefix + root + "/news/b.html"); got != "ab" {
+		t.Fatalf("replica b.html = %q after append", got)
+	}
+	stop()
+
+	// 断开期间的写入在重启后从保存的位置继续复制
+	handleOps(t, s.ctFile, &FileData{Method: METHOD_REMOVE_FILE, Path: root + "/news/b.html"})
+	r, stop = newTestReplica(t, addr, root, prefix)
+	defer stop()
+	waitReplica(t, r, s.ctFile.journal.Seq())
+	if _, err := os.Stat(prefix + root + "/news/b.html"); !os.IsNotExist(err) {
+		t.Fatalf("removed file still on replica: %v", err)
+	}
+	if r.Status().Resyncs != 0 {
+		t.Fatal("unexpected full resync")
+	}
+}
+
+func TestReplicaResync(t *testing.T) {
+	// 每条记录一个分段
+	s, root, addr := newTestPrimary(t, 1)
+	prefix, _ := ioutil.TempDir("", "freplica")
+	defer os.RemoveAll(prefix)
+
+	handleOps(t, s.ctFile,
+		&FileData{Method: METHOD_CREATE_DIR, Path: root + "/news"},
+		&FileData{Method: METHOD_CREATE_FILE, Path: root + "/news/a.html", Body: []byte("a")},
+		&FileData{Method: METHOD_CREATE_FILE, Path: root + "/b.html", Body: []byte("b")},
+	)
+	segs, err := journalSegments(s.ctFile.journal.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(segs[0].name)
+
+	// 副本上主节点没有的内容在全量同步时删除
+	os.MkdirAll(prefix+root+"/old", 0755)
+	ioutil.WriteFile(prefix+root+"/old/c.html", []byte("c"), 0644)
+	ioutil.WriteFile(prefix+root+"/b.html", []byte("stale"), 0644)
+
+	r, stop := newTestReplica(t, addr, root, prefix)
+	defer stop()
+	waitReplica(t, r, s.ctFile.journal.Seq())
+	if got := readTestFile(prefix + root + "/news/a.html"); got != "a" {
+		t.Fatalf("replica a.html = %q", got)
+	}
+	if got := readTestFile(prefix + root + "/b.html"); got != "b" {
+		t.Fatalf("replica b.html = %q", got)
+	}
+	if _, err := os.Stat(prefix + root + "/old"); !os.IsNotExist(err) {
+		t.Fatalf("extra dir still on replica: %v", err)
+	}
+	if r.Status().Resyncs != 1 {
+		t.Fatalf("resyncs = %d, want 1", r.Status().Resyncs)
+	}
+
+	// 全量同步后继续增量复制
+	handleOps(t, s.ctFile, &FileData{Method: METHOD_REMOVE_DIR, Path: root + "/news"})
+	waitReplica(t, r, s.ctFile.journal.Seq())
+	if _, err := os.Stat(prefix + root + "/news"); !os.IsNotExist(err) {
+		t.Fatalf("removed dir still on replica: %v", err)
+	}
+}
+
+// 全量同步不阻止主节点上的写入，同步期间的写入之后重新同步
+func TestReplicaResyncWrites(t *testing.T) {
+	s, root, addr := newTestPrimary(t, 1)
+	prefix, _ := ioutil.TempDir("", "freplica")
+	defer os.RemoveAll(prefix)
+
+	for i := 0; i < 20; i++ {
+		handleOps(t, s.ctFile, &FileData{Method: METHOD_CREATE_FILE, Path: root + "/d" + strconv.Itoa(i%3) + "/" + strconv.Itoa(i) + ".html", Body: []byte{byte(i)}})
+	}
+	segs, err := journalSegments(s.ctFile.journal.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(segs[0].name)
+
+	r, stop := newTestReplica(t, addr, root, prefix)
+	defer stop()
+	for i := 0; r.Status().Seq == 0 || i < 50; i++ {
+		p := root + "/d" + strconv.Itoa(i%4) + "/" + strconv.Itoa(i%25) + ".html"
+		op := &FileData{Method: METHOD_CREATE_FILE, Path: p, Body: []byte("w" + strconv.Itoa(i))}
+		switch i % 5 {
+		case 3:
+			op = &FileData{Method: METHOD_APPEND_FILE, Path: p, Body: []byte("a")}
+		case 4:
+			op = &FileData{Method: METHOD_REMOVE_FILE, Path: p}
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+		}
+		handleOps(t, s.ctFile, op)
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitReplica(t, r, s.ctFile.journal.Seq())
+
+	list := func(dir string) string {
+		data, err := s.ctFile.List(dir, []byte(`{"recursive":true,"hash":true}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		for _, f := range data {
+			b.WriteString(f.Path + ":" + f.Hash + "\n")
+		}
+		return b.String()
+	}
+	if p, r := list(root), list(prefix+root); p != r {
+		t.Errorf("replica differs from primary:\n%s\n%s", p, r)
+	}
+	if r.Status().Resyncs != 1 {
+		t.Errorf("resyncs = %d, want 1", r.Status().Resyncs)
+	}
+}
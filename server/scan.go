@@ -0,0 +1,596 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+scan of existing files.
+
+a scan walks a directory in rootDir and runs every regular file through the
+path policy and the content filter used for writes (Inspect), without
+logging, rejecting or mailing. files with findings are written to a report,
+json (one object per line) or csv (one row per finding), and optionally
+moved to quarantineDir, the file is removed like METHOD_REMOVE_FILE and the
+removal is journaled.
+
+files are inspected by a bounded number of workers, the report is written in
+walk order. a checkpoint is saved every SCAN_CHECKPOINT files: the last path
+reported and the report size, a resumed scan truncates the report to that
+size and skips the files walked before the last path.
+
+the scan runs from the command line (--scan) or through METHOD_SCAN, the
+body is ScanParams, the response is ScanStatus. only one scan runs at a
+time through METHOD_SCAN, reports and the checkpoint are kept in scanDir.
+*/
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/9466/goconfig"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEF_SCAN_WORKERS     = 4    // 默认并发检查的文件数
+	SCAN_CHECKPOINT      = 1000 // 每检查多少个文件保存一次检查点
+	SCAN_JSON            = "json"
+	SCAN_CSV             = "csv"
+	SCAN_CHECKPOINT_FILE = "checkpoint.json" // scanDir中的检查点文件
+)
+
+// METHOD_SCAN的参数，body是它的json编码
+type ScanParams struct {
+	Action     string `json:"action,omitempty"`     // start开始，stop停止，status获取状态，默认status
+	Format     string `json:"format,omitempty"`     // 报告格式json或csv，默认json
+	Quarantine bool   `json:"quarantine,omitempty"` // 是否隔离发现问题的文件
+	Resume     bool   `json:"resume,omitempty"`     // 从检查点继续上次的扫描
+}
+
+// 扫描状态，METHOD_SCAN的响应数据
+type ScanStatus struct {
+	Running     bool   `json:"running"`
+	Dir         string `json:"dir,omitempty"`      // 扫描的目录
+	Report      string `json:"report,omitempty"`   // 报告文件
+	Started     int64  `json:"started,omitempty"`  // 开始时间，unix时间戳
+	Finished    int64  `json:"finished,omitempty"` // 结束时间，unix时间戳
+	Files       int64  `json:"files"`              // 已检查的文件数
+	Hits        int64  `json:"hits"`               // 发现问题的文件数
+	Quarantined int64  `json:"quarantined"`        // 隔离的文件数
+	Skipped     int64  `json:"skipped"`            // 超过maxSize跳过的文件数
+	Errors      int64  `json:"errors"`             // 读取失败的文件数
+	Last        string `json:"last,omitempty"`     // 此路径及之前的文件都已写入报告
+	Error       string `json:"error,omitempty"`    // 扫描失败或停止的原因
+}
+
+// 扫描选项
+type ScanOptions struct {
+	Report     string // 报告文件
+	Format     string // json或csv
+	Checkpoint string // 检查点文件，为空时不保存
+	Resume     bool   // 检查点存在时继续
+	Quarantine bool   // 是否隔离发现问题的文件
+	Workers    int    // 并发检查的文件数
+}
+
+// 检查点，和报告一起保存
+type scanCheckpoint struct {
+	Status     ScanStatus `json:"status"`
+	Format     string     `json:"format"`
+	Quarantine bool       `json:"quarantine"`
+	ReportSize int64      `json:"reportSize"` // 检查点时报告的大小
+}
+
+// 报告中的一个文件
+type ScanHit struct {
+	Path        string     `json:"path"`
+	Size        int64      `json:"size"`
+	Mtime       int64      `json:"mtime"`
+	Findings    []*Finding `json:"findings"`
+	Quarantined string     `json:"quarantined,omitempty"` // 隔离保存的路径
+	Error       string     `json:"error,omitempty"`       // 隔离失败的原因
+}
+
+// 一个需要检查的文件，seq是遍历的顺序
+type scanItem struct {
+	seq     int64
+	path    string
+	info    os.FileInfo
+	hit     *ScanHit
+	skipped bool
+	err     error
+}
+
+// 扫描配置和METHOD_SCAN正在执行的扫描
+type scanner struct {
+	dir     string // 报告和检查点目录
+	workers int
+	mu      sync.Mutex
+	job     *ScanJob
+}
+
+// 停止正在执行的扫描，保留检查点
+func (sc *scanner) stop() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.job != nil {
+		sc.job.Stop()
+	}
+}
+
+// 读取[scan]配置，scanDir不能在rootDir中
+func (sc *scanner) init(conf *goconfig.ConfigFile, rootDir []string) error {
+	if n, _ := conf.GetInt("scan", "workers"); n > 0 {
+		sc.workers = n
+	}
+	dir, _ := conf.GetString("scan", "scanDir")
+	if dir == "" {
+		return nil
+	}
+	sc.dir = path.Clean(dir)
+	for _, d := range rootDir {
+		if inDir(sc.dir, d) || inDir(d, sc.dir) {
+			return errors.New("scanDir cannot inside or contain rootDir: " + d)
+		}
+	}
+	err := os.MkdirAll(sc.dir, 0700)
+	if err != nil {
+		return errors.New("scanDir cannot create: " + err.Error())
+	}
+	return nil
+}
+
+// 一次扫描
+type ScanJob struct {
+	server *Server
+	dir    string
+	opts   ScanOptions
+	stop   chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	status ScanStatus
+}
+
+// 创建扫描，dir必须在rootDir中，隔离需要配置quarantineDir
+func (s *Server) NewScanJob(dir string, opts ScanOptions) (*ScanJob, error) {
+	c := s.settings()
+	dir = cleanPath(dir)
+	err := c.checkPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = SCAN_JSON
+	case SCAN_JSON, SCAN_CSV:
+	default:
+		return nil, errors.New("scan format not supported: " + opts.Format)
+	}
+	if opts.Report == "" {
+		return nil, errors.New("scan report cannot empty")
+	}
+	if opts.Quarantine && c.filter.quarantine == "" {
+		return nil, errors.New("quarantineDir not configured")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DEF_SCAN_WORKERS
+	}
+	j := &ScanJob{server: s, dir: dir, opts: opts, stop: make(chan struct{})}
+	j.status.Dir = dir
+	j.status.Report = opts.Report
+	return j, nil
+}
+
+// 当前状态
+func (j *ScanJob) Status() ScanStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// 停止扫描，已检查的文件写入报告并保存检查点
+func (j *ScanJob) Stop() {
+	j.once.Do(func() { close(j.stop) })
+}
+
+func (j *ScanJob) stopped() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// 执行扫描，完成后删除检查点
+func (j *ScanJob) Run() error {
+	err := j.run()
+	j.mu.Lock()
+	j.status.Running = false
+	j.status.Finished = time.Now().Unix()
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+	j.mu.Unlock()
+	return err
+}
+
+func (j *ScanJob) run() error {
+	// 从检查点继续时使用上次的报告
+	var cp *scanCheckpoint
+	if j.opts.Resume && j.opts.Checkpoint != "" {
+		data, err := ioutil.ReadFile(j.opts.Checkpoint)
+		if err == nil {
+			cp = new(scanCheckpoint)
+			if err = json.Unmarshal(data, cp); err != nil {
+				return errors.New("scan checkpoint error: " + err.Error())
+			}
+			if cp.Status.Dir != j.dir {
+				return errors.New("scan checkpoint is for another dir: " + cp.Status.Dir)
+			}
+			j.opts.Format, j.opts.Report = cp.Format, cp.Status.Report
+			j.opts.Quarantine = j.opts.Quarantine || cp.Quarantine
+		} else if !os.IsNotExist(err) {
+			return errors.New("scan checkpoint error: " + err.Error())
+		}
+	}
+
+	f, err := os.OpenFile(j.opts.Report, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New("scan report cannot open: " + err.Error())
+	}
+	defer f.Close()
+	var size int64
+	if cp != nil {
+		size = cp.ReportSize
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		return errors.New("scan report error: " + err.Error())
+	}
+	rw := &reportWriter{w: bufio.NewWriter(f), size: size, format: j.opts.Format}
+	if cp == nil && j.opts.Format == SCAN_CSV {
+		rw.header()
+	}
+
+	j.mu.Lock()
+	if cp != nil {
+		j.status = cp.Status
+		j.status.Error = ""
+	}
+	j.status.Running = true
+	j.status.Started = time.Now().Unix()
+	j.status.Finished = 0
+	j.status.Report = j.opts.Report
+	last := j.status.Last
+	j.mu.Unlock()
+
+	// 遍历，从检查点继续时跳过last及之前的文件
+	items := make(chan *scanItem, j.opts.Workers*4)
+	results := make(chan *scanItem, j.opts.Workers*4)
+	var walkErr error
+	go func() {
+		defer close(items)
+		var seq int64
+		walkErr = filepath.Walk(j.dir, func(p string, info os.FileInfo, err error) error {
+			if j.stopped() {
+				return errScanStopped
+			}
+			if info != nil && info.IsDir() {
+				if err == nil && last != "" && walkBefore(p, last) && !inDir(last, p) {
+					return filepath.SkipDir
+				}
+				if err == nil {
+					return nil
+				}
+			}
+			if last != "" && !walkBefore(last, p) {
+				return nil
+			}
+			if err == nil && !info.Mode().IsRegular() {
+				return nil
+			}
+			seq++
+			items <- &scanItem{seq: seq, path: p, info: info, err: err}
+			return nil
+		})
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < j.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range items {
+				if it.err == nil {
+					j.inspect(it)
+				}
+				results <- it
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// 按遍历顺序写入报告
+	pending := make(map[int64]*scanItem)
+	next := int64(1)
+	done := 0
+	for it := range results {
+		pending[it.seq] = it
+		for {
+			it, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if err == nil {
+				err = j.record(rw, it)
+				if err != nil {
+					j.Stop()
+				}
+			}
+			done++
+			if done%SCAN_CHECKPOINT == 0 && err == nil {
+				err = j.checkpoint(rw)
+			}
+		}
+	}
+	if err == nil {
+		err = walkErr
+	}
+	if err == nil {
+		err = rw.flush()
+		if err == nil && j.opts.Checkpoint != "" {
+			os.Remove(j.opts.Checkpoint)
+		}
+		return err
+	}
+	if e := j.checkpoint(rw); e != nil {
+		j.server.Logger.Println("scan checkpoint error: " + e.Error())
+	}
+	return err
+}
+
+var errScanStopped = errors.New("scan stopped")
+
+// 记录一个文件的结果
+func (j *ScanJob) record(rw *reportWriter, it *scanItem) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Last = it.path
+	switch {
+	case it.err != nil:
+		j.status.Errors++
+		j.server.Logger.Println("scan error: " + it.err.Error())
+		return nil
+	case it.skipped:
+		j.status.Skipped++
+		return nil
+	}
+	j.status.Files++
+	if it.hit == nil {
+		return nil
+	}
+	j.status.Hits++
+	if it.hit.Quarantined != "" {
+		j.status.Quarantined++
+	}
+	return rw.write(it.hit)
+}
+
+// 写入报告并保存检查点
+func (j *ScanJob) checkpoint(rw *reportWriter) error {
+	err := rw.flush()
+	if err != nil || j.opts.Checkpoint == "" {
+		return err
+	}
+	j.mu.Lock()
+	cp := &scanCheckpoint{Status: j.status, Format: j.opts.Format, Quarantine: j.opts.Quarantine, ReportSize: rw.size}
+	j.mu.Unlock()
+	data, _ := json.Marshal(cp)
+	tmp := j.opts.Checkpoint + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, j.opts.Checkpoint)
+	}
+	return err
+}
+
+// 检查一个文件的路径和内容，需要时隔离，每个文件按开始检查时的配置
+func (j *ScanJob) inspect(it *scanItem) {
+	c := j.server.settings()
+	if it.info.Size() > int64(c.maxSize) {
+		it.skipped = true
+		return
+	}
+	body, err := ioutil.ReadFile(it.path)
+	if err != nil {
+		it.err = err
+		return
+	}
+	findings := make([]*Finding, 0)
+	err = c.checkPath(it.path)
+	if err == nil {
+		err = c.policy.CheckWrite(it.path)
+	}
+	if err != nil {
+		findings = append(findings, &Finding{Rule: "path", Message: err.Error()})
+	}
+	_, found := c.filter.Inspect(METHOD_CREATE_FILE, it.path, body)
+	findings = append(findings, found...)
+	if len(findings) == 0 {
+		return
+	}
+	it.hit = &ScanHit{Path: it.path, Size: it.info.Size(), Mtime: it.info.ModTime().Unix(), Findings: findings}
+	if j.opts.Quarantine {
+		it.hit.Quarantined, err = j.quarantine(c.filter, it, body, findings)
+		if err != nil {
+			it.hit.Error = "quarantine error: " + err.Error()
+		}
+	}
+}
+
+// 保存到隔离目录并删除文件，删除记录到操作日志，文件在检查之后被修改时不隔离
+func (j *ScanJob) quarantine(f *CTFilter, it *scanItem, body []byte, findings []*Finding) (string, error) {
+	t := j.server.ctFile
+	unlock, err := t.locks.Lock("", lockPath{it.path, false})
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	info, err := os.Lstat(it.path)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != it.info.Size() || !info.ModTime().Equal(it.info.ModTime()) {
+		return "", errors.New("file changed while scanning")
+	}
+	saved, err := f.keep(it.path, body, findings)
+	if err != nil {
+		return "", err
+	}
+	err = t.RemoveFile(it.path)
+	if err == nil {
+		err = t.journalOp(&FileData{Method: METHOD_REMOVE_FILE, Path: it.path})
+	}
+	if err != nil {
+		return "", err
+	}
+	j.server.Logger.Println("scan quarantined " + it.path + " to " + saved)
+	return saved, nil
+}
+
+// a在遍历顺序中是否在b之前，按路径的每一段比较，和filepath.Walk的顺序一致
+func walkBefore(a, b string) bool {
+	pa, pb := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] != pb[i] {
+			return pa[i] < pb[i]
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+// 写入报告，记录写入的大小
+type reportWriter struct {
+	w      *bufio.Writer
+	size   int64
+	format string
+}
+
+func (rw *reportWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *reportWriter) flush() error {
+	return rw.w.Flush()
+}
+
+// csv的表头
+func (rw *reportWriter) header() error {
+	c := csv.NewWriter(rw)
+	c.Write([]string{"path", "size", "mtime", "rule", "line", "message", "quarantined", "error"})
+	c.Flush()
+	return c.Error()
+}
+
+// json每个文件一行，csv每个问题一行
+func (rw *reportWriter) write(hit *ScanHit) error {
+	if rw.format == SCAN_JSON {
+		data, _ := json.Marshal(hit)
+		_, err := rw.Write(append(data, '\n'))
+		return err
+	}
+	c := csv.NewWriter(rw)
+	for _, f := range hit.Findings {
+		c.Write([]string{hit.Path, strconv.FormatInt(hit.Size, 10), time.Unix(hit.Mtime, 0).Format(time.RFC3339),
+			f.Rule, strconv.Itoa(f.Line), f.Message, hit.Quarantined, hit.Error})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// 处理METHOD_SCAN，开始、停止扫描或获取状态
+func (s *Server) Scan(dir string, body []byte) (*ScanStatus, error) {
+	params := new(ScanParams)
+	if len(body) > 0 {
+		err := json.Unmarshal(body, params)
+		if err != nil {
+			return nil, errors.New("scan params error: " + err.Error())
+		}
+	}
+	sc := s.scanner
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	switch params.Action {
+	case "", "status":
+	case "stop":
+		if sc.job != nil {
+			sc.job.Stop()
+		}
+	case "start":
+		if sc.dir == "" {
+			return nil, errors.New("scanDir not configured")
+		}
+		if sc.job != nil && sc.job.Status().Running {
+			return nil, errors.New("scan is running: " + sc.job.dir)
+		}
+		format := params.Format
+		if format == "" {
+			format = SCAN_JSON
+		}
+		opts := ScanOptions{
+			Report:     sc.dir + "/scan-" + time.Now().Format("20060102-150405") + "." + format,
+			Format:     format,
+			Checkpoint: sc.dir + "/" + SCAN_CHECKPOINT_FILE,
+			Resume:     params.Resume,
+			Quarantine: params.Quarantine,
+			Workers:    sc.workers,
+		}
+		if !params.Resume {
+			os.Remove(opts.Checkpoint)
+		}
+		job, err := s.NewScanJob(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		// 开始前设置状态，避免响应时还没有运行
+		job.status.Running = true
+		started := s.goBackground(func() {
+			err := job.Run()
+			if err != nil {
+				s.Logger.Println("scan " + job.dir + " error: " + err.Error())
+			} else {
+				st := job.Status()
+				s.Logger.Println("scan " + job.dir + " finished, files " + strconv.FormatInt(st.Files, 10) +
+					", hits " + strconv.FormatInt(st.Hits, 10) + ", report " + st.Report)
+			}
+		})
+		if !started {
+			return nil, errors.New("server is shutting down")
+		}
+		sc.job = job
+	default:
+		return nil, errors.New("scan action not supported: " + params.Action)
+	}
+	if sc.job == nil {
+		return &ScanStatus{}, nil
+	}
+	st := sc.job.Status()
+	return &st, nil
+}
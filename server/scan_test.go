@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWalkBefore(t *testing.T) {
+	// 和filepath.Walk的顺序一致，a的子目录在a.txt之后
+	order := []string{"/r", "/r/a", "/r/a/b", "/r/a/c.html", "/r/a.txt", "/r/b"}
+	for i := range order {
+		for j := range order {
+			if walkBefore(order[i], order[j]) != (i < j) {
+				t.Errorf("%s before %s: %v", order[i], order[j], !(i < j))
+			}
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().filter.sniff = true
+	files := map[string]string{
+		"index.html":         "<html>ok</html>",
+		"a/shell.html":       "<?php system($_GET['c']);",
+		"a/b/ok.txt":         "plain",
+		"a/b/run.txt":        "\x7fELF\x02\x01\x01\x00",
+		"a/x.php":            "plain",
+		"c/deep/d/logo.html": "<html><?= `id` ?></html>",
+		"c/empty.txt":        "",
+	}
+	for p, body := range files {
+		os.MkdirAll(filepath.Dir(root+"/"+p), 0755)
+		ioutil.WriteFile(root+"/"+p, []byte(body), 0644)
+	}
+	os.Symlink("/etc/passwd", root+"/link.txt")
+	hits := []string{root + "/a/b/run.txt", root + "/a/shell.html", root + "/a/x.php", root + "/c/deep/d/logo.html"}
+
+	dir, err := ioutil.TempDir("", "fserver-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	report := dir + "/report.json"
+	job, err := s.NewScanJob(root, ScanOptions{Report: report, Checkpoint: report + ".checkpoint", Resume: true, Workers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = job.Run(); err != nil {
+		t.Fatal(err)
+	}
+	st := job.Status()
+	if st.Running || st.Files != 7 || st.Hits != 4 || st.Errors != 0 {
+		t.Errorf("status: %+v", st)
+	}
+	full, _ := ioutil.ReadFile(report)
+	lines := strings.Split(strings.TrimSpace(string(full)), "\n")
+	if len(lines) != len(hits) {
+		t.Fatalf("report: %s", full)
+	}
+	for i, l := range lines {
+		hit := new(ScanHit)
+		json.Unmarshal([]byte(l), hit)
+		if hit.Path != hits[i] || len(hit.Findings) == 0 {
+			t.Errorf("line %d: %s", i, l)
+		}
+	}
+	if !strings.Contains(lines[2], `"rule":"path"`) {
+		t.Errorf("path finding: %s", lines[2])
+	}
+	if _, err = os.Stat(report + ".checkpoint"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed: %v", err)
+	}
+
+	// 从检查点继续，检查点之后写入的内容被截断，结果和完整扫描相同
+	cut := bytes.Index(full, []byte("\n")) + 1
+	cp := &scanCheckpoint{Status: ScanStatus{Dir: root, Report: report, Files: 2, Hits: 1, Last: root + "/a/b/run.txt"},
+		Format: SCAN_JSON, ReportSize: int64(cut)}
+	data, _ := json.Marshal(cp)
+	ioutil.WriteFile(report+".checkpoint", data, 0600)
+	ioutil.WriteFile(report, append(full[:cut:cut], "{\"path\":\"partial"...), 0600)
+	job, _ = s.NewScanJob(root, ScanOptions{Report: dir + "/other.json", Checkpoint: report + ".checkpoint", Resume: true})
+	if err = job.Run(); err != nil {
+		t.Fatal(err)
+	}
+	resumed, _ := ioutil.ReadFile(report)
+	if !bytes.Equal(resumed, full) {
+		t.Errorf("resumed report:\n%s\nwant:\n%s", resumed, full)
+	}
+	if st = job.Status(); st.Files != 7 || st.Hits != 4 {
+		t.Errorf("resumed status: %+v", st)
+	}
+
+	// csv每个问题一行
+	job, _ = s.NewScanJob(root+"/a", ScanOptions{Report: dir + "/report.csv", Format: SCAN_CSV})
+	if err = job.Run(); err != nil {
+		t.Fatal(err)
+	}
+	csv, _ := ioutil.ReadFile(dir + "/report.csv")
+	if !strings.HasPrefix(string(csv), "path,size,mtime,rule,line,message,quarantined,error\n") || strings.Count(string(csv), "\n") != 4 {
+		t.Errorf("csv:\n%s", csv)
+	}
+
+	if _, err = s.NewScanJob(root, ScanOptions{Report: report, Quarantine: true}); err == nil {
+		t.Error("quarantine without quarantineDir")
+	}
+	if _, err = s.NewScanJob("/etc", ScanOptions{Report: report}); err == nil {
+		t.Error("scan outside rootDir")
+	}
+}
+
+func TestScanMethod(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	s.settings().filter.sniff = true
+	dir, err := ioutil.TempDir("", "fserver-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.scanner.dir = dir + "/reports"
+	os.Mkdir(s.scanner.dir, 0700)
+	s.settings().filter.quarantine = dir + "/quarantine"
+	ioutil.WriteFile(root+"/ok.html", []byte("<p>ok</p>"), 0644)
+	ioutil.WriteFile(root+"/bad.html", []byte("<?php eval($_POST['x']);"), 0644)
+
+	scan := func(p string, params *ScanParams) (*ScanStatus, error) {
+		body, _ := json.Marshal(params)
+		data, err := s.handleRequest(&FileData{Method: METHOD_SCAN, Password: "pw", Path: p, Body: body})
+		if err != nil {
+			return nil, err
+		}
+		return data.(*ScanStatus), nil
+	}
+	st, err := scan("", &ScanParams{})
+	if err != nil || st.Dir != "" {
+		t.Fatalf("status before start: %+v %v", st, err)
+	}
+	st, err = scan(root, &ScanParams{Action: "start", Format: SCAN_CSV, Quarantine: true})
+	if err != nil || !st.Running || !strings.HasSuffix(st.Report, ".csv") {
+		t.Fatalf("start: %+v %v", st, err)
+	}
+	for st.Running {
+		time.Sleep(10 * time.Millisecond)
+		st, _ = scan("", &ScanParams{Action: "status"})
+	}
+	if st.Files != 2 || st.Hits != 1 || st.Quarantined != 1 || st.Error != "" {
+		t.Errorf("finished: %+v", st)
+	}
+	if _, err = os.Stat(root + "/bad.html"); !os.IsNotExist(err) {
+		t.Errorf("bad.html not quarantined: %v", err)
+	}
+	kept, _ := filepath.Glob(s.settings().filter.quarantine + "/*/*-bad.html")
+	if len(kept) != 1 {
+		t.Fatalf("quarantine: %v", kept)
+	}
+	csv, _ := ioutil.ReadFile(st.Report)
+	if !strings.Contains(string(csv), root+"/bad.html") || !strings.Contains(string(csv), kept[0]) {
+		t.Errorf("report:\n%s", csv)
+	}
+	if _, err = scan(root, &ScanParams{Action: "pause"}); err == nil {
+		t.Error("unknown action")
+	}
+}
+
+// 命令行扫描和服务同时运行，初始化时不能打开操作日志
+func TestInitOfflineJournal(t *testing.T) {
+	root, jdir := t.TempDir(), t.TempDir()
+	j, err := OpenJournal(jdir, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Write(&JournalRecord{Method: METHOD_CREATE_DIR, Path: root + "/a"}, nil)
+	name := j.f.Name()
+	// 服务正在写入的记录
+	j.f.Write([]byte{50, 0, 0, 0, 1, 2})
+	before, _ := os.Stat(name)
+
+	f := filepath.Join(t.TempDir(), "cmstop.conf")
+	ioutil.WriteFile(f, []byte("[common]\nrootDir="+root+"\nallowExt=html\n[journal]\njournalDir="+jdir+"\n"), 0600)
+	conf, err := goconfig.ReadConfigFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err = s.InitOffline(conf); err != nil {
+		t.Fatal(err)
+	}
+	if s.ctFile.journal != nil {
+		t.Error("offline init opened the journal")
+	}
+	if after, _ := os.Stat(name); after.Size() != before.Size() {
+		t.Errorf("journal segment truncated from %d to %d", before.Size(), after.Size())
+	}
+	j.Close()
+}
@@ -15,6 +15,17 @@ receive protocol:
 16byte header, 4uint. then password,path,body.
 if method is copy or rename, body is json encode params.
 
+操作类型的低16位是操作代码，高16位是请求标志(FLAG_*)。
+with FLAG_REQUEST_ID, a 4b(uint) request id follows the 16byte header,
+the server may process such requests concurrently and the response
+message carries the id, responses may return out of order.
+with FLAG_META, a 4b(uint) meta length and json encode RequestMeta
+follow (after the request id), then password,path,body.
+with FLAG_GZIP or FLAG_ZSTD the body is compressed and body length is the
+compressed length, the decompressed body must not exceed maxSize.
+RequestMeta may carry sha256 or crc32c of the (decompressed) body, the request is rejected
+with CODE_CHECKSUM_MISMATCH and nothing is written when it does not match.
+
 response protocol:
 |-----------|-----------------------------------------------------------------------|
 | 4b(uint)  | N                                                                     |
@@ -22,54 +33,79 @@ response protocol:
 | 消息长度  | 消息内容(JSON)                                                        |
 |-----------|-----------------------------------------------------------------------|
 4byte header, 1uint, then message.
+message json: {"code":0,"message":"success","id":1,"data":...}
+METHOD_ARCHIVE streams chunks after the response, see archive.go.
 */
 package server
 
 import (
 	"bytes"
 	"cmstop-fserver/util"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/9466/goconfig"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	MAX_PATH_LENGTH uint32 = 1 << 10   // 路径最大长度2014
-	MAX_BODY_SIZE   uint32 = 1 << 30   // 硬编码限制大小 1024 * 1024 * 1024 1G
-	DEF_IP                 = "0.0.0.0" // 默认监听IP
-	DEF_PORT               = "9468"    // 默认监听端口
-)
-
-var (
-	DENY_EXT = [4]string{"php", "cgi", "pl", "py"} // 禁止使用的扩展名
-	DENY_DIR = [2]string{"/etc/", "/boot/"}        // 禁止写入的目录
+	MAX_PATH_LENGTH      uint32 = 1 << 10   // 路径最大长度2014
+	MAX_BODY_SIZE        uint32 = 1 << 30   // 硬编码限制大小 1024 * 1024 * 1024 1G
+	MAX_META_LENGTH      uint32 = 1 << 16   // 附加信息最大长度64K
+	DEF_IP                      = "0.0.0.0" // 默认监听IP
+	DEF_PORT                    = "9468"    // 默认监听端口
+	DEF_PIPELINE                = 16        // 默认每个连接并发处理的流水线请求数
+	DEF_JANITOR_INTERVAL        = time.Hour // 默认清理历史版本、回收站和操作日志的间隔
 )
 
 // 服务器结构
 type Server struct {
-	Logger     *log.Logger      // 日志操作句柄
-	Chs        chan uint32      // 和主进程通信的信号
-	ConnNum    uint32           // 当前连接数
-	Shutdown   bool             // 关闭信号
-	listenIp   string           // 监听IP
-	listenPort string           // 监听端口
-	listener   *net.TCPListener // TCP处理句柄
-	debug      bool             // 是否开启调试模式
-	rootDir    []string         // 允许操作的目录
-	allowExt   []string         // 允许运行使用的文件扩展名
-	maxSize    uint32           // 允许操作的最大文件大小
-	password   string           // 密钥
-	mail       *mailConf        // 邮件配置信息
-	ctFile     *CTFile          // 文件操作句柄
+	Logger       *log.Logger              // 日志操作句柄
+	ctx          context.Context          // 服务的生命周期，停止时取消
+	cancel       context.CancelFunc       // 取消ctx
+	connLock     sync.Mutex               // 保护listener、conns和bg的计数
+	conns        map[*serverConn]struct{} // 当前连接
+	bg           sync.WaitGroup           // 清理、复制和扫描等后台任务
+	timeout      time.Duration            // 停止时等待处理中请求的最长时间
+	listenIp     string                   // 监听IP
+	listenPort   string                   // 监听端口
+	listener     *net.TCPListener         // TCP处理句柄
+	debug        bool                     // 是否开启调试模式
+	conf         atomic.Value             // 当前的运行时配置，*settings，重新加载时整体替换
+	scanner      *scanner                 // 扫描已有文件
+	reporter     *reporter                // 发送内容检查的报告邮件
+	tls          *tls.Config              // TLS配置，为nil时不使用TLS
+	pipeline     int                      // 每个连接并发处理的流水线请求数
+	janitor      time.Duration            // 历史版本、回收站和操作日志的清理间隔
+	journalConf  *goconfig.ConfigFile     // 升级启动时还没有打开的操作日志的配置
+	journalReady chan struct{}            // 升级启动时打开操作日志后关闭，为nil时已经打开
+	ctFile       *CTFile                  // 文件操作句柄
+}
+
+// 可以在运行时重新加载的配置，加载后不再修改，重新加载时整体替换
+// 请求开始时取一次，处理中不需要加锁
+type settings struct {
+	rootDir  []string    // 允许操作的目录
+	maxSize  uint32      // 允许操作的最大文件大小
+	policy   *PathPolicy // 禁止和允许的目录、文件名和扩展名
+	filter   *CTFilter   // 写入内容检查
+	password string      // 密钥
+	hmac     bool        // 是否只接受签名的请求
+	mail     *mailConf   // 邮件配置信息
 }
 
 // 邮件发送信息结构
@@ -85,11 +121,40 @@ type mailConf struct {
 
 func NewServer() *Server {
 	s := new(Server)
-	s.Chs = make(chan uint32, 3)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.conns = make(map[*serverConn]struct{})
+	s.timeout = DEF_SHUTDOWN_TIMEOUT
+	c := &settings{filter: NewCtFilter(s)}
+	c.policy, _ = NewPathPolicy(nil, nil, nil, nil)
+	s.conf.Store(c)
+	s.scanner = &scanner{workers: DEF_SCAN_WORKERS}
+	s.reporter = newReporter(s)
 	return s
 }
 
+// 初始化方式
+const (
+	initServe   = iota // 开始服务
+	initOffline        // 在服务之外运行的任务
+	initUpgrade        // 升级启动，原进程还在服务
+)
+
 func (s *Server) Init(conf *goconfig.ConfigFile) error {
+	return s.init(conf, initServe)
+}
+
+// 初始化在服务之外运行的任务，如命令行扫描
+// 不打开操作日志，不作为副本运行，操作日志只能由运行中的服务写入
+func (s *Server) InitOffline(conf *goconfig.ConfigFile) error {
+	return s.init(conf, initOffline)
+}
+
+// 升级启动时初始化，操作日志还被原进程打开时先不打开，由Takeover在原进程关闭后打开
+func (s *Server) InitUpgrade(conf *goconfig.ConfigFile) error {
+	return s.init(conf, initUpgrade)
+}
+
+func (s *Server) init(conf *goconfig.ConfigFile, mode int) error {
 	ip, err := conf.GetString("common", "listen")
 	if err != nil || ip == "" {
 		s.listenIp = DEF_IP
@@ -102,154 +167,436 @@ func (s *Server) Init(conf *goconfig.ConfigFile) error {
 	} else {
 		s.listenPort = port
 	}
+	c, err := s.loadSettings(conf)
+	if err != nil {
+		return err
+	}
+	s.conf.Store(c)
+	s.pipeline, _ = conf.GetInt("common", "pipeline")
+	if s.pipeline <= 0 {
+		s.pipeline = DEF_PIPELINE
+	}
+	timeout, _ := conf.GetInt("common", "shutdownTimeout")
+	if timeout > 0 {
+		s.timeout = time.Duration(timeout) * time.Second
+	}
+	s.debug, _ = conf.GetBool("log", "debug")
+	s.tls, err = loadServerTLS(conf)
+	if err != nil {
+		return err
+	}
+	err = s.scanner.init(conf, c.rootDir)
+	if err != nil {
+		return err
+	}
+
+	// 初始化CTFile
+	s.ctFile = NewCtFile(s)
+
+	// 历史版本和回收站，保存目录不能在允许操作的目录中
+	storeDir, _ := conf.GetString("retention", "storeDir")
+	if storeDir != "" {
+		versions, _ := conf.GetInt("retention", "versions")
+		days, _ := conf.GetInt("retention", "days")
+		store, err := NewStore(storeDir, versions, days)
+		if err != nil {
+			return err
+		}
+		for _, d := range c.rootDir {
+			if store.contains(d) {
+				return errors.New("storeDir cannot inside or contain rootDir: " + d)
+			}
+		}
+		s.ctFile.store = store
+	}
+	interval, _ := conf.GetInt("retention", "interval")
+	s.janitor = time.Duration(interval) * time.Minute
+	if s.janitor <= 0 {
+		s.janitor = DEF_JANITOR_INTERVAL
+	}
+
+	// 快照，快照目录和rootDir在同一个文件系统中时使用硬链接
+	snapshotDir, _ := conf.GetString("snapshot", "snapshotDir")
+	if snapshotDir != "" {
+		snaps, err := NewSnapshotStore(snapshotDir)
+		if err != nil {
+			return err
+		}
+		for _, d := range c.rootDir {
+			if snaps.contains(d) {
+				return errors.New("snapshotDir cannot inside or contain rootDir: " + d)
+			}
+		}
+		s.ctFile.snaps = snaps
+	}
+	if mode == initOffline {
+		return nil
+	}
+
+	// 操作日志
+	journal, err := OpenJournalConf(conf)
+	if err == errJournalLocked && mode == initUpgrade {
+		s.journalConf = conf
+		s.journalReady = make(chan struct{})
+	} else if err != nil {
+		return err
+	}
+	s.ctFile.journal = journal
+
+	// 复制，配置了主节点时作为副本运行
+	primary, _ := conf.GetString("replica", "primary")
+	if primary != "" {
+		password, _ := conf.GetString("replica", "password")
+		stateFile, _ := conf.GetString("replica", "stateFile")
+		prefix, _ := conf.GetString("replica", "pathPrefix")
+		replica, err := NewReplica(s.ctFile, primary, password, stateFile, prefix)
+		if err != nil {
+			return err
+		}
+		replica.sign, _ = conf.GetBool("replica", "hmac")
+		if on, _ := conf.GetBool("replica", "tls"); on {
+			caFile, _ := conf.GetString("replica", "tlsCA")
+			serverName, _ := conf.GetString("replica", "tlsServerName")
+			replica.tls, err = ClientTLSConfig(caFile, serverName)
+			if err != nil {
+				return err
+			}
+		}
+		s.ctFile.replica = replica
+	}
+
+	return nil
+}
+
+// 读取可以在运行时重新加载的配置：rootDir、maxSize、扩展名和目录的策略、密钥、邮件和内容检查
+// 返回新的配置，不修改当前的配置
+func (s *Server) loadSettings(conf *goconfig.ConfigFile) (*settings, error) {
+	c := new(settings)
 	rootDir, err := conf.GetString("common", "rootDir")
 	if err != nil || rootDir == "" {
-		return errors.New("rootDir cannot empty")
+		return nil, errors.New("rootDir cannot empty")
+	}
+	c.rootDir = strings.Split(rootDir, ",")
+	for i, d := range c.rootDir {
+		d = strings.TrimSpace(d)
+		if !path.IsAbs(d) {
+			return nil, errors.New("rootDir must be absolute: " + d)
+		}
+		c.rootDir[i] = path.Clean(d)
 	}
-	s.rootDir = strings.Split(rootDir, ",")
-	maxSize, err := conf.GetString("common", "maxSize")
+	maxSize, _ := conf.GetString("common", "maxSize")
 	if maxSize == "" {
-		s.maxSize = MAX_BODY_SIZE
+		c.maxSize = MAX_BODY_SIZE
 	} else {
-		s.maxSize = min(uint32(util.ReverseFormatSize(maxSize)), MAX_BODY_SIZE)
+		c.maxSize = min(uint32(util.ReverseFormatSize(maxSize)), MAX_BODY_SIZE)
 	}
 	allowExt, err := conf.GetString("common", "allowExt")
 	if err != nil || allowExt == "" {
-		return errors.New("allowExt cannot empty")
+		return nil, errors.New("allowExt cannot empty")
 	}
-	s.allowExt = strings.Split(allowExt, ",")
-
-	s.password, _ = conf.GetString("common", "password")
-	s.debug, _ = conf.GetBool("log", "debug")
+	denyExt, _ := conf.GetString("common", "denyExt")
+	denyDir, _ := conf.GetString("common", "denyDir")
+	denyName, _ := conf.GetString("common", "denyName")
+	c.policy, err = NewPathPolicy(strings.Split(allowExt, ","), strings.Split(denyExt, ","),
+		strings.Split(denyDir, ","), strings.Split(denyName, ","))
+	if err != nil {
+		return nil, err
+	}
+	c.policy.allowNoExt, _ = conf.GetBool("common", "allowNoExt")
 
-	s.mail = new(mailConf)
-	s.mail.host, _ = conf.GetString("mail", "mailHost")
-	s.mail.user, _ = conf.GetString("mail", "mailUser")
-	s.mail.pass, _ = conf.GetString("mail", "mailPass")
-	s.mail.from, _ = conf.GetString("mail", "mailFrom")
-	s.mail.to, _ = conf.GetString("mail", "mailTo")
-	s.mail.title, _ = conf.GetString("mail", "mailTitle")
-	s.mail.serverInfo, _ = conf.GetString("mail", "serverInfo")
+	c.password, _ = conf.GetString("common", "password")
+	c.hmac, _ = conf.GetBool("common", "hmac")
+	if c.hmac && c.password == "" {
+		return nil, errors.New("hmac requires password")
+	}
 
-	// 初始化CTFile
-	s.ctFile = NewCtFile(s)
+	c.mail = new(mailConf)
+	c.mail.host, _ = conf.GetString("mail", "mailHost")
+	c.mail.user, _ = conf.GetString("mail", "mailUser")
+	c.mail.pass, _ = conf.GetString("mail", "mailPass")
+	c.mail.from, _ = conf.GetString("mail", "mailFrom")
+	c.mail.to, _ = conf.GetString("mail", "mailTo")
+	c.mail.title, _ = conf.GetString("mail", "mailTitle")
+	c.mail.serverInfo, _ = conf.GetString("mail", "serverInfo")
 
-	return nil
+	c.filter = NewCtFilter(s)
+	c.filter.mailConf = c.mail
+	err = c.filter.Init(conf, c.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-func (s *Server) Start() {
-	addr, err := net.ResolveTCPAddr("tcp4", s.listenIp+":"+s.listenPort)
-	if err != nil {
-		s.Logger.Fatalln(err)
+// 开始服务，listener为nil时监听配置的地址，升级启动时使用继承的监听
+// 停止后返回nil，监听出错时返回错误
+func (s *Server) Start(listener *net.TCPListener) error {
+	if listener == nil {
+		addr, err := net.ResolveTCPAddr("tcp4", s.listenIp+":"+s.listenPort)
+		if err != nil {
+			return err
+		}
+		listener, err = net.ListenTCP("tcp4", addr)
+		if err != nil {
+			return err
+		}
 	}
-	listener, err := net.ListenTCP("tcp4", addr)
-	if err != nil {
-		s.Logger.Fatalln(err)
+	s.goBackground(func() {
+		// 清理和复制都会写入操作日志
+		if s.waitJournal() != nil {
+			return
+		}
+		if s.ctFile.replica != nil {
+			s.goBackground(func() {
+				s.ctFile.replica.Run(func() bool { return s.ctx.Err() != nil })
+			})
+		}
+		s.runJanitor()
+	})
+	return s.Serve(listener)
+}
+
+// 在已经建立的监听上提供服务，直到停止或监听出错
+func (s *Server) Serve(listener *net.TCPListener) error {
+	s.connLock.Lock()
+	if s.ctx.Err() != nil {
+		s.connLock.Unlock()
+		listener.Close()
+		return nil
 	}
 	s.listener = listener
+	s.connLock.Unlock()
 	s.Logger.Println("CmsTop File Server begin serve.")
+	var delay time.Duration
 	for {
-		if s.Shutdown == true {
-			if s.ConnNum == 0 {
-				s.Logger.Println("active connections serve done, now beginning shutdown...")
-				break
-			} else {
-				s.Logger.Println("CmsTop File Server has", s.ConnNum, "actvie connections, serve continue...")
-			}
-			time.Sleep(100 * time.Millisecond) // 如果还在处理，等待1000毫秒继续
-			continue
-		}
 		if s.debug {
 			s.Logger.Println("CmsTop File Server new accept...")
 		}
-		conn, err := s.listener.AcceptTCP()
+		conn, err := listener.AcceptTCP()
 		if err != nil {
-			if oerr, ok := err.(*net.OpError); ok && oerr.Err.Error() == "use of closed network connection" {
-				/* this hack happens because the error is returned when the
-				 * network socket is closing and instead of returning a
-				 * io.EOF it returns this error.New(...) struct.
-				 */
-				continue // 这是listener被关闭，不记录日志
+			// 停止时关闭了监听
+			if s.ctx.Err() != nil {
+				s.Logger.Println("CmsTop File Server stop accepting.")
+				return nil
+			}
+			// 文件句柄不足等临时错误，等待后继续
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.Logger.Println(err.Error())
+				time.Sleep(delay)
+				continue
 			}
-			s.Logger.Println(err.Error())
-			continue // 输出异常，继续提供服务
+			return err
+		}
+		delay = 0
+		c := &serverConn{conn: conn}
+		if s.tls != nil {
+			c.conn = tls.Server(conn, s.tls)
+		}
+		if !s.trackConn(c) {
+			conn.Close()
+			continue
 		}
-		s.ConnNum++ // 每启动一个处理，连接数+1
-		go s.handle(conn)
+		go s.handle(c)
 	}
-	s.Logger.Println("CmsTop File Server has been shutdown.")
-	s.Chs <- 1 // 程序终止，写入Channel数据
 }
 
-func (s *Server) Stop() {
-	s.listener.Close()
-	s.Chs <- 1 // TODO 将写入和读取分离
-	s.Chs <- 1 // TODO 过滤器，检测注入和木马
+// 定时清理过期的历史版本、回收站条目和操作日志分段，直到停止
+func (s *Server) runJanitor() {
+	interval := s.janitor
+	if interval <= 0 {
+		interval = DEF_JANITOR_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.ctFile.store != nil {
+			if err := s.ctFile.store.Clean(); err != nil {
+				s.Logger.Println("store janitor error: " + err.Error())
+			}
+		}
+		if s.ctFile.journal != nil {
+			if err := s.ctFile.journal.Compact(); err != nil {
+				s.Logger.Println("journal compact error: " + err.Error())
+			}
+		}
+	}
 }
 
-func (s *Server) handle(conn *net.TCPConn) {
+func (s *Server) handle(c *serverConn) {
+	conn := c.conn
 	if s.debug {
 		s.Logger.Println("Conn Acccpt", conn)
 		s.Logger.Println("Client", conn.RemoteAddr().String())
 	}
+	var mu sync.Mutex     // 流水线模式下多个goroutine写入响应，需要加锁
+	var wg sync.WaitGroup // 并发处理中的流水线请求
+	sem := make(chan struct{}, s.pipeline)
 	defer func() {
 		if s.debug {
 			s.Logger.Println("Conn Closed", conn)
 		}
-		conn.Close()
-		s.ConnNum-- // 每结束一个处理，连接数-1
+		s.untrackConn(c)
 	}()
-	var err error
-	var idleTime time.Time
+	defer wg.Wait() // 关闭连接前等待流水线请求处理完成
 	for {
-		err = s.handleRequest(conn)
+		rec, err := s.readRequest(conn)
 		if err != nil {
-			if err == io.EOF { // io.EOF对方传输终止，关闭了连接，暂时没有数据
-				if time.Now().After(idleTime.Add(time.Second * 10)) { // 空闲超时
-					break
-				}
-				continue
+			// io.EOF对方关闭了连接，停止时连接被关闭，都不需要响应
+			if err != io.EOF && !s.connClosed(c) {
+				s.Logger.Println(err)
+				wg.Wait()
+				ClientWrite(conn, []byte(err.Error()), 1)
 			}
+			break
+		}
+		// 停止时空闲的连接已经关闭，读到的请求不再处理
+		if !s.beginRequest(c) {
+			break
+		}
+
+		// 流水线请求并发处理，响应带有请求ID，可以乱序返回
+		if rec.Flags&FLAG_REQUEST_ID != 0 {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(rec *FileData) {
+				defer func() {
+					s.endRequest(c)
+					<-sem
+					wg.Done()
+				}()
+				data, err := s.handleRequest(rec)
+				mu.Lock()
+				err = respond(conn, rec.RequestId, data, err)
+				mu.Unlock()
+				if err != nil {
+					s.Logger.Println(err)
+				}
+			}(rec)
+			continue
+		}
+
+		// 普通请求按顺序处理，先等待之前的流水线请求完成
+		wg.Wait()
+		data, err := s.handleRequest(rec)
+		err = respond(conn, 0, data, err)
+		s.endRequest(c)
+		if err != nil {
 			s.Logger.Println(err)
-			ClientWrite(conn, []byte(err.Error()), 1)
 			break
-		} else {
-			ClientWrite(conn, []byte("success"), 0)
-			// 每次处理成功后重置超时时间
-			idleTime = time.Now()
-			if s.debug {
-				s.Logger.Println("Conn IdleTime Reset", conn)
-			}
 		}
-		time.Sleep(5 * time.Millisecond) // 如果还在处理，等待5毫秒继续
 	}
 }
 
-func (s *Server) handleRequest(conn *net.TCPConn) error {
-	// 接收数据
+// 读取一个请求
+func (s *Server) readRequest(conn net.Conn) (*FileData, error) {
 	//conn.SetReadDeadline(time.Now().Add(time.Second * 30)) // 3秒超时
 	rec, err := TCPConnRead(conn)
 	if err != nil {
 		if err == io.EOF {
-			return err
+			return nil, err
 		}
-		return errors.New("TCPConnRead Data Error: " + err.Error())
+		return nil, errors.New("TCPConnRead Data Error: " + err.Error())
 	}
+	rec.Client = conn.RemoteAddr().String()
+	return rec, nil
+}
 
-	// 判断密钥
-	if len(s.password) > 0 && s.password != rec.Password {
-		return errors.New("Password check failed")
-	}
+// 处理一个请求，返回需要响应给客户端的数据
+func (s *Server) handleRequest(rec *FileData) (interface{}, error) {
+	// 请求开始时的配置，重新加载不等待处理中的请求
+	c := s.settings()
 
-	// 判断路径
-	err = s.CheckPath(rec.Path)
+	// 判断密钥或签名
+	err := c.checkAuth(rec)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// 解压内容，文件写入在检查路径后解压到暂存文件，批量操作和压缩包在执行时边读取边解压
+	switch int(rec.Method) {
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE, METHOD_BATCH, METHOD_EXTRACT:
+	default:
+		if rec.Flags&FLAG_COMPRESS != 0 {
+			body, err := decompress(rec.Flags, rec.Body, c.maxSize)
+			if err != nil {
+				return nil, err
+			}
+			rec.Body = body
+			rec.BodySize = uint32(len(body))
+			rec.Flags &^= FLAG_COMPRESS
+		}
+	}
+	defer func() {
+		if rec.BodyFile != "" {
+			os.Remove(rec.BodyFile)
+		}
+	}()
+
+	// 升级启动时修改文件和读取操作日志的请求等待原进程关闭操作日志
+	if !readOnlyMethod(rec.Method) || int(rec.Method) == METHOD_JOURNAL_READ || int(rec.Method) == METHOD_REPLICA_STATUS {
+		err := s.waitJournal()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 清理路径，之后的检查和操作都使用清理后的路径
+	rec.Path = cleanPath(rec.Path)
+
+	// 副本只接受读操作，修改由复制执行
+	if s.ctFile.replica != nil && !readOnlyMethod(rec.Method) {
+		return nil, errors.New("replica is read-only")
+	}
+
+	// 判断路径，写入同时检查内容大小，批量操作在执行时检查每个子操作的路径，释放租约锁和复制请求不需要检查
+	// 扫描在开始时检查路径，停止和获取状态不需要路径
+	switch int(rec.Method) {
+	case METHOD_BATCH, METHOD_UNLOCK, METHOD_JOURNAL_READ, METHOD_REPLICA_STATUS, METHOD_SCAN:
+	case METHOD_CREATE_FILE, METHOD_MODIFY_FILE, METHOD_APPEND_FILE:
+		if rec.Flags&FLAG_COMPRESS != 0 {
+			err := c.checkStaged(rec)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		body, err := c.checkWrite(rec.Method, rec.Path, rec.Body)
+		if err != nil {
+			return nil, err
+		}
+		// 内容被改写时先校验原内容，之后写入改写的内容
+		if !bytes.Equal(body, rec.Body) {
+			err = checkChecksum(rec)
+			if err != nil {
+				return nil, err
+			}
+			rec.Body = body
+			rec.BodySize = uint32(len(body))
+			rec.Rewritten = true
+			if rec.Meta != nil {
+				rec.Meta.Sha256, rec.Meta.Crc32c = "", ""
+			}
+		}
+	default:
+		err := c.checkPath(rec.Path)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// DEBUG
 	if s.debug {
-		fmt.Println("conn: ", conn)
+		fmt.Println("requestId: ", rec.RequestId)
 		fmt.Println("method: ", rec.Method)
 		fmt.Println("path: ", rec.Path)
 		fmt.Println("bodySize: ", rec.BodySize)
@@ -259,50 +606,238 @@ func (s *Server) handleRequest(conn *net.TCPConn) error {
 	return s.ctFile.Handle(rec)
 }
 
-// 检测路径是否合法
+// 当前的运行时配置
+func (s *Server) settings() *settings {
+	return s.conf.Load().(*settings)
+}
+
+// 读取木马检测的关键词文件，没有开启木马检测时不读取
+// 在开始服务前调用，运行中由Reload读取
+func (s *Server) LoadInjection(file string) error {
+	return s.settings().loadInjection(file)
+}
+
+func (c *settings) loadInjection(file string) error {
+	if !c.filter.injection.open {
+		return nil
+	}
+	return c.filter.injection.load(file)
+}
+
+// 按当前配置检测写入，见checkWrite
+func (s *Server) CheckWrite(method uint32, filepath string, body []byte) ([]byte, error) {
+	return s.settings().checkWrite(method, filepath, body)
+}
+
+// 按当前配置检测复制和重命名的目标路径，见checkDest
+func (s *Server) CheckDest(src, dest string) error {
+	return s.settings().checkDest(src, dest)
+}
+
+// 按当前配置检测路径，见checkPath
 func (s *Server) CheckPath(filepath string) error {
+	return s.settings().checkPath(filepath)
+}
+
+// 检测写入是否合法，检查路径、扩展名、内容大小和内容，单个写入、批量操作和解压都使用
+// method为写入方法，追加写入的内容不在文件开头
+// 返回需要写入的内容，内容检查重新编码图片时和body不同
+func (c *settings) checkWrite(method uint32, filepath string, body []byte) ([]byte, error) {
+	err := c.checkPath(filepath)
+	if err != nil {
+		return nil, err
+	}
+	err = c.policy.CheckWrite(filepath)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(body)) > c.maxSize {
+		return nil, errors.New("body too large! body should less than " + strconv.FormatInt(int64(c.maxSize), 10))
+	}
+	return c.filter.Check(method, filepath, body)
+}
+
+// 检测压缩的写入，检查路径后将内容解压到暂存文件，解压后超过maxSize时返回错误
+// 内容检查需要完整的内容，需要检查时读取暂存文件，改写内容时写入改写后的内容
+func (c *settings) checkStaged(rec *FileData) error {
+	err := c.checkPath(rec.Path)
+	if err == nil {
+		err = c.policy.CheckWrite(rec.Path)
+	}
+	if err == nil {
+		err = stageBody(rec, c.maxSize)
+	}
+	if err != nil || !c.filter.inspects(rec.Path) {
+		return err
+	}
+	body, err := ioutil.ReadFile(rec.BodyFile)
+	if err != nil {
+		return err
+	}
+	out, err := c.filter.Check(rec.Method, rec.Path, body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(out, body) {
+		os.Remove(rec.BodyFile)
+		rec.BodyFile = ""
+		rec.Body = out
+		rec.BodySize = uint32(len(out))
+		rec.Rewritten = true
+		if rec.Meta != nil {
+			rec.Meta.Sha256, rec.Meta.Crc32c = "", ""
+		}
+	}
+	return nil
+}
+
+// 检测复制和重命名的目标路径，源路径是目录时只检查路径
+// 源路径是文件或还不存在(批量操作中之后才创建)时目标的扩展名必须允许写入，
+// 扩展名和源文件不同时源文件的内容按目标的扩展名检查，避免写入后改名绕过内容检查
+func (c *settings) checkDest(src, dest string) error {
+	err := c.checkPath(dest)
+	if err != nil {
+		return err
+	}
+	f, err := os.Lstat(src)
+	if err == nil && f.IsDir() {
+		return nil
+	}
+	if err == nil && f.Mode().IsRegular() && fileExt(src) != fileExt(dest) {
+		if f.Size() > int64(c.maxSize) {
+			return errors.New("body too large! body should less than " + strconv.FormatInt(int64(c.maxSize), 10))
+		}
+		body, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return c.checkDestContent(dest, body)
+	}
+	return c.policy.CheckWrite(dest)
+}
+
+// 按目标的扩展名检查复制或重命名的内容
+// 内容检查需要改写内容时(如图片重新编码)拒绝，应重新上传
+func (c *settings) checkDestContent(dest string, body []byte) error {
+	err := c.policy.CheckWrite(dest)
+	if err != nil {
+		return err
+	}
+	out, err := c.filter.Check(METHOD_CREATE_FILE, dest, body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(out, body) {
+		return &CodeError{CODE_CONTENT_REJECTED, "content rejected: content must be rewritten for " + fileExt(dest) + ", upload it instead"}
+	}
+	return nil
+}
+
+// 检测路径是否合法
+func (c *settings) checkPath(filepath string) error {
 	// -- 判断是否是绝对路径
 	if path.IsAbs(filepath) == false {
 		return errors.New("Path must be absolute")
 	}
 
-	// -- 判断路径是否在黑名单中
-	for _, d := range DENY_DIR {
-		if strings.HasPrefix(filepath, d) {
-			return errors.New("Path in DENY_DIR")
-		}
+	// -- 路径必须是清理过的，不能含有..、.和多余的/
+	if path.Clean(filepath) != filepath {
+		return errors.New("Path must be clean")
 	}
 
-	// -- 判断文件扩展名是否在黑名单中
-	ext := path.Ext(filepath)
-	if ext != "" {
-		for _, e := range DENY_EXT {
-			if ext == "."+e {
-				return errors.New("Extension in DENY_EXT")
-			}
-		}
+	// -- 判断路径、文件名和扩展名是否在黑名单中
+	err := c.policy.Check(filepath)
+	if err != nil {
+		return err
 	}
 
-	// -- 判断路径是否在可允许的范围
-	_dirAllow := false
-	for _, d := range s.rootDir {
-		if strings.HasPrefix(filepath, d) {
-			_dirAllow = true
-			break
+	// -- 判断路径是否在可允许的范围，逐级检查符号链接不离开rootDir
+	for _, d := range c.rootDir {
+		if inDir(filepath, d) {
+			return resolveInRoot(d, filepath)
 		}
 	}
-	if _dirAllow == false {
-		return errors.New("Path not in rootDir")
+	return errors.New("Path not in rootDir")
+}
+
+// 路径所在的rootDir，不在rootDir中时返回空
+func (c *settings) rootOf(p string) string {
+	for _, d := range c.rootDir {
+		if inDir(p, d) {
+			return d
+		}
 	}
+	return ""
+}
 
-	return nil
+// 路径是否是rootDir本身，替换目录的临时目录在父目录中，不能用于rootDir
+func (c *settings) isRootDir(p string) bool {
+	for _, d := range c.rootDir {
+		if p == d {
+			return true
+		}
+	}
+	return false
 }
 
 // 响应客户端信息
-func ClientWrite(conn *net.TCPConn, msg []byte, code int) {
+func ClientWrite(conn net.Conn, msg []byte, code int) {
 	send := new(ResponseData)
 	send.Code = code
 	send.Message = string(msg)
+	writeResponse(conn, send)
+}
+
+// 响应客户端成功信息，data不为空时附带在响应中
+func ClientWriteData(conn net.Conn, data interface{}) {
+	writeResponse(conn, newResponse(0, data, nil))
+}
+
+// 写入处理结果，打包下载在响应后写入打包流，返回处理或打包中的错误
+func respond(conn net.Conn, id uint32, data interface{}, err error) error {
+	if st, ok := data.(*archiveStream); ok && st != nil && err == nil {
+		return st.stream(conn, id)
+	}
+	writeResponse(conn, newResponse(id, data, err))
+	return err
+}
+
+// 根据处理结果生成响应，id为流水线请求的请求ID
+// 处理失败时也会附带data，如批量操作中每个子操作的状态
+func newResponse(id uint32, data interface{}, err error) *ResponseData {
+	send := new(ResponseData)
+	send.Id = id
+	send.Message = "success"
+	if err != nil {
+		send.Code = CODE_ERROR
+		if ce, ok := err.(*CodeError); ok {
+			send.Code = ce.Code
+		}
+		send.Message = err.Error()
+	}
+	if data != nil && !isNil(data) {
+		raw, jerr := json.Marshal(data)
+		if jerr != nil {
+			send.Code = 1
+			send.Message = "response encode error: " + jerr.Error()
+			return send
+		}
+		send.Data = raw
+	}
+	return send
+}
+
+// 判断接口中是否是空指针或空切片
+func isNil(data interface{}) bool {
+	v := reflect.ValueOf(data)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		return v.IsNil()
+	}
+	return false
+}
+
+func writeResponse(conn net.Conn, send *ResponseData) {
 	json, _ := json.Marshal(send)
 	length := uint32(len(json))
 	binary.Write(conn, binary.LittleEndian, length)
@@ -310,7 +845,7 @@ func ClientWrite(conn *net.TCPConn, msg []byte, code int) {
 }
 
 // 协议封装读取
-func TCPConnRead(conn *net.TCPConn) (*FileData, error) {
+func TCPConnRead(conn net.Conn) (*FileData, error) {
 	rec := new(FileData)
 	result := bytes.NewBuffer(nil)
 	// 读取操作类型
@@ -331,10 +866,14 @@ func TCPConnRead(conn *net.TCPConn) (*FileData, error) {
 	if err != nil {
 		return nil, err
 	}
-	rec.Method = method
+	rec.Method = method & METHOD_MASK
+	rec.Flags = method &^ METHOD_MASK
 	if int(rec.Method) <= METHOD_MIN || int(rec.Method) >= METHOD_MAX {
 		return nil, errors.New("method not defined")
 	}
+	if rec.Flags&^FLAG_ALL != 0 {
+		return nil, errors.New("method flags not defined")
+	}
 
 	// 读取密钥长度
 	num, err = conn.Read(data[4:8])
@@ -390,6 +929,36 @@ func TCPConnRead(conn *net.TCPConn) (*FileData, error) {
 		return nil, errors.New("body too large! body should less than " + strconv.FormatInt(int64(MAX_BODY_SIZE), 10))
 	}
 
+	// 读取请求ID
+	if rec.Flags&FLAG_REQUEST_ID != 0 {
+		err = binary.Read(conn, binary.LittleEndian, &rec.RequestId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 读取附加信息
+	if rec.Flags&FLAG_META != 0 {
+		var metaLength uint32
+		err = binary.Read(conn, binary.LittleEndian, &metaLength)
+		if err != nil {
+			return nil, err
+		}
+		if metaLength > MAX_META_LENGTH {
+			return nil, errors.New("meta legnth too large! meta length should less than " + strconv.FormatInt(int64(MAX_META_LENGTH), 10))
+		}
+		_meta := make([]byte, metaLength)
+		_, err = io.ReadFull(conn, _meta)
+		if err != nil {
+			return nil, err
+		}
+		rec.Meta = new(RequestMeta)
+		err = json.Unmarshal(_meta, rec.Meta)
+		if err != nil {
+			return nil, errors.New("meta decode error: " + err.Error())
+		}
+	}
+
 	// 读取密钥
 	_password := make([]byte, rec.PassLength)
 	num, err = io.ReadFull(conn, _password)
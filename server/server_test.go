@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// 启动一个测试服务，rootDir为临时目录，返回服务、rootDir和监听地址
+func newTestServer(t *testing.T) (*Server, string, string) {
+	root, err := ioutil.TempDir("", "fserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	c := s.settings()
+	c.rootDir = []string{root}
+	c.maxSize = MAX_BODY_SIZE
+	s.pipeline = 4
+	c.password = "pw"
+	s.ctFile = NewCtFile(s)
+
+	addr, _ := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	l, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		l.Close()
+		os.RemoveAll(root)
+	})
+	return s, root, l.Addr().String()
+}
+
+func dialTestServer(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// 按协议发送一个请求
+func sendTestRequest(conn net.Conn, rec *FileData) error {
+	flags := rec.Flags
+	if rec.Meta != nil {
+		flags |= FLAG_META
+	}
+	head := []uint32{rec.Method | flags, uint32(len(rec.Password)), uint32(len(rec.Path)), uint32(len(rec.Body))}
+	if rec.Flags&FLAG_REQUEST_ID != 0 {
+		head = append(head, rec.RequestId)
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, head)
+	if rec.Meta != nil {
+		meta, _ := json.Marshal(rec.Meta)
+		binary.Write(buf, binary.LittleEndian, uint32(len(meta)))
+		buf.Write(meta)
+	}
+	buf.WriteString(rec.Password)
+	buf.WriteString(rec.Path)
+	buf.Write(rec.Body)
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+func readTestResponse(t *testing.T, conn net.Conn) *ResponseData {
+	var length uint32
+	if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	resp := new(ResponseData)
+	if err := json.Unmarshal(data, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestPipelineResponses(t *testing.T) {
+	_, root, addr := newTestServer(t)
+	conn := dialTestServer(t, addr)
+	const n = 50
+	go func() {
+		for i := 1; i <= n; i++ {
+			rec := &FileData{Method: METHOD_CREATE_FILE, Flags: FLAG_REQUEST_ID, RequestId: uint32(i),
+				Password: "pw", Path: root + "/f" + strconv.Itoa(i) + ".html", Body: []byte(strconv.Itoa(i))}
+			if i == n {
+				rec.Password = "bad" // 流水线请求失败不关闭连接
+			}
+			if err := sendTestRequest(conn, rec); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	seen := make(map[uint32]bool)
+	for i := 0; i < n; i++ {
+		resp := readTestResponse(t, conn)
+		if seen[resp.Id] || resp.Id == 0 || resp.Id > n {
+			t.Fatalf("unexpected response id %d", resp.Id)
+		}
+		seen[resp.Id] = true
+		if (resp.Id == n) != (resp.Code != 0) {
+			t.Errorf("request %d: code %d %s", resp.Id, resp.Code, resp.Message)
+		}
+	}
+	for i := 1; i < n; i++ {
+		b, err := ioutil.ReadFile(root + "/f" + strconv.Itoa(i) + ".html")
+		if err != nil || string(b) != strconv.Itoa(i) {
+			t.Errorf("file %d: %q %v", i, b, err)
+		}
+	}
+
+	// 之后的普通请求按顺序处理
+	if err := sendTestRequest(conn, &FileData{Method: METHOD_STAT, Password: "pw", Path: root + "/f1.html"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := readTestResponse(t, conn); resp.Code != 0 || resp.Id != 0 {
+		t.Errorf("plain request after pipeline: %+v", resp)
+	}
+}
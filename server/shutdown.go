@@ -0,0 +1,172 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+graceful shutdown.
+
+Shutdown cancels the server context, closes the listener and the idle
+connections, connections handling a request are closed when it's done
+(pipelined requests included). background tasks (janitor, replica and a
+running scan, which keeps its checkpoint) stop with the context, then the
+journal is closed. when the deadline passes before everything is done, the
+remaining connections are closed and an error is returned, the journal is
+released when the process exits. Stop uses shutdownTimeout of [common].
+*/
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DEF_SHUTDOWN_TIMEOUT = 30 * time.Second // 默认停止时等待处理中请求的时间
+	SHUTDOWN_POLL        = 10 * time.Millisecond
+)
+
+// 服务中的连接，active为处理中的请求数，为0时连接空闲
+type serverConn struct {
+	conn   net.Conn
+	active int
+	closed bool
+}
+
+// 记录新的连接，停止后不再接受
+func (s *Server) trackConn(c *serverConn) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// 连接处理结束
+func (s *Server) untrackConn(c *serverConn) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	c.closed = true
+	c.conn.Close()
+	delete(s.conns, c)
+}
+
+// 开始处理一个请求，连接已经因为停止被关闭时返回false
+func (s *Server) beginRequest(c *serverConn) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if c.closed {
+		return false
+	}
+	c.active++
+	return true
+}
+
+// 请求处理完成，停止时连接空闲后关闭
+func (s *Server) endRequest(c *serverConn) {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	c.active--
+	if c.active == 0 && s.ctx.Err() != nil {
+		c.closed = true
+		c.conn.Close()
+	}
+}
+
+func (s *Server) connClosed(c *serverConn) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return c.closed
+}
+
+// 当前连接数
+func (s *Server) ConnNum() int {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	return len(s.conns)
+}
+
+// 启动后台任务，停止后不再启动
+func (s *Server) goBackground(f func()) bool {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.bg.Add(1)
+	go func() {
+		defer s.bg.Done()
+		f()
+	}()
+	return true
+}
+
+// 停止服务，不再接受连接，关闭空闲的连接，等待处理中的请求和后台任务完成
+// ctx到期时关闭剩余的连接，返回错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connLock.Lock()
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for c := range s.conns {
+		if c.active == 0 {
+			c.closed = true
+			c.conn.Close()
+		}
+	}
+	s.connLock.Unlock()
+	s.scanner.stop()
+
+	ticker := time.NewTicker(SHUTDOWN_POLL)
+	defer ticker.Stop()
+	for n := s.ConnNum(); n > 0; n = s.ConnNum() {
+		if s.debug {
+			s.Logger.Println("CmsTop File Server has", n, "active connections, waiting...")
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("shutdown timeout, " + strconv.Itoa(s.closeConns()) + " connections closed")
+		case <-ticker.C:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.bg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return errors.New("shutdown timeout, background tasks not finished")
+	case <-done:
+	}
+
+	// 关闭操作日志，升级启动的新进程等待关闭后打开
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.ctFile != nil && s.ctFile.journal != nil {
+		return s.ctFile.journal.Close()
+	}
+	return nil
+}
+
+// 强制关闭所有连接，返回关闭的连接数
+func (s *Server) closeConns() int {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	for c := range s.conns {
+		c.closed = true
+		c.conn.Close()
+	}
+	return len(s.conns)
+}
+
+// 使用配置的超时时间停止服务
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
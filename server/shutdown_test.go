@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 等待有count个请求在处理中
+func waitActive(t *testing.T, s *Server, count int) {
+	for i := 0; i < 500; i++ {
+		n := 0
+		s.connLock.Lock()
+		for c := range s.conns {
+			n += c.active
+		}
+		s.connLock.Unlock()
+		if n == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d requests not active", count)
+}
+
+// 连接被服务端关闭
+func expectClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("connection not closed: %d %v", n, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	idle := dialTestServer(t, addr)
+	if err := sendTestRequest(idle, &FileData{Method: METHOD_STAT, Password: "pw", Path: root}); err != nil {
+		t.Fatal(err)
+	}
+	readTestResponse(t, idle)
+
+	// 持有路径锁，请求停在处理中
+	unlock, _ := s.ctFile.locks.Lock("", lockPath{root + "/a.html", false})
+	busy := dialTestServer(t, addr)
+	if err := sendTestRequest(busy, &FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/a.html", Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	waitActive(t, s, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// 空闲的连接立即关闭，不再接受新的连接
+	expectClosed(t, idle)
+	if conn, err := net.DialTimeout("tcp4", addr, time.Second); err == nil {
+		conn.Close()
+		t.Error("new connection accepted")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown before request done: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 处理中的请求完成后响应，再关闭连接
+	unlock()
+	if resp := readTestResponse(t, busy); resp.Code != 0 {
+		t.Errorf("in-flight request: %s", resp.Message)
+	}
+	expectClosed(t, busy)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := s.ConnNum(); n != 0 {
+		t.Errorf("connections after shutdown: %d", n)
+	}
+	if s.goBackground(func() {}) {
+		t.Error("background task started after shutdown")
+	}
+	l, _ := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err := s.Serve(l); err != nil {
+		t.Errorf("serve after shutdown: %v", err)
+	}
+	if _, err := l.AcceptTCP(); err == nil {
+		t.Error("listener not closed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, root, addr := newTestServer(t)
+	unlock, _ := s.ctFile.locks.Lock("", lockPath{root + "/a.html", false})
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conns[i] = dialTestServer(t, addr)
+		rec := &FileData{Method: METHOD_CREATE_FILE, Flags: FLAG_REQUEST_ID, RequestId: 1, Password: "pw",
+			Path: root + "/a.html", Body: []byte("x")}
+		if err := sendTestRequest(conns[i], rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitActive(t, s, 2)
+
+	// 超时后强制关闭处理中的连接
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), "2 connections closed") {
+		t.Errorf("shutdown: %v", err)
+	}
+	for _, conn := range conns {
+		expectClosed(t, conn)
+	}
+	unlock()
+	for i := 0; s.ConnNum() > 0 && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.ConnNum(); n != 0 {
+		t.Errorf("connections after handlers done: %d", n)
+	}
+}
+
+func TestShutdownScan(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	dir, err := ioutil.TempDir("", "fserver-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s.scanner.dir = dir
+	if err = s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Scan(root, []byte(`{"action":"start"}`)); err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Errorf("scan after shutdown: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+point-in-time snapshots of a directory subtree.
+
+file contents are kept once in a content-addressed object store
+<snapshotDir>/objects/<sha256>, a file is copied only when no object has it's
+content yet. objects are copies, never hard links of live files, so a file
+changed in place by another process doesn't change the snapshot. a snapshot
+is a json manifest <snapshotDir>/snapshots/<id>.json listing every directory
+and file with it's mode, mtime and content hash.
+
+restore builds the whole tree next to the target from copies of the objects,
+checks every copy against it's hash, restores modes and mtimes, then swaps it
+in with two renames. a rootDir itself cannot be restored, the tree would be
+built outside of it.
+*/
+package server
+
+import (
+	"cmstop-fserver/util"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	SNAPSHOT_OBJECTS_DIR = "objects"   // 内容对象目录
+	SNAPSHOT_MANIFESTS   = "snapshots" // 快照清单目录
+)
+
+// 快照中的一个目录或文件
+type SnapshotEntry struct {
+	Path  string `json:"path"` // 相对于快照根目录的路径
+	IsDir bool   `json:"is_dir"`
+	Mode  uint32 `json:"mode"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Hash  string `json:"hash,omitempty"` // 文件内容的sha256
+}
+
+// 一个快照，列表中不含Entries
+type Snapshot struct {
+	Id      string           `json:"id"`
+	Name    string           `json:"name,omitempty"` // 快照说明
+	Path    string           `json:"path"`           // 快照的目录
+	Time    int64            `json:"time"`           // 创建时间
+	Files   int              `json:"files"`          // 文件数
+	Size    int64            `json:"size"`           // 文件总大小
+	Entries []*SnapshotEntry `json:"entries,omitempty"`
+}
+
+// 快照参数，METHOD_SNAPSHOT_*的body是它的json编码
+type snapshotParams struct {
+	Id   string `json:"id"`   // 恢复和删除时的快照ID
+	Name string `json:"name"` // 创建时的快照说明
+}
+
+// 快照存储
+type SnapshotStore struct {
+	dir string
+	mu  sync.RWMutex // 创建和恢复共享，删除和回收对象时独占
+}
+
+var snapshotSeq uint64
+
+func NewSnapshotStore(dir string) (*SnapshotStore, error) {
+	ss := new(SnapshotStore)
+	ss.dir = path.Clean(dir)
+	for _, d := range []string{SNAPSHOT_OBJECTS_DIR, SNAPSHOT_MANIFESTS} {
+		err := os.MkdirAll(ss.dir+"/"+d, 0755)
+		if err != nil {
+			return nil, errors.New("cannot create snapshot dir: " + err.Error())
+		}
+	}
+	return ss, nil
+}
+
+// 创建目录的快照
+func (ss *SnapshotStore) Create(dir, name string) (*Snapshot, error) {
+	dir = path.Clean(dir)
+	if !isDir(dir) {
+		return nil, errors.New("snapshot path is not a directory: " + dir)
+	}
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	now := time.Now()
+	snap := &Snapshot{
+		Id:   strconv.FormatInt(now.UnixNano(), 10) + "-" + strconv.FormatUint(atomic.AddUint64(&snapshotSeq, 1), 10),
+		Name: name,
+		Path: dir,
+		Time: now.Unix(),
+	}
+	snap.Entries = make([]*SnapshotEntry, 0)
+	err := ss.walk(dir, "", snap)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	tmp := ss.dir + "/" + SNAPSHOT_MANIFESTS + "/." + snap.Id
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, ss.manifest(snap.Id))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	snap.Entries = nil
+	return snap, nil
+}
+
+// 递归保存目录中的文件，只保存目录和普通文件
+func (ss *SnapshotStore) walk(dir, rel string, snap *Snapshot) error {
+	fl, err := util.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range fl {
+		p := dir + "/" + f.Name()
+		e := &SnapshotEntry{
+			Path:  rel + f.Name(),
+			IsDir: f.IsDir(),
+			Mode:  uint32(f.Mode().Perm()),
+			Mtime: f.ModTime().Unix(),
+		}
+		if f.IsDir() {
+			snap.Entries = append(snap.Entries, e)
+			err = ss.walk(p, e.Path+"/", snap)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		e.Size = f.Size()
+		e.Hash, err = ss.saveObject(p)
+		if err != nil {
+			return err
+		}
+		snap.Entries = append(snap.Entries, e)
+		snap.Files++
+		snap.Size += e.Size
+	}
+	return nil
+}
+
+// 保存文件内容为对象，已有相同内容的对象时不再保存，返回内容哈希
+// 对象是复制的内容，哈希按复制后的内容计算，复制时文件被修改也和对象一致
+func (ss *SnapshotStore) saveObject(p string) (string, error) {
+	h, err := util.FileHash(p)
+	if err != nil {
+		return "", err
+	}
+	obj := ss.object(h)
+	if ok, _ := util.IsExist(obj); ok {
+		// 以前的版本中对象和文件是硬链接，改为复制
+		return h, breakLink(obj)
+	}
+	err = os.MkdirAll(ss.dir+"/"+SNAPSHOT_OBJECTS_DIR, 0755)
+	if err != nil {
+		return "", err
+	}
+	tmp := tmpName(ss.dir + "/" + SNAPSHOT_OBJECTS_DIR + "/" + path.Base(p))
+	err = util.CopyFile(p, tmp)
+	if err == nil {
+		h, err = util.FileHash(tmp)
+	}
+	if err == nil {
+		obj = ss.object(h)
+		err = os.MkdirAll(path.Dir(obj), 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmp, obj)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return h, nil
+}
+
+// 列出目录及其子目录的快照，按时间倒序
+func (ss *SnapshotStore) List(dir string) ([]*Snapshot, error) {
+	dir = path.Clean(dir)
+	fl, err := ioutil.ReadDir(ss.dir + "/" + SNAPSHOT_MANIFESTS)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Snapshot, 0)
+	for _, f := range fl {
+		if strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		snap, err := ss.load(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		if snap.Path == dir || strings.HasPrefix(snap.Path, dir+"/") {
+			snap.Entries = nil
+			list = append(list, snap)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id > list[j].Id })
+	return list, nil
+}
+
+// 将目录恢复到快照时的状态，新目录构建完成后替换原目录
+// keep不为nil时用它保存被替换的原目录，否则删除
+func (ss *SnapshotStore) Restore(dir, id string, keep func(p, old string) error) (*Snapshot, error) {
+	dir = path.Clean(dir)
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	snap, err := ss.load(id)
+	if err != nil {
+		return nil, errors.New("snapshot not found: " + id)
+	}
+	if snap.Path != dir {
+		return nil, errors.New("snapshot belongs to another path: " + snap.Path)
+	}
+	err = checkPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// 在同一目录中构建新的目录树
+	tmp := tmpName(dir)
+	err = ss.build(tmp, snap)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	swapped, err := swapDir(dir, tmp, keep)
+	if err != nil {
+		if !swapped {
+			os.RemoveAll(tmp)
+			return nil, err
+		}
+		return nil, errors.New("snapshot restored, but " + err.Error())
+	}
+	snap.Entries = nil
+	return snap, nil
+}
+
+// 用同目录中构建好的tmp替换dir，dir不存在时直接重命名
+// 替换后原目录交给keep保存，keep为nil时删除，swapped表示是否已经替换
+func swapDir(dir, tmp string, keep func(p, old string) error) (swapped bool, err error) {
+	old := ""
+	if ok, _ := util.IsExist(dir); ok {
+		old = tmpName(dir)
+		err = os.Rename(dir, old)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		if old != "" {
+			os.Rename(old, dir)
+		}
+		return false, err
+	}
+	if old != "" {
+		if keep != nil {
+			err = keep(dir, old)
+		} else {
+			err = os.RemoveAll(old)
+		}
+		if err != nil {
+			return true, errors.New("old directory " + old + " not removed: " + err.Error())
+		}
+	}
+	return true, nil
+}
+
+// 按快照清单构建目录树，文件从对象复制，复制后校验内容哈希，恢复文件和目录的权限和修改时间
+func (ss *SnapshotStore) build(root string, snap *Snapshot) error {
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		return err
+	}
+	dirs := make([]*SnapshotEntry, 0)
+	for _, e := range snap.Entries {
+		p := root + "/" + e.Path
+		if e.IsDir {
+			err = os.Mkdir(p, 0755)
+			dirs = append(dirs, e)
+		} else {
+			err = ss.copyObject(e, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// 目录权限最后设置，避免只读目录中无法创建文件
+	for _, e := range dirs {
+		p := root + "/" + e.Path
+		os.Chmod(p, os.FileMode(e.Mode))
+		os.Chtimes(p, time.Unix(e.Mtime, 0), time.Unix(e.Mtime, 0))
+	}
+	return nil
+}
+
+// 复制对象到p，内容和清单中的哈希不一致时返回错误
+func (ss *SnapshotStore) copyObject(e *SnapshotEntry, p string) error {
+	err := util.CopyFile(ss.object(e.Hash), p)
+	if err != nil {
+		return err
+	}
+	h, err := util.FileHash(p)
+	if err != nil {
+		return err
+	}
+	if h != e.Hash {
+		return errors.New("snapshot object corrupted: " + e.Hash + " (" + e.Path + ")")
+	}
+	err = os.Chmod(p, os.FileMode(e.Mode))
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, time.Unix(e.Mtime, 0), time.Unix(e.Mtime, 0))
+}
+
+// 删除快照，并回收没有被其他快照引用的对象，返回回收的对象数
+func (ss *SnapshotStore) Delete(dir, id string) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	snap, err := ss.load(id)
+	if err != nil {
+		return 0, errors.New("snapshot not found: " + id)
+	}
+	if snap.Path != path.Clean(dir) {
+		return 0, errors.New("snapshot belongs to another path: " + snap.Path)
+	}
+	err = os.Remove(ss.manifest(id))
+	if err != nil {
+		return 0, err
+	}
+	return ss.gc()
+}
+
+// 删除没有被任何快照引用的对象，需要持有写锁
+func (ss *SnapshotStore) gc() (int, error) {
+	used := make(map[string]bool)
+	fl, err := ioutil.ReadDir(ss.dir + "/" + SNAPSHOT_MANIFESTS)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range fl {
+		if strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		snap, err := ss.load(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			// 清单无法读取时不能判断对象是否被引用
+			return 0, errors.New("read snapshot " + f.Name() + " error: " + err.Error())
+		}
+		for _, e := range snap.Entries {
+			if !e.IsDir {
+				used[e.Hash] = true
+			}
+		}
+	}
+	n := 0
+	odir := ss.dir + "/" + SNAPSHOT_OBJECTS_DIR
+	buckets, err := util.ReadDir(odir)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range buckets {
+		objs, err := util.ReadDir(odir + "/" + b.Name())
+		if err != nil {
+			return n, err
+		}
+		for _, o := range objs {
+			if !used[o.Name()] {
+				os.Remove(odir + "/" + b.Name() + "/" + o.Name())
+				n++
+			}
+		}
+		os.Remove(odir + "/" + b.Name())
+	}
+	return n, nil
+}
+
+func (ss *SnapshotStore) load(id string) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(ss.manifest(id))
+	if err != nil {
+		return nil, err
+	}
+	snap := new(Snapshot)
+	err = json.Unmarshal(b, snap)
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (ss *SnapshotStore) manifest(id string) string {
+	return ss.dir + "/" + SNAPSHOT_MANIFESTS + "/" + path.Base(id) + ".json"
+}
+
+func (ss *SnapshotStore) object(h string) string {
+	return ss.dir + "/" + SNAPSHOT_OBJECTS_DIR + "/" + h[:2] + "/" + h
+}
+
+// 判断路径是否在快照目录中
+func (ss *SnapshotStore) contains(p string) bool {
+	p = path.Clean(p)
+	return p == ss.dir || strings.HasPrefix(p, ss.dir+"/") || strings.HasPrefix(ss.dir, p+"/")
+}
+
+// 文件有多个硬链接时，复制一份替换原文件，以前的版本中快照的对象和文件是硬链接
+func breakLink(p string) error {
+	f, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	st, ok := f.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 || !f.Mode().IsRegular() {
+		return nil
+	}
+	tmp := tmpName(p)
+	err = util.CopyFile(p, tmp)
+	if err == nil {
+		os.Chmod(tmp, f.Mode().Perm())
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
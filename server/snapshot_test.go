@@ -0,0 +1,102 @@
+package server
+
+import (
+	"cmstop-fserver/util"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	snaps, err := NewSnapshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.snaps = snaps
+	dir := root + "/www"
+	os.MkdirAll(dir+"/css", 0755)
+	ioutil.WriteFile(dir+"/index.html", []byte("index"), 0644)
+	ioutil.WriteFile(dir+"/css/a.html", []byte("same"), 0644)
+	ioutil.WriteFile(dir+"/css/b.html", []byte("same"), 0644)
+	os.Chmod(dir+"/index.html", 0600)
+	os.Chmod(dir+"/css", 0750)
+
+	resp, err := s.ctFile.Handle(&FileData{Method: METHOD_SNAPSHOT_CREATE, Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := resp.(*Snapshot)
+	if snap.Files != 3 || snap.Size != 13 {
+		t.Fatalf("snapshot files %d size %d", snap.Files, snap.Size)
+	}
+
+	// 其他进程直接修改的文件和通过服务端修改的文件都不影响快照中的对象
+	ioutil.WriteFile(dir+"/css/b.html", []byte("edit"), 0644)
+	for _, rec := range []*FileData{
+		{Method: METHOD_MODIFY_FILE, Path: dir + "/index.html", Body: []byte("redesign")},
+		{Method: METHOD_APPEND_FILE, Path: dir + "/css/a.html", Body: []byte("+")},
+		{Method: METHOD_REMOVE_DIR, Path: dir + "/css"},
+		{Method: METHOD_CREATE_FILE, Path: dir + "/new.html", Body: []byte("new")},
+	} {
+		if _, err = s.ctFile.Handle(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_SNAPSHOT_RESTORE, Path: dir, Body: []byte(`{"id":"` + snap.Id + `"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{"/index.html": "index", "/css/a.html": "same", "/css/b.html": "same"} {
+		if b, _ := ioutil.ReadFile(dir + p); string(b) != want {
+			t.Errorf("%s = %q, want %q", p, b, want)
+		}
+	}
+	if _, err = os.Stat(dir + "/new.html"); !os.IsNotExist(err) {
+		t.Error("file created after snapshot still exists")
+	}
+	// 恢复的文件是对象的副本，恢复权限
+	f, _ := os.Stat(dir + "/css/a.html")
+	if n := f.Sys().(*syscall.Stat_t).Nlink; n != 1 {
+		t.Errorf("restored file nlink %d, want a copy of the object", n)
+	}
+	for p, want := range map[string]os.FileMode{"/index.html": 0600, "/css/a.html": 0644, "/css": 0750} {
+		if f, err := os.Stat(dir + p); err != nil || f.Mode().Perm() != want {
+			t.Errorf("%s mode %v, want %v", p, f.Mode().Perm(), want)
+		}
+	}
+	// 被修改的对象在恢复时校验失败
+	ioutil.WriteFile(snaps.object(util.Hash([]byte("index"))), []byte("tampered"), 0644)
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_SNAPSHOT_RESTORE, Path: dir, Body: []byte(`{"id":"` + snap.Id + `"}`)})
+	if err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Errorf("tampered object restored: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/index.html"); string(b) != "index" {
+		t.Errorf("failed restore changed index.html: %q", b)
+	}
+
+	// rootDir不能恢复，临时目录会在rootDir之外
+	rs, err := s.ctFile.Handle(&FileData{Method: METHOD_SNAPSHOT_CREATE, Path: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_SNAPSHOT_RESTORE, Path: root, Body: []byte(`{"id":"` + rs.(*Snapshot).Id + `"}`)})
+	if err == nil {
+		t.Error("rootDir restored")
+	}
+	snaps.Delete(root, rs.(*Snapshot).Id)
+
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_SNAPSHOT_DELETE, Path: dir, Body: []byte(`{"id":"` + snap.Id + `"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := snaps.List(root); len(list) != 0 {
+		t.Fatalf("snapshot not deleted: %d", len(list))
+	}
+	if objs, _ := ioutil.ReadDir(snaps.dir + "/" + SNAPSHOT_OBJECTS_DIR); len(objs) != 0 {
+		t.Fatalf("unreferenced objects kept: %d", len(objs))
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// 可以执行的内容类型，没有配置允许时任何扩展名都不能写入
+const (
+	TYPE_ELF   = "application/x-elf"
+	TYPE_PE    = "application/x-msdownload"
+	TYPE_MACHO = "application/x-mach-binary"
+	TYPE_SHELL = "text/x-shellscript"
+	TYPE_PHP   = "application/x-php"
+)
+
+var (
+	// php开始标签，含短标签和<script language="php">，不匹配<?xml
+	phpTag = regexp.MustCompile(`(?i)<\?(php|=|\s)|<script[^>]*language\s*=\s*["']?php`)
+	// Mach-O和通用二进制的开头
+	machoMagic = [][]byte{{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf}, {0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe}, {0xca, 0xfe, 0xba, 0xbe}}
+)
+
+// 判断内容的类型，可执行文件和脚本优先，其他使用http.DetectContentType
+// start为false时内容是追加写入的一段，不在文件开头，只检查php标签，其他返回空
+func sniffType(body []byte, start bool) string {
+	if start {
+		switch {
+		case bytes.HasPrefix(body, []byte("\x7fELF")):
+			return TYPE_ELF
+		case isPE(body):
+			return TYPE_PE
+		case bytes.HasPrefix(body, []byte("#!")):
+			return TYPE_SHELL
+		}
+		for _, m := range machoMagic {
+			if bytes.HasPrefix(body, m) {
+				return TYPE_MACHO
+			}
+		}
+	}
+	if phpTag.Match(body) {
+		return TYPE_PHP
+	}
+	if !start {
+		return ""
+	}
+	return mediaType(http.DetectContentType(body))
+}
+
+// MZ开头，并且0x3c处的偏移指向PE签名
+func isPE(body []byte) bool {
+	if len(body) < 0x40 || !bytes.HasPrefix(body, []byte("MZ")) {
+		return false
+	}
+	off := int(binary.LittleEndian.Uint32(body[0x3c:]))
+	return off >= 0 && off+4 <= len(body) && bytes.Equal(body[off:off+4], []byte("PE\x00\x00"))
+}
+
+// 判断是否是可以执行的类型
+func executableType(t string) bool {
+	switch t {
+	case TYPE_ELF, TYPE_PE, TYPE_MACHO, TYPE_SHELL, TYPE_PHP:
+		return true
+	}
+	return false
+}
+
+// 类型是否在允许的列表中，列表中的类型可以用/*结尾
+func typeAllowed(allowed []string, t string) bool {
+	for _, a := range allowed {
+		if a == t || strings.HasSuffix(a, "/*") && strings.HasPrefix(t, a[:len(a)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// 扩展名对应的类型，没有时返回扩展名
+func claimedType(ext string) string {
+	if t := mediaType(mime.TypeByExtension("." + ext)); t != "" {
+		return t
+	}
+	return ext
+}
+
+// 去掉类型中的参数，如; charset=utf-8
+func mediaType(t string) string {
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = t[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(t))
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSniffType(t *testing.T) {
+	pe := make([]byte, 0x80)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 0x40)
+	copy(pe[0x40:], "PE\x00\x00")
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+
+	cases := []struct {
+		body  []byte
+		start bool
+		want  string
+	}{
+		{[]byte("\x7fELF\x02\x01\x01"), true, TYPE_ELF},
+		{pe, true, TYPE_PE},
+		{[]byte("MZ is not enough"), true, "text/plain"},
+		{[]byte{0xcf, 0xfa, 0xed, 0xfe, 7, 0, 0, 1}, true, TYPE_MACHO},
+		{[]byte("#!/bin/sh\nrm -rf /"), true, TYPE_SHELL},
+		{[]byte("<html><?php system($_GET['c']); ?></html>"), true, TYPE_PHP},
+		{[]byte("<html><?= `id` ?></html>"), true, TYPE_PHP},
+		{[]byte("<?PHP\necho 1;"), true, TYPE_PHP},
+		{[]byte("<script language='php'>echo 1;</script>"), true, TYPE_PHP},
+		{append(jpeg, []byte("<?php eval($_POST[x]);")...), true, TYPE_PHP},
+		{[]byte("<?xml version=\"1.0\"?><svg></svg>"), true, "text/xml"},
+		{[]byte("<!DOCTYPE html><html><body>hi</body></html>"), true, "text/html"},
+		{jpeg, true, "image/jpeg"},
+		{[]byte("a{color:red}"), true, "text/plain"},
+		{[]byte("\x7fELF\x02\x01\x01"), false, ""},
+		{[]byte("more text <?php echo 1;"), false, TYPE_PHP},
+	}
+	for i, c := range cases {
+		if got := sniffType(c.body, c.start); got != c.want {
+			t.Errorf("%d: sniffType = %q, want %q", i, got, c.want)
+		}
+	}
+
+	if !typeAllowed([]string{"image/*"}, "image/png") || typeAllowed([]string{"image/*"}, "text/plain") {
+		t.Errorf("wildcard type error")
+	}
+	if claimedType("jpg") != "image/jpeg" {
+		t.Errorf("claimed type of jpg: %s", claimedType("jpg"))
+	}
+}
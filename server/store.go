@@ -0,0 +1,371 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+retention store, keep overwritten and deleted content.
+
+overwritten files are kept as versions under <storeDir>/versions/<hash of path>/,
+deleted files and directories are moved to <storeDir>/trash/.
+every entry is a directory with info.json and the kept data.
+the server janitor removes versions beyond the newest N of each path, and
+versions or trash entries older than D days.
+*/
+package server
+
+import (
+	"cmstop-fserver/util"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	STORE_VERSIONS_DIR = "versions"  // 历史版本目录
+	STORE_TRASH_DIR    = "trash"     // 回收站目录
+	STORE_INFO_FILE    = "info.json" // 条目信息文件
+	STORE_DATA_FILE    = "data"      // 条目保存的内容，文件或目录
+)
+
+// 保留的一个历史版本或回收站条目
+type StoreEntry struct {
+	Id    string `json:"id"`
+	Path  string `json:"path"`   // 原路径
+	IsDir bool   `json:"is_dir"` // 是否是目录，只有回收站条目可能是目录
+	Size  int64  `json:"size"`   // 文件大小，目录为0
+	Mtime int64  `json:"mtime"`  // 原内容的修改时间
+	Time  int64  `json:"time"`   // 被覆盖或删除的时间
+}
+
+// 恢复参数，METHOD_RESTORE的body是它的json编码，Version和Trash二选一
+type restoreParams struct {
+	Version string `json:"version"` // 历史版本ID
+	Trash   string `json:"trash"`   // 回收站条目ID
+}
+
+// 历史版本和回收站
+type Store struct {
+	dir      string // 保存目录
+	versions int    // 每个文件保留的版本数，0 表示不限制
+	days     int    // 保留天数，0 表示不限制
+}
+
+var storeSeq uint64
+
+func NewStore(dir string, versions, days int) (*Store, error) {
+	st := new(Store)
+	st.dir = path.Clean(dir)
+	st.versions = versions
+	st.days = days
+	for _, d := range []string{STORE_VERSIONS_DIR, STORE_TRASH_DIR} {
+		err := os.MkdirAll(st.dir+"/"+d, 0755)
+		if err != nil {
+			return nil, errors.New("cannot create store dir: " + err.Error())
+		}
+	}
+	return st, nil
+}
+
+// 保存文件当前内容为一个历史版本，文件不存在或不是普通文件时不保存
+func (st *Store) KeepVersion(p string) error {
+	f, err := os.Stat(p)
+	if err != nil || !f.Mode().IsRegular() {
+		return nil
+	}
+	return st.save(p, p, false, false)
+}
+
+// 将路径移到回收站，路径不存在时直接返回
+func (st *Store) Trash(p string) error {
+	if ok, _ := util.IsExist(p); !ok {
+		return nil
+	}
+	return st.save(p, p, true, true)
+}
+
+// 将已经移出原位置的内容src保存为p的历史版本或回收站条目，src会被移走
+// src是目录时总是保存到回收站
+func (st *Store) Keep(p, src string, deleted bool) error {
+	return st.save(p, src, deleted, true)
+}
+
+// 保存一个条目，先写入临时目录，完成后重命名，列表中不会出现不完整的条目
+func (st *Store) save(p, src string, trash, move bool) error {
+	f, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if f.IsDir() {
+		trash = true
+	}
+	now := time.Now()
+	e := &StoreEntry{
+		Id:    strconv.FormatInt(now.UnixNano(), 10) + "-" + strconv.FormatUint(atomic.AddUint64(&storeSeq, 1), 10),
+		Path:  p,
+		IsDir: f.IsDir(),
+		Mtime: f.ModTime().Unix(),
+		Time:  now.Unix(),
+	}
+	if !f.IsDir() {
+		e.Size = f.Size()
+	}
+	dir := st.versionDir(p)
+	if trash {
+		dir = st.dir + "/" + STORE_TRASH_DIR
+	}
+	tmp := dir + "/." + e.Id
+	err = os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return err
+	}
+	if move {
+		err = moveAll(src, tmp+"/"+STORE_DATA_FILE)
+	} else {
+		err = util.CopyFile(src, tmp+"/"+STORE_DATA_FILE)
+	}
+	if err == nil {
+		err = writeEntryInfo(tmp, e)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir+"/"+e.Id)
+	}
+	if err != nil {
+		// 移动失败时内容还在原位置，复制失败时原内容没有变化
+		os.RemoveAll(tmp)
+		return errors.New("keep " + p + " failed: " + err.Error())
+	}
+	if !trash && st.versions > 0 {
+		st.prune(dir)
+	}
+	return nil
+}
+
+// 文件的历史版本，按时间倒序
+func (st *Store) Versions(p string) ([]*StoreEntry, error) {
+	return readEntries(st.versionDir(path.Clean(p)))
+}
+
+// 路径及其子目录中被删除的条目，按时间倒序
+func (st *Store) TrashList(p string) ([]*StoreEntry, error) {
+	list, err := readEntries(st.dir + "/" + STORE_TRASH_DIR)
+	if err != nil {
+		return nil, err
+	}
+	p = path.Clean(p)
+	res := make([]*StoreEntry, 0)
+	for _, e := range list {
+		if e.Path == p || strings.HasPrefix(e.Path, p+"/") {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+// 恢复文件的一个历史版本，当前内容保存为新的历史版本
+func (st *Store) RestoreVersion(p, id string) (*StoreEntry, error) {
+	dir := st.versionDir(path.Clean(p)) + "/" + path.Base(id)
+	e, err := readEntryInfo(dir)
+	if err != nil {
+		return nil, errors.New("version not found: " + id)
+	}
+	err = checkPath(p)
+	if err != nil {
+		return nil, err
+	}
+	// 先复制到同目录的临时文件再重命名，失败时不影响当前内容
+	// 保存当前内容时可能清理掉要恢复的版本，需要先复制
+	tmp := tmpName(p)
+	err = util.CopyFile(dir+"/"+STORE_DATA_FILE, tmp)
+	if err == nil {
+		err = st.KeepVersion(p)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return e, nil
+}
+
+// 将回收站条目恢复到原路径，原路径存在时只允许是空目录（清空目录后的状态）
+func (st *Store) RestoreTrash(p, id string) (*StoreEntry, error) {
+	dir := st.dir + "/" + STORE_TRASH_DIR + "/" + path.Base(id)
+	e, err := readEntryInfo(dir)
+	if err != nil {
+		return nil, errors.New("trash entry not found: " + id)
+	}
+	if e.Path != path.Clean(p) {
+		return nil, errors.New("trash entry belongs to another path: " + e.Path)
+	}
+	if ok, _ := util.IsExist(p); ok {
+		// 目录非空时Remove失败
+		if !isDir(p) || os.Remove(p) != nil {
+			return nil, preconditionFailed("path exists: " + p)
+		}
+	}
+	err = checkPath(p)
+	if err != nil {
+		return nil, err
+	}
+	err = moveAll(dir+"/"+STORE_DATA_FILE, p)
+	if err != nil {
+		return nil, err
+	}
+	os.RemoveAll(dir)
+	return e, nil
+}
+
+// 清空路径及其子目录在回收站中的条目，返回删除的条目数
+func (st *Store) EmptyTrash(p string) (int, error) {
+	list, err := st.TrashList(p)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range list {
+		err = os.RemoveAll(st.dir + "/" + STORE_TRASH_DIR + "/" + e.Id)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(list), nil
+}
+
+// 清理过期的历史版本和回收站条目
+func (st *Store) Clean() error {
+	vdir := st.dir + "/" + STORE_VERSIONS_DIR
+	buckets, err := util.ReadDir(vdir)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		dirs, err := util.ReadDir(vdir + "/" + b.Name())
+		if err != nil {
+			return err
+		}
+		for _, d := range dirs {
+			p := vdir + "/" + b.Name() + "/" + d.Name()
+			st.prune(p)
+			// 删除已经没有版本的目录，非空时Remove失败
+			os.Remove(p)
+		}
+		os.Remove(vdir + "/" + b.Name())
+	}
+	if st.days <= 0 {
+		return nil
+	}
+	list, err := readEntries(st.dir + "/" + STORE_TRASH_DIR)
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		if st.expired(e) {
+			os.RemoveAll(st.dir + "/" + STORE_TRASH_DIR + "/" + e.Id)
+		}
+	}
+	return nil
+}
+
+// 删除一个文件超出数量或过期的历史版本
+func (st *Store) prune(dir string) {
+	list, err := readEntries(dir)
+	if err != nil {
+		return
+	}
+	for i, e := range list {
+		if (st.versions > 0 && i >= st.versions) || st.expired(e) {
+			os.RemoveAll(dir + "/" + e.Id)
+		}
+	}
+}
+
+func (st *Store) expired(e *StoreEntry) bool {
+	return st.days > 0 && time.Since(time.Unix(e.Time, 0)) > time.Duration(st.days)*24*time.Hour
+}
+
+// 文件历史版本的目录，按路径哈希分散到子目录中
+func (st *Store) versionDir(p string) string {
+	h := util.Hash([]byte(p))
+	return st.dir + "/" + STORE_VERSIONS_DIR + "/" + h[:2] + "/" + h
+}
+
+// 判断路径是否在保存目录中
+func (st *Store) contains(p string) bool {
+	p = path.Clean(p)
+	return p == st.dir || strings.HasPrefix(p, st.dir+"/") || strings.HasPrefix(st.dir, p+"/")
+}
+
+// 读取目录中的全部条目，按时间倒序，忽略未完成的临时条目
+func readEntries(dir string) ([]*StoreEntry, error) {
+	list := make([]*StoreEntry, 0)
+	fl, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return list, nil
+		}
+		return nil, err
+	}
+	for _, f := range fl {
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		e, err := readEntryInfo(dir + "/" + f.Name())
+		if err != nil {
+			continue
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Time != list[j].Time {
+			return list[i].Time > list[j].Time
+		}
+		return list[i].Id > list[j].Id
+	})
+	return list, nil
+}
+
+func readEntryInfo(dir string) (*StoreEntry, error) {
+	b, err := ioutil.ReadFile(dir + "/" + STORE_INFO_FILE)
+	if err != nil {
+		return nil, err
+	}
+	e := new(StoreEntry)
+	err = json.Unmarshal(b, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func writeEntryInfo(dir string, e *StoreEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir+"/"+STORE_INFO_FILE, b, 0644)
+}
+
+// 移动文件或目录，跨文件系统时复制后删除
+func moveAll(src, dest string) error {
+	err := os.Rename(src, dest)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	if isDir(src) {
+		err = util.CopyDir(src, dest)
+	} else {
+		err = util.CopyFile(src, dest)
+	}
+	if err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	return os.RemoveAll(src)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T, s *Server, versions, days int) *Store {
+	st, err := NewStore(t.TempDir(), versions, days)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctFile.store = st
+	return st
+}
+
+// 覆盖写入保留历史版本，超出数量的旧版本被删除，恢复后当前内容也成为历史版本
+func TestStoreVersions(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	st := newTestStore(t, s, 2, 0)
+	p := root + "/page.html"
+	for _, body := range []string{"v1", "v2", "v3", "v4"} {
+		_, err := s.ctFile.Handle(&FileData{Method: METHOD_CREATE_FILE, Path: p, Body: []byte(body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := st.Versions(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("got %d versions, want 2", len(list))
+	}
+	// 最新的历史版本是v3
+	if list[0].Size != 2 || list[1].Time > list[0].Time {
+		t.Fatalf("versions not sorted: %+v %+v", list[0], list[1])
+	}
+	_, err = s.ctFile.Handle(&FileData{Method: METHOD_RESTORE, Path: p,
+		Body: []byte(`{"version":"` + list[1].Id + `"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(p); string(b) != "v2" {
+		t.Fatalf("restored content %q, want v2", b)
+	}
+	list, _ = st.Versions(p)
+	if b, _ := ioutil.ReadFile(st.versionDir(p) + "/" + list[0].Id + "/" + STORE_DATA_FILE); string(b) != "v4" {
+		t.Fatalf("content before restore not kept, newest version %q", b)
+	}
+}
+
+func TestStoreTrash(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	st := newTestStore(t, s, 0, 0)
+	dir := root + "/news"
+	os.MkdirAll(dir+"/2015", 0755)
+	ioutil.WriteFile(dir+"/2015/a.html", []byte("a"), 0644)
+	ioutil.WriteFile(dir+"/b.html", []byte("b"), 0644)
+
+	for _, rec := range []*FileData{
+		{Method: METHOD_REMOVE_FILE, Path: dir + "/b.html"},
+		{Method: METHOD_CLEAR_DIR, Path: dir},
+	} {
+		if _, err := s.ctFile.Handle(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := st.TrashList(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Path != dir || !list[0].IsDir {
+		t.Fatalf("unexpected trash: %+v", list)
+	}
+	// 清空后的空目录被替换
+	_, err = st.RestoreTrash(dir, list[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/2015/a.html"); string(b) != "a" {
+		t.Fatalf("restored content %q", b)
+	}
+	// 原路径已存在
+	ioutil.WriteFile(dir+"/b.html", []byte("new"), 0644)
+	_, err = st.RestoreTrash(dir+"/b.html", list[1].Id)
+	if e, ok := err.(*CodeError); !ok || e.Code != CODE_PRECONDITION_FAILED {
+		t.Fatalf("restore over existing file: %v", err)
+	}
+	n, err := st.EmptyTrash(root)
+	if err != nil || n != 1 {
+		t.Fatalf("empty trash removed %d: %v", n, err)
+	}
+}
+
+func TestStoreClean(t *testing.T) {
+	s, root, _ := newTestServer(t)
+	st := newTestStore(t, s, 0, 1)
+	p := root + "/a.html"
+	ioutil.WriteFile(p, []byte("a"), 0644)
+	st.KeepVersion(p)
+	st.Trash(p)
+	// 将条目的保存时间改为两天前
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	for _, dir := range []string{st.versionDir(p), st.dir + "/" + STORE_TRASH_DIR} {
+		list, _ := readEntries(dir)
+		for _, e := range list {
+			e.Time = old
+			writeEntryInfo(dir+"/"+e.Id, e)
+		}
+	}
+	if err := st.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := st.TrashList(root); len(list) != 0 {
+		t.Fatalf("expired trash entries kept: %d", len(list))
+	}
+	if ok, _ := os.Stat(st.versionDir(p)); ok != nil {
+		t.Fatal("empty version dir not removed")
+	}
+}
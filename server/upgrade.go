@@ -0,0 +1,171 @@
+// Copyright (c) 2015 Beijing CmsTop Technology Co.,Ltd. (http://www.cmstop.com)
+
+/*
+binary upgrade with listener inheritance.
+
+on SIGUSR2 the running process starts the binary again with the same
+arguments (Upgrade), the listening socket is passed as fd 3, LISTEN_FD_ENV
+and UPGRADE_PID_ENV tell the new process the fd and the old pid. the new
+process takes the listener (InheritedListener), starts serving on it and
+sends SIGTERM to the old process (Takeover), which stops accepting and exits
+when its connections are done. when the new process fails to start, the old
+one keeps serving.
+
+two processes must not append to the same journal. with journalDir the new
+process loads and checks the config (InitUpgrade) and starts serving before
+it signals the old process, then opens the journal once the old process
+closed it after its last request (Server.Takeover). meanwhile read requests
+are served and requests which change files or read the journal wait.
+when the journal cannot be opened the new process stops, the old one is
+stopping already at that point.
+*/
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	LISTEN_FD_ENV   = "FSERVER_LISTEN_FD"   // 继承的监听fd
+	UPGRADE_PID_ENV = "FSERVER_UPGRADE_PID" // 原进程的pid
+	UPGRADE_POLL    = 100 * time.Millisecond
+	UPGRADE_GRACE   = 5 * time.Second // 原进程停止超时后退出的时间
+)
+
+// 升级启动时继承的监听和原进程的pid，不是升级启动时返回nil
+// 读取后清除环境变量，再次升级时不会误用
+func InheritedListener() (*net.TCPListener, int, error) {
+	fd := os.Getenv(LISTEN_FD_ENV)
+	if fd == "" {
+		return nil, 0, nil
+	}
+	pid, _ := strconv.Atoi(os.Getenv(UPGRADE_PID_ENV))
+	os.Unsetenv(LISTEN_FD_ENV)
+	os.Unsetenv(UPGRADE_PID_ENV)
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < 3 {
+		return nil, 0, errors.New("inherited listener fd error: " + fd)
+	}
+	f := os.NewFile(uintptr(n), "listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, 0, errors.New("inherited listener error: " + err.Error())
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, 0, errors.New("inherited listener is not tcp")
+	}
+	return tl, pid, nil
+}
+
+// 使用相同的参数启动新的进程，传递监听，新进程开始服务后通知本进程退出
+func (s *Server) Upgrade() (*os.Process, error) {
+	s.connLock.Lock()
+	listener := s.listener
+	s.connLock.Unlock()
+	if listener == nil {
+		return nil, errors.New("server not listening")
+	}
+	f, err := listener.File()
+	if err != nil {
+		return nil, errors.New("listener file error: " + err.Error())
+	}
+	defer f.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	wd, _ := os.Getwd()
+	env := append(os.Environ(), LISTEN_FD_ENV+"=3", UPGRADE_PID_ENV+"="+strconv.Itoa(os.Getpid()))
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Dir:   wd,
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, f},
+	})
+	if err != nil {
+		return nil, errors.New("upgrade process start error: " + err.Error())
+	}
+	// 新进程在本进程退出前结束时回收并记录
+	go func() {
+		st, err := p.Wait()
+		if err != nil {
+			s.Logger.Println("upgrade process wait error: " + err.Error())
+			return
+		}
+		s.Logger.Println("upgrade process exited: " + st.String())
+	}()
+	return p, nil
+}
+
+// 通知原进程停止接受连接并退出，wait为true时等待它退出
+func Takeover(pid int, wait bool) error {
+	if pid <= 0 {
+		return nil
+	}
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		return errors.New("signal old process error: " + err.Error())
+	}
+	for wait && syscall.Kill(pid, 0) == nil {
+		time.Sleep(UPGRADE_POLL)
+	}
+	return nil
+}
+
+// 升级启动并开始服务后通知原进程退出，原进程打开了操作日志时等待它关闭后打开
+// 最多等待停止超时时间，之前等待中的请求继续处理，返回打开操作日志的错误
+func (s *Server) Takeover(pid int) error {
+	err := Takeover(pid, false)
+	if err != nil {
+		s.Logger.Println(err.Error())
+	}
+	if s.journalReady == nil {
+		return nil
+	}
+	deadline := time.Now().Add(s.timeout + UPGRADE_GRACE)
+	for {
+		j, err := OpenJournalConf(s.journalConf)
+		if err == nil {
+			s.connLock.Lock()
+			defer s.connLock.Unlock()
+			if s.ctx.Err() != nil {
+				j.Close()
+				return errors.New("server stopped")
+			}
+			s.ctFile.journal = j
+			close(s.journalReady)
+			return nil
+		}
+		if err != errJournalLocked {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New("the old process " + strconv.Itoa(pid) + " did not close the journal")
+		}
+		select {
+		case <-s.ctx.Done():
+			return errors.New("server stopped")
+		case <-time.After(UPGRADE_POLL):
+		}
+	}
+}
+
+// 等待升级启动时操作日志打开，停止时返回错误
+func (s *Server) waitJournal() error {
+	if s.journalReady == nil {
+		return nil
+	}
+	select {
+	case <-s.journalReady:
+		return nil
+	case <-s.ctx.Done():
+		return errors.New("server stopped")
+	}
+}
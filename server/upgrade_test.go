@@ -0,0 +1,149 @@
+package server
+
+import (
+	"github.com/9466/goconfig"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenerInheritance(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	l1, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+
+	// 和升级一样，通过fd和环境变量把监听交给第二个服务
+	f, err := l1.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(LISTEN_FD_ENV, strconv.Itoa(fd))
+	os.Setenv(UPGRADE_PID_ENV, "123")
+	l2, pid, err := InheritedListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	if pid != 123 || os.Getenv(LISTEN_FD_ENV) != "" || os.Getenv(UPGRADE_PID_ENV) != "" {
+		t.Errorf("pid %d, env %q", pid, os.Getenv(LISTEN_FD_ENV))
+	}
+	if l2.Addr().String() != l1.Addr().String() {
+		t.Fatalf("inherited %s, want %s", l2.Addr(), l1.Addr())
+	}
+
+	accept := func() {
+		c, err := net.Dial("tcp4", l1.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		l2.SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err := l2.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	// 原进程关闭监听后，继承的监听继续接受连接
+	accept()
+	l1.Close()
+	accept()
+
+	os.Setenv(LISTEN_FD_ENV, "x")
+	if l, _, err := InheritedListener(); err == nil || l != nil {
+		t.Error("bad fd accepted")
+	}
+	if l, _, err := InheritedListener(); err != nil || l != nil {
+		t.Errorf("without env: %v %v", l, err)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	go cmd.Wait() // 回收子进程，否则一直存在
+	if err := Takeover(cmd.Process.Pid, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := Takeover(cmd.Process.Pid, false); err == nil {
+		t.Error("signal exited process")
+	}
+}
+
+// 升级启动时原进程还打开着操作日志，读取正常处理，写入等待原进程关闭操作日志
+func TestTakeoverJournal(t *testing.T) {
+	root, jdir := t.TempDir(), t.TempDir()
+	old, err := OpenJournal(jdir, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	f := filepath.Join(t.TempDir(), "cmstop.conf")
+	ioutil.WriteFile(f, []byte("[common]\nrootDir="+root+"\nallowExt=html\npassword=pw\n[journal]\njournalDir="+jdir+"\n"), 0600)
+	conf, err := goconfig.ReadConfigFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err = s.Init(conf); err != errJournalLocked {
+		t.Fatalf("init with a locked journal: %v", err)
+	}
+	s = NewServer()
+	s.Logger = log.New(ioutil.Discard, "", 0)
+	if err = s.InitUpgrade(conf); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	l, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(l)
+	defer s.Stop()
+
+	conn := dialTestServer(t, l.Addr().String())
+	sendTestRequest(conn, &FileData{Method: METHOD_STAT, Password: "pw", Path: root})
+	if res := readTestResponse(t, conn); res.Code != 0 {
+		t.Fatalf("stat before takeover: %s", res.Message)
+	}
+	sendTestRequest(conn, &FileData{Method: METHOD_CREATE_FILE, Password: "pw", Path: root + "/a.html", Body: []byte("a")})
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	go cmd.Wait()
+	done := make(chan error, 1)
+	go func() { done <- s.Takeover(cmd.Process.Pid) }()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(root + "/a.html"); err == nil {
+		t.Fatal("written before the old process closed the journal")
+	}
+	old.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Code != 0 {
+		t.Fatalf("write after takeover: %s", res.Message)
+	}
+	if s.ctFile.journal.Seq() != 1 {
+		t.Errorf("journal seq %d, want 1", s.ctFile.journal.Seq())
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -268,6 +270,7 @@ func CopyFile(src, dest string) error {
 }
 
 // 复制一个文件夹，如果同名文件夹已存在，返回错误
+// 文件夹中有符号链接或其他特殊文件时返回错误，已复制的部分不删除
 func CopyDir(src, dest string) error {
 	if ok, _ := IsExist(dest); ok {
 		return errors.New(dest + " is exists")
@@ -289,10 +292,14 @@ func CopyDir(src, dest string) error {
 	for _, item := range items {
 		srcNew := src + "/" + item.Name()
 		destNew := dest + "/" + item.Name()
-		if item.IsDir() {
+		switch {
+		case item.IsDir():
 			err = CopyDir(srcNew, destNew)
-		} else {
+		case item.Mode().IsRegular():
 			err = CopyFile(srcNew, destNew)
+		default:
+			// 不跟随符号链接，链接可能指向目录之外
+			err = errors.New(srcNew + " is not a regular file or directory")
 		}
 		if err != nil {
 			return err
@@ -325,3 +332,24 @@ func GetPathSize(path string) (int64, error) {
 	}
 	return size, nil
 }
+
+// 计算内容的sha256，返回16进制字符串
+func Hash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// 计算一个文件内容的sha256，返回16进制字符串
+func FileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
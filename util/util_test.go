@@ -1,6 +1,8 @@
 package util
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -10,3 +12,24 @@ func TestCopyDir(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// 目录中的符号链接不跟随
+func TestCopyDirSymlink(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()+"/copy"
+	os.Mkdir(src+"/sub", 0755)
+	ioutil.WriteFile(src+"/sub/a.html", []byte("a"), 0644)
+	err := CopyDir(src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(dest + "/sub/a.html"); string(b) != "a" {
+		t.Errorf("copied %q", b)
+	}
+	os.Symlink("/etc/passwd", src+"/sub/passwd.html")
+	if err = CopyDir(src, dest+"2"); err == nil {
+		t.Error("symlink copied")
+	}
+	if _, err = os.Stat(dest + "2/sub/passwd.html"); !os.IsNotExist(err) {
+		t.Error("symlink target copied")
+	}
+}